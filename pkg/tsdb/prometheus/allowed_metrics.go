@@ -0,0 +1,131 @@
+package prometheus
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// checkAllowedMetrics returns an error if expr selects a metric which doesn't start with one of the allowed prefixes.
+// Selectors without a metric name, or matching it with a regular expression, are rejected, as the metrics they
+// select can't be told without running them.
+func checkAllowedMetrics(expr string, allowedPrefixes []string) error {
+	parsed, err := parser.ParseExpr(expr)
+	if err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+
+	var checkErr error
+	parser.Inspect(parsed, func(node parser.Node, _ []parser.Node) error {
+		selector, ok := node.(*parser.VectorSelector)
+		if !ok || checkErr != nil {
+			return nil
+		}
+
+		name, ok := selectorMetricName(selector)
+		if !ok {
+			checkErr = fmt.Errorf("the selector %s doesn't select a single metric by its name, which is required as only metrics starting with %s are allowed", selector, strings.Join(allowedPrefixes, ", "))
+			return nil
+		}
+		if !hasAllowedPrefix(name, allowedPrefixes) {
+			checkErr = fmt.Errorf("the metric %q is not allowed, only metrics starting with %s can be queried", name, strings.Join(allowedPrefixes, ", "))
+		}
+		return nil
+	})
+	return checkErr
+}
+
+// checkAllowedSelectors returns an error if one of the series selectors, e.g. the match[] parameters of metrics
+// lookups, selects a metric which doesn't start with one of the allowed prefixes.
+func checkAllowedSelectors(selectors []string, allowedPrefixes []string) error {
+	for _, selector := range selectors {
+		if err := checkAllowedMetrics(selector, allowedPrefixes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectorMetricName returns the metric name selector matches by equality, e.g. up in up{job="a"} or {__name__="up"}.
+func selectorMetricName(selector *parser.VectorSelector) (string, bool) {
+	if selector.Name != "" {
+		return selector.Name, true
+	}
+	for _, matcher := range selector.LabelMatchers {
+		if matcher.Name == labels.MetricName && matcher.Type == labels.MatchEqual {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+func hasAllowedPrefix(name string, allowedPrefixes []string) bool {
+	for _, prefix := range allowedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTSDBStats leaves out the statistics of metrics which don't start with one of the allowed prefixes, which would
+// tell the names and number of series of metrics that can't be queried.
+func filterTSDBStats(result apiv1.TSDBResult, allowedPrefixes []string) apiv1.TSDBResult {
+	seriesCountByMetricName := make([]apiv1.Stat, 0, len(result.SeriesCountByMetricName))
+	for _, stat := range result.SeriesCountByMetricName {
+		if hasAllowedPrefix(stat.Name, allowedPrefixes) {
+			seriesCountByMetricName = append(seriesCountByMetricName, stat)
+		}
+	}
+	result.SeriesCountByMetricName = seriesCountByMetricName
+
+	// Pairs of the metric name label are in the form __name__=<metric>
+	metricNamePair := labels.MetricName + "="
+	seriesCountByLabelValuePair := make([]apiv1.Stat, 0, len(result.SeriesCountByLabelValuePair))
+	for _, stat := range result.SeriesCountByLabelValuePair {
+		if !strings.HasPrefix(stat.Name, metricNamePair) || hasAllowedPrefix(strings.TrimPrefix(stat.Name, metricNamePair), allowedPrefixes) {
+			seriesCountByLabelValuePair = append(seriesCountByLabelValuePair, stat)
+		}
+	}
+	result.SeriesCountByLabelValuePair = seriesCountByLabelValuePair
+
+	return result
+}
+
+// filterMetricNames leaves out the metric names which don't start with one of the allowed prefixes.
+func filterMetricNames(names model.LabelValues, allowedPrefixes []string) model.LabelValues {
+	filtered := make(model.LabelValues, 0, len(names))
+	for _, name := range names {
+		if hasAllowedPrefix(string(name), allowedPrefixes) {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+// filterSeries leaves out the series of metrics which don't start with one of the allowed prefixes.
+func filterSeries(series []model.LabelSet, allowedPrefixes []string) []model.LabelSet {
+	filtered := make([]model.LabelSet, 0, len(series))
+	for _, s := range series {
+		if hasAllowedPrefix(string(s[model.MetricNameLabel]), allowedPrefixes) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// filterMetadata leaves out the metadata of metrics which don't start with one of the allowed prefixes. The metadata
+// is copied, as it is shared by the metadata cache.
+func filterMetadata(metadata map[string]metricMetadata, allowedPrefixes []string) map[string]metricMetadata {
+	filtered := make(map[string]metricMetadata, len(metadata))
+	for name, m := range metadata {
+		if hasAllowedPrefix(name, allowedPrefixes) {
+			filtered[name] = m
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,57 @@
+package prometheus
+
+import (
+	"testing"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_checkAllowedMetrics(t *testing.T) {
+	allowed := []string{"node_", "up"}
+
+	t.Run("queries of allowed metrics should be accepted", func(t *testing.T) {
+		for _, expr := range []string{
+			`up`,
+			`rate(node_cpu_seconds_total{mode="idle"}[5m])`,
+			`sum by (job) (up) / count(node_load1)`,
+			`{__name__="node_load5"}`,
+			`node_load1 offset 1h`,
+		} {
+			require.NoError(t, checkAllowedMetrics(expr, allowed), expr)
+		}
+	})
+
+	t.Run("queries of other metrics should be rejected", func(t *testing.T) {
+		err := checkAllowedMetrics(`up + on(job) group_left process_cpu_seconds_total`, allowed)
+		require.EqualError(t, err, `the metric "process_cpu_seconds_total" is not allowed, only metrics starting with node_, up can be queried`)
+
+		err = checkAllowedMetrics(`sum(rate({__name__="go_gc_duration_seconds"}[5m]))`, allowed)
+		require.EqualError(t, err, `the metric "go_gc_duration_seconds" is not allowed, only metrics starting with node_, up can be queried`)
+	})
+
+	t.Run("selectors without a metric name should be rejected", func(t *testing.T) {
+		for _, expr := range []string{`{job="node"}`, `{__name__=~"node_.*"}`} {
+			err := checkAllowedMetrics(expr, allowed)
+			require.Error(t, err, expr)
+			require.Contains(t, err.Error(), "doesn't select a single metric by its name")
+		}
+	})
+
+	t.Run("invalid queries should be rejected", func(t *testing.T) {
+		require.Error(t, checkAllowedMetrics(`sum(up`, allowed))
+	})
+}
+
+func TestPrometheus_filterTSDBStats(t *testing.T) {
+	result := apiv1.TSDBResult{
+		SeriesCountByMetricName:     []apiv1.Stat{{Name: "app_requests_total", Value: 10}, {Name: "node_cpu_seconds_total", Value: 20}},
+		LabelValueCountByLabelName:  []apiv1.Stat{{Name: "instance", Value: 5}},
+		SeriesCountByLabelValuePair: []apiv1.Stat{{Name: "__name__=app_requests_total", Value: 10}, {Name: "__name__=node_cpu_seconds_total", Value: 20}, {Name: "job=app", Value: 30}},
+	}
+
+	filtered := filterTSDBStats(result, []string{"app_"})
+	require.Equal(t, []apiv1.Stat{{Name: "app_requests_total", Value: 10}}, filtered.SeriesCountByMetricName)
+	require.Equal(t, []apiv1.Stat{{Name: "instance", Value: 5}}, filtered.LabelValueCountByLabelName)
+	require.Equal(t, []apiv1.Stat{{Name: "__name__=app_requests_total", Value: 10}, {Name: "job=app", Value: 30}}, filtered.SeriesCountByLabelValuePair)
+}
@@ -0,0 +1,203 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_cancellation(t *testing.T) {
+	var received int32
+	started := make(chan struct{}, 10)
+	canceled := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/status/buildinfo" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// The server only notices that the client closed the connection once the body is read
+		_ = req.ParseForm()
+		atomic.AddInt32(&received, 1)
+		started <- struct{}{}
+		select {
+		case <-req.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+		ID:       1,
+		URL:      srv.URL,
+		JSONData: []byte(`{}`),
+	})
+	require.NoError(t, err)
+	dsInfo := instance.(DatasourceInfo)
+	s := newTestServiceWithDSInfo(&dsInfo)
+
+	run := func(t *testing.T, req *backend.QueryDataRequest) *backend.QueryDataResponse {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		type result struct {
+			res *backend.QueryDataResponse
+			err error
+		}
+		// The query runs in another goroutine, its result is checked by the test goroutine
+		done := make(chan result, 1)
+		go func() {
+			res, err := s.executeTimeSeriesQuery(ctx, req, &dsInfo)
+			done <- result{res: res, err: err}
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("query was not sent")
+		}
+		cancel()
+
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request was not canceled")
+		}
+		select {
+		case r := <-done:
+			require.NoError(t, r.err)
+			return r.res
+		case <-time.After(5 * time.Second):
+			t.Fatal("query did not return after being canceled")
+			return nil
+		}
+	}
+
+	now := time.Now()
+	timeRange := backend.TimeRange{From: now.Add(-time.Hour), To: now}
+
+	t.Run("canceling a query should abort its request", func(t *testing.T) {
+		for _, model := range []string{`{"expr": "up", "range": true}`, `{"expr": "up", "range": true, "streaming": true}`, `{"expr": "up", "instant": true}`} {
+			res := run(t, queryContext(model, timeRange))
+
+			var queryErr *QueryError
+			require.ErrorAs(t, res.Responses["A"].Error, &queryErr, model)
+			require.Equal(t, ErrorStatusCanceled, queryErr.Status, model)
+		}
+	})
+
+	t.Run("canceling a request should not send its queries waiting for their turn", func(t *testing.T) {
+		concurrency := queryConcurrency
+		queryConcurrency = 1
+		t.Cleanup(func() { queryConcurrency = concurrency })
+		atomic.StoreInt32(&received, 0)
+
+		res := run(t, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "process_cpu_seconds_total", "range": true}`)},
+			},
+		})
+		require.Equal(t, int32(1), atomic.LoadInt32(&received))
+		for _, refID := range []string{"A", "B"} {
+			var queryErr *QueryError
+			require.ErrorAs(t, res.Responses[refID].Error, &queryErr, refID)
+			require.Equal(t, ErrorStatusCanceled, queryErr.Status, refID)
+		}
+	})
+	t.Run("canceling a request should not send its queries waiting for the limit of the datasource", func(t *testing.T) {
+		atomic.StoreInt32(&received, 0)
+		limited := dsInfo
+		limited.querySlots = make(chan struct{}, 1)
+		// Another request holds the only slot
+		limited.querySlots <- struct{}{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		res, err := s.executeTimeSeriesQuery(ctx, queryContext(`{"expr": "up", "range": true}`, timeRange), &limited)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), atomic.LoadInt32(&received))
+
+		var queryErr *QueryError
+		require.ErrorAs(t, res.Responses["A"].Error, &queryErr)
+		require.Equal(t, ErrorStatusTimeout, queryErr.Status)
+	})
+}
+
+func TestPrometheus_maxConcurrentQueries(t *testing.T) {
+	var running, maxRunning int32
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/status/buildinfo" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			prev := atomic.LoadInt32(&maxRunning)
+			if n <= prev || atomic.CompareAndSwapInt32(&maxRunning, prev, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+		ID:       1,
+		URL:      srv.URL,
+		JSONData: []byte(`{"maxConcurrentQueries": 2}`),
+	})
+	require.NoError(t, err)
+	dsInfo := instance.(DatasourceInfo)
+	s := newTestServiceWithDSInfo(&dsInfo)
+
+	now := time.Now()
+	timeRange := backend.TimeRange{From: now.Add(-time.Hour), To: now}
+	req := func(exprs ...string) *backend.QueryDataRequest {
+		req := &backend.QueryDataRequest{}
+		for _, expr := range exprs {
+			req.Queries = append(req.Queries, backend.DataQuery{RefID: expr, TimeRange: timeRange, JSON: []byte(fmt.Sprintf(`{"expr": %q, "range": true}`, expr))})
+		}
+		return req
+	}
+
+	// The limit is shared by concurrent requests, e.g. of the panels of a dashboard
+	requests := []*backend.QueryDataRequest{req("a", "b", "c"), req("d", "e", "f")}
+	// The requests run in other goroutines, their errors are checked by the test goroutine
+	errs := make(chan error, 6)
+	var wg sync.WaitGroup
+	for _, r := range requests {
+		wg.Add(1)
+		go func(r *backend.QueryDataRequest) {
+			defer wg.Done()
+			res, err := s.executeTimeSeriesQuery(context.Background(), r, &dsInfo)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, q := range r.Queries {
+				if err := res.Responses[q.RefID].Error; err != nil {
+					errs <- fmt.Errorf("query %s: %w", q.RefID, err)
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
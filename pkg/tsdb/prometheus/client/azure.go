@@ -0,0 +1,58 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/azuremonitor/azcredentials"
+	"github.com/grafana/grafana/pkg/tsdb/azuremonitor/aztokenprovider"
+)
+
+// defaultAzureResourceId is the resource of Azure Monitor managed service for Prometheus
+const defaultAzureResourceId = "https://prometheus.monitor.azure.com"
+
+// AzureMiddleware returns a middleware authenticating requests with Azure AD, or nil if
+// no azureCredentials are configured. Access tokens are cached and refreshed before they expire.
+func AzureMiddleware(cfg *setting.Cfg, jsonData map[string]interface{}, secureJsonData map[string]string) (sdkhttpclient.Middleware, error) {
+	credentials, err := azcredentials.FromDatasourceData(jsonData, secureJsonData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure credentials: %w", err)
+	}
+	if credentials == nil {
+		return nil, nil
+	}
+
+	tokenProvider, err := aztokenprovider.NewAzureAccessTokenProvider(cfg, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := azureScopes(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	return aztokenprovider.AuthMiddleware(tokenProvider, scopes), nil
+}
+
+func azureScopes(jsonData map[string]interface{}) ([]string, error) {
+	resourceIdString := defaultAzureResourceId
+	if resourceIdJson, exists := jsonData["azureEndpointResourceId"]; exists && resourceIdJson != nil {
+		var ok bool
+		resourceIdString, ok = resourceIdJson.(string)
+		if !ok {
+			return nil, fmt.Errorf("the field 'azureEndpointResourceId' should be a string")
+		}
+	}
+
+	resourceId, err := url.Parse(resourceIdString)
+	if err != nil || resourceId.Scheme == "" || resourceId.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint Resource ID URL '%s'", resourceIdString)
+	}
+
+	resourceId.Path = path.Join(resourceId.Path, ".default")
+	return []string{resourceId.String()}, nil
+}
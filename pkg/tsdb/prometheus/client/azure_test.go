@@ -0,0 +1,69 @@
+package client
+
+import (
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureMiddleware(t *testing.T) {
+	cfg := setting.NewCfg()
+
+	t.Run("Without azureCredentials, should not authenticate", func(t *testing.T) {
+		mw, err := AzureMiddleware(cfg, map[string]interface{}{}, nil)
+		require.NoError(t, err)
+		require.Nil(t, mw)
+	})
+
+	t.Run("With client secret credentials, should authenticate", func(t *testing.T) {
+		mw, err := AzureMiddleware(cfg, map[string]interface{}{
+			"azureCredentials": map[string]interface{}{
+				"authType":   "clientsecret",
+				"azureCloud": "AzureCloud",
+				"tenantId":   "tenant",
+				"clientId":   "client",
+			},
+		}, map[string]string{"azureClientSecret": "secret"})
+		require.NoError(t, err)
+		require.NotNil(t, mw)
+
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, "AzureAuthentication", middlewareName.MiddlewareName())
+	})
+
+	t.Run("With managed identity disabled in the config, should fail", func(t *testing.T) {
+		_, err := AzureMiddleware(cfg, map[string]interface{}{
+			"azureCredentials": map[string]interface{}{"authType": "msi"},
+		}, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("With invalid credentials, should fail", func(t *testing.T) {
+		_, err := AzureMiddleware(cfg, map[string]interface{}{
+			"azureCredentials": map[string]interface{}{"authType": "password"},
+		}, nil)
+		require.Error(t, err)
+	})
+}
+
+func TestAzureScopes(t *testing.T) {
+	t.Run("Without resource ID, should use Azure Monitor managed Prometheus", func(t *testing.T) {
+		scopes, err := azureScopes(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"https://prometheus.monitor.azure.com/.default"}, scopes)
+	})
+
+	t.Run("With resource ID, should use it", func(t *testing.T) {
+		scopes, err := azureScopes(map[string]interface{}{"azureEndpointResourceId": "https://example.com/app"})
+		require.NoError(t, err)
+		require.Equal(t, []string{"https://example.com/app/.default"}, scopes)
+	})
+
+	t.Run("With invalid resource ID, should fail", func(t *testing.T) {
+		_, err := azureScopes(map[string]interface{}{"azureEndpointResourceId": "example"})
+		require.Error(t, err)
+	})
+}
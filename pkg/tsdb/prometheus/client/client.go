@@ -0,0 +1,579 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+	"github.com/prometheus/client_golang/api"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Client is a Prometheus API client which can also decode range query responses series by series, and native
+// histogram samples of query results.
+type Client struct {
+	apiv1.API
+
+	url        string
+	httpClient *http.Client
+}
+
+// New returns a client sending requests to the Prometheus server at url through roundTripper.
+func New(url string, roundTripper http.RoundTripper) (*Client, error) {
+	roundTripper = contentTypeRoundTripper{next: payloadTooLargeRoundTripper{next: rateLimitRoundTripper{next: roundTripper}}}
+	client, err := api.NewClient(api.Config{
+		Address:      url,
+		RoundTripper: roundTripper,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		API:        apiv1.NewAPI(client),
+		url:        url,
+		httpClient: &http.Client{Transport: roundTripper},
+	}, nil
+}
+
+// QueryRange runs a range query. Unlike the Prometheus client, it also decodes native histogram samples,
+// which are returned as series of cumulative bucket counts.
+func (c *Client) QueryRange(ctx context.Context, query string, r apiv1.Range) (model.Value, apiv1.Warnings, error) {
+	matrix := model.Matrix{}
+	warnings, err := c.QueryRangeStream(ctx, query, r, func(series *model.SampleStream) error {
+		matrix = append(matrix, series)
+		return nil
+	})
+	if err != nil {
+		return nil, warnings, err
+	}
+	return matrix, warnings, nil
+}
+
+// QueryRangeStream runs a range query and calls onSeries for every series of the result as soon as it
+// is decoded, so that the whole response never has to be kept in memory.
+// Like the other queries, it is sent with POST and falls back to GET if POST isn't allowed.
+func (c *Client) QueryRangeStream(ctx context.Context, query string, r apiv1.Range, onSeries func(*model.SampleStream) error) (apiv1.Warnings, error) {
+	args := url.Values{}
+	args.Set("query", query)
+	args.Set("start", formatTime(r.Start))
+	args.Set("end", formatTime(r.End))
+	args.Set("step", strconv.FormatFloat(r.Step.Seconds(), 'f', -1, 64))
+
+	res, err := c.post(ctx, "/api/v1/query_range", args)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(res)
+
+	return decodeRangeResponse(json.NewDecoder(res.Body), onSeries)
+}
+
+// Query runs an instant query. Unlike the Prometheus client, it also decodes native histogram samples,
+// which are returned as samples of cumulative bucket counts, like the ones of QueryRange.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (model.Value, apiv1.Warnings, error) {
+	args := url.Values{}
+	args.Set("query", query)
+	if !ts.IsZero() {
+		args.Set("time", formatTime(ts))
+	}
+
+	res, err := c.post(ctx, "/api/v1/query", args)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeBody(res)
+
+	return decodeInstantResponse(json.NewDecoder(res.Body))
+}
+
+// post sends a query to endpoint with POST, and again with GET if POST isn't allowed. Responses without an API
+// response in the body are returned as errors.
+func (c *Client) post(ctx context.Context, endpoint string, args url.Values) (*http.Response, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(args.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented {
+		closeBody(res)
+		u.RawQuery = args.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err = c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasAPIResponse(res.StatusCode) {
+		defer closeBody(res)
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, &apiv1.Error{
+			Type:   errorTypeFor(res.StatusCode),
+			Msg:    errorMsgFor(res.StatusCode),
+			Detail: string(body),
+		}
+	}
+	return res, nil
+}
+
+// payloadTooLargeRoundTripper returns an error telling the user what to do about 413 Payload Too Large responses,
+// which reverse proxies in front of Prometheus return for long query expressions, instead of a bare status code.
+type payloadTooLargeRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt payloadTooLargeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusRequestEntityTooLarge {
+		return res, err
+	}
+	closeBody(res)
+
+	apiErr := &apiv1.Error{
+		Type: apiv1.ErrClient,
+		Msg:  "the request is too large for Prometheus (413 Payload Too Large), reduce the time range or narrow the query",
+	}
+	if req.Method == http.MethodPost && req.ContentLength > 0 {
+		apiErr.Detail = fmt.Sprintf("the POST request body was %d bytes", req.ContentLength)
+	}
+	return nil, apiErr
+}
+
+// RateLimitError is returned for 429 Too Many Requests responses, which Prometheus or a gateway in front of it return
+// for requests over their rate limit. The requests weren't processed, so they can be sent again after RetryAfter.
+type RateLimitError struct {
+	// RetryAfter is the wait asked for by the Retry-After header of the response, or zero if it had none
+	RetryAfter time.Duration
+
+	err *apiv1.Error
+}
+
+func (e *RateLimitError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the Prometheus client, so rate limited requests are categorized as client errors.
+func (e *RateLimitError) Unwrap() error {
+	return e.err
+}
+
+// rateLimitRoundTripper returns a RateLimitError for 429 Too Many Requests responses, which are left once the retries
+// of the request, if enabled, are exhausted.
+type rateLimitRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt rateLimitRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.next.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusTooManyRequests {
+		return res, err
+	}
+	closeBody(res)
+
+	retryAfter := middleware.RetryAfter(res, time.Now()).Round(time.Second)
+	msg := "Prometheus is rate limiting requests (429 Too Many Requests), try again later"
+	if retryAfter > 0 {
+		msg = fmt.Sprintf("Prometheus is rate limiting requests (429 Too Many Requests), try again in %s", retryAfter)
+	}
+	return nil, &RateLimitError{
+		RetryAfter: retryAfter,
+		err:        &apiv1.Error{Type: apiv1.ErrClient, Msg: msg},
+	}
+}
+
+const maxResponseBytesMiddlewareName = "prom-max-response-bytes"
+
+// maxResponseBytesMiddleware fails reading response bodies larger than limit, instead of reading them in memory
+// whatever their size.
+func maxResponseBytesMiddleware(limit int64) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(maxResponseBytesMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := next.RoundTrip(req)
+			if err != nil || res.Body == nil {
+				return res, err
+			}
+			res.Body = &limitedBody{
+				reader: io.LimitReader(res.Body, limit+1),
+				body:   res.Body,
+				limit:  limit,
+			}
+			return res, nil
+		})
+	})
+}
+
+// limitedBody reads at most one byte more than limit from body, which tells that the body is too large
+type limitedBody struct {
+	reader io.Reader
+	body   io.ReadCloser
+	limit  int64
+	read   int64
+	err    error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.reader.Read(p)
+	if b.read+int64(n) > b.limit {
+		// Only the bytes up to the limit are returned
+		n = int(b.limit - b.read)
+		err = &apiv1.Error{
+			Type: apiv1.ErrBadResponse,
+			Msg:  fmt.Sprintf("the response of Prometheus is larger than the limit of %d bytes, narrow the query or increase maxResponseBytes", b.limit),
+		}
+		b.err = err
+	}
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// bodySnippetSize is the number of bytes of an unexpected response body shown in the error
+const bodySnippetSize = 256
+
+// contentTypeRoundTripper returns an error telling the user what went wrong when a response isn't JSON, e.g. the HTML
+// login page of an authentication proxy or a compressed body the proxy didn't decode, instead of a JSON syntax error.
+// Bodies which look like JSON are passed on whatever their content type, as some proxies don't keep it.
+type contentTypeRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt contentTypeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.next.RoundTrip(req)
+	if err != nil || !hasAPIResponse(res.StatusCode) {
+		return res, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return res, nil
+	}
+
+	// The start of the body is read again before the rest of it. Errors reading it, e.g. of a short body, are
+	// returned again by reading the rest.
+	peek := make([]byte, bodySnippetSize)
+	n, _ := io.ReadFull(res.Body, peek)
+	peek = peek[:n]
+	if trimmed := bytes.TrimSpace(peek); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(peek), res.Body), res.Body}
+		return res, nil
+	}
+	closeBody(res)
+
+	if mediaType == "" {
+		mediaType = "a response without content type"
+	}
+	return nil, &apiv1.Error{
+		Type:   apiv1.ErrBadResponse,
+		Msg:    fmt.Sprintf("expected JSON but received %s; check authentication/proxy configuration", mediaType),
+		Detail: bodySnippet(peek),
+	}
+}
+
+// hasAPIResponse tells if a response with statusCode comes with an API response in the body,
+// same as the Prometheus client
+func hasAPIResponse(statusCode int) bool {
+	return statusCode/100 == 2 || statusCode == http.StatusBadRequest ||
+		statusCode == http.StatusUnprocessableEntity || statusCode == http.StatusServiceUnavailable
+}
+
+// bodySnippet describes the start of an unexpected response body
+func bodySnippet(body []byte) string {
+	if len(body) >= 2 && body[0] == 0x1f && body[1] == 0x8b {
+		return "the response body is gzip compressed"
+	}
+	// The snippet may end in the middle of a character
+	return strings.TrimSpace(string(bytes.ToValidUTF8(body, nil)))
+}
+
+// decodeRangeResponse walks through the tokens of a response of the form
+// {"status": ..., "data": {"resultType": "matrix", "result": [...]}, "warnings": [...]}
+// and decodes the series of the result one by one.
+func decodeRangeResponse(dec *json.Decoder, onSeries func(*model.SampleStream) error) (apiv1.Warnings, error) {
+	var (
+		status, errorType, errorMsg string
+		warnings                    apiv1.Warnings
+	)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, badResponse(err)
+		}
+
+		switch key {
+		case "status":
+			err = dec.Decode(&status)
+		case "errorType":
+			err = dec.Decode(&errorType)
+		case "error":
+			err = dec.Decode(&errorMsg)
+		case "warnings":
+			err = dec.Decode(&warnings)
+		case "data":
+			if err := decodeRangeData(dec, onSeries); err != nil {
+				return warnings, err
+			}
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return warnings, badResponse(err)
+		}
+	}
+
+	if status == "error" {
+		return warnings, &apiv1.Error{Type: apiv1.ErrorType(errorType), Msg: errorMsg}
+	}
+	return warnings, nil
+}
+
+func decodeRangeData(dec *json.Decoder, onSeries func(*model.SampleStream) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return badResponse(err)
+		}
+
+		switch key {
+		case "resultType":
+			var resultType string
+			if err := dec.Decode(&resultType); err != nil {
+				return badResponse(err)
+			}
+			if resultType != model.ValMatrix.String() {
+				return badResponse(fmt.Errorf("unexpected result type %q", resultType))
+			}
+		case "result":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				series := &rangeSeries{}
+				if err := dec.Decode(series); err != nil {
+					return badResponse(err)
+				}
+				if err := decodedSeries(series, onSeries); err != nil {
+					return err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		default:
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return badResponse(err)
+			}
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// decodeInstantResponse decodes a response of the form
+// {"status": ..., "data": {"resultType": ..., "result": ...}, "warnings": [...]} as a whole.
+func decodeInstantResponse(dec *json.Decoder) (model.Value, apiv1.Warnings, error) {
+	var response struct {
+		Status    string         `json:"status"`
+		ErrorType string         `json:"errorType"`
+		Error     string         `json:"error"`
+		Warnings  apiv1.Warnings `json:"warnings"`
+		Data      struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := dec.Decode(&response); err != nil {
+		return nil, nil, badResponse(err)
+	}
+	if response.Status == "error" {
+		return nil, response.Warnings, &apiv1.Error{Type: apiv1.ErrorType(response.ErrorType), Msg: response.Error}
+	}
+
+	value, err := decodeInstantResult(response.Data.ResultType, response.Data.Result)
+	if err != nil {
+		return nil, response.Warnings, err
+	}
+	return value, response.Warnings, nil
+}
+
+// decodeInstantResult decodes the result of an instant query, which can be of any type.
+func decodeInstantResult(resultType string, result json.RawMessage) (model.Value, error) {
+	switch resultType {
+	case model.ValVector.String():
+		var samples []instantSample
+		if err := json.Unmarshal(result, &samples); err != nil {
+			return nil, badResponse(err)
+		}
+		vector := model.Vector{}
+		for _, sample := range samples {
+			if sample.Value == nil && sample.Histogram == nil {
+				return nil, badResponse(fmt.Errorf("sample of %s has no value", sample.Metric))
+			}
+			if sample.Value != nil {
+				vector = append(vector, &model.Sample{Metric: sample.Metric, Value: sample.Value.Value, Timestamp: sample.Value.Timestamp})
+			}
+			if sample.Histogram == nil {
+				continue
+			}
+			buckets, err := bucketSeries(sample.Metric, []histogramPair{*sample.Histogram})
+			if err != nil {
+				return nil, badResponse(fmt.Errorf("invalid native histogram: %w", err))
+			}
+			for _, bucket := range buckets {
+				vector = append(vector, &model.Sample{Metric: bucket.Metric, Value: bucket.Values[0].Value, Timestamp: bucket.Values[0].Timestamp})
+			}
+		}
+		return vector, nil
+	case model.ValMatrix.String():
+		var series []*rangeSeries
+		if err := json.Unmarshal(result, &series); err != nil {
+			return nil, badResponse(err)
+		}
+		matrix := model.Matrix{}
+		for _, s := range series {
+			err := decodedSeries(s, func(stream *model.SampleStream) error {
+				matrix = append(matrix, stream)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return matrix, nil
+	case model.ValScalar.String():
+		scalar := &model.Scalar{}
+		if err := json.Unmarshal(result, scalar); err != nil {
+			return nil, badResponse(err)
+		}
+		return scalar, nil
+	case model.ValString.String():
+		str := &model.String{}
+		if err := json.Unmarshal(result, str); err != nil {
+			return nil, badResponse(err)
+		}
+		return str, nil
+	}
+	return nil, badResponse(fmt.Errorf("unexpected result type %q", resultType))
+}
+
+// decodedSeries calls onSeries for the float samples of series, and for the buckets of its native histogram samples.
+func decodedSeries(series *rangeSeries, onSeries func(*model.SampleStream) error) error {
+	if len(series.Values) > 0 || len(series.Histograms) == 0 {
+		if err := onSeries(&model.SampleStream{Metric: series.Metric, Values: series.Values}); err != nil {
+			return err
+		}
+	}
+	if len(series.Histograms) == 0 {
+		return nil
+	}
+
+	buckets, err := bucketSeries(series.Metric, series.Histograms)
+	if err != nil {
+		return badResponse(fmt.Errorf("invalid native histogram: %w", err))
+	}
+	for _, bucket := range buckets {
+		if err := onSeries(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return badResponse(err)
+	}
+	if token != delim {
+		return badResponse(fmt.Errorf("expected %s but got %v", delim, token))
+	}
+	return nil
+}
+
+func badResponse(err error) error {
+	// Errors reading the body, e.g. too large bodies, already tell what went wrong
+	var apiErr *apiv1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &apiv1.Error{Type: apiv1.ErrBadResponse, Msg: err.Error()}
+}
+
+func errorTypeFor(statusCode int) apiv1.ErrorType {
+	switch statusCode / 100 {
+	case 4:
+		return apiv1.ErrClient
+	case 5:
+		return apiv1.ErrServer
+	}
+	return apiv1.ErrBadResponse
+}
+
+func errorMsgFor(statusCode int) string {
+	switch statusCode / 100 {
+	case 4:
+		return fmt.Sprintf("client error: %d", statusCode)
+	case 5:
+		return fmt.Sprintf("server error: %d", statusCode)
+	}
+	return fmt.Sprintf("bad response code %d", statusCode)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.Unix())+float64(t.Nanosecond())/1e9, 'f', -1, 64)
+}
+
+func closeBody(res *http.Response) {
+	// Drain the body, so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+}
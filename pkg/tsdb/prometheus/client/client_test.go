@@ -0,0 +1,341 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_QueryRangeStream(t *testing.T) {
+	r := apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: 30 * time.Second}
+
+	stream := func(t *testing.T, handler http.HandlerFunc) ([]*model.SampleStream, apiv1.Warnings, error) {
+		t.Helper()
+
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+
+		client, err := New(srv.URL, http.DefaultTransport)
+		require.NoError(t, err)
+
+		var series []*model.SampleStream
+		warnings, err := client.QueryRangeStream(context.Background(), "up", r, func(s *model.SampleStream) error {
+			series = append(series, s)
+			return nil
+		})
+		return series, warnings, err
+	}
+
+	t.Run("Should decode every series of the result", func(t *testing.T) {
+		series, warnings, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.Equal(t, http.MethodPost, req.Method)
+			require.Equal(t, "/api/v1/query_range", req.URL.Path)
+			require.NoError(t, req.ParseForm())
+			require.Equal(t, "up", req.Form.Get("query"))
+			require.Equal(t, "0", req.Form.Get("start"))
+			require.Equal(t, "60", req.Form.Get("end"))
+			require.Equal(t, "30", req.Form.Get("step"))
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"job":"a"},"values":[[0,"1"],[30,"2"]]},
+				{"metric":{"job":"b"},"values":[[60,"3"]]}
+			]},"warnings":["partial response"]}`))
+		})
+		require.NoError(t, err)
+		require.Equal(t, apiv1.Warnings{"partial response"}, warnings)
+		require.Len(t, series, 2)
+		require.Equal(t, model.LabelValue("a"), series[0].Metric["job"])
+		require.Len(t, series[0].Values, 2)
+		require.Equal(t, model.SampleValue(3), series[1].Values[0].Value)
+	})
+
+	t.Run("Should decode NaN and infinite values", func(t *testing.T) {
+		series, _, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"job":"a"},"values":[[0,"NaN"],[30,"+Inf"],[60,"-Inf"]]}
+			]}}`))
+		})
+		require.NoError(t, err)
+		require.Len(t, series, 1)
+		require.True(t, math.IsNaN(float64(series[0].Values[0].Value)))
+		require.True(t, math.IsInf(float64(series[0].Values[1].Value), 1))
+		require.True(t, math.IsInf(float64(series[0].Values[2].Value), -1))
+	})
+
+	t.Run("Should fall back to GET", func(t *testing.T) {
+		series, _, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodPost {
+				rw.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			require.Equal(t, "up", req.URL.Query().Get("query"))
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[0,"1"]]}]}}`))
+		})
+		require.NoError(t, err)
+		require.Len(t, series, 1)
+	})
+
+	t.Run("Should return API errors", func(t *testing.T) {
+		_, _, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+		})
+		require.Equal(t, &apiv1.Error{Type: apiv1.ErrBadData, Msg: "parse error"}, err)
+	})
+
+	t.Run("Should return status errors", func(t *testing.T) {
+		_, _, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte(`unauthorized`))
+		})
+		require.Equal(t, &apiv1.Error{Type: apiv1.ErrClient, Msg: "client error: 401", Detail: "unauthorized"}, err)
+	})
+
+	t.Run("Should fail on invalid responses", func(t *testing.T) {
+		_, _, err := stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{}`))
+		})
+		var apiErr *apiv1.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, apiv1.ErrBadResponse, apiErr.Type)
+
+		_, _, err = stream(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		})
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, apiv1.ErrBadResponse, apiErr.Type)
+	})
+}
+
+func TestClient_QueryRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__name__":"up"},"values":[[0,"1"]]},
+			{"metric":{"__name__":"request_duration_seconds"},"histograms":[
+				[0,{"count":"5","sum":"2.5","buckets":[[0,"0","0.5","2"],[0,"0.5","1","3"]]}],
+				[30,{"count":"4","sum":"1","buckets":[[0,"0.5","1","1"],[0,"1","2","3"]]}]
+			]}
+		]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+
+	value, _, err := client.QueryRange(context.Background(), "up", apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(30, 0), Step: 30 * time.Second})
+	require.NoError(t, err)
+
+	matrix, ok := value.(model.Matrix)
+	require.True(t, ok)
+	require.Len(t, matrix, 5)
+	require.Equal(t, model.Metric{"__name__": "up"}, matrix[0].Metric)
+
+	// Native histograms are returned as cumulative bucket counts by upper bound
+	expected := map[model.LabelValue][]model.SampleValue{
+		"0.5":  {2, 0},
+		"1":    {5, 1},
+		"2":    {5, 4},
+		"+Inf": {5, 4},
+	}
+	for _, series := range matrix[1:] {
+		require.Equal(t, model.LabelValue("request_duration_seconds"), series.Metric["__name__"])
+		le := series.Metric["le"]
+		require.Contains(t, expected, le)
+		require.Equal(t, expected[le], []model.SampleValue{series.Values[0].Value, series.Values[1].Value}, "le=%s", le)
+		require.Equal(t, model.Time(30000), series.Values[1].Timestamp)
+	}
+}
+
+func TestClient_Query(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+
+	t.Run("Should return native histograms as cumulative bucket counts", func(t *testing.T) {
+		body = `{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"__name__":"up"},"value":[30,"1"]},
+			{"metric":{"__name__":"request_duration_seconds"},"histogram":[30,{"count":"4","sum":"1","buckets":[[0,"0.5","1","1"],[0,"1","2","3"]]}]}
+		]}}`
+		value, _, err := client.Query(context.Background(), "up", time.Unix(30, 0))
+		require.NoError(t, err)
+
+		vector, ok := value.(model.Vector)
+		require.True(t, ok)
+		require.Len(t, vector, 4)
+		require.Equal(t, &model.Sample{Metric: model.Metric{"__name__": "up"}, Value: 1, Timestamp: 30000}, vector[0])
+
+		expected := map[model.LabelValue]model.SampleValue{"1": 1, "2": 4, "+Inf": 4}
+		for _, sample := range vector[1:] {
+			le := sample.Metric["le"]
+			require.Contains(t, expected, le)
+			require.Equal(t, expected[le], sample.Value, "le=%s", le)
+			require.Equal(t, model.Time(30000), sample.Timestamp)
+		}
+	})
+
+	t.Run("Should return results of other types", func(t *testing.T) {
+		body = `{"status":"success","data":{"resultType":"scalar","result":[30,"2"]}}`
+		value, _, err := client.Query(context.Background(), "scalar(up)", time.Unix(30, 0))
+		require.NoError(t, err)
+		require.Equal(t, &model.Scalar{Value: 2, Timestamp: 30000}, value)
+
+		body = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[0,"1"],[30,"1"]]}]}}`
+		value, _, err = client.Query(context.Background(), "up[30s]", time.Unix(30, 0))
+		require.NoError(t, err)
+		require.Equal(t, model.Matrix{{Metric: model.Metric{"__name__": "up"}, Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 30000, Value: 1}}}}, value)
+	})
+
+	t.Run("Should return errors and warnings of the response", func(t *testing.T) {
+		body = `{"status":"error","errorType":"execution","error":"query timed out","warnings":["partial"]}`
+		_, warnings, err := client.Query(context.Background(), "up", time.Unix(30, 0))
+		var apiErr *apiv1.Error
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, apiv1.ErrExec, apiErr.Type)
+		require.Equal(t, "query timed out", apiErr.Msg)
+		require.Equal(t, apiv1.Warnings{"partial"}, warnings)
+	})
+}
+
+func TestClient_PayloadTooLarge(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		methods = append(methods, req.Method)
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = rw.Write([]byte(`<html>413 Request Entity Too Large</html>`))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+
+	requireTooLarge := func(t *testing.T, err error) {
+		t.Helper()
+		var apiErr *apiv1.Error
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, apiv1.ErrClient, apiErr.Type)
+		require.Equal(t, "the request is too large for Prometheus (413 Payload Too Large), reduce the time range or narrow the query", apiErr.Msg)
+		require.Regexp(t, `^the POST request body was \d+ bytes$`, apiErr.Detail)
+	}
+
+	t.Run("instant query should return an error telling to narrow the query", func(t *testing.T) {
+		methods = nil
+		_, _, err := client.Query(context.Background(), "up", time.Now())
+		requireTooLarge(t, err)
+		// The query isn't sent again with GET, which would only make the URL too long
+		require.Equal(t, []string{http.MethodPost}, methods)
+	})
+
+	t.Run("range query should return an error telling to narrow the query", func(t *testing.T) {
+		methods = nil
+		_, _, err := client.QueryRange(context.Background(), "up", apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Minute})
+		requireTooLarge(t, err)
+		require.Equal(t, []string{http.MethodPost}, methods)
+	})
+}
+
+func TestClient_RateLimited(t *testing.T) {
+	retryAfter := "30"
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if retryAfter != "" {
+			rw.Header().Set("Retry-After", retryAfter)
+		}
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_, _ = rw.Write([]byte(`rate limit exceeded`))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+
+	t.Run("instant query should return a rate limit error with the wait of Retry-After", func(t *testing.T) {
+		_, _, err := client.Query(context.Background(), "up", time.Now())
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(err, &rateLimitErr))
+		require.Equal(t, 30*time.Second, rateLimitErr.RetryAfter)
+		require.EqualError(t, rateLimitErr, "client_error: Prometheus is rate limiting requests (429 Too Many Requests), try again in 30s")
+
+		var apiErr *apiv1.Error
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, apiv1.ErrClient, apiErr.Type)
+	})
+
+	t.Run("range query should return a rate limit error without Retry-After", func(t *testing.T) {
+		retryAfter = ""
+		t.Cleanup(func() { retryAfter = "30" })
+
+		_, _, err := client.QueryRange(context.Background(), "up", apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Minute})
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(err, &rateLimitErr))
+		require.Zero(t, rateLimitErr.RetryAfter)
+		require.EqualError(t, rateLimitErr, "client_error: Prometheus is rate limiting requests (429 Too Many Requests), try again later")
+	})
+}
+
+func TestClient_UnexpectedContentType(t *testing.T) {
+	var contentType string
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		_, _ = rw.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+
+	t.Run("HTML page should return an error telling to check the proxy", func(t *testing.T) {
+		contentType = "text/html; charset=utf-8"
+		body = []byte("  <html><body>Please log in" + strings.Repeat(".", 1000) + "</body></html>")
+
+		for _, query := range []func() error{
+			func() error {
+				_, _, err := client.Query(context.Background(), "up", time.Now())
+				return err
+			},
+			func() error {
+				_, _, err := client.QueryRange(context.Background(), "up", apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Minute})
+				return err
+			},
+		} {
+			var apiErr *apiv1.Error
+			require.True(t, errors.As(query(), &apiErr))
+			require.Equal(t, apiv1.ErrBadResponse, apiErr.Type)
+			require.Equal(t, "expected JSON but received text/html; check authentication/proxy configuration", apiErr.Msg)
+			require.True(t, strings.HasPrefix(apiErr.Detail, "<html><body>Please log in..."))
+			require.Less(t, len(apiErr.Detail), 300)
+		}
+	})
+
+	t.Run("gzip compressed body should return an error telling it isn't decoded", func(t *testing.T) {
+		contentType = "application/octet-stream"
+		body = []byte{0x1f, 0x8b, 0x08, 0x00}
+
+		_, _, err := client.Query(context.Background(), "up", time.Now())
+		var apiErr *apiv1.Error
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, "expected JSON but received application/octet-stream; check authentication/proxy configuration", apiErr.Msg)
+		require.Equal(t, "the response body is gzip compressed", apiErr.Detail)
+	})
+
+	t.Run("JSON body should be decoded whatever the content type", func(t *testing.T) {
+		contentType = "text/plain"
+		body = []byte(`{"status":"success","data":{"resultType":"scalar","result":[1,"2"]}}`)
+
+		value, _, err := client.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+		require.Equal(t, model.SampleValue(2), value.(*model.Scalar).Value)
+	})
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// Flavor is the kind of backend serving the Prometheus API.
+type Flavor string
+
+const (
+	FlavorUnknown    Flavor = ""
+	FlavorPrometheus Flavor = "prometheus"
+	FlavorThanos     Flavor = "thanos"
+	FlavorMimir      Flavor = "mimir"
+)
+
+type buildinfoResponse struct {
+	Data struct {
+		Application string `json:"application"`
+		Version     string `json:"version"`
+	} `json:"data"`
+}
+
+// Flavor detects the backend from its build info and API. Mimir names itself as the application of the build info.
+// Thanos reports the same build info fields as Prometheus, but unlike it serves the stores of its querier.
+func (c *Client) Flavor(ctx context.Context) (Flavor, error) {
+	res, err := c.get(ctx, "/api/v1/status/buildinfo")
+	if err != nil {
+		return FlavorUnknown, err
+	}
+	defer closeBody(res)
+
+	// Backends without the build info endpoint are assumed to be Prometheus compatible
+	if res.StatusCode == http.StatusNotFound {
+		return FlavorPrometheus, nil
+	}
+	if res.StatusCode/100 != 2 {
+		return FlavorUnknown, statusError(res.StatusCode)
+	}
+
+	var buildinfo buildinfoResponse
+	if err := json.NewDecoder(res.Body).Decode(&buildinfo); err != nil {
+		return FlavorUnknown, badResponse(err)
+	}
+	if flavor := flavorFromApplication(buildinfo.Data.Application); flavor != FlavorUnknown {
+		return flavor, nil
+	}
+
+	stores, err := c.get(ctx, "/api/v1/stores")
+	if err != nil {
+		return FlavorUnknown, err
+	}
+	defer closeBody(stores)
+
+	switch {
+	case stores.StatusCode/100 == 2:
+		return FlavorThanos, nil
+	case stores.StatusCode/100 == 4:
+		return FlavorPrometheus, nil
+	}
+	return FlavorUnknown, statusError(stores.StatusCode)
+}
+
+// get sends a GET request to endpoint, the caller closes the body of the response.
+func (c *Client) get(ctx context.Context, endpoint string) (*http.Response, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
+
+func statusError(statusCode int) error {
+	return &apiv1.Error{
+		Type: errorTypeFor(statusCode),
+		Msg:  errorMsgFor(statusCode),
+	}
+}
+
+// flavorFromApplication returns the flavor of the backend named by the application of its build info, or
+// FlavorUnknown if it doesn't name one.
+func flavorFromApplication(application string) Flavor {
+	application = strings.ToLower(application)
+	switch {
+	case strings.Contains(application, "mimir"):
+		return FlavorMimir
+	case strings.Contains(application, "thanos"):
+		return FlavorThanos
+	}
+	return FlavorUnknown
+}
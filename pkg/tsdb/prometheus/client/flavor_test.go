@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Flavor(t *testing.T) {
+	flavor := func(t *testing.T, status int, body string, storesStatus int) (Flavor, error) {
+		t.Helper()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/status/buildinfo":
+				rw.WriteHeader(status)
+				_, _ = rw.Write([]byte(body))
+			case "/api/v1/stores":
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(storesStatus)
+				_, _ = rw.Write([]byte(`{"status":"success","data":{}}`))
+			default:
+				t.Fatalf("unexpected request to %s", req.URL.Path)
+			}
+		}))
+		t.Cleanup(srv.Close)
+
+		c, err := New(srv.URL, http.DefaultTransport)
+		require.NoError(t, err)
+		return c.Flavor(context.Background())
+	}
+
+	t.Run("should detect Prometheus", func(t *testing.T) {
+		f, err := flavor(t, http.StatusOK, `{"status":"success","data":{"version":"2.32.1","revision":"41f1a8125e664985dd30674e5bdf6b683eff5d32"}}`, http.StatusNotFound)
+		require.NoError(t, err)
+		require.Equal(t, FlavorPrometheus, f)
+	})
+
+	t.Run("should detect Mimir from the application", func(t *testing.T) {
+		f, err := flavor(t, http.StatusOK, `{"status":"success","data":{"application":"Grafana Mimir","version":"2.0.0"}}`, http.StatusOK)
+		require.NoError(t, err)
+		require.Equal(t, FlavorMimir, f)
+	})
+
+	t.Run("should detect Thanos from its stores", func(t *testing.T) {
+		f, err := flavor(t, http.StatusOK, `{"status":"success","data":{"version":"0.24.0"}}`, http.StatusOK)
+		require.NoError(t, err)
+		require.Equal(t, FlavorThanos, f)
+	})
+
+	t.Run("should not detect Thanos from the version only", func(t *testing.T) {
+		f, err := flavor(t, http.StatusOK, `{"status":"success","data":{"version":"0.9.0"}}`, http.StatusNotFound)
+		require.NoError(t, err)
+		require.Equal(t, FlavorPrometheus, f)
+	})
+
+	t.Run("should assume Prometheus without the build info endpoint", func(t *testing.T) {
+		f, err := flavor(t, http.StatusNotFound, `404 page not found`, http.StatusOK)
+		require.NoError(t, err)
+		require.Equal(t, FlavorPrometheus, f)
+	})
+
+	t.Run("should return an error for a failed request", func(t *testing.T) {
+		f, err := flavor(t, http.StatusInternalServerError, `oops`, http.StatusOK)
+		require.Error(t, err)
+		require.Equal(t, FlavorUnknown, f)
+
+		f, err = flavor(t, http.StatusOK, `{"status":"success","data":{"version":"2.32.1"}}`, http.StatusBadGateway)
+		require.Error(t, err)
+		require.Equal(t, FlavorUnknown, f)
+	})
+
+	t.Run("should return an error for an invalid response", func(t *testing.T) {
+		_, err := flavor(t, http.StatusOK, `{"status":`, http.StatusOK)
+		require.Error(t, err)
+	})
+}
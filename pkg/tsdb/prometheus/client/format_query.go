@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+type formatQueryResponse struct {
+	Status    string `json:"status"`
+	Data      string `json:"data"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+}
+
+// FormatQuery returns the query formatted by Prometheus, available since Prometheus 2.38.
+// Servers without the endpoint return a client error with the 404 status code.
+func (c *Client) FormatQuery(ctx context.Context, query string) (string, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, "/api/v1/format_query")
+
+	args := url.Values{}
+	args.Set("query", query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(args.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(res)
+
+	if !hasAPIResponse(res.StatusCode) {
+		return "", &apiv1.Error{
+			Type: errorTypeFor(res.StatusCode),
+			Msg:  errorMsgFor(res.StatusCode),
+		}
+	}
+
+	var formatted formatQueryResponse
+	if err := json.NewDecoder(res.Body).Decode(&formatted); err != nil {
+		return "", badResponse(err)
+	}
+	if formatted.Status != "success" {
+		return "", &apiv1.Error{
+			Type: apiv1.ErrorType(formatted.ErrorType),
+			Msg:  formatted.Error,
+		}
+	}
+	return formatted.Data, nil
+}
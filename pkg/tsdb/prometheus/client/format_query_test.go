@@ -0,0 +1,47 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_FormatQuery(t *testing.T) {
+	formatQuery := func(t *testing.T, status int, body string) (string, error) {
+		t.Helper()
+
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			require.Equal(t, "/api/v1/format_query", req.URL.Path)
+			require.NoError(t, req.ParseForm())
+			require.Equal(t, "sum(rate(up[5m]))by(job)", req.PostForm.Get("query"))
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(status)
+			_, _ = rw.Write([]byte(body))
+		}))
+		t.Cleanup(srv.Close)
+
+		c, err := New(srv.URL, http.DefaultTransport)
+		require.NoError(t, err)
+		return c.FormatQuery(context.Background(), "sum(rate(up[5m]))by(job)")
+	}
+
+	t.Run("should return the formatted query", func(t *testing.T) {
+		formatted, err := formatQuery(t, http.StatusOK, `{"status":"success","data":"sum by (job) (rate(up[5m]))"}`)
+		require.NoError(t, err)
+		require.Equal(t, "sum by (job) (rate(up[5m]))", formatted)
+	})
+
+	t.Run("should return the error of an invalid query", func(t *testing.T) {
+		_, err := formatQuery(t, http.StatusBadRequest, `{"status":"error","errorType":"bad_data","error":"1:5: parse error"}`)
+		require.EqualError(t, err, "bad_data: 1:5: parse error")
+	})
+
+	t.Run("should return a not found error without the endpoint", func(t *testing.T) {
+		_, err := formatQuery(t, http.StatusNotFound, `404 page not found`)
+		require.Equal(t, &apiv1.Error{Type: apiv1.ErrClient, Msg: "client error: 404"}, err)
+	})
+}
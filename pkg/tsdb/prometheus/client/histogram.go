@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/common/model"
+)
+
+// rangeSeries is a series of a range query result, which holds float samples, native histogram samples, or both.
+type rangeSeries struct {
+	Metric     model.Metric       `json:"metric"`
+	Values     []model.SamplePair `json:"values"`
+	Histograms []histogramPair    `json:"histograms"`
+}
+
+// instantSample is a sample of an instant query result, which holds a float value or a native histogram.
+type instantSample struct {
+	Metric    model.Metric      `json:"metric"`
+	Value     *model.SamplePair `json:"value"`
+	Histogram *histogramPair    `json:"histogram"`
+}
+
+type histogramPair struct {
+	Timestamp model.Time
+	Histogram histogram
+}
+
+type histogram struct {
+	Count   string            `json:"count"`
+	Sum     string            `json:"sum"`
+	Buckets []json.RawMessage `json:"buckets"`
+}
+
+func (p *histogramPair) UnmarshalJSON(b []byte) error {
+	var pair [2]json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(pair[0], &p.Timestamp); err != nil {
+		return err
+	}
+	return json.Unmarshal(pair[1], &p.Histogram)
+}
+
+// upperBounds returns the upper bounds and counts of the buckets, which are encoded as
+// [boundary rule, lower bound, upper bound, count].
+func (h histogram) upperBounds() ([]float64, []float64, error) {
+	bounds := make([]float64, 0, len(h.Buckets))
+	counts := make([]float64, 0, len(h.Buckets))
+	for _, bucket := range h.Buckets {
+		var fields []json.RawMessage
+		if err := json.Unmarshal(bucket, &fields); err != nil {
+			return nil, nil, err
+		}
+		if len(fields) != 4 {
+			return nil, nil, fmt.Errorf("invalid histogram bucket %s", bucket)
+		}
+
+		var upper, count string
+		if err := json.Unmarshal(fields[2], &upper); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(fields[3], &count); err != nil {
+			return nil, nil, err
+		}
+		upperBound, err := strconv.ParseFloat(upper, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		bucketCount, err := strconv.ParseFloat(count, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		bounds = append(bounds, upperBound)
+		counts = append(counts, bucketCount)
+	}
+	return bounds, counts, nil
+}
+
+// bucketSeries converts native histogram samples to one series per bucket, with the cumulative count
+// of observations up to the upper bound of the bucket in the le label, like the series of a classic
+// histogram. The buckets can then be shown by the heatmap format.
+func bucketSeries(metric model.Metric, histograms []histogramPair) ([]*model.SampleStream, error) {
+	type sample struct {
+		timestamp model.Time
+		count     float64
+		bounds    []float64
+		counts    []float64
+	}
+
+	samples := make([]sample, 0, len(histograms))
+	allBounds := map[float64]struct{}{math.Inf(1): {}}
+	for _, h := range histograms {
+		bounds, counts, err := h.Histogram.upperBounds()
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.ParseFloat(h.Histogram.Count, 64)
+		if err != nil {
+			return nil, err
+		}
+		for _, bound := range bounds {
+			allBounds[bound] = struct{}{}
+		}
+		samples = append(samples, sample{timestamp: h.Timestamp, count: count, bounds: bounds, counts: counts})
+	}
+
+	sortedBounds := make([]float64, 0, len(allBounds))
+	for bound := range allBounds {
+		sortedBounds = append(sortedBounds, bound)
+	}
+	sort.Float64s(sortedBounds)
+	boundIndex := make(map[float64]int, len(sortedBounds))
+	for i, bound := range sortedBounds {
+		boundIndex[bound] = i
+	}
+
+	series := make([]*model.SampleStream, len(sortedBounds))
+	for i, bound := range sortedBounds {
+		bucketMetric := metric.Clone()
+		bucketMetric[model.BucketLabel] = model.LabelValue(formatBound(bound))
+		series[i] = &model.SampleStream{Metric: bucketMetric, Values: make([]model.SamplePair, 0, len(samples))}
+	}
+
+	// The counts of the buckets of a sample are added up in the order of the bounds, so every sample is
+	// walked through once whatever the number of bounds
+	counts := make([]float64, len(sortedBounds))
+	for _, smpl := range samples {
+		for i := range counts {
+			counts[i] = 0
+		}
+		for i, upper := range smpl.bounds {
+			counts[boundIndex[upper]] += smpl.counts[i]
+		}
+
+		cumulative := 0.0
+		for i, bound := range sortedBounds {
+			cumulative += counts[i]
+			value := cumulative
+			if math.IsInf(bound, 1) {
+				value = smpl.count
+			}
+			series[i].Values = append(series[i].Values, model.SamplePair{Timestamp: smpl.timestamp, Value: model.SampleValue(value)})
+		}
+	}
+
+	return series, nil
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'f', -1, 64)
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketSeries(t *testing.T) {
+	t.Run("should order buckets by upper bound", func(t *testing.T) {
+		var histograms []histogramPair
+		require.NoError(t, json.Unmarshal([]byte(`[[1,{"count":"3","sum":"0","buckets":[[0,"-2","-1","1"],[3,"-0.001","0.001","2"]]}]]`), &histograms))
+
+		series, err := bucketSeries(model.Metric{"job": "api"}, histograms)
+		require.NoError(t, err)
+		require.Len(t, series, 3)
+
+		require.Equal(t, model.Metric{"job": "api", "le": "-1"}, series[0].Metric)
+		require.Equal(t, model.SampleValue(1), series[0].Values[0].Value)
+		require.Equal(t, model.LabelValue("0.001"), series[1].Metric["le"])
+		require.Equal(t, model.SampleValue(3), series[1].Values[0].Value)
+		require.Equal(t, model.LabelValue("+Inf"), series[2].Metric["le"])
+		require.Equal(t, model.Time(1000), series[2].Values[0].Timestamp)
+	})
+
+	t.Run("should fail on invalid buckets", func(t *testing.T) {
+		var histograms []histogramPair
+		require.NoError(t, json.Unmarshal([]byte(`[[1,{"count":"3","sum":"0","buckets":[[0,"0","1"]]}]]`), &histograms))
+
+		_, err := bucketSeries(model.Metric{}, histograms)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const oauth2MiddlewareName = "prom-oauth2-client-credentials"
+
+// OAuth2Middleware returns a middleware authenticating requests with bearer tokens fetched from
+// oauth2TokenUrl with the OAuth2 client credentials flow, or nil if no token URL is configured.
+// Tokens are cached and refreshed shortly before they expire. Requests rejected with a 401 are
+// sent once more with a new token, in case the token was revoked before its expiry.
+func OAuth2Middleware(jsonData map[string]interface{}, secureJsonData map[string]string) (sdkhttpclient.Middleware, error) {
+	tokenURL, _ := jsonData["oauth2TokenUrl"].(string)
+	if tokenURL == "" {
+		return nil, nil
+	}
+
+	clientID, _ := jsonData["oauth2ClientId"].(string)
+	if clientID == "" {
+		return nil, errors.New("invalid OAuth2 client credentials: a client ID is required")
+	}
+
+	var scopes []string
+	if scopesJson, exists := jsonData["oauth2Scopes"]; exists && scopesJson != nil {
+		scopesString, ok := scopesJson.(string)
+		if !ok {
+			return nil, errors.New("invalid OAuth2 client credentials: scopes should be a comma-separated string")
+		}
+		for _, scope := range strings.Split(scopesString, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	tokens := &oauth2Tokens{
+		config: clientcredentials.Config{
+			ClientID:     clientID,
+			ClientSecret: secureJsonData["oauth2ClientSecret"],
+			TokenURL:     tokenURL,
+			Scopes:       scopes,
+		},
+	}
+
+	return sdkhttpclient.NamedMiddlewareFunc(oauth2MiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := tokens.roundTrip(req, next, false)
+			if err != nil || res.StatusCode != http.StatusUnauthorized {
+				return res, err
+			}
+			// The request can only be sent again if its body can be read again
+			if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+				return res, nil
+			}
+
+			_ = res.Body.Close()
+			retry := req.Clone(req.Context())
+			if req.GetBody != nil {
+				if retry.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+			return tokens.roundTrip(retry, next, true)
+		})
+	}), nil
+}
+
+// oauth2Tokens keeps the token of the client credentials, which is shared by all requests of a datasource.
+type oauth2Tokens struct {
+	config clientcredentials.Config
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// get returns the cached token, or a new one if it expires soon or refresh is set.
+func (t *oauth2Tokens) get(ctx context.Context, refresh bool) (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !refresh && t.token.Valid() {
+		return t.token, nil
+	}
+
+	token, err := t.config.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get OAuth2 token: %w", err)
+	}
+	t.token = token
+	return token, nil
+}
+
+func (t *oauth2Tokens) roundTrip(req *http.Request, next http.RoundTripper, refresh bool) (*http.Response, error) {
+	token, err := t.get(req.Context(), refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trippers must not modify the request
+	req = req.Clone(req.Context())
+	token.SetAuthHeader(req)
+	return next.RoundTrip(req)
+}
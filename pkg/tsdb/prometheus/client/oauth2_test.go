@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOAuth2Middleware(t *testing.T) {
+	t.Run("Without oauth2TokenUrl, should not authenticate", func(t *testing.T) {
+		mw, err := OAuth2Middleware(map[string]interface{}{}, nil)
+		require.NoError(t, err)
+		require.Nil(t, mw)
+	})
+
+	t.Run("Without client ID, should fail", func(t *testing.T) {
+		_, err := OAuth2Middleware(map[string]interface{}{"oauth2TokenUrl": "http://localhost/token"}, nil)
+		require.Error(t, err)
+	})
+
+	t.Run("With invalid scopes, should fail", func(t *testing.T) {
+		_, err := OAuth2Middleware(map[string]interface{}{
+			"oauth2TokenUrl": "http://localhost/token",
+			"oauth2ClientId": "grafana",
+			"oauth2Scopes":   []interface{}{"read"},
+		}, nil)
+		require.Error(t, err)
+	})
+
+	issued := 0
+	var scope string
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		user, password, _ := req.BasicAuth()
+		require.Equal(t, "grafana", user)
+		require.Equal(t, "secret", password)
+		require.Equal(t, "client_credentials", req.Form.Get("grant_type"))
+		scope = req.Form.Get("scope")
+
+		issued++
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(rw, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, issued)
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	var authorizations []string
+	revoked := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		require.Equal(t, "up", req.Form.Get("query"))
+
+		authorization := req.Header.Get("Authorization")
+		authorizations = append(authorizations, authorization)
+		if authorization == revoked || revoked == "*" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	newClient := func(t *testing.T) *Client {
+		t.Helper()
+		issued, authorizations, revoked = 0, nil, ""
+
+		mw, err := OAuth2Middleware(map[string]interface{}{
+			"oauth2TokenUrl": tokenSrv.URL,
+			"oauth2ClientId": "grafana",
+			"oauth2Scopes":   "read, query",
+		}, map[string]string{"oauth2ClientSecret": "secret"})
+		require.NoError(t, err)
+
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, oauth2MiddlewareName, middlewareName.MiddlewareName())
+
+		c, err := New(srv.URL, mw.CreateMiddleware(sdkhttpclient.Options{}, http.DefaultTransport))
+		require.NoError(t, err)
+		return c
+	}
+
+	t.Run("With client credentials, should cache the token", func(t *testing.T) {
+		c := newClient(t)
+
+		for i := 0; i < 2; i++ {
+			_, _, err := c.Query(context.Background(), "up", time.Now())
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, issued)
+		require.Equal(t, "read query", scope)
+		require.Equal(t, []string{"Bearer token-1", "Bearer token-1"}, authorizations)
+	})
+
+	t.Run("With a rejected token, should send the request once more with a new token", func(t *testing.T) {
+		c := newClient(t)
+
+		_, _, err := c.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+
+		revoked = "Bearer token-1"
+		_, _, err = c.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+		require.Equal(t, 2, issued)
+		require.Equal(t, []string{"Bearer token-1", "Bearer token-1", "Bearer token-2"}, authorizations)
+	})
+
+	t.Run("With a rejected new token, should not retry again", func(t *testing.T) {
+		c := newClient(t)
+		revoked = "*"
+
+		_, _, err := c.Query(context.Background(), "up", time.Now())
+		require.Error(t, err)
+		require.Equal(t, 2, issued)
+		require.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, authorizations)
+	})
+}
@@ -1,43 +1,473 @@
 package client
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
 
 	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana/pkg/infra/httpclient"
 	"github.com/grafana/grafana/pkg/infra/log"
-	"github.com/prometheus/client_golang/api"
-	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
 )
 
-func Create(url string, httpOpts sdkhttpclient.Options, clientProvider httpclient.Provider, jsonData map[string]interface{}, plog log.Logger) (apiv1.API, error) {
+const (
+	defaultQueryCacheSize   = 1000
+	defaultRetryBackoff     = 100 * time.Millisecond
+	defaultMaxResponseBytes = 100 << 20
+
+	defaultCircuitBreakerWindow   = time.Minute
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
+func Create(url string, httpOpts sdkhttpclient.Options, clientProvider httpclient.Provider, jsonData map[string]interface{}, plog log.Logger) (*Client, error) {
+	userAgent, err := userAgent(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
 	customParamsMiddleware := middleware.CustomQueryParameters(plog)
-	middlewares := []sdkhttpclient.Middleware{customParamsMiddleware}
+	middlewares := []sdkhttpclient.Middleware{middleware.UserAgent(plog, userAgent), customParamsMiddleware, middleware.QueryStatsMiddleware(plog)}
 	if shouldForceGet(jsonData) {
 		middlewares = append(middlewares, middleware.ForceHttpGet(plog))
 	}
-	httpOpts.Middlewares = middlewares
 
-	roundTripper, err := clientProvider.GetTransport(httpOpts)
+	cacheSize, cacheTTL, err := queryCacheSettings(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if cacheTTL > 0 {
+		middlewares = append(middlewares, middleware.QueryCache(plog, cacheSize, cacheTTL))
+	}
+
+	// The circuit breaker runs after the query cache, which can still answer while Prometheus is down, and before the
+	// retries, so that a request counts as failed only once all its attempts failed
+	breakerFailures, breakerWindow, breakerCooldown, err := circuitBreakerSettings(jsonData)
 	if err != nil {
 		return nil, err
 	}
+	if breakerFailures > 0 {
+		middlewares = append(middlewares, middleware.CircuitBreaker(plog, breakerFailures, breakerWindow, breakerCooldown))
+	}
 
-	cfg := api.Config{
-		Address:      url,
-		RoundTripper: roundTripper,
+	retryAttempts, retryBackoff, err := retrySettings(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if retryAttempts > 1 {
+		middlewares = append(middlewares, middleware.Retry(plog, retryAttempts, retryBackoff))
 	}
 
-	client, err := api.NewClient(cfg)
+	// Each instance of a datasource creates its own client, so the rate limit isn't shared across instances
+	requestsPerSecond, burst, err := rateLimitSettings(jsonData)
 	if err != nil {
 		return nil, err
 	}
+	if requestsPerSecond > 0 {
+		middlewares = append(middlewares, middleware.RateLimit(plog, requestsPerSecond, burst))
+	}
+
+	// Prometheus behind a reverse proxy may serve its API under a path prefix of the URL, the same prefix is used
+	// for the replicas of a highly available Prometheus
+	urls, err := replicaURLs(url, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	apiURLs := make([]*neturl.URL, 0, len(urls))
+	for _, u := range urls {
+		apiURL, err := apiURL(u, jsonData)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := neturl.Parse(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL: %w", err)
+		}
+		apiURLs = append(apiURLs, parsed)
+	}
+	if len(apiURLs) > 1 {
+		middlewares = append(middlewares, middleware.Failover(plog, apiURLs[0], apiURLs[1:]))
+	}
+
+	// Responses are limited in size, so that a misbehaving Prometheus can't exhaust the memory of Grafana
+	maxResponseBytes, err := maxResponseBytes(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Middlewares of the caller, e.g. for authentication, are run after the ones of the client
+	httpOpts.Middlewares = append(middlewares, httpOpts.Middlewares...)
+	// The headers of a query override the custom headers of the datasource, so they are set right after them,
+	// before the request is signed by the default middlewares of the HTTP client.
+	// The size limit of responses is the innermost middleware, so that the middlewares reading whole bodies, e.g. the
+	// query cache, never read more than the limit.
+	configureMiddleware := httpOpts.ConfigureMiddleware
+	httpOpts.ConfigureMiddleware = func(opts sdkhttpclient.Options, existing []sdkhttpclient.Middleware) []sdkhttpclient.Middleware {
+		if configureMiddleware != nil {
+			existing = configureMiddleware(opts, existing)
+		}
+		existing = insertAfter(existing, sdkhttpclient.CustomHeadersMiddlewareName, middleware.QueryHeaders(plog))
+		return append(existing, maxResponseBytesMiddleware(maxResponseBytes))
+	}
+	// Requests are logged last, so the logged duration is the one of the round trip to Prometheus
+	if logQueries, ok := jsonData["logQueries"].(bool); ok && logQueries {
+		httpOpts.Middlewares = append(httpOpts.Middlewares, middleware.RequestLogging(plog))
+	}
+
+	// The transport requests gzip compressed responses and decompresses them, unless it is disabled.
+	// Decompressed responses have an unknown content length, instead of the one of the compressed body.
+	if !compressionEnabled(jsonData) {
+		configureTransport := httpOpts.ConfigureTransport
+		httpOpts.ConfigureTransport = func(opts sdkhttpclient.Options, transport *http.Transport) {
+			if configureTransport != nil {
+				configureTransport(opts, transport)
+			}
+			transport.DisableCompression = true
+		}
+	}
+
+	// A short connect timeout fails requests to unreachable backends fast. The query timeout is the deadline of the
+	// context of queries rather than a transport setting, so once it is configured the responses are no longer bounded
+	// by the timeout of the HTTP settings, which would cut off queries with a longer timeout of their own. Both
+	// default to the timeouts of the HTTP settings.
+	connectTimeout, queryTimeout, err := timeoutSettings(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if connectTimeout > 0 || queryTimeout > 0 {
+		configureTransport := httpOpts.ConfigureTransport
+		httpOpts.ConfigureTransport = func(opts sdkhttpclient.Options, transport *http.Transport) {
+			if configureTransport != nil {
+				configureTransport(opts, transport)
+			}
+			if connectTimeout > 0 {
+				transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: opts.Timeouts.KeepAlive}).DialContext
+				transport.TLSHandshakeTimeout = connectTimeout
+			}
+			if queryTimeout > 0 {
+				transport.ResponseHeaderTimeout = 0
+			}
+		}
+	}
+
+	// The server name verified against the certificate of Prometheus, e.g. when it is reached through a proxy or an IP.
+	// It also applies without a custom CA certificate or client authentication, unlike the serverName setting.
+	serverName, err := tlsServerName(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	if serverName != "" {
+		configureTLSConfig := httpOpts.ConfigureTLSConfig
+		httpOpts.ConfigureTLSConfig = func(opts sdkhttpclient.Options, tlsConfig *tls.Config) {
+			if configureTLSConfig != nil {
+				configureTLSConfig(opts, tlsConfig)
+			}
+			tlsConfig.ServerName = serverName
+		}
+	}
+
+	roundTripper, err := clientProvider.GetTransport(httpOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(apiURLs[0].String(), roundTripper)
+}
+
+// insertAfter returns middlewares with mw inserted after the middleware with the given name, or appended to them if
+// there is none.
+func insertAfter(middlewares []sdkhttpclient.Middleware, name string, mw sdkhttpclient.Middleware) []sdkhttpclient.Middleware {
+	result := make([]sdkhttpclient.Middleware, 0, len(middlewares)+1)
+	inserted := false
+	for _, m := range middlewares {
+		result = append(result, m)
+		if named, ok := m.(sdkhttpclient.MiddlewareName); ok && named.MiddlewareName() == name && !inserted {
+			result = append(result, mw)
+			inserted = true
+		}
+	}
+	if !inserted {
+		result = append(result, mw)
+	}
+	return result
+}
+
+// userAgent returns the User-Agent header requests are sent with, Grafana and its version unless userAgent is set,
+// so that Prometheus operators can tell the requests of Grafana, or of a datasource, in their access logs.
+func userAgent(settingsJson map[string]interface{}) (string, error) {
+	userAgent, ok := settingsJson["userAgent"].(string)
+	if !ok && settingsJson["userAgent"] != nil {
+		return "", errors.New("invalid user agent provided")
+	}
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("Grafana/%s", setting.BuildVersion)
+	}
+	return userAgent, nil
+}
+
+// queryCacheSettings returns the size and ttl of the query cache.
+// The cache is disabled, and a zero ttl returned, if no ttl is configured or disableQueryCache is set.
+func queryCacheSettings(settingsJson map[string]interface{}) (int, time.Duration, error) {
+	if disabled, ok := settingsJson["disableQueryCache"].(bool); ok && disabled {
+		return 0, 0, nil
+	}
+
+	ttlString, ok := settingsJson["queryCacheTTL"].(string)
+	if !ok || ttlString == "" {
+		return 0, 0, nil
+	}
+
+	ttl, err := intervalv2.ParseIntervalStringToTimeDuration(ttlString)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid query cache TTL: %w", err)
+	}
+
+	size := defaultQueryCacheSize
+	if sizeJson, exists := settingsJson["queryCacheSize"]; exists && sizeJson != nil {
+		sizeFloat, ok := sizeJson.(float64)
+		if !ok || sizeFloat < 1 {
+			return 0, 0, errors.New("invalid query cache size, it must be a positive number")
+		}
+		size = int(sizeFloat)
+	}
+
+	return size, ttl, nil
+}
+
+// retrySettings returns the maximum number of attempts and the base backoff for failed requests.
+// Requests are not retried if retryMaxAttempts isn't configured.
+func retrySettings(settingsJson map[string]interface{}) (int, time.Duration, error) {
+	attempts := 1
+	if attemptsJson, exists := settingsJson["retryMaxAttempts"]; exists && attemptsJson != nil {
+		attemptsFloat, ok := attemptsJson.(float64)
+		if !ok || attemptsFloat < 1 {
+			return 0, 0, errors.New("invalid retry max attempts, it must be a positive number")
+		}
+		attempts = int(attemptsFloat)
+	}
+
+	backoff := defaultRetryBackoff
+	if backoffString, ok := settingsJson["retryBackoff"].(string); ok && backoffString != "" {
+		var err error
+		backoff, err = intervalv2.ParseIntervalStringToTimeDuration(backoffString)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid retry backoff: %w", err)
+		}
+	}
+
+	return attempts, backoff, nil
+}
+
+// rateLimitSettings returns the maximum number of requests per second and the burst size.
+// Requests are not rate limited if rateLimitRequestsPerSecond isn't configured.
+// The burst defaults to the number of requests per second.
+func rateLimitSettings(settingsJson map[string]interface{}) (float64, int, error) {
+	requestsPerSecondJson, exists := settingsJson["rateLimitRequestsPerSecond"]
+	if !exists || requestsPerSecondJson == nil {
+		return 0, 0, nil
+	}
+	requestsPerSecond, ok := requestsPerSecondJson.(float64)
+	if !ok || requestsPerSecond <= 0 {
+		return 0, 0, errors.New("invalid rate limit requests per second, it must be a positive number")
+	}
+
+	burst := int(math.Max(1, math.Ceil(requestsPerSecond)))
+	if burstJson, exists := settingsJson["rateLimitBurst"]; exists && burstJson != nil {
+		burstFloat, ok := burstJson.(float64)
+		if !ok || burstFloat < 1 {
+			return 0, 0, errors.New("invalid rate limit burst, it must be a positive number")
+		}
+		burst = int(burstFloat)
+	}
+
+	return requestsPerSecond, burst, nil
+}
+
+// circuitBreakerSettings returns the number of consecutive failed requests within the window which open the circuit,
+// and the cooldown before probing Prometheus again. The circuit breaker is disabled, and zero failures returned, if
+// circuitBreakerFailures isn't configured.
+func circuitBreakerSettings(settingsJson map[string]interface{}) (int, time.Duration, time.Duration, error) {
+	failuresJson, exists := settingsJson["circuitBreakerFailures"]
+	if !exists || failuresJson == nil {
+		return 0, 0, 0, nil
+	}
+	failures, ok := failuresJson.(float64)
+	if !ok || failures < 1 {
+		return 0, 0, 0, errors.New("invalid circuit breaker failures, it must be a positive number")
+	}
+
+	window, err := durationSetting(settingsJson, "circuitBreakerWindow")
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid circuit breaker window: %w", err)
+	}
+	if window == 0 {
+		window = defaultCircuitBreakerWindow
+	}
+	cooldown, err := durationSetting(settingsJson, "circuitBreakerCooldown")
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid circuit breaker cooldown: %w", err)
+	}
+	if cooldown == 0 {
+		cooldown = defaultCircuitBreakerCooldown
+	}
+
+	return int(failures), window, cooldown, nil
+}
+
+// timeoutSettings returns the connectTimeout, covering dialing and the TLS handshake, and the queryTimeout, the
+// deadline of queries. Zero durations are returned for timeouts which aren't configured.
+func timeoutSettings(settingsJson map[string]interface{}) (time.Duration, time.Duration, error) {
+	connectTimeout, err := durationSetting(settingsJson, "connectTimeout")
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid connect timeout: %w", err)
+	}
+	queryTimeout, err := durationSetting(settingsJson, "queryTimeout")
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid query timeout: %w", err)
+	}
+	return connectTimeout, queryTimeout, nil
+}
+
+// durationSetting parses the optional duration string of the settings, a zero duration stands for the default.
+func durationSetting(settingsJson map[string]interface{}, key string) (time.Duration, error) {
+	durationJson, exists := settingsJson[key]
+	if !exists || durationJson == nil {
+		return 0, nil
+	}
+	durationString, ok := durationJson.(string)
+	if !ok {
+		return 0, errors.New("it must be a duration string")
+	}
+	if durationString == "" {
+		return 0, nil
+	}
+	duration, err := intervalv2.ParseIntervalStringToTimeDuration(durationString)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, errors.New("it must not be negative")
+	}
+	return duration, nil
+}
+
+// tlsServerName returns the configured tlsServerName, or an empty string if it isn't set.
+func tlsServerName(settingsJson map[string]interface{}) (string, error) {
+	serverNameJson, exists := settingsJson["tlsServerName"]
+	if !exists || serverNameJson == nil {
+		return "", nil
+	}
+	serverName, ok := serverNameJson.(string)
+	if !ok {
+		return "", errors.New("invalid TLS server name provided")
+	}
+	return strings.TrimSpace(serverName), nil
+}
+
+// replicaURLs returns the URL of the datasource followed by the URLs of its replicas, which requests fail over to if
+// the previous one is unavailable. Replicas are listed after the URL, separated by commas, or in replicaUrls.
+func replicaURLs(rawURL string, settingsJson map[string]interface{}) ([]string, error) {
+	urls := []string{rawURL}
+	if strings.Contains(rawURL, ",") {
+		urls = nil
+		for _, u := range strings.Split(rawURL, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	if replicasJson, exists := settingsJson["replicaUrls"]; exists && replicasJson != nil {
+		replicas, ok := replicasJson.([]interface{})
+		if !ok {
+			return nil, errors.New("invalid replica URLs provided")
+		}
+		for _, replica := range replicas {
+			replicaString, ok := replica.(string)
+			if !ok {
+				return nil, errors.New("invalid replica URLs provided")
+			}
+			urls = append(urls, strings.TrimSpace(replicaString))
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("invalid replica URL %q, it must be an absolute URL such as http://prometheus:9090", rawURL)
+	}
+	if len(urls) > 1 {
+		for _, u := range urls {
+			parsed, err := neturl.Parse(u)
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid replica URL %q, it must be an absolute URL such as http://prometheus:9090", u)
+			}
+		}
+	}
+	return urls, nil
+}
+
+// apiURL returns rawURL with the apiPrefix path of the settings appended, or rawURL if apiPrefix isn't configured.
+// The prefix must be a relative or absolute path, e.g. /prometheus, slashes are normalized when it is joined.
+func apiURL(rawURL string, settingsJson map[string]interface{}) (string, error) {
+	prefixJson, exists := settingsJson["apiPrefix"]
+	if !exists || prefixJson == nil {
+		return rawURL, nil
+	}
+	prefix, ok := prefixJson.(string)
+	if !ok {
+		return "", errors.New("invalid API prefix provided")
+	}
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return rawURL, nil
+	}
+
+	prefixURL, err := neturl.Parse(prefix)
+	if err != nil || prefixURL.Scheme != "" || prefixURL.Host != "" || prefixURL.RawQuery != "" || prefixURL.Fragment != "" ||
+		strings.Contains(prefixURL.Path, "..") {
+		return "", fmt.Errorf("invalid API prefix %q, it must be a path such as /prometheus", prefix)
+	}
+
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	}
+	u.Path = path.Join("/", u.Path, prefixURL.Path)
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// maxResponseBytes returns the size limit of response bodies, after decompression.
+// The limit defaults to defaultMaxResponseBytes if maxResponseBytes isn't configured.
+func maxResponseBytes(settingsJson map[string]interface{}) (int64, error) {
+	limitJson, exists := settingsJson["maxResponseBytes"]
+	if !exists || limitJson == nil {
+		return defaultMaxResponseBytes, nil
+	}
+	limit, ok := limitJson.(float64)
+	if !ok || limit < 1 {
+		return 0, errors.New("invalid max response bytes provided, it must be a positive number")
+	}
+	return int64(limit), nil
+}
 
-	return apiv1.NewAPI(client), nil
+// compressionEnabled returns whether responses should be requested with gzip compression, which is the default.
+func compressionEnabled(settingsJson map[string]interface{}) bool {
+	enabled, ok := settingsJson["enableCompression"].(bool)
+	return !ok || enabled
 }
 
+// shouldForceGet returns whether queries are sent with GET. Otherwise they are sent as form-encoded POST
+// requests, which keeps long expressions out of the URL, falling back to GET if POST isn't allowed.
 func shouldForceGet(settingsJson map[string]interface{}) bool {
 	methodInterface, exists := settingsJson["httpMethod"]
 	if !exists {
@@ -1,11 +1,123 @@
 package client
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/stretchr/testify/require"
 )
 
+func TestCreate(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		query  string
+		tenant string
+	}
+
+	var received []request
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		received = append(received, request{
+			method: req.Method,
+			path:   req.URL.Path,
+			query:  req.Form.Get("query"),
+			tenant: req.URL.Query().Get("tenant"),
+		})
+		if req.URL.Path == "/api/v1/query_range" {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	send := func(t *testing.T, jsonData map[string]interface{}) {
+		t.Helper()
+		received = nil
+
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+		_, _, err = client.QueryRange(context.Background(), "up", apiv1.Range{Start: time.Now().Add(-time.Hour), End: time.Now(), Step: time.Minute})
+		require.NoError(t, err)
+	}
+
+	t.Run("With httpMethod=POST, should send queries in the body and keep custom query parameters", func(t *testing.T) {
+		send(t, map[string]interface{}{"httpMethod": "POST", "customQueryParameters": "tenant=a"})
+		require.Equal(t, []request{
+			{method: http.MethodPost, path: "/api/v1/query", query: "up", tenant: "a"},
+			{method: http.MethodPost, path: "/api/v1/query_range", query: "up", tenant: "a"},
+		}, received)
+	})
+
+	t.Run("With httpMethod=GET, should send queries in the URL and keep custom query parameters", func(t *testing.T) {
+		send(t, map[string]interface{}{"httpMethod": "GET", "customQueryParameters": "tenant=a"})
+		require.Equal(t, []request{
+			{method: http.MethodGet, path: "/api/v1/query", query: "up", tenant: "a"},
+			{method: http.MethodGet, path: "/api/v1/query_range", query: "up", tenant: "a"},
+		}, received)
+	})
+
+	t.Run("Without httpMethod, should send queries with POST", func(t *testing.T) {
+		send(t, map[string]interface{}{})
+		require.Equal(t, http.MethodPost, received[0].method)
+	})
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		userAgent = req.Header.Get("User-Agent")
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	send := func(t *testing.T, jsonData map[string]interface{}) {
+		t.Helper()
+		client, err := Create(srv.URL, sdkhttpclient.Options{}, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+	}
+
+	t.Run("Without userAgent, should send the version of Grafana", func(t *testing.T) {
+		version := setting.BuildVersion
+		setting.BuildVersion = "8.3.0"
+		t.Cleanup(func() { setting.BuildVersion = version })
+
+		send(t, map[string]interface{}{})
+		require.Equal(t, "Grafana/8.3.0", userAgent)
+	})
+
+	t.Run("With userAgent, should send it", func(t *testing.T) {
+		send(t, map[string]interface{}{"userAgent": "Grafana-team-a/1.0"})
+		require.Equal(t, "Grafana-team-a/1.0", userAgent)
+	})
+
+	t.Run("With invalid userAgent, should fail", func(t *testing.T) {
+		_, err := Create(srv.URL, sdkhttpclient.Options{}, httpclient.NewProvider(), map[string]interface{}{"userAgent": 1}, log.New("test"))
+		require.Error(t, err)
+	})
+}
+
 func TestForceGet(t *testing.T) {
 	t.Run("With nil jsonOpts, should not force get-method", func(t *testing.T) {
 		var jsonOpts map[string]interface{}
@@ -45,3 +157,617 @@ func TestForceGet(t *testing.T) {
 		require.True(t, shouldForceGet(jsonOpts))
 	})
 }
+
+func TestQueryCacheSettings(t *testing.T) {
+	t.Run("Without ttl, should disable the cache", func(t *testing.T) {
+		_, ttl, err := queryCacheSettings(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(0), ttl)
+	})
+
+	t.Run("With ttl, should use the default size", func(t *testing.T) {
+		size, ttl, err := queryCacheSettings(map[string]interface{}{
+			"queryCacheTTL": "5m",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Minute, ttl)
+		require.Equal(t, defaultQueryCacheSize, size)
+	})
+
+	t.Run("With ttl and size, should use the configured size", func(t *testing.T) {
+		size, _, err := queryCacheSettings(map[string]interface{}{
+			"queryCacheTTL":  "5m",
+			"queryCacheSize": float64(50),
+		})
+		require.NoError(t, err)
+		require.Equal(t, 50, size)
+	})
+
+	t.Run("With disableQueryCache, should disable the cache", func(t *testing.T) {
+		_, ttl, err := queryCacheSettings(map[string]interface{}{
+			"queryCacheTTL":     "5m",
+			"disableQueryCache": true,
+		})
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(0), ttl)
+	})
+
+	t.Run("With invalid settings, should fail", func(t *testing.T) {
+		_, _, err := queryCacheSettings(map[string]interface{}{
+			"queryCacheTTL": "later",
+		})
+		require.Error(t, err)
+
+		_, _, err = queryCacheSettings(map[string]interface{}{
+			"queryCacheTTL":  "5m",
+			"queryCacheSize": float64(0),
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestRetrySettings(t *testing.T) {
+	t.Run("Without settings, should not retry", func(t *testing.T) {
+		attempts, backoff, err := retrySettings(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Equal(t, 1, attempts)
+		require.Equal(t, defaultRetryBackoff, backoff)
+	})
+
+	t.Run("With settings, should use them", func(t *testing.T) {
+		attempts, backoff, err := retrySettings(map[string]interface{}{
+			"retryMaxAttempts": float64(3),
+			"retryBackoff":     "1s",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, attempts)
+		require.Equal(t, time.Second, backoff)
+	})
+
+	t.Run("With invalid settings, should fail", func(t *testing.T) {
+		_, _, err := retrySettings(map[string]interface{}{
+			"retryMaxAttempts": float64(0),
+		})
+		require.Error(t, err)
+
+		_, _, err = retrySettings(map[string]interface{}{
+			"retryBackoff": "soon",
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	const body = `{"status":"success","data":{"resultType":"vector","result":[]}}`
+
+	var acceptEncoding string
+	corrupt := false
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		acceptEncoding = req.Header.Get("Accept-Encoding")
+		if !strings.Contains(acceptEncoding, "gzip") {
+			_, _ = rw.Write([]byte(body))
+			return
+		}
+
+		rw.Header().Set("Content-Encoding", "gzip")
+		if corrupt {
+			_, _ = rw.Write([]byte("not gzip"))
+			return
+		}
+		gz := gzip.NewWriter(rw)
+		_, _ = gz.Write([]byte(body))
+		require.NoError(t, gz.Close())
+	}))
+	t.Cleanup(srv.Close)
+
+	query := func(jsonData map[string]interface{}) error {
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		return err
+	}
+
+	t.Run("Without enableCompression, should request and decompress gzip responses", func(t *testing.T) {
+		require.NoError(t, query(map[string]interface{}{}))
+		require.Equal(t, "gzip", acceptEncoding)
+	})
+
+	t.Run("With enableCompression=false, should not request compressed responses", func(t *testing.T) {
+		require.NoError(t, query(map[string]interface{}{"enableCompression": false}))
+		require.Empty(t, acceptEncoding)
+	})
+
+	t.Run("With a corrupt compressed response, should return an error", func(t *testing.T) {
+		corrupt = true
+		t.Cleanup(func() { corrupt = false })
+
+		require.Error(t, query(map[string]interface{}{"enableCompression": true}))
+	})
+}
+
+func TestRateLimitSettings(t *testing.T) {
+	t.Run("Without settings, should not rate limit", func(t *testing.T) {
+		requestsPerSecond, _, err := rateLimitSettings(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Zero(t, requestsPerSecond)
+	})
+
+	t.Run("Without burst, should allow a burst of one second of requests", func(t *testing.T) {
+		requestsPerSecond, burst, err := rateLimitSettings(map[string]interface{}{"rateLimitRequestsPerSecond": 2.5})
+		require.NoError(t, err)
+		require.Equal(t, 2.5, requestsPerSecond)
+		require.Equal(t, 3, burst)
+	})
+
+	t.Run("With settings, should use them", func(t *testing.T) {
+		requestsPerSecond, burst, err := rateLimitSettings(map[string]interface{}{
+			"rateLimitRequestsPerSecond": float64(10),
+			"rateLimitBurst":             float64(20),
+		})
+		require.NoError(t, err)
+		require.Equal(t, float64(10), requestsPerSecond)
+		require.Equal(t, 20, burst)
+	})
+
+	t.Run("With invalid settings, should fail", func(t *testing.T) {
+		_, _, err := rateLimitSettings(map[string]interface{}{"rateLimitRequestsPerSecond": "fast"})
+		require.Error(t, err)
+
+		_, _, err = rateLimitSettings(map[string]interface{}{"rateLimitRequestsPerSecond": float64(-1)})
+		require.Error(t, err)
+
+		_, _, err = rateLimitSettings(map[string]interface{}{
+			"rateLimitRequestsPerSecond": float64(1),
+			"rateLimitBurst":             float64(0),
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestCircuitBreakerSettings(t *testing.T) {
+	t.Run("Without settings, should not open the circuit", func(t *testing.T) {
+		failures, _, _, err := circuitBreakerSettings(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Zero(t, failures)
+	})
+
+	t.Run("With failures only, should use the default window and cooldown", func(t *testing.T) {
+		failures, window, cooldown, err := circuitBreakerSettings(map[string]interface{}{"circuitBreakerFailures": float64(5)})
+		require.NoError(t, err)
+		require.Equal(t, 5, failures)
+		require.Equal(t, defaultCircuitBreakerWindow, window)
+		require.Equal(t, defaultCircuitBreakerCooldown, cooldown)
+	})
+
+	t.Run("With settings, should use them", func(t *testing.T) {
+		failures, window, cooldown, err := circuitBreakerSettings(map[string]interface{}{
+			"circuitBreakerFailures": float64(3),
+			"circuitBreakerWindow":   "30s",
+			"circuitBreakerCooldown": "2m",
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, failures)
+		require.Equal(t, 30*time.Second, window)
+		require.Equal(t, 2*time.Minute, cooldown)
+	})
+
+	t.Run("With invalid settings, should fail", func(t *testing.T) {
+		_, _, _, err := circuitBreakerSettings(map[string]interface{}{"circuitBreakerFailures": float64(0)})
+		require.EqualError(t, err, "invalid circuit breaker failures, it must be a positive number")
+
+		_, _, _, err = circuitBreakerSettings(map[string]interface{}{"circuitBreakerFailures": float64(3), "circuitBreakerCooldown": "soon"})
+		require.Error(t, err)
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	jsonData := map[string]interface{}{"rateLimitRequestsPerSecond": 0.001, "rateLimitBurst": float64(1)}
+	create := func() *Client {
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+		return client
+	}
+	first, second := create(), create()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, _, err := first.Query(ctx, "up", time.Now())
+	require.NoError(t, err)
+	_, _, err = first.Query(ctx, "up", time.Now())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rate limited")
+
+	// Clients of other datasource instances have their own limit
+	_, _, err = second.Query(ctx, "up", time.Now())
+	require.NoError(t, err)
+}
+
+func TestTLSServerName(t *testing.T) {
+	// The certificate of the test server is valid for example.com and the loopback addresses
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	query := func(t *testing.T, jsonData map[string]interface{}) error {
+		t.Helper()
+		opts := sdkhttpclient.Options{
+			TLS:           &sdkhttpclient.TLSOptions{CACertificate: caCert},
+			CustomOptions: map[string]interface{}{"grafanaData": jsonData},
+		}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		if err != nil {
+			return err
+		}
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		return err
+	}
+
+	t.Run("Without tlsServerName, should verify the certificate against the host", func(t *testing.T) {
+		require.NoError(t, query(t, map[string]interface{}{}))
+	})
+
+	t.Run("With tlsServerName, should verify the certificate against it together with the CA certificate", func(t *testing.T) {
+		require.NoError(t, query(t, map[string]interface{}{"tlsServerName": "example.com"}))
+
+		err := query(t, map[string]interface{}{"tlsServerName": "prometheus.example.org"})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "prometheus.example.org")
+	})
+
+	t.Run("With an invalid tlsServerName, should fail", func(t *testing.T) {
+		require.EqualError(t, query(t, map[string]interface{}{"tlsServerName": 1}), "invalid TLS server name provided")
+	})
+}
+
+func TestAPIPrefix(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	create := func(url string, jsonData map[string]interface{}) (*Client, error) {
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		return Create(url, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+	}
+
+	t.Run("Should join the API prefix with the URL and the API endpoints", func(t *testing.T) {
+		tcs := []struct {
+			url      string
+			prefix   interface{}
+			expected string
+		}{
+			{url: srv.URL, prefix: nil, expected: "/api/v1/query"},
+			{url: srv.URL, prefix: "", expected: "/api/v1/query"},
+			{url: srv.URL, prefix: "/prometheus", expected: "/prometheus/api/v1/query"},
+			{url: srv.URL + "/", prefix: "/prometheus/", expected: "/prometheus/api/v1/query"},
+			{url: srv.URL + "/proxy/", prefix: "prometheus", expected: "/proxy/prometheus/api/v1/query"},
+			{url: srv.URL + "/proxy", prefix: "/monitoring//prometheus/", expected: "/proxy/monitoring/prometheus/api/v1/query"},
+		}
+		for _, tc := range tcs {
+			paths = nil
+			client, err := create(tc.url, map[string]interface{}{"apiPrefix": tc.prefix})
+			require.NoError(t, err)
+			_, _, err = client.Query(context.Background(), "up", time.Now())
+			require.NoError(t, err)
+			require.Equal(t, []string{tc.expected}, paths, "url %q, prefix %q", tc.url, tc.prefix)
+		}
+	})
+
+	t.Run("Should fail with an invalid API prefix", func(t *testing.T) {
+		_, err := create(srv.URL, map[string]interface{}{"apiPrefix": 1})
+		require.EqualError(t, err, "invalid API prefix provided")
+
+		for _, prefix := range []string{"http://prometheus:9090/prometheus", "/prometheus?tenant=a", "/prometheus#api", "/../admin"} {
+			_, err := create(srv.URL, map[string]interface{}{"apiPrefix": prefix})
+			require.EqualError(t, err, fmt.Sprintf("invalid API prefix %q, it must be a path such as /prometheus", prefix))
+		}
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	create := func(t *testing.T, url string, jsonData map[string]interface{}) *Client {
+		t.Helper()
+		opts := sdkhttpclient.Options{
+			Timeouts:      &sdkhttpclient.TimeoutOptions{Timeout: 100 * time.Millisecond, DialTimeout: 10 * time.Second, TLSHandshakeTimeout: 10 * time.Second},
+			CustomOptions: map[string]interface{}{"grafanaData": jsonData},
+		}
+		client, err := Create(url, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+		return client
+	}
+
+	t.Run("With queryTimeout, should wait longer than the timeout of the HTTP settings for the response", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		_, _, err := create(t, srv.URL, map[string]interface{}{}).Query(context.Background(), "up", time.Now())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "timeout awaiting response headers")
+
+		_, _, err = create(t, srv.URL, map[string]interface{}{"queryTimeout": "5s"}).Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+	})
+
+	t.Run("With queryTimeout, should leave the deadline of the response to the context of the query", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		// The timeout of a query can be longer than the one of the datasource
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, _, err := create(t, srv.URL, map[string]interface{}{"queryTimeout": "100ms"}).Query(ctx, "up", time.Now())
+		require.NoError(t, err)
+
+		ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, _, err = create(t, srv.URL, map[string]interface{}{"queryTimeout": "5s"}).Query(ctx, "up", time.Now())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("With connectTimeout, should fail fast if the TLS handshake doesn't complete", func(t *testing.T) {
+		// The listener accepts connections but never responds to the TLS handshake
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() { _ = conn.Close() })
+			}
+		}()
+
+		started := time.Now()
+		_, _, err = create(t, "https://"+listener.Addr().String(), map[string]interface{}{"connectTimeout": "100ms", "queryTimeout": "5m"}).Query(context.Background(), "up", time.Now())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "TLS handshake timeout")
+		require.Less(t, time.Since(started), 5*time.Second)
+	})
+
+	t.Run("With invalid timeouts, should fail", func(t *testing.T) {
+		for _, jsonData := range []map[string]interface{}{
+			{"connectTimeout": "soon"},
+			{"connectTimeout": 10},
+			{"queryTimeout": "-1s"},
+		} {
+			opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+			_, err := Create("http://localhost:9090", opts, httpclient.NewProvider(), jsonData, log.New("test"))
+			require.Error(t, err, jsonData)
+		}
+	})
+}
+
+func TestReplicas(t *testing.T) {
+	newServer := func(status int) (*httptest.Server, *int) {
+		var requests int
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			require.Equal(t, "/prometheus/api/v1/query", req.URL.Path)
+			rw.WriteHeader(status)
+			if status == http.StatusBadRequest {
+				_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &requests
+	}
+
+	create := func(url string, jsonData map[string]interface{}) (*Client, error) {
+		jsonData["apiPrefix"] = "/prometheus"
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		return Create(url, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+	}
+
+	t.Run("Should fail over to the next replica if a replica is unavailable", func(t *testing.T) {
+		unavailable, unavailableRequests := newServer(http.StatusOK)
+		unavailable.Close()
+		failing, failingRequests := newServer(http.StatusServiceUnavailable)
+		replica, replicaRequests := newServer(http.StatusOK)
+
+		client, err := create(unavailable.URL+", "+failing.URL, map[string]interface{}{"replicaUrls": []interface{}{replica.URL}})
+		require.NoError(t, err)
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+		require.Equal(t, 0, *unavailableRequests)
+		require.Equal(t, 1, *failingRequests)
+		require.Equal(t, 1, *replicaRequests)
+	})
+
+	t.Run("Should not fail over if the query is invalid", func(t *testing.T) {
+		primary, primaryRequests := newServer(http.StatusBadRequest)
+		replica, replicaRequests := newServer(http.StatusOK)
+
+		client, err := create(primary.URL, map[string]interface{}{"replicaUrls": []interface{}{replica.URL}})
+		require.NoError(t, err)
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		require.Error(t, err)
+		require.Equal(t, 1, *primaryRequests)
+		require.Equal(t, 0, *replicaRequests)
+	})
+
+	t.Run("Should fail with invalid replica URLs", func(t *testing.T) {
+		_, err := create("http://prometheus-0:9090", map[string]interface{}{"replicaUrls": "http://prometheus-1:9090"})
+		require.EqualError(t, err, "invalid replica URLs provided")
+
+		_, err = create("http://prometheus-0:9090", map[string]interface{}{"replicaUrls": []interface{}{1}})
+		require.EqualError(t, err, "invalid replica URLs provided")
+
+		_, err = create("http://prometheus-0:9090,prometheus-1", map[string]interface{}{})
+		require.EqualError(t, err, `invalid replica URL "prometheus-1", it must be an absolute URL such as http://prometheus:9090`)
+
+		_, err = create(",", map[string]interface{}{})
+		require.Error(t, err)
+	})
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	const body = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"]]}]}}`
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		_, _ = rw.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	newClient := func(t *testing.T, jsonData map[string]interface{}) *Client {
+		t.Helper()
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+		return client
+	}
+	r := apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(60, 0), Step: time.Minute}
+
+	t.Run("Without settings, should use the default limit", func(t *testing.T) {
+		limit, err := maxResponseBytes(map[string]interface{}{})
+		require.NoError(t, err)
+		require.Equal(t, int64(defaultMaxResponseBytes), limit)
+
+		_, _, err = newClient(t, map[string]interface{}{}).QueryRange(context.Background(), "up", r)
+		require.NoError(t, err)
+	})
+
+	t.Run("With a response under the limit, should succeed", func(t *testing.T) {
+		client := newClient(t, map[string]interface{}{"maxResponseBytes": float64(len(body))})
+		_, _, err := client.QueryRange(context.Background(), "up", r)
+		require.NoError(t, err)
+	})
+
+	t.Run("With a response over the limit, should fail", func(t *testing.T) {
+		client := newClient(t, map[string]interface{}{"maxResponseBytes": float64(len(body) - 1)})
+
+		expected := fmt.Sprintf("bad_response: the response of Prometheus is larger than the limit of %d bytes, narrow the query or increase maxResponseBytes", len(body)-1)
+		_, _, err := client.QueryRange(context.Background(), "up", r)
+		require.EqualError(t, err, expected)
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		require.EqualError(t, err, expected)
+	})
+
+	t.Run("With the query cache, should fail before reading or caching a response over the limit", func(t *testing.T) {
+		client := newClient(t, map[string]interface{}{"maxResponseBytes": float64(len(body) - 1), "queryCacheTTL": "1m"})
+		past := apiv1.Range{Start: time.Now().Add(-2 * time.Hour), End: time.Now().Add(-time.Hour), Step: time.Minute}
+
+		requests = 0
+		for i := 0; i < 2; i++ {
+			_, _, err := client.QueryRange(context.Background(), "up", past)
+			var apiErr *apiv1.Error
+			require.ErrorAs(t, err, &apiErr)
+			require.Equal(t, apiv1.ErrBadResponse, apiErr.Type)
+			require.Contains(t, apiErr.Msg, "larger than the limit")
+		}
+		// The response isn't cached, so the second query is sent again
+		require.Equal(t, 2, requests)
+
+		// Responses within the limit are still cached
+		client = newClient(t, map[string]interface{}{"queryCacheTTL": "1m"})
+		requests = 0
+		for i := 0; i < 2; i++ {
+			_, _, err := client.QueryRange(context.Background(), "up", past)
+			require.NoError(t, err)
+		}
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("With invalid settings, should fail", func(t *testing.T) {
+		for _, invalid := range []interface{}{float64(0), "100MB"} {
+			_, err := maxResponseBytes(map[string]interface{}{"maxResponseBytes": invalid})
+			require.EqualError(t, err, "invalid max response bytes provided, it must be a positive number")
+		}
+	})
+}
+
+func TestQueryHeaders(t *testing.T) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	jsonData := map[string]interface{}{}
+	opts := sdkhttpclient.Options{
+		Headers:       map[string]string{"X-Backend": "datasource", "X-Other": "datasource"},
+		CustomOptions: map[string]interface{}{"grafanaData": jsonData},
+	}
+	client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+	require.NoError(t, err)
+
+	t.Run("should send the custom headers of the datasource", func(t *testing.T) {
+		_, _, err := client.Query(context.Background(), "up", time.Now())
+		require.NoError(t, err)
+		require.Equal(t, "datasource", header.Get("X-Backend"))
+	})
+
+	t.Run("should override the custom headers of the datasource with the headers of the query", func(t *testing.T) {
+		ctx := middleware.WithHeaders(context.Background(), map[string]string{"X-Backend": "eu-west", "X-Region": "eu"})
+		_, _, err := client.Query(ctx, "up", time.Now())
+		require.NoError(t, err)
+		require.Equal(t, "eu-west", header.Get("X-Backend"))
+		require.Equal(t, "datasource", header.Get("X-Other"))
+		require.Equal(t, "eu", header.Get("X-Region"))
+	})
+}
+
+func TestRateLimited(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	query := func(t *testing.T, jsonData map[string]interface{}) error {
+		t.Helper()
+		calls = 0
+
+		opts := sdkhttpclient.Options{CustomOptions: map[string]interface{}{"grafanaData": jsonData}}
+		client, err := Create(srv.URL, opts, httpclient.NewProvider(), jsonData, log.New("test"))
+		require.NoError(t, err)
+
+		_, _, err = client.Query(context.Background(), "up", time.Now())
+		return err
+	}
+
+	t.Run("Without retries, should return the rate limit error", func(t *testing.T) {
+		err := query(t, map[string]interface{}{})
+		var rateLimitErr *RateLimitError
+		require.ErrorAs(t, err, &rateLimitErr)
+		require.Equal(t, time.Second, rateLimitErr.RetryAfter)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("With retries, should send the query again after the wait of Retry-After", func(t *testing.T) {
+		start := time.Now()
+		require.NoError(t, query(t, map[string]interface{}{"retryMaxAttempts": float64(2)}))
+		require.Equal(t, 2, calls)
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+}
@@ -0,0 +1,106 @@
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Ways of handling series with the same labels, which Prometheus returns e.g. through federation or deduplication
+// quirks of long term storages
+const (
+	duplicateSeriesKeep  = "keep"
+	duplicateSeriesMerge = "merge"
+)
+
+func validateDuplicateSeries(duplicateSeries string) error {
+	switch duplicateSeries {
+	case "", duplicateSeriesKeep, duplicateSeriesMerge:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate series %q, it must be merge or keep", duplicateSeries)
+}
+
+// handleDuplicateSeries finds the range query series of frames with the same labels. By default they are kept,
+// with a suffix telling them apart in their name and a warning notice on the first one. Merged series are joined
+// into the first one, which keeps its values unless they are null.
+func handleDuplicateSeries(frames data.Frames, duplicateSeries string) data.Frames {
+	result := make(data.Frames, 0, len(frames))
+	first := map[string]*data.Frame{}
+	counts := map[string]int{}
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 {
+			result = append(result, frame)
+			continue
+		}
+
+		key := seriesLabels(frame).String()
+		original, ok := first[key]
+		if !ok {
+			first[key] = frame
+			counts[key] = 1
+			result = append(result, frame)
+			continue
+		}
+
+		counts[key]++
+		if duplicateSeries == duplicateSeriesMerge {
+			mergeSeries(original, frame)
+			continue
+		}
+		suffix := fmt.Sprintf(" (%d)", counts[key])
+		frame.Name += suffix
+		if frame.Fields[1].Config != nil {
+			frame.Fields[1].Config.DisplayNameFromDS += suffix
+		}
+		result = append(result, frame)
+	}
+
+	if duplicateSeries != duplicateSeriesMerge {
+		for key, frame := range first {
+			if counts[key] < 2 {
+				continue
+			}
+			frame.AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("Prometheus returned %d series with the labels {%s}, set the duplicate series option to merge to join them.", counts[key], key),
+			})
+		}
+	}
+	return result
+}
+
+// mergeSeries joins the samples of from into the series of frame, the values of frame win over the ones of from at
+// the same time unless they are null. The samples are sorted by time.
+func mergeSeries(frame *data.Frame, from *data.Frame) {
+	values := map[time.Time]*float64{}
+	for _, series := range []*data.Frame{frame, from} {
+		for i := 0; i < series.Fields[0].Len(); i++ {
+			t := series.Fields[0].At(i).(time.Time)
+			value, _ := series.Fields[1].At(i).(*float64)
+			if existing, ok := values[t]; !ok || existing == nil {
+				values[t] = value
+			}
+		}
+	}
+
+	times := make([]time.Time, 0, len(values))
+	for t := range values {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, len(times))
+	timeField.Name = frame.Fields[0].Name
+	valueField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, len(times))
+	valueField.Name = frame.Fields[1].Name
+	valueField.Labels = frame.Fields[1].Labels
+	valueField.Config = frame.Fields[1].Config
+	for i, t := range times {
+		timeField.Set(i, t)
+		valueField.Set(i, values[t])
+	}
+	frame.Fields[0], frame.Fields[1] = timeField, valueField
+}
@@ -0,0 +1,70 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_handleDuplicateSeries(t *testing.T) {
+	nan := p.SampleValue(math.NaN())
+	value := map[TimeSeriesQueryType]interface{}{
+		RangeQueryType: p.Matrix{
+			{
+				Metric: p.Metric{"app": "Application", "job": "federate"},
+				Values: []p.SamplePair{{Value: 1, Timestamp: 1000}, {Value: nan, Timestamp: 2000}},
+			},
+			{
+				Metric: p.Metric{"app": "Other"},
+				Values: []p.SamplePair{{Value: 5, Timestamp: 1000}},
+			},
+			{
+				Metric: p.Metric{"job": "federate", "app": "Application"},
+				Values: []p.SamplePair{{Value: 9, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: 3, Timestamp: 3000}},
+			},
+		},
+	}
+	number := func(v float64) *float64 { return &v }
+
+	t.Run("series with the same labels should be kept apart by default", func(t *testing.T) {
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{LegendFormat: "{{app}}"})
+		require.NoError(t, err)
+
+		require.Len(t, res, 3)
+		require.Equal(t, "Application", res[0].Name)
+		require.Equal(t, "Other", res[1].Name)
+		require.Equal(t, "Application (2)", res[2].Name)
+		require.Equal(t, "Application (2)", res[2].Fields[1].Config.DisplayNameFromDS)
+
+		require.Len(t, res[0].Meta.Notices, 1)
+		require.Equal(t, `Prometheus returned 2 series with the labels {app=Application, job=federate}, set the duplicate series option to merge to join them.`, res[0].Meta.Notices[0].Text)
+		require.Empty(t, res[1].Meta.Notices)
+		require.Empty(t, res[2].Meta.Notices)
+	})
+
+	t.Run("series with the same labels should be merged, preferring numbers over NaN values", func(t *testing.T) {
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{LegendFormat: "{{app}}", DuplicateSeries: duplicateSeriesMerge})
+		require.NoError(t, err)
+
+		require.Len(t, res, 2)
+		require.Equal(t, "Application", res[0].Name)
+		require.Empty(t, res[0].Meta.Notices)
+		require.Equal(t, 3, res[0].Fields[0].Len())
+		require.Equal(t, time.Unix(1, 0).UTC(), res[0].Fields[0].At(0))
+		require.Equal(t, time.Unix(3, 0).UTC(), res[0].Fields[0].At(2))
+		// The first series wins at the same time
+		require.Equal(t, number(1), res[0].Fields[1].At(0))
+		require.Equal(t, number(2), res[0].Fields[1].At(1))
+		require.Equal(t, number(3), res[0].Fields[1].At(2))
+		require.Equal(t, "Other", res[1].Name)
+	})
+
+	t.Run("unknown duplicate series option should fail", func(t *testing.T) {
+		require.NoError(t, validateDuplicateSeries(""))
+		require.NoError(t, validateDuplicateSeries("keep"))
+		require.EqualError(t, validateDuplicateSeries("drop"), `invalid duplicate series "drop", it must be merge or keep`)
+	})
+}
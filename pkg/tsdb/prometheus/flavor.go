@@ -0,0 +1,99 @@
+package prometheus
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// flavorDetector is implemented by clients which can detect the kind of backend serving the Prometheus API.
+type flavorDetector interface {
+	Flavor(ctx context.Context) (client.Flavor, error)
+}
+
+const (
+	// minFlavorRetryBackoff is the wait before a failed detection of the backend is tried again, it doubles with every
+	// failure up to maxFlavorRetryBackoff
+	minFlavorRetryBackoff = 10 * time.Second
+	maxFlavorRetryBackoff = 10 * time.Minute
+)
+
+// backendFlavor detects the flavor of the backend of a datasource on its first query and keeps it.
+// The backend is detected by one query at a time, the others run meanwhile without the parameters of the backend.
+// A failed detection is tried again after a backoff, so that an unavailable backend isn't probed by every query.
+type backendFlavor struct {
+	mu       sync.Mutex
+	flavor   client.Flavor
+	detected bool
+	probing  bool
+	retryAt  time.Time
+	backoff  time.Duration
+}
+
+func (f *backendFlavor) get(ctx context.Context, promClient apiv1.API) client.Flavor {
+	if f == nil {
+		return client.FlavorUnknown
+	}
+	d, ok := promClient.(flavorDetector)
+	if !ok {
+		return client.FlavorUnknown
+	}
+
+	f.mu.Lock()
+	if f.detected || f.probing || time.Now().Before(f.retryAt) {
+		flavor := f.flavor
+		f.mu.Unlock()
+		return flavor
+	}
+	f.probing = true
+	f.mu.Unlock()
+
+	flavor, err := d.Flavor(ctx)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probing = false
+	if err != nil {
+		// A query cancelled by the user doesn't tell anything about the backend
+		if ctx.Err() == nil {
+			f.backoff *= 2
+			if f.backoff < minFlavorRetryBackoff {
+				f.backoff = minFlavorRetryBackoff
+			} else if f.backoff > maxFlavorRetryBackoff {
+				f.backoff = maxFlavorRetryBackoff
+			}
+			f.retryAt = time.Now().Add(f.backoff)
+		}
+		plog.Debug("Failed to detect the Prometheus backend", "error", err, "retryAt", f.retryAt)
+		return client.FlavorUnknown
+	}
+	plog.Debug("Detected Prometheus backend", "flavor", flavor)
+
+	f.flavor = flavor
+	f.detected = true
+	return flavor
+}
+
+// flavorQueryParameters returns the query parameters sent to the backend of the given flavor,
+// leaving out the ones configured by the custom query parameters of the datasource.
+func flavorQueryParameters(flavor client.Flavor, custom url.Values, alerting bool) url.Values {
+	params := url.Values{}
+	switch flavor {
+	case client.FlavorThanos:
+		// Deduplicate the series of replicated Prometheus servers
+		params.Set("dedup", "true")
+		// Unavailable stores only leave a warning, except for alert queries, which aren't evaluated on a part of the
+		// series
+		params.Set("partial_response", strconv.FormatBool(!alerting))
+	}
+
+	for k := range custom {
+		params.Del(k)
+	}
+	return params
+}
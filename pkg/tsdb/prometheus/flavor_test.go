@@ -0,0 +1,178 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlavorQueryParameters(t *testing.T) {
+	query := func(t *testing.T, thanos bool, jsonData string, queryType string) (url.Values, int) {
+		t.Helper()
+
+		var params url.Values
+		buildinfoRequests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/status/buildinfo":
+				buildinfoRequests++
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.32.1"}}`))
+				return
+			case "/api/v1/stores":
+				if !thanos {
+					rw.WriteHeader(http.StatusNotFound)
+				}
+				_, _ = rw.Write([]byte(`{"status":"success","data":{}}`))
+				return
+			}
+			params = req.URL.Query()
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+			ID:       1,
+			URL:      srv.URL,
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		dsInfo := instance.(DatasourceInfo)
+		s := newTestServiceWithDSInfo(&dsInfo)
+
+		now := time.Now()
+		req := queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{From: now.Add(-time.Hour), To: now})
+		req.Queries[0].QueryType = queryType
+		for i := 0; i < 2; i++ {
+			res, err := s.executeTimeSeriesQuery(context.Background(), req, &dsInfo)
+			require.NoError(t, err)
+			require.NoError(t, res.Responses["A"].Error)
+		}
+
+		return params, buildinfoRequests
+	}
+
+	t.Run("should deduplicate series of Thanos and detect it once", func(t *testing.T) {
+		params, buildinfoRequests := query(t, true, `{}`, "")
+		require.Equal(t, "true", params.Get("dedup"))
+		require.Equal(t, "true", params.Get("partial_response"))
+		require.Equal(t, 1, buildinfoRequests)
+	})
+
+	t.Run("should not allow partial responses of Thanos for alert queries", func(t *testing.T) {
+		params, _ := query(t, true, `{}`, alertQueryType)
+		require.Equal(t, "false", params.Get("partial_response"))
+	})
+
+	t.Run("should prefer the custom query parameters", func(t *testing.T) {
+		params, _ := query(t, true, `{"customQueryParameters": "dedup=false"}`, "")
+		require.Equal(t, []string{"false"}, params["dedup"])
+	})
+
+	t.Run("should not add parameters for Prometheus", func(t *testing.T) {
+		params, _ := query(t, false, `{}`, "")
+		require.NotContains(t, params, "dedup")
+		require.NotContains(t, params, "partial_response")
+	})
+}
+
+func TestBackendFlavor(t *testing.T) {
+	t.Run("should retry a failed detection after a backoff", func(t *testing.T) {
+		detector := &fakeFlavorDetector{err: errors.New("connection refused")}
+		f := &backendFlavor{}
+
+		require.Equal(t, client.FlavorUnknown, f.get(context.Background(), detector))
+		require.Equal(t, minFlavorRetryBackoff, f.backoff)
+
+		detector.err = nil
+		detector.flavor = client.FlavorMimir
+		require.Equal(t, client.FlavorUnknown, f.get(context.Background(), detector))
+		require.Equal(t, 1, detector.calls)
+
+		f.retryAt = time.Now()
+		require.Equal(t, client.FlavorMimir, f.get(context.Background(), detector))
+		require.Equal(t, 2, detector.calls)
+	})
+
+	t.Run("should double the backoff of repeated failures", func(t *testing.T) {
+		detector := &fakeFlavorDetector{err: errors.New("connection refused")}
+		f := &backendFlavor{}
+
+		for _, backoff := range []time.Duration{minFlavorRetryBackoff, 2 * minFlavorRetryBackoff, 4 * minFlavorRetryBackoff} {
+			f.retryAt = time.Time{}
+			f.get(context.Background(), detector)
+			require.Equal(t, backoff, f.backoff)
+		}
+
+		f.backoff = maxFlavorRetryBackoff
+		f.retryAt = time.Time{}
+		f.get(context.Background(), detector)
+		require.Equal(t, maxFlavorRetryBackoff, f.backoff)
+	})
+
+	t.Run("should not back off from a detection of a cancelled query", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		detector := &fakeFlavorDetector{err: context.Canceled}
+		f := &backendFlavor{}
+
+		f.get(ctx, detector)
+		f.get(context.Background(), detector)
+		require.Equal(t, 2, detector.calls)
+	})
+
+	t.Run("should not make other queries wait for the detection", func(t *testing.T) {
+		detector := &blockingFlavorDetector{started: make(chan struct{}), release: make(chan struct{})}
+		f := &backendFlavor{}
+
+		done := make(chan client.Flavor)
+		go func() {
+			done <- f.get(context.Background(), detector)
+		}()
+		<-detector.started
+
+		require.Equal(t, client.FlavorUnknown, f.get(context.Background(), detector))
+		close(detector.release)
+		require.Equal(t, client.FlavorThanos, <-done)
+		require.Equal(t, client.FlavorThanos, f.get(context.Background(), detector))
+	})
+
+	t.Run("should not detect the flavor without a detecting client", func(t *testing.T) {
+		var f *backendFlavor
+		require.Equal(t, client.FlavorUnknown, f.get(context.Background(), nil))
+	})
+}
+
+type blockingFlavorDetector struct {
+	apiv1.API
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingFlavorDetector) Flavor(context.Context) (client.Flavor, error) {
+	close(d.started)
+	<-d.release
+	return client.FlavorThanos, nil
+}
+
+type fakeFlavorDetector struct {
+	apiv1.API
+	flavor client.Flavor
+	err    error
+	calls  int
+}
+
+func (d *fakeFlavorDetector) Flavor(context.Context) (client.Flavor, error) {
+	d.calls++
+	return d.flavor, d.err
+}
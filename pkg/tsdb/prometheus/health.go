@@ -0,0 +1,80 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/common/model"
+)
+
+// healthCheckQuery is cheap to evaluate and returns a result on every Prometheus server.
+const healthCheckQuery = "1"
+
+func (s *Service) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	dsInfo, err := s.getDSInfo(req.PluginContext)
+	if err != nil {
+		return nil, err
+	}
+
+	// A custom query checks that the credentials of the datasource can read its metrics, not only reach Prometheus
+	query := healthCheckQuery
+	if dsInfo.HealthCheckQuery != "" {
+		query = dsInfo.HealthCheckQuery
+	}
+
+	value, _, err := dsInfo.promClient.Query(ctx, query, time.Now())
+	if err != nil {
+		plog.Debug("Health check failed", "error", err)
+		if IsAPIError(err) {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("Prometheus returned an error: %s", ConvertAPIError(err)),
+			}, nil
+		}
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("Failed to connect to Prometheus: %s", err),
+		}, nil
+	}
+
+	message := "Successfully queried the Prometheus API."
+	if dsInfo.HealthCheckQuery != "" {
+		message = fmt.Sprintf("Successfully queried the Prometheus API. The health check query returned %d series.", seriesCount(value))
+	}
+	result := &backend.CheckHealthResult{
+		Status:  backend.HealthStatusOk,
+		Message: message,
+	}
+
+	// The build info endpoint is missing in older Prometheus versions and some compatible
+	// backends, so the check doesn't fail without it.
+	buildInfo, err := dsInfo.promClient.Buildinfo(ctx)
+	if err != nil {
+		plog.Debug("Failed to get Prometheus build info", "error", err)
+		return result, nil
+	}
+
+	result.Message = fmt.Sprintf("%s Prometheus version: %s", message, buildInfo.Version)
+	if details, err := json.Marshal(buildInfo); err == nil {
+		result.JSONDetails = details
+	}
+
+	return result, nil
+}
+
+// seriesCount returns the number of series of a query result, scalars and strings count as one.
+func seriesCount(value model.Value) int {
+	switch v := value.(type) {
+	case model.Vector:
+		return len(v)
+	case model.Matrix:
+		return len(v)
+	case nil:
+		return 0
+	default:
+		return 1
+	}
+}
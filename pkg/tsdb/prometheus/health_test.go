@@ -0,0 +1,95 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_CheckHealth(t *testing.T) {
+	req := &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1},
+		},
+	}
+
+	t.Run("reachable Prometheus should be healthy and report its version", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`))
+			case "/api/v1/status/buildinfo":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.32.1","revision":"abc"}}`))
+			}
+		})
+
+		res, err := service.CheckHealth(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Contains(t, res.Message, "2.32.1")
+		require.Contains(t, string(res.JSONDetails), `"revision":"abc"`)
+	})
+
+	t.Run("missing build info should still be healthy", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/api/v1/query" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`))
+		})
+
+		res, err := service.CheckHealth(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Equal(t, "Successfully queried the Prometheus API.", res.Message)
+	})
+
+	t.Run("health check query should be run and report the number of series", func(t *testing.T) {
+		var query string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query":
+				require.NoError(t, req.ParseForm())
+				query = req.Form.Get("query")
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"api"},"value":[1,"1"]},{"metric":{"job":"db"},"value":[1,"1"]}]}}`))
+			case "/api/v1/status/buildinfo":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.32.1"}}`))
+			}
+		})
+		dsInfo.HealthCheckQuery = `up{job=~"api|db"}`
+
+		res, err := newTestServiceWithDSInfo(dsInfo).CheckHealth(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Equal(t, `up{job=~"api|db"}`, query)
+		require.Equal(t, "Successfully queried the Prometheus API. The health check query returned 2 series. Prometheus version: 2.32.1", res.Message)
+	})
+
+	t.Run("API error should be reported", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			_, _ = rw.Write([]byte(`unauthorized`))
+		})
+
+		res, err := service.CheckHealth(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Contains(t, res.Message, "Prometheus returned an error")
+		require.Contains(t, res.Message, "unauthorized")
+	})
+
+	t.Run("connection error should be reported", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+
+		res, err := service.CheckHealth(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.Contains(t, res.Message, "Failed to connect to Prometheus")
+	})
+}
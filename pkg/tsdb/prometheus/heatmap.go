@@ -0,0 +1,92 @@
+package prometheus
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const heatmapFormat = "heatmap"
+
+type histogramBucket struct {
+	upperBound float64
+	frame      *data.Frame
+}
+
+// transformToHeatmap sorts histogram bucket series by their upper bound (le label) and
+// converts the cumulative bucket counts to the counts of each individual bucket.
+// Buckets are grouped by their other labels, so multiple histograms can be returned by one query.
+// If any of the frames isn't a bucket series with a numeric le label, frames are returned unchanged.
+func transformToHeatmap(frames data.Frames) data.Frames {
+	groups := map[string][]histogramBucket{}
+	groupKeys := []string{}
+
+	for _, frame := range frames {
+		if len(frame.Fields) != 2 || frame.Fields[1].Type() != data.FieldTypeNullableFloat64 {
+			return frames
+		}
+
+		labels := frame.Fields[1].Labels
+		upperBound, err := strconv.ParseFloat(labels["le"], 64)
+		if err != nil {
+			return frames
+		}
+
+		groupLabels := data.Labels{}
+		for k, v := range labels {
+			if k != "le" {
+				groupLabels[k] = v
+			}
+		}
+		key := groupLabels.String()
+		if _, exists := groups[key]; !exists {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], histogramBucket{upperBound: upperBound, frame: frame})
+	}
+
+	result := make(data.Frames, 0, len(frames))
+	for _, key := range groupKeys {
+		buckets := groups[key]
+		// +Inf is parsed as positive infinity and is always sorted last
+		sort.SliceStable(buckets, func(i, j int) bool {
+			return buckets[i].upperBound < buckets[j].upperBound
+		})
+
+		// Going from the highest bucket down, so the lower bucket still holds its cumulative count
+		for i := len(buckets) - 1; i > 0; i-- {
+			subtractBucket(buckets[i].frame, buckets[i-1].frame)
+		}
+
+		for _, bucket := range buckets {
+			result = append(result, bucket.frame)
+		}
+	}
+
+	return result
+}
+
+// subtractBucket subtracts the values of the lower bucket from the bucket, matched by timestamp.
+func subtractBucket(bucket *data.Frame, lower *data.Frame) {
+	lowerValues := make(map[int64]float64, lower.Fields[0].Len())
+	for i := 0; i < lower.Fields[0].Len(); i++ {
+		if v, ok := lower.Fields[1].At(i).(*float64); ok && v != nil {
+			lowerValues[lower.Fields[0].At(i).(time.Time).UnixNano()] = *v
+		}
+	}
+
+	for i := 0; i < bucket.Fields[0].Len(); i++ {
+		v, ok := bucket.Fields[1].At(i).(*float64)
+		if !ok || v == nil {
+			continue
+		}
+		lowerValue, exists := lowerValues[bucket.Fields[0].At(i).(time.Time).UnixNano()]
+		if !exists {
+			continue
+		}
+		value := *v - lowerValue
+		bucket.Fields[1].Set(i, &value)
+	}
+}
@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"testing"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_transformToHeatmap(t *testing.T) {
+	bucket := func(le string, values ...p.SampleValue) *p.SampleStream {
+		stream := &p.SampleStream{
+			Metric: p.Metric{"__name__": "request_duration_seconds_bucket", "le": p.LabelValue(le)},
+		}
+		for i, v := range values {
+			stream.Values = append(stream.Values, p.SamplePair{Value: v, Timestamp: p.Time(int64(i+1) * 1000)})
+		}
+		return stream
+	}
+
+	t.Run("buckets should be sorted by le and converted to non-cumulative counts", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				bucket("+Inf", 10, 20),
+				bucket("0.5", 4, 8),
+				bucket("1", 7, 15),
+			},
+		}
+		query := &PrometheusQuery{
+			LegendFormat: "{{le}}",
+			Format:       "heatmap",
+		}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 3)
+		require.Equal(t, "0.5", res[0].Name)
+		require.Equal(t, "1", res[1].Name)
+		require.Equal(t, "+Inf", res[2].Name)
+
+		expected := [][]float64{{4, 8}, {3, 7}, {3, 5}}
+		for i, frame := range res {
+			for j, v := range expected[i] {
+				require.Equal(t, v, *frame.Fields[1].At(j).(*float64))
+			}
+		}
+	})
+
+	t.Run("buckets of different histograms should not be mixed", func(t *testing.T) {
+		first := bucket("1", 5)
+		second := bucket("1", 8)
+		second.Metric["job"] = "other"
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{bucket("+Inf", 6), first, second},
+		}
+		query := &PrometheusQuery{Format: "heatmap"}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 3)
+		require.Equal(t, 5.0, *res[0].Fields[1].At(0).(*float64))
+		require.Equal(t, 1.0, *res[1].Fields[1].At(0).(*float64))
+		require.Equal(t, 8.0, *res[2].Fields[1].At(0).(*float64))
+	})
+
+	t.Run("non-numeric le should return the raw frames", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				bucket("+Inf", 10),
+				bucket("high", 4),
+			},
+		}
+		query := &PrometheusQuery{
+			LegendFormat: "{{le}}",
+			Format:       "heatmap",
+		}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 2)
+		require.Equal(t, "+Inf", res[0].Name)
+		require.Equal(t, 10.0, *res[0].Fields[1].At(0).(*float64))
+		require.Equal(t, "high", res[1].Name)
+	})
+}
@@ -0,0 +1,103 @@
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// prefixRefID prefixes the names of frames and the display names of their series with the ref ID of the query,
+// which tells apart the same series returned by several queries, e.g. in transformations.
+func prefixRefID(frames data.Frames, refID string) {
+	prefix := refID + ": "
+	for _, frame := range frames {
+		if frame.Name != "" {
+			frame.Name = prefix + frame.Name
+		}
+		for _, field := range frame.Fields {
+			if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+				field.Config.DisplayNameFromDS = prefix + field.Config.DisplayNameFromDS
+			}
+		}
+	}
+}
+
+// applyAutoLegend names the series of frames after the labels whose values differ between them,
+// instead of the full label set. A single series is named after its metric.
+func applyAutoLegend(frames data.Frames, query *PrometheusQuery) {
+	labels := make([]data.Labels, 0, len(frames))
+	for _, frame := range frames {
+		labels = append(labels, seriesLabels(frame))
+	}
+
+	varying := varyingLabels(labels)
+	for i, frame := range frames {
+		name := autoLegend(labels[i], varying)
+		if name == "" {
+			name = labels[i]["__name__"]
+		}
+		if name == "" {
+			name = query.Expr
+		}
+
+		frame.Name = name
+		for _, field := range frame.Fields[1:] {
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{}
+			}
+			field.Config.DisplayNameFromDS = name
+		}
+	}
+}
+
+// seriesLabels returns the labels of the value field of a time series frame.
+func seriesLabels(frame *data.Frame) data.Labels {
+	if len(frame.Fields) < 2 {
+		return nil
+	}
+	return frame.Fields[1].Labels
+}
+
+// varyingLabels returns the sorted names of the labels which don't have the same value in all series.
+func varyingLabels(series []data.Labels) []string {
+	if len(series) < 2 {
+		return nil
+	}
+
+	names := map[string]struct{}{}
+	for _, labels := range series {
+		for name := range labels {
+			names[name] = struct{}{}
+		}
+	}
+
+	varying := []string{}
+	for name := range names {
+		value, exists := series[0][name]
+		for _, labels := range series[1:] {
+			if v, ok := labels[name]; ok != exists || v != value {
+				varying = append(varying, name)
+				break
+			}
+		}
+	}
+	sort.Strings(varying)
+
+	return varying
+}
+
+func autoLegend(labels data.Labels, varying []string) string {
+	if len(varying) == 1 {
+		return labels[varying[0]]
+	}
+
+	parts := make([]string, 0, len(varying))
+	for _, name := range varying {
+		if value, ok := labels[name]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%q", name, value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,109 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_applyAutoLegend(t *testing.T) {
+	series := func(metric p.Metric) *p.SampleStream {
+		return &p.SampleStream{
+			Metric: metric,
+			Values: []p.SamplePair{{Value: 1, Timestamp: 1000}},
+		}
+	}
+
+	t.Run("series should be named after the single label that differs", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				series(p.Metric{"__name__": "up", "job": "api", "instance": "a:9090"}),
+				series(p.Metric{"__name__": "up", "job": "api", "instance": "b:9090"}),
+			},
+		}
+		query := &PrometheusQuery{Expr: "up", AutoLegend: true}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 2)
+		require.Equal(t, "a:9090", res[0].Name)
+		require.Equal(t, "a:9090", res[0].Fields[1].Config.DisplayNameFromDS)
+		require.Equal(t, "b:9090", res[1].Name)
+	})
+
+	t.Run("series should be named after all labels that differ", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				series(p.Metric{"__name__": "up", "job": "api", "instance": "a:9090"}),
+				series(p.Metric{"__name__": "up", "job": "db", "instance": "b:9090"}),
+				series(p.Metric{"__name__": "up", "job": "db"}),
+			},
+		}
+		query := &PrometheusQuery{Expr: "up", AutoLegend: true}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 3)
+		require.Equal(t, `instance="a:9090", job="api"`, res[0].Name)
+		require.Equal(t, `instance="b:9090", job="db"`, res[1].Name)
+		require.Equal(t, `job="db"`, res[2].Name)
+	})
+
+	t.Run("single series should be named after its metric", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			InstantQueryType: p.Vector{
+				&p.Sample{Metric: p.Metric{"__name__": "up", "job": "api"}, Value: 1, Timestamp: 1000},
+			},
+		}
+		query := &PrometheusQuery{Expr: "up", AutoLegend: true}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 1)
+		require.Equal(t, "up", res[0].Name)
+		require.Equal(t, "up", res[0].Fields[1].Config.DisplayNameFromDS)
+	})
+
+	t.Run("single series without metric name should be named after the query", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{series(p.Metric{})},
+		}
+		query := &PrometheusQuery{Expr: "sum(up)", AutoLegend: true}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Equal(t, "sum(up)", res[0].Name)
+	})
+
+	t.Run("legend format should take precedence", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				series(p.Metric{"__name__": "up", "instance": "a:9090"}),
+				series(p.Metric{"__name__": "up", "instance": "b:9090"}),
+			},
+		}
+		query := &PrometheusQuery{Expr: "up", LegendFormat: "{{__name__}} {{instance}}", AutoLegend: true}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Equal(t, "up a:9090", res[0].Name)
+	})
+}
+
+func TestPrometheus_prefixRefID(t *testing.T) {
+	value := map[TimeSeriesQueryType]interface{}{
+		RangeQueryType: p.Matrix{
+			{Metric: p.Metric{"__name__": "up", "job": "api"}, Values: []p.SamplePair{{Value: 1, Timestamp: 1000}}},
+		},
+	}
+	query := &PrometheusQuery{Expr: "up", RefId: "A", Step: time.Second, PrefixRefID: true}
+	frames, err := parseTimeSeriesResponse(value, query)
+	require.NoError(t, err)
+
+	prefixRefID(frames, query.RefId)
+	require.Equal(t, `A: up{job="api"}`, frames[0].Name)
+	require.Equal(t, `A: up{job="api"}`, frames[0].Fields[1].Config.DisplayNameFromDS)
+	require.Equal(t, "Value", frames[0].Fields[1].Name)
+}
@@ -0,0 +1,80 @@
+package prometheus
+
+import (
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const longFormat = "long"
+
+// transformToLong joins the series of a query result into one frame with a row per sample, holding its time, value
+// and a field per label. Series without one of the labels of the others get an empty value for it. Rows are sorted
+// by time, samples with the same time keep the order of their series.
+func transformToLong(frames data.Frames) data.Frames {
+	if len(frames) == 0 {
+		return frames
+	}
+
+	labelNames := map[string]struct{}{}
+	for _, frame := range frames {
+		for name := range seriesLabels(frame) {
+			labelNames[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(labelNames))
+	for name := range labelNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type row struct {
+		time   time.Time
+		value  *float64
+		labels data.Labels
+	}
+	var rows []row
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 {
+			continue
+		}
+		labels := seriesLabels(frame)
+		for i := 0; i < frame.Fields[0].Len(); i++ {
+			r := row{time: frame.Fields[0].At(i).(time.Time), labels: labels}
+			if value, ok := frame.Fields[1].ConcreteAt(i); ok {
+				v := value.(float64)
+				r.value = &v
+			}
+			rows = append(rows, r)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].time.Before(rows[j].time) })
+
+	timeField := data.NewFieldFromFieldType(data.FieldTypeTime, len(rows))
+	timeField.Name = data.TimeSeriesTimeFieldName
+	valueField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, len(rows))
+	valueField.Name = data.TimeSeriesValueFieldName
+	fields := []*data.Field{timeField, valueField}
+	for _, name := range names {
+		field := data.NewFieldFromFieldType(data.FieldTypeString, len(rows))
+		field.Name = name
+		fields = append(fields, field)
+	}
+
+	for i, r := range rows {
+		timeField.Set(i, r.time)
+		valueField.Set(i, r.value)
+		for j, name := range names {
+			fields[j+2].Set(i, r.labels[name])
+		}
+	}
+
+	resultType := "matrix"
+	if custom, ok := frames[0].Meta.Custom.(map[string]interface{}); ok {
+		if typ, ok := custom["resultType"].(string); ok {
+			resultType = typ
+		}
+	}
+	return data.Frames{newDataFrame("", resultType, fields...)}
+}
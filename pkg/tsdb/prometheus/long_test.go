@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_transformToLong(t *testing.T) {
+	t.Run("range query series should be joined into one frame with a field per label", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				{
+					Metric: p.Metric{"__name__": "up", "job": "api"},
+					Values: []p.SamplePair{{Value: 1, Timestamp: 1000}, {Value: p.SampleValue(math.NaN()), Timestamp: 2000}},
+				},
+				{
+					Metric: p.Metric{"__name__": "up", "instance": "b"},
+					Values: []p.SamplePair{{Value: 0, Timestamp: 1000}},
+				},
+			},
+		}
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Format: "long"})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+
+		frame := res[0]
+		require.Equal(t, "matrix", frame.Meta.Custom.(map[string]interface{})["resultType"])
+		require.Equal(t, data.TimeSeriesTypeLong, frame.TimeSeriesSchema().Type)
+
+		names := make([]string, 0, len(frame.Fields))
+		for _, field := range frame.Fields {
+			names = append(names, field.Name)
+		}
+		require.Equal(t, []string{"Time", "Value", "__name__", "instance", "job"}, names)
+
+		one, zero := 1.0, 0.0
+		rows := make([][]interface{}, 0, frame.Rows())
+		for i := 0; i < frame.Rows(); i++ {
+			rows = append(rows, frame.RowCopy(i))
+		}
+		require.Equal(t, [][]interface{}{
+			{time.Unix(1, 0).UTC(), &one, "up", "", "api"},
+			{time.Unix(1, 0).UTC(), &zero, "up", "b", ""},
+			{time.Unix(2, 0).UTC(), (*float64)(nil), "up", "", "api"},
+		}, rows)
+	})
+
+	t.Run("instant query series should be joined into one frame", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			InstantQueryType: p.Vector{
+				{Metric: p.Metric{"job": "api"}, Value: 2, Timestamp: 1000},
+				{Metric: p.Metric{"job": "db"}, Value: 3, Timestamp: 1000},
+			},
+		}
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Format: "long", End: time.Unix(1, 0)})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+
+		frame := res[0]
+		require.Equal(t, "vector", frame.Meta.Custom.(map[string]interface{})["resultType"])
+		require.Equal(t, 2, frame.Rows())
+		require.Equal(t, 3.0, *frame.Fields[1].At(1).(*float64))
+		require.Equal(t, "db", frame.Fields[2].At(1))
+	})
+
+	t.Run("empty results should stay empty", func(t *testing.T) {
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{RangeQueryType: p.Matrix{}}, &PrometheusQuery{Format: "long"})
+		require.NoError(t, err)
+		require.Empty(t, res)
+	})
+}
@@ -0,0 +1,49 @@
+package prometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+)
+
+// defaultMetadataCacheTTL is how long the metric metadata and names of a datasource are cached, as they are expensive
+// to compute for Prometheus and rarely change
+const defaultMetadataCacheTTL = time.Minute
+
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// fetchMetadata returns the metadata of metric, or of all metrics if it is empty, from the cache or from Prometheus.
+// Tenants of multi-tenant backends and users whose token is forwarded may see different metrics, so they are cached
+// separately.
+func fetchMetadata(ctx context.Context, dsInfo *DatasourceInfo, metric string) (map[string]metricMetadata, error) {
+	cacheKey := middleware.UserKey(ctx) + "\x00" + metric
+	if cached, ok := dsInfo.metadataCache.get(cacheKey); ok {
+		return cached.(map[string]metricMetadata), nil
+	}
+
+	res, err := dsInfo.promClient.Metadata(ctx, metric, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Prometheus returns one entry per distinct metadata of a metric, which usually is the same across targets
+	metadata := make(map[string]metricMetadata, len(res))
+	for name, entries := range res {
+		if len(entries) == 0 {
+			continue
+		}
+		metadata[name] = metricMetadata{
+			Type: string(entries[0].Type),
+			Help: entries[0].Help,
+			Unit: entries[0].Unit,
+		}
+	}
+	dsInfo.metadataCache.set(cacheKey, metadata)
+
+	return metadata, nil
+}
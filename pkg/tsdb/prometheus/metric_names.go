@@ -0,0 +1,96 @@
+package prometheus
+
+import (
+	"sort"
+	"strings"
+)
+
+// defaultMetricNamesLimit is the number of metric names returned by a search if no limit is requested
+const defaultMetricNamesLimit = 100
+
+// Kinds of matches of a metric name, from the best to the worst
+const (
+	exactMatch = iota
+	prefixMatch
+	substringMatch
+	fuzzyMatch
+)
+
+type metricNameMatch struct {
+	name string
+	kind int
+	// penalty orders matches of the same kind, e.g. by the position of a substring
+	penalty int
+}
+
+// searchMetricNames returns the names matching search, ranked from the best to the worst match, and the number of matches.
+// Names match if they contain the characters of search in the same order, ignoring case. Exact, prefix and substring
+// matches rank first, fuzzy matches are ranked by how close together the characters are.
+// At most limit names are returned, a limit of zero or less returns all matches.
+func searchMetricNames(names []string, search string, limit int) ([]string, int) {
+	search = strings.ToLower(strings.TrimSpace(search))
+
+	matches := make([]metricNameMatch, 0, len(names))
+	for _, name := range names {
+		if match, ok := matchMetricName(name, search); ok {
+			matches = append(matches, match)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.penalty != b.penalty {
+			return a.penalty < b.penalty
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	total := len(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	result := make([]string, 0, len(matches))
+	for _, match := range matches {
+		result = append(result, match.name)
+	}
+	return result, total
+}
+
+// matchMetricName matches name against the lower case search.
+func matchMetricName(name string, search string) (metricNameMatch, bool) {
+	lower := strings.ToLower(name)
+
+	switch i := strings.Index(lower, search); {
+	case search == "":
+		return metricNameMatch{name: name, kind: prefixMatch}, true
+	case lower == search:
+		return metricNameMatch{name: name, kind: exactMatch}, true
+	case i == 0:
+		return metricNameMatch{name: name, kind: prefixMatch}, true
+	case i > 0:
+		return metricNameMatch{name: name, kind: substringMatch, penalty: i}, true
+	}
+
+	// The penalty of a fuzzy match is the number of characters skipped between the first and the last matched character
+	first, matched, pos := -1, 0, 0
+	for ; pos < len(lower) && matched < len(search); pos++ {
+		if lower[pos] != search[matched] {
+			continue
+		}
+		if first < 0 {
+			first = pos
+		}
+		matched++
+	}
+	if matched < len(search) {
+		return metricNameMatch{}, false
+	}
+	return metricNameMatch{name: name, kind: fuzzyMatch, penalty: pos - first - len(search)}, true
+}
@@ -0,0 +1,60 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchMetricNames(t *testing.T) {
+	names := []string{
+		"go_goroutines",
+		"http_requests_total",
+		"http_request_duration_seconds",
+		"process_cpu_seconds_total",
+		"prometheus_http_requests_total",
+		"up",
+	}
+
+	t.Run("should rank exact, prefix, substring and fuzzy matches in this order", func(t *testing.T) {
+		metrics, total := searchMetricNames(append(names, "http_requests"), "http_requests", 0)
+		require.Equal(t, []string{"http_requests", "http_requests_total", "prometheus_http_requests_total", "http_request_duration_seconds"}, metrics)
+		require.Equal(t, 4, total)
+
+		metrics, total = searchMetricNames(names, "HTTP_REQ", 0)
+		require.Equal(t, []string{"http_requests_total", "http_request_duration_seconds", "prometheus_http_requests_total"}, metrics)
+		require.Equal(t, 3, total)
+	})
+
+	t.Run("should rank fuzzy matches by the characters skipped", func(t *testing.T) {
+		metrics, total := searchMetricNames(names, "cpusec", 0)
+		require.Equal(t, []string{"process_cpu_seconds_total"}, metrics)
+		require.Equal(t, 1, total)
+
+		metrics, _ = searchMetricNames(names, "hrt", 0)
+		require.Equal(t, []string{"http_requests_total", "http_request_duration_seconds", "prometheus_http_requests_total"}, metrics)
+
+		metrics, total = searchMetricNames(names, "xyz", 0)
+		require.Empty(t, metrics)
+		require.Equal(t, 0, total)
+	})
+
+	t.Run("should return all names by length without search", func(t *testing.T) {
+		metrics, total := searchMetricNames(names, " ", 0)
+		require.Equal(t, []string{
+			"up",
+			"go_goroutines",
+			"http_requests_total",
+			"process_cpu_seconds_total",
+			"http_request_duration_seconds",
+			"prometheus_http_requests_total",
+		}, metrics)
+		require.Equal(t, len(names), total)
+	})
+
+	t.Run("should return at most limit names", func(t *testing.T) {
+		metrics, total := searchMetricNames(names, "total", 1)
+		require.Equal(t, []string{"http_requests_total"}, metrics)
+		require.Equal(t, 3, total)
+	})
+}
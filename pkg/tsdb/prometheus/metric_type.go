@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"context"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+)
+
+// Suffixes of the series of histograms and summaries, whose metadata is stored under the name of the metric without them
+var metricTypeSuffixes = []string{"_bucket", "_count", "_sum"}
+
+// addMetricTypes sets the type of the metric of each frame, e.g. counter or gauge, as the metricType of its custom
+// metadata. Types are looked up in the metadata of Prometheus, frames of series without a metric name or without
+// metadata don't get a type. Failing to look up the metadata doesn't fail the query.
+func addMetricTypes(ctx context.Context, frames data.Frames, dsInfo *DatasourceInfo) {
+	types := map[string]string{}
+	for _, frame := range frames {
+		name := frameMetricName(frame)
+		if name == "" {
+			continue
+		}
+
+		metricType, ok := types[name]
+		if !ok {
+			metricType = lookupMetricType(ctx, dsInfo, name)
+			types[name] = metricType
+		}
+		if metricType == "" {
+			continue
+		}
+
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, ok := frame.Meta.Custom.(map[string]interface{})
+		if !ok {
+			custom = map[string]interface{}{}
+			frame.Meta.Custom = custom
+		}
+		custom["metricType"] = metricType
+	}
+}
+
+// lookupMetricType returns the type in the metadata of the metric, or an empty string if it is unknown.
+func lookupMetricType(ctx context.Context, dsInfo *DatasourceInfo, name string) string {
+	names := []string{name}
+	for _, suffix := range metricTypeSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			names = append(names, strings.TrimSuffix(name, suffix))
+		}
+	}
+
+	for _, name := range names {
+		metadata, err := fetchMetadata(ctx, dsInfo, name)
+		if err != nil {
+			plog.Debug("Failed to look up the metric type", "metric", name, "err", err)
+			return ""
+		}
+		if m, ok := metadata[name]; ok && m.Type != "" {
+			return m.Type
+		}
+	}
+	return ""
+}
+
+// frameMetricName returns the metric name of the series of frame, or an empty string if it has none.
+func frameMetricName(frame *data.Frame) string {
+	for _, field := range frame.Fields {
+		if name := field.Labels[model.MetricNameLabel]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
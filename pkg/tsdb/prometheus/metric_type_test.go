@@ -0,0 +1,71 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddMetricTypes(t *testing.T) {
+	now := time.Now()
+	timeRange := backend.TimeRange{From: now.Add(-time.Hour), To: now}
+
+	query := func(t *testing.T, metadata string, result string) (*backend.DataResponse, []string) {
+		t.Helper()
+
+		var lookups []string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/metadata" {
+				lookups = append(lookups, req.URL.Query().Get("metric"))
+				if metadata == "" {
+					rw.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				_, _ = rw.Write([]byte(metadata))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":` + result + `}}`))
+		})
+		service := newTestServiceWithDSInfo(dsInfo)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true, "fetchMetricType": true}`, timeRange), dsInfo)
+		require.NoError(t, err)
+		response := res.Responses["A"]
+		return &response, lookups
+	}
+
+	metricType := func(response *backend.DataResponse, i int) interface{} {
+		return response.Frames[i].Meta.Custom.(map[string]interface{})["metricType"]
+	}
+
+	t.Run("should add the type of the metric to the frames and look it up once", func(t *testing.T) {
+		response, lookups := query(t,
+			`{"status":"success","data":{"http_requests_total":[{"type":"counter","help":"","unit":""}]}}`,
+			`[{"metric":{"__name__":"http_requests_total","code":"200"},"values":[[1,"1"]]},{"metric":{"__name__":"http_requests_total","code":"500"},"values":[[1,"1"]]},{"metric":{"code":"200"},"values":[[1,"1"]]}]`)
+		require.NoError(t, response.Error)
+		require.Equal(t, "counter", metricType(response, 0))
+		require.Equal(t, "counter", metricType(response, 1))
+		require.Nil(t, metricType(response, 2))
+		require.Equal(t, []string{"http_requests_total"}, lookups)
+	})
+
+	t.Run("should look up the type of histogram series by the name of the histogram", func(t *testing.T) {
+		response, lookups := query(t,
+			`{"status":"success","data":{"request_duration_seconds":[{"type":"histogram","help":"","unit":""}]}}`,
+			`[{"metric":{"__name__":"request_duration_seconds_bucket","le":"+Inf"},"values":[[1,"1"]]}]`)
+		require.NoError(t, response.Error)
+		require.Equal(t, "histogram", metricType(response, 0))
+		require.Equal(t, []string{"request_duration_seconds_bucket", "request_duration_seconds"}, lookups)
+	})
+
+	t.Run("should not fail the query if the metadata can't be looked up", func(t *testing.T) {
+		response, _ := query(t, "", `[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]`)
+		require.NoError(t, response.Error)
+		require.Len(t, response.Frames, 1)
+		require.Nil(t, metricType(response, 0))
+	})
+}
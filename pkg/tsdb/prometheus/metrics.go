@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the queries sent to Prometheus, labeled by the UID of the datasource and the type of the query, i.e.
+// range, instant or exemplar. Expressions aren't added as labels, as their number isn't bounded.
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "prometheus_datasource",
+		Name:      "queries_total",
+		Help:      "Number of queries sent to Prometheus",
+	}, []string{"datasource", "query_type"})
+
+	queryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Subsystem: "prometheus_datasource",
+		Name:      "query_errors_total",
+		Help:      "Number of queries sent to Prometheus which failed",
+	}, []string{"datasource", "query_type"})
+
+	queryDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Subsystem: "prometheus_datasource",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of the queries sent to Prometheus",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"datasource", "query_type"})
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal, queryErrorsTotal, queryDurationSeconds)
+}
+
+// observeQuery records a query of dsInfo which was sent at start and failed with err, if it isn't nil.
+func observeQuery(dsInfo *DatasourceInfo, queryType TimeSeriesQueryType, start time.Time, err error) {
+	labels := prometheus.Labels{"datasource": dsInfo.UID, "query_type": string(queryType)}
+	queriesTotal.With(labels).Inc()
+	queryDurationSeconds.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil {
+		queryErrorsTotal.With(labels).Inc()
+	}
+}
@@ -0,0 +1,38 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_queryMetrics(t *testing.T) {
+	service := Service{
+		intervalCalculator: intervalv2.NewCalculator(),
+	}
+	dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/query" {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	})
+	dsInfo.UID = "metrics-test"
+
+	now := time.Now()
+	query := queryContext(`{"expr": "up", "range": true, "instant": true}`, backend.TimeRange{From: now.Add(-time.Hour), To: now})
+	_, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+	require.NoError(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(queriesTotal.WithLabelValues("metrics-test", "range")))
+	require.Equal(t, 0.0, testutil.ToFloat64(queryErrorsTotal.WithLabelValues("metrics-test", "range")))
+	require.Equal(t, 1.0, testutil.ToFloat64(queriesTotal.WithLabelValues("metrics-test", "instant")))
+	require.Equal(t, 1.0, testutil.ToFloat64(queryErrorsTotal.WithLabelValues("metrics-test", "instant")))
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const circuitBreakerMiddlewareName = "prom-circuit-breaker"
+
+// ErrCircuitOpen is returned for the requests short-circuited while Prometheus is considered down
+var ErrCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker counts the consecutive requests which failed to connect to Prometheus
+type circuitBreaker struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu           sync.Mutex
+	consecutive  int
+	firstFailure time.Time
+	openUntil    time.Time
+	probing      bool
+}
+
+// CircuitBreaker fails requests immediately for cooldown, once failures consecutive requests within window failed to
+// connect to Prometheus, instead of having each of them wait for its timeout while Prometheus is down. After the
+// cooldown, a single request probes Prometheus: it closes the circuit if it gets a response, or opens it again.
+// Requests canceled by their context don't count, nor do error responses, as Prometheus is up to send them.
+// The state is shared by all requests sent through the round trippers created by the middleware.
+func CircuitBreaker(logger log.Logger, failures int, window time.Duration, cooldown time.Duration) sdkhttpclient.Middleware {
+	cb := &circuitBreaker{failures: failures, window: window, cooldown: cooldown}
+
+	return sdkhttpclient.NamedMiddlewareFunc(circuitBreakerMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			probe, err := cb.allow(time.Now())
+			if err != nil {
+				logger.Debug("Request short-circuited", "url", req.URL.Path)
+				return nil, err
+			}
+
+			res, err := next.RoundTrip(req)
+			switch {
+			case err == nil:
+				cb.succeeded()
+			case req.Context().Err() != nil:
+				cb.canceled(probe)
+			default:
+				if cb.failed(time.Now(), probe) {
+					logger.Warn("Opened the circuit, Prometheus failed consecutive requests", "failures", failures, "cooldown", cooldown, "error", err)
+				}
+			}
+			return res, err
+		})
+	})
+}
+
+// allow tells if a request can be sent at now, and whether it is the probe of a circuit whose cooldown is over
+func (cb *circuitBreaker) allow(now time.Time) (bool, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return false, nil
+	}
+	if now.Before(cb.openUntil) || cb.probing {
+		return false, fmt.Errorf("%w: the last %d requests to Prometheus failed to connect, waiting %s before trying again", ErrCircuitOpen, cb.failures, cb.cooldown)
+	}
+	cb.probing = true
+	return true, nil
+}
+
+func (cb *circuitBreaker) succeeded() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.consecutive = 0
+	cb.openUntil = time.Time{}
+	cb.probing = false
+}
+
+func (cb *circuitBreaker) canceled(probe bool) {
+	if !probe {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+}
+
+// failed counts a request which failed at now, and tells if it opened the circuit
+func (cb *circuitBreaker) failed(now time.Time, probe bool) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if probe {
+		cb.probing = false
+		cb.openUntil = now.Add(cb.cooldown)
+		return false
+	}
+	if !cb.openUntil.IsZero() {
+		// Requests sent before the circuit opened
+		return false
+	}
+
+	if cb.consecutive == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.consecutive = 0
+		cb.firstFailure = now
+	}
+	cb.consecutive++
+	if cb.consecutive < cb.failures {
+		return false
+	}
+	cb.openUntil = now.Add(cb.cooldown)
+	return true
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	sent := 0
+	down := true
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		if down {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	send := func(t *testing.T, rt http.RoundTripper, ctx context.Context) error {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	t.Run("should have a name", func(t *testing.T) {
+		mw := CircuitBreaker(log.New("test"), 3, time.Minute, time.Minute)
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, circuitBreakerMiddlewareName, middlewareName.MiddlewareName())
+	})
+
+	t.Run("should short-circuit requests after consecutive failures, then probe", func(t *testing.T) {
+		sent, down = 0, true
+		rt := CircuitBreaker(log.New("test"), 3, time.Minute, 50*time.Millisecond).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		for i := 0; i < 3; i++ {
+			err := send(t, rt, context.Background())
+			require.EqualError(t, err, "connection refused")
+		}
+		err := send(t, rt, context.Background())
+		require.True(t, errors.Is(err, ErrCircuitOpen))
+		require.EqualError(t, err, "circuit open: the last 3 requests to Prometheus failed to connect, waiting 50ms before trying again")
+		require.Equal(t, 3, sent)
+
+		// The failed probe opens the circuit again
+		time.Sleep(60 * time.Millisecond)
+		require.EqualError(t, send(t, rt, context.Background()), "connection refused")
+		require.True(t, errors.Is(send(t, rt, context.Background()), ErrCircuitOpen))
+		require.Equal(t, 4, sent)
+
+		// The successful probe closes the circuit
+		down = false
+		time.Sleep(60 * time.Millisecond)
+		require.NoError(t, send(t, rt, context.Background()))
+		require.NoError(t, send(t, rt, context.Background()))
+		require.Equal(t, 6, sent)
+	})
+
+	t.Run("should not count failures interrupted by a response or outside the window", func(t *testing.T) {
+		sent, down = 0, true
+		rt := CircuitBreaker(log.New("test"), 2, 20*time.Millisecond, time.Minute).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		require.Error(t, send(t, rt, context.Background()))
+		down = false
+		require.NoError(t, send(t, rt, context.Background()))
+		down = true
+		require.Error(t, send(t, rt, context.Background()))
+		time.Sleep(30 * time.Millisecond)
+		require.Error(t, send(t, rt, context.Background()))
+
+		down = false
+		require.NoError(t, send(t, rt, context.Background()))
+		require.Equal(t, 5, sent)
+	})
+
+	t.Run("should not count canceled requests", func(t *testing.T) {
+		sent, down = 0, true
+		rt := CircuitBreaker(log.New("test"), 1, time.Minute, time.Minute).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		require.EqualError(t, send(t, rt, ctx), "connection refused")
+		require.EqualError(t, send(t, rt, context.Background()), "connection refused")
+		require.True(t, errors.Is(send(t, rt, context.Background()), ErrCircuitOpen))
+		require.Equal(t, 2, sent)
+	})
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 
@@ -14,38 +15,43 @@ const (
 	grafanaDataKey                      = "grafanaData"
 )
 
-func CustomQueryParameters(logger log.Logger) sdkhttpclient.Middleware {
-	return sdkhttpclient.NamedMiddlewareFunc(customQueryParametersMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
-		grafanaData, exists := opts.CustomOptions[grafanaDataKey]
-		if !exists {
-			return next
-		}
+type queryParametersKey struct{}
 
-		data, ok := grafanaData.(map[string]interface{})
-		if !ok {
-			return next
-		}
-		customQueryParamsVal, exists := data[customQueryParametersKey]
-		if !exists {
-			return next
-		}
+// WithQueryParameters returns a copy of ctx which makes the CustomQueryParameters middleware
+// add values to the query parameters of the requests sent with it, after the ones already in ctx.
+func WithQueryParameters(ctx context.Context, values url.Values) context.Context {
+	parentValues, _ := ctx.Value(queryParametersKey{}).(url.Values)
+	if len(parentValues) == 0 {
+		return context.WithValue(ctx, queryParametersKey{}, values)
+	}
 
-		customQueryParams, ok := customQueryParamsVal.(string)
-		if !ok || customQueryParams == "" {
-			return next
+	merged := make(url.Values, len(parentValues)+len(values))
+	for _, v := range []url.Values{parentValues, values} {
+		for k, keyValues := range v {
+			merged[k] = append(merged[k], keyValues...)
 		}
+	}
+	return context.WithValue(ctx, queryParametersKey{}, merged)
+}
 
-		values, err := url.ParseQuery(customQueryParams)
-		if err != nil {
-			logger.Error("Failed to parse custom query parameters, skipping middleware", "error", err)
-			return next
-		}
+// CustomQueryParameters adds the customQueryParameters of the datasource, and the ones
+// of the request context, to the query parameters of every request.
+func CustomQueryParameters(logger log.Logger) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(customQueryParametersMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		values := customQueryParameters(opts, logger)
 
 		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			contextValues, _ := req.Context().Value(queryParametersKey{}).(url.Values)
+			if len(values) == 0 && len(contextValues) == 0 {
+				return next.RoundTrip(req)
+			}
+
 			q := req.URL.Query()
-			for k, keyValues := range values {
-				for _, value := range keyValues {
-					q.Add(k, value)
+			for _, v := range []url.Values{values, contextValues} {
+				for k, keyValues := range v {
+					for _, value := range keyValues {
+						q.Add(k, value)
+					}
 				}
 			}
 			req.URL.RawQuery = q.Encode()
@@ -54,3 +60,32 @@ func CustomQueryParameters(logger log.Logger) sdkhttpclient.Middleware {
 		})
 	})
 }
+
+func customQueryParameters(opts sdkhttpclient.Options, logger log.Logger) url.Values {
+	grafanaData, exists := opts.CustomOptions[grafanaDataKey]
+	if !exists {
+		return nil
+	}
+
+	data, ok := grafanaData.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	customQueryParamsVal, exists := data[customQueryParametersKey]
+	if !exists {
+		return nil
+	}
+
+	customQueryParams, ok := customQueryParamsVal.(string)
+	if !ok || customQueryParams == "" {
+		return nil
+	}
+
+	values, err := url.ParseQuery(customQueryParams)
+	if err != nil {
+		logger.Error("Failed to parse custom query parameters, skipping middleware", "error", err)
+		return nil
+	}
+
+	return values
+}
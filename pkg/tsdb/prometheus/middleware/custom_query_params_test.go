@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"strings"
@@ -167,4 +168,59 @@ func TestCustomQueryParametersMiddleware(t *testing.T) {
 
 		require.Equal(t, "http://test.com/query?custom=par%2Fam&second=f+oo", req.URL.String())
 	})
+
+	t.Run("With query parameters in the request context should add them after the custom query parameters", func(t *testing.T) {
+		mw := CustomQueryParameters(log.New("test"))
+		rt := mw.CreateMiddleware(httpclient.Options{
+			CustomOptions: map[string]interface{}{
+				grafanaDataKey: map[string]interface{}{
+					customQueryParametersKey: "custom=param",
+				},
+			},
+		}, finalRoundTripper)
+
+		ctx := WithQueryParameters(context.Background(), url.Values{"dedup": []string{"true"}})
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/query?hello=name", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		if res.Body != nil {
+			require.NoError(t, res.Body.Close())
+		}
+
+		require.Equal(t, "http://test.com/query?custom=param&dedup=true&hello=name", req.URL.String())
+	})
+
+	t.Run("With query parameters only in the request context should add them", func(t *testing.T) {
+		mw := CustomQueryParameters(log.New("test"))
+		rt := mw.CreateMiddleware(httpclient.Options{}, finalRoundTripper)
+
+		ctx := WithQueryParameters(context.Background(), url.Values{"dedup": []string{"true"}})
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		if res.Body != nil {
+			require.NoError(t, res.Body.Close())
+		}
+
+		require.Equal(t, "http://test.com/query?dedup=true", req.URL.String())
+	})
+
+	t.Run("With query parameters added to the request context twice should add all of them", func(t *testing.T) {
+		mw := CustomQueryParameters(log.New("test"))
+		rt := mw.CreateMiddleware(httpclient.Options{}, finalRoundTripper)
+
+		parent := WithQueryParameters(context.Background(), url.Values{"dedup": []string{"true"}})
+		ctx := WithQueryParameters(parent, url.Values{"lookback_delta": []string{"600"}})
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		if res.Body != nil {
+			require.NoError(t, res.Body.Close())
+		}
+
+		require.Equal(t, "http://test.com/query?dedup=true&lookback_delta=600", req.URL.String())
+	})
 }
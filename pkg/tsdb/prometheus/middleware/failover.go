@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const failoverMiddlewareName = "prom-failover"
+
+// Failover sends requests failing with a network error, or a 502, 503 or 504 response of an unavailable server, to the
+// replicas of the Prometheus server at primary, one after the other, and returns the first response which doesn't
+// fail. Other errors, e.g. a bad_data error of an invalid query or the timeout of a query too expensive to evaluate,
+// are returned as is, as every replica would return them.
+// The path of a request relative to primary is kept, e.g. /api/v1/query is sent to /api/v1/query of the replicas.
+func Failover(logger log.Logger, primary *url.URL, replicas []*url.URL) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(failoverMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := next.RoundTrip(req)
+			failover := shouldFailover(res, err)
+			for _, replica := range replicas {
+				if !failover || req.Context().Err() != nil {
+					return res, err
+				}
+
+				replicaReq, ok := replicaRequest(req, primary, replica)
+				if !ok {
+					// The body was already sent and can't be sent again
+					return res, err
+				}
+
+				if res != nil {
+					logger.Debug("Failing over to replica", "url", req.URL.Path, "status", res.StatusCode, "replica", replica.Host)
+					if res.Body != nil {
+						if err := res.Body.Close(); err != nil {
+							logger.Warn("Failed to close response body", "error", err)
+						}
+					}
+				} else {
+					logger.Debug("Failing over to replica", "url", req.URL.Path, "error", err, "replica", replica.Host)
+				}
+
+				res, err = next.RoundTrip(replicaReq)
+				if failover = shouldFailover(res, err); !failover {
+					logger.Debug("Request served by replica", "url", req.URL.Path, "replica", replica.Host)
+				}
+			}
+			return res, err
+		})
+	})
+}
+
+// failoverPeekSize is the number of bytes of a 503 response read to tell if it holds an error of the query
+const failoverPeekSize = 4096
+
+func shouldFailover(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	case http.StatusServiceUnavailable:
+		// Prometheus also returns 503 for queries which timed out or were canceled
+		return !isQueryError(res)
+	default:
+		return false
+	}
+}
+
+// isQueryError tells if res holds a Prometheus API error of the query itself, which is returned by every replica.
+// The start of the body is read again before the rest of it.
+func isQueryError(res *http.Response) bool {
+	if res.Body == nil {
+		return false
+	}
+
+	peek, _ := ioutil.ReadAll(io.LimitReader(res.Body, failoverPeekSize))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek), res.Body), res.Body}
+
+	var apiErr struct {
+		Status    string `json:"status"`
+		ErrorType string `json:"errorType"`
+	}
+	if err := json.Unmarshal(peek, &apiErr); err != nil {
+		return false
+	}
+	return apiErr.Status == "error" && (apiErr.ErrorType == "timeout" || apiErr.ErrorType == "canceled")
+}
+
+// replicaRequest returns a copy of req sent to replica instead of primary.
+func replicaRequest(req *http.Request, primary *url.URL, replica *url.URL) (*http.Request, bool) {
+	replicaReq := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, false
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		replicaReq.Body = body
+	}
+
+	relativePath := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(primary.Path, "/"))
+	replicaReq.URL.Scheme = replica.Scheme
+	replicaReq.URL.Host = replica.Host
+	replicaReq.URL.Path = strings.TrimSuffix(replica.Path, "/") + relativePath
+	replicaReq.URL.RawPath = ""
+	replicaReq.Host = ""
+	return replicaReq, true
+}
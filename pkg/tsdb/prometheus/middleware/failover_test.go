@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailoverMiddleware(t *testing.T) {
+	primary, err := url.Parse("http://prometheus-0:9090/prometheus")
+	require.NoError(t, err)
+	replicas := []*url.URL{{Scheme: "http", Host: "prometheus-1:9090", Path: "/prometheus"}, {Scheme: "https", Host: "prometheus-2"}}
+
+	type sent struct {
+		url  string
+		body string
+	}
+
+	newRoundTripper := func(responses map[string]int, responseBody string) (http.RoundTripper, *[]sent) {
+		var requests []sent
+		finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			var body string
+			if req.Body != nil {
+				b, err := ioutil.ReadAll(req.Body)
+				require.NoError(t, err)
+				body = string(b)
+			}
+			requests = append(requests, sent{url: req.URL.String(), body: body})
+
+			status, ok := responses[req.URL.Host]
+			if !ok {
+				return nil, errors.New("connection refused")
+			}
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(responseBody))}, nil
+		})
+
+		mw := Failover(log.New("test"), primary, replicas)
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, failoverMiddlewareName, middlewareName.MiddlewareName())
+		return mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper), &requests
+	}
+
+	post := func(t *testing.T, rt http.RoundTripper) (*http.Response, error) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://prometheus-0:9090/prometheus/api/v1/query", strings.NewReader("query=up"))
+		require.NoError(t, err)
+		return rt.RoundTrip(req)
+	}
+
+	t.Run("successful requests should not fail over", func(t *testing.T) {
+		rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": http.StatusOK}, "")
+		res, err := post(t, rt)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Len(t, *requests, 1)
+	})
+
+	t.Run("requests failing with a connection error or a 503 response should fail over to the next replica", func(t *testing.T) {
+		rt, requests := newRoundTripper(map[string]int{"prometheus-1:9090": http.StatusServiceUnavailable, "prometheus-2": http.StatusOK}, "")
+		res, err := post(t, rt)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, []sent{
+			{url: "http://prometheus-0:9090/prometheus/api/v1/query", body: "query=up"},
+			{url: "http://prometheus-1:9090/prometheus/api/v1/query", body: "query=up"},
+			{url: "https://prometheus-2/api/v1/query", body: "query=up"},
+		}, *requests)
+	})
+
+	t.Run("requests failing with a bad request should not fail over", func(t *testing.T) {
+		rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": http.StatusBadRequest, "prometheus-1:9090": http.StatusOK}, "")
+		res, err := post(t, rt)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		require.Len(t, *requests, 1)
+	})
+
+	t.Run("requests failing with a 502 or 504 response should fail over", func(t *testing.T) {
+		for _, status := range []int{http.StatusBadGateway, http.StatusGatewayTimeout} {
+			rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": status, "prometheus-1:9090": http.StatusOK}, "")
+			res, err := post(t, rt)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, res.StatusCode)
+			require.Len(t, *requests, 2, "status %d", status)
+		}
+	})
+
+	t.Run("requests failing with other 5xx responses should not fail over", func(t *testing.T) {
+		for _, status := range []int{http.StatusInternalServerError, http.StatusNotImplemented} {
+			rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": status, "prometheus-1:9090": http.StatusOK}, "")
+			res, err := post(t, rt)
+			require.NoError(t, err)
+			require.Equal(t, status, res.StatusCode)
+			require.Len(t, *requests, 1, "status %d", status)
+		}
+	})
+
+	t.Run("queries which timed out or were canceled should not fail over", func(t *testing.T) {
+		for _, errorType := range []string{"timeout", "canceled"} {
+			body := `{"status":"error","errorType":"` + errorType + `","error":"query timed out in expression evaluation"}`
+			rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": http.StatusServiceUnavailable, "prometheus-1:9090": http.StatusOK}, body)
+			res, err := post(t, rt)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+			require.Len(t, *requests, 1, errorType)
+
+			// The body is still returned as a whole
+			b, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, body, string(b))
+		}
+	})
+
+	t.Run("requests failing with a 503 of an unavailable server should fail over", func(t *testing.T) {
+		body := `{"status":"error","errorType":"unavailable","error":"Service Unavailable"}`
+		rt, requests := newRoundTripper(map[string]int{"prometheus-0:9090": http.StatusServiceUnavailable, "prometheus-1:9090": http.StatusOK}, body)
+		res, err := post(t, rt)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Len(t, *requests, 2)
+	})
+
+	t.Run("requests failing on every replica should return the last error", func(t *testing.T) {
+		rt, requests := newRoundTripper(map[string]int{}, "")
+		_, err := post(t, rt)
+		require.EqualError(t, err, "connection refused")
+		require.Len(t, *requests, 3)
+	})
+}
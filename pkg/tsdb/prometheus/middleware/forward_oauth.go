@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const (
+	forwardOAuthMiddlewareName = "prom-forward-oauth"
+	// IDTokenHeader holds the OpenID Connect ID token of the user, forwarded alongside the access token
+	IDTokenHeader = "X-ID-Token"
+)
+
+type oauthTokenKey struct{}
+
+type oauthToken struct {
+	authorization string
+	idToken       string
+}
+
+// WithOAuthToken returns a copy of ctx which makes the ForwardOAuth middleware send the requests sent with it
+// with the Authorization header and the ID token of the user.
+func WithOAuthToken(ctx context.Context, authorization string, idToken string) context.Context {
+	return context.WithValue(ctx, oauthTokenKey{}, oauthToken{authorization: authorization, idToken: idToken})
+}
+
+func oauthTokenFromContext(ctx context.Context) (oauthToken, bool) {
+	token, ok := ctx.Value(oauthTokenKey{}).(oauthToken)
+	return token, ok && token.authorization != ""
+}
+
+// ForwardOAuth sets the Authorization and X-ID-Token headers of requests to the OAuth token of the user in their
+// context. The token is only kept in the context of the request, never by the middleware, as the datasource is
+// shared by all users.
+func ForwardOAuth(logger log.Logger) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(forwardOAuthMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			token, ok := oauthTokenFromContext(req.Context())
+			if !ok {
+				return next.RoundTrip(req)
+			}
+
+			// The token must not be left in the request of the caller
+			req = req.Clone(req.Context())
+			req.Header.Set("Authorization", token.authorization)
+			if token.idToken != "" {
+				req.Header.Set(IDTokenHeader, token.idToken)
+			}
+
+			return next.RoundTrip(req)
+		})
+	})
+}
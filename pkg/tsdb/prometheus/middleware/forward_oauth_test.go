@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardOAuthMiddleware(t *testing.T) {
+	var header http.Header
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	mw := ForwardOAuth(log.New("test"))
+	middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+	require.True(t, ok)
+	require.Equal(t, forwardOAuthMiddlewareName, middlewareName.MiddlewareName())
+	rt := mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+	send := func(t *testing.T, ctx context.Context) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	t.Run("should forward the token of the request context", func(t *testing.T) {
+		send(t, WithOAuthToken(context.Background(), "Bearer access-token", "id-token"))
+		require.Equal(t, "Bearer access-token", header.Get("Authorization"))
+		require.Equal(t, "id-token", header.Get(IDTokenHeader))
+	})
+
+	t.Run("should not leave the token in the request of the caller", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(WithOAuthToken(context.Background(), "Bearer access-token", "id-token"), http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, "Bearer access-token", header.Get("Authorization"))
+		require.Empty(t, req.Header.Get("Authorization"))
+		require.Empty(t, req.Header.Get(IDTokenHeader))
+	})
+
+	t.Run("should forward the token of each request only", func(t *testing.T) {
+		send(t, WithOAuthToken(context.Background(), "Bearer other-token", ""))
+		require.Equal(t, "Bearer other-token", header.Get("Authorization"))
+		require.Empty(t, header.Get(IDTokenHeader))
+
+		send(t, context.Background())
+		require.Empty(t, header.Get("Authorization"))
+	})
+}
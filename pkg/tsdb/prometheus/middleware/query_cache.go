@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const queryCacheMiddlewareName = "prom-query-cache"
+
+type cachedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	expires    time.Time
+}
+
+// QueryCache caches successful range query responses in memory for the given ttl, by all their parameters.
+// Only queries whose end time is in the past are cached, as the result of a query
+// ending now still changes with every new sample.
+func QueryCache(logger log.Logger, size int, ttl time.Duration) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(queryCacheMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		cache, err := lru.New(size)
+		if err != nil {
+			logger.Error("Failed to create query cache, skipping middleware", "error", err)
+			return next
+		}
+
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !strings.HasSuffix(req.URL.Path, "/api/v1/query_range") {
+				return next.RoundTrip(req)
+			}
+
+			params, err := requestParams(req)
+			if err != nil {
+				return nil, err
+			}
+
+			end, err := strconv.ParseFloat(params.Get("end"), 64)
+			if err != nil || end >= float64(time.Now().Unix()) {
+				return next.RoundTrip(req)
+			}
+
+			// All parameters shape the response, e.g. partial_response or stats, not only the query and its range
+			key := strings.Join([]string{req.Method, req.URL.Path, params.Encode(), UserKey(req.Context())}, "\x00")
+			if v, ok := cache.Get(key); ok {
+				cached := v.(*cachedResponse)
+				if time.Now().Before(cached.expires) {
+					return cached.response(req), nil
+				}
+				cache.Remove(key)
+			}
+
+			res, err := next.RoundTrip(req)
+			if err != nil || res.StatusCode != http.StatusOK {
+				return res, err
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				return nil, err
+			}
+			if err := res.Body.Close(); err != nil {
+				logger.Warn("Failed to close response body", "error", err)
+			}
+
+			cached := &cachedResponse{
+				statusCode: res.StatusCode,
+				header:     res.Header.Clone(),
+				body:       body,
+				expires:    time.Now().Add(ttl),
+			}
+			cache.Add(key, cached)
+
+			return cached.response(req), nil
+		})
+	})
+}
+
+// UserKey identifies the tenant, the forwarded OAuth token and the query headers of the requests sent with ctx, whose
+// responses must not be shared with other users, or with queries routed elsewhere by their headers. The token is
+// hashed, so that it isn't kept in memory by caches.
+func UserKey(ctx context.Context) string {
+	key := TenantFromContext(ctx)
+	if token, ok := oauthTokenFromContext(ctx); ok {
+		hash := sha256.Sum256([]byte(token.authorization))
+		key += "\x00" + hex.EncodeToString(hash[:])
+	}
+	if header := headersFromContext(ctx); len(header) > 0 {
+		names := make([]string, 0, len(header))
+		for name := range header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key += "\x00" + name + ":" + strings.Join(header[name], ",")
+		}
+	}
+	return key
+}
+
+func (c *cachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.statusCode, http.StatusText(c.statusCode)),
+		StatusCode:    c.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        c.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(c.body)),
+		ContentLength: int64(len(c.body)),
+		Request:       req,
+	}
+}
+
+// requestParams returns the query parameters of req, including the ones sent in a form-encoded body.
+// The body is restored so it can be sent afterwards.
+func requestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+	if req.Body == nil || req.Method != http.MethodPost {
+		return params, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Body.Close(); err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range form {
+		for _, v := range values {
+			params.Add(k, v)
+		}
+	}
+
+	return params, nil
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCacheMiddleware(t *testing.T) {
+	newRoundTripper := func(ttl time.Duration) (http.RoundTripper, *int) {
+		calls := 0
+		finalRoundTripper := httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(fmt.Sprintf("response %d", calls))),
+			}, nil
+		})
+		mw := QueryCache(log.New("test"), 10, ttl)
+		middlewareName, ok := mw.(httpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, queryCacheMiddlewareName, middlewareName.MiddlewareName())
+
+		return mw.CreateMiddleware(httpclient.Options{}, finalRoundTripper), &calls
+	}
+
+	send := func(t *testing.T, rt http.RoundTripper, method string, path string, params url.Values) string {
+		t.Helper()
+
+		var req *http.Request
+		var err error
+		if method == http.MethodPost {
+			req, err = http.NewRequest(method, "http://test.com"+path, strings.NewReader(params.Encode()))
+		} else {
+			req, err = http.NewRequest(method, "http://test.com"+path+"?"+params.Encode(), nil)
+		}
+		require.NoError(t, err)
+
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return string(body)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	pastParams := url.Values{
+		"query": []string{"up"},
+		"start": []string{fmt.Sprint(past.Add(-time.Hour).Unix())},
+		"end":   []string{fmt.Sprint(past.Unix())},
+		"step":  []string{"15"},
+	}
+
+	t.Run("range queries ending in the past should be cached", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Minute)
+
+		require.Equal(t, "response 1", send(t, rt, http.MethodPost, "/api/v1/query_range", pastParams))
+		require.Equal(t, "response 1", send(t, rt, http.MethodPost, "/api/v1/query_range", pastParams))
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		require.Equal(t, 2, *calls)
+	})
+
+	t.Run("range queries with different parameters should not share cache entries", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Minute)
+
+		otherParams := url.Values{}
+		for k, v := range pastParams {
+			otherParams[k] = v
+		}
+		otherParams.Set("step", "30")
+		partialParams := url.Values{"partial_response": []string{"false"}}
+		for k, v := range pastParams {
+			partialParams[k] = v
+		}
+		statsParams := url.Values{"stats": []string{"all"}}
+		for k, v := range pastParams {
+			statsParams[k] = v
+		}
+
+		require.Equal(t, "response 1", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query_range", otherParams))
+		require.Equal(t, "response 3", send(t, rt, http.MethodGet, "/api/v1/query_range", partialParams))
+		require.Equal(t, "response 4", send(t, rt, http.MethodGet, "/api/v1/query_range", statsParams))
+		require.Equal(t, "response 1", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		require.Equal(t, 4, *calls)
+	})
+
+	t.Run("range queries of other users should not share cache entries", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Minute)
+
+		sendWithContext := func(ctx context.Context) string {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query_range?"+pastParams.Encode(), nil)
+			require.NoError(t, err)
+			res, err := rt.RoundTrip(req)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.NoError(t, res.Body.Close())
+			return string(body)
+		}
+
+		require.Equal(t, "response 1", sendWithContext(WithOAuthToken(context.Background(), "Bearer user-a", "")))
+		require.Equal(t, "response 2", sendWithContext(WithOAuthToken(context.Background(), "Bearer user-b", "")))
+		require.Equal(t, "response 3", sendWithContext(WithTenant(context.Background(), "team-a")))
+		require.Equal(t, "response 4", sendWithContext(WithHeaders(context.Background(), map[string]string{"X-Backend": "eu-west"})))
+		require.Equal(t, "response 1", sendWithContext(WithOAuthToken(context.Background(), "Bearer user-a", "")))
+		require.Equal(t, 4, *calls)
+	})
+
+	t.Run("range queries ending now should bypass the cache", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Minute)
+
+		params := url.Values{
+			"query": []string{"up"},
+			"start": []string{fmt.Sprint(time.Now().Add(-time.Hour).Unix())},
+			"end":   []string{fmt.Sprint(time.Now().Add(time.Minute).Unix())},
+			"step":  []string{"15"},
+		}
+
+		require.Equal(t, "response 1", send(t, rt, http.MethodGet, "/api/v1/query_range", params))
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query_range", params))
+		require.Equal(t, 2, *calls)
+	})
+
+	t.Run("instant queries should bypass the cache", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Minute)
+
+		require.Equal(t, "response 1", send(t, rt, http.MethodGet, "/api/v1/query", pastParams))
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query", pastParams))
+		require.Equal(t, 2, *calls)
+	})
+
+	t.Run("expired entries should be fetched again", func(t *testing.T) {
+		rt, calls := newRoundTripper(time.Nanosecond)
+
+		require.Equal(t, "response 1", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		time.Sleep(time.Millisecond)
+		require.Equal(t, "response 2", send(t, rt, http.MethodGet, "/api/v1/query_range", pastParams))
+		require.Equal(t, 2, *calls)
+	})
+}
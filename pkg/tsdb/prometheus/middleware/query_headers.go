@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"golang.org/x/net/http/httpguts"
+)
+
+// QueryHeadersMiddlewareName is the name of the QueryHeaders middleware, which the client runs after the custom
+// headers of the datasource
+const QueryHeadersMiddlewareName = "prom-query-headers"
+
+// reservedHeaders can't be set by queries, as they hold credentials, select the tenant or describe the request body.
+var reservedHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+	"Cookie":              {},
+	"Host":                {},
+	"Content-Type":        {},
+	"Content-Length":      {},
+	"Content-Encoding":    {},
+	"Transfer-Encoding":   {},
+	"Connection":          {},
+	// Canonical, as the names of the headers are looked up in their canonical form
+	http.CanonicalHeaderKey(TenantHeader):  {},
+	http.CanonicalHeaderKey(IDTokenHeader): {},
+}
+
+type queryHeadersKey struct{}
+
+// ValidateHeaders checks that headers can be sent with the requests of a query.
+func ValidateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if _, ok := reservedHeaders[canonical]; ok || strings.HasPrefix(canonical, "X-Amz-") {
+			return fmt.Errorf("invalid header %q, it can't be set by a query", name)
+		}
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid header %q", name)
+		}
+	}
+	return nil
+}
+
+// WithHeaders returns a copy of ctx which makes the QueryHeaders middleware set headers on the requests sent with it.
+func WithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return context.WithValue(ctx, queryHeadersKey{}, header)
+}
+
+// headersFromContext returns the headers of ctx set with WithHeaders, or nil if there are none.
+func headersFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(queryHeadersKey{}).(http.Header)
+	return header
+}
+
+// QueryHeaders sets the headers of the request context, overriding the custom headers of the datasource. Headers
+// holding credentials can't be set, as ValidateHeaders rejects them.
+func QueryHeaders(logger log.Logger) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(QueryHeadersMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := headersFromContext(req.Context())
+			if len(header) == 0 {
+				return next.RoundTrip(req)
+			}
+
+			req = req.Clone(req.Context())
+			for name, values := range header {
+				req.Header[name] = values
+			}
+
+			return next.RoundTrip(req)
+		})
+	})
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryHeadersMiddleware(t *testing.T) {
+	var header http.Header
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	send := func(t *testing.T, ctx context.Context) {
+		t.Helper()
+		header = nil
+
+		mw := QueryHeaders(log.New("test"))
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, QueryHeadersMiddlewareName, middlewareName.MiddlewareName())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Backend", "datasource")
+		req.Header.Set("X-Other", "datasource")
+		_, err = mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper).RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, "datasource", req.Header.Get("X-Backend"), "the request of the caller must not be modified")
+	}
+
+	t.Run("should override the headers of the request with the ones of the request context", func(t *testing.T) {
+		send(t, WithHeaders(context.Background(), map[string]string{"x-backend": "eu-west", "X-Region": "eu"}))
+		require.Equal(t, "eu-west", header.Get("X-Backend"))
+		require.Equal(t, "eu", header.Get("X-Region"))
+		require.Equal(t, "datasource", header.Get("X-Other"))
+	})
+
+	t.Run("should keep the headers of the request without headers in the request context", func(t *testing.T) {
+		send(t, context.Background())
+		require.Equal(t, "datasource", header.Get("X-Backend"))
+	})
+}
+
+func TestValidateHeaders(t *testing.T) {
+	require.NoError(t, ValidateHeaders(nil))
+	require.NoError(t, ValidateHeaders(map[string]string{"X-Backend": "eu-west"}))
+
+	for _, name := range []string{"Authorization", "cookie", "X-Scope-OrgID", "X-ID-Token", "x-amz-date", "Content-Type"} {
+		require.EqualError(t, ValidateHeaders(map[string]string{name: "value"}), `invalid header "`+name+`", it can't be set by a query`)
+	}
+	require.EqualError(t, ValidateHeaders(map[string]string{"X Backend": "eu-west"}), `invalid header "X Backend"`)
+	require.EqualError(t, ValidateHeaders(map[string]string{"X-Backend": "eu\nwest"}), `invalid header "X-Backend"`)
+}
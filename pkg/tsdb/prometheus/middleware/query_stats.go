@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const queryStatsMiddlewareName = "prom-query-stats"
+
+// QueryStats holds the statistics Prometheus returns for queries sent with stats=all.
+type QueryStats struct {
+	// TotalQueryableSamples is the number of samples loaded while evaluating the query.
+	TotalQueryableSamples int64
+	// ExecTotalTime is the server-side execution time in seconds.
+	ExecTotalTime float64
+	// Received is set if at least one response contained statistics.
+	Received bool
+}
+
+type queryStatsKey struct{}
+
+// WithQueryStats returns a copy of ctx which makes the QueryStats middleware
+// request statistics for the queries sent with it and collect them in stats.
+func WithQueryStats(ctx context.Context, stats *QueryStats) context.Context {
+	return context.WithValue(ctx, queryStatsKey{}, stats)
+}
+
+type statsResponse struct {
+	Data struct {
+		Stats *struct {
+			Timings struct {
+				ExecTotalTime float64 `json:"execTotalTime"`
+			} `json:"timings"`
+			Samples struct {
+				TotalQueryableSamples int64 `json:"totalQueryableSamples"`
+			} `json:"samples"`
+		} `json:"stats"`
+	} `json:"data"`
+}
+
+// QueryStatsMiddleware requests query statistics for requests whose context was created with WithQueryStats.
+func QueryStatsMiddleware(logger log.Logger) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(queryStatsMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			stats, ok := req.Context().Value(queryStatsKey{}).(*QueryStats)
+			if !ok || stats == nil {
+				return next.RoundTrip(req)
+			}
+
+			q := req.URL.Query()
+			q.Set("stats", "all")
+			req.URL.RawQuery = q.Encode()
+
+			res, err := next.RoundTrip(req)
+			if err != nil || res.Body == nil {
+				return res, err
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				return nil, err
+			}
+			if err := res.Body.Close(); err != nil {
+				logger.Warn("Failed to close response body", "error", err)
+			}
+			res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			// Responses without statistics, e.g. from older Prometheus versions, are fine
+			parsed := statsResponse{}
+			if err := json.Unmarshal(body, &parsed); err != nil || parsed.Data.Stats == nil {
+				return res, nil
+			}
+
+			stats.Received = true
+			stats.TotalQueryableSamples += parsed.Data.Stats.Samples.TotalQueryableSamples
+			stats.ExecTotalTime += parsed.Data.Stats.Timings.ExecTotalTime
+
+			return res, nil
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryStatsMiddleware(t *testing.T) {
+	newRoundTripper := func(body string, received **http.Request) http.RoundTripper {
+		finalRoundTripper := httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			*received = req
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		})
+		return QueryStatsMiddleware(log.New("test")).CreateMiddleware(httpclient.Options{}, finalRoundTripper)
+	}
+
+	t.Run("Name should be correct", func(t *testing.T) {
+		mw := QueryStatsMiddleware(log.New("test"))
+		middlewareName, ok := mw.(httpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, "prom-query-stats", middlewareName.MiddlewareName())
+	})
+
+	t.Run("Should not request stats without a collector in the context", func(t *testing.T) {
+		var received *http.Request
+		rt := newRoundTripper(`{}`, &received)
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/v1/query?query=up", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Empty(t, received.URL.Query().Get("stats"))
+	})
+
+	t.Run("Should request and collect stats", func(t *testing.T) {
+		body := `{"status":"success","data":{"resultType":"vector","result":[],"stats":{"timings":{"execTotalTime":0.25},"samples":{"totalQueryableSamples":120}}}}`
+		var received *http.Request
+		rt := newRoundTripper(body, &received)
+
+		stats := &QueryStats{}
+		req, err := http.NewRequestWithContext(WithQueryStats(context.Background(), stats), http.MethodGet, "http://example.com/api/v1/query?query=up", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+
+		require.Equal(t, "all", received.URL.Query().Get("stats"))
+		require.Equal(t, "up", received.URL.Query().Get("query"))
+		require.True(t, stats.Received)
+		require.Equal(t, int64(120), stats.TotalQueryableSamples)
+		require.Equal(t, 0.25, stats.ExecTotalTime)
+
+		resBody, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, body, string(resBody))
+	})
+
+	t.Run("Should ignore responses without stats", func(t *testing.T) {
+		var received *http.Request
+		rt := newRoundTripper(`{"status":"success","data":{"resultType":"vector","result":[]}}`, &received)
+
+		stats := &QueryStats{}
+		req, err := http.NewRequestWithContext(WithQueryStats(context.Background(), stats), http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.False(t, stats.Received)
+	})
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"golang.org/x/time/rate"
+)
+
+const rateLimitMiddlewareName = "prom-rate-limit"
+
+// RateLimit limits the requests sent to requestsPerSecond, allowing bursts of up to burst requests.
+// Requests over the limit wait for their turn, unless it would come after the deadline of their context.
+// The limit is shared by all requests sent through the round trippers created by the middleware.
+func RateLimit(logger log.Logger, requestsPerSecond float64, burst int) sdkhttpclient.Middleware {
+	limiter := rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+
+	return sdkhttpclient.NamedMiddlewareFunc(rateLimitMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := limiter.Wait(req.Context()); err != nil {
+				logger.Debug("Request rate limited", "url", req.URL.Path, "error", err)
+				return nil, fmt.Errorf("rate limited: %w", err)
+			}
+
+			return next.RoundTrip(req)
+		})
+	})
+}
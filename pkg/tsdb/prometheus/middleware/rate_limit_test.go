@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	sent := 0
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	send := func(t *testing.T, rt http.RoundTripper, ctx context.Context) error {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		return err
+	}
+
+	t.Run("should have a name", func(t *testing.T) {
+		mw := RateLimit(log.New("test"), 1, 1)
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, rateLimitMiddlewareName, middlewareName.MiddlewareName())
+	})
+
+	t.Run("should send a burst of requests without waiting", func(t *testing.T) {
+		sent = 0
+		rt := RateLimit(log.New("test"), 0.001, 3).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, send(t, rt, context.Background()))
+		}
+		require.Equal(t, 3, sent)
+	})
+
+	t.Run("should wait for the next request to be allowed", func(t *testing.T) {
+		sent = 0
+		rt := RateLimit(log.New("test"), 50, 1).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		start := time.Now()
+		require.NoError(t, send(t, rt, context.Background()))
+		require.NoError(t, send(t, rt, context.Background()))
+		require.GreaterOrEqual(t, time.Since(start), 15*time.Millisecond)
+		require.Equal(t, 2, sent)
+	})
+
+	t.Run("should fail requests which can't be sent before their deadline", func(t *testing.T) {
+		sent = 0
+		rt := RateLimit(log.New("test"), 0.001, 1).CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		require.NoError(t, send(t, rt, context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := send(t, rt, ctx)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "rate limited")
+		require.Equal(t, 1, sent)
+	})
+
+	t.Run("should share the limit between round trippers of the same middleware", func(t *testing.T) {
+		sent = 0
+		mw := RateLimit(log.New("test"), 0.001, 1)
+		first := mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+		second := mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, send(t, first, ctx))
+		require.Error(t, send(t, second, ctx))
+	})
+}
@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const (
+	requestLoggingMiddlewareName = "prom-request-logging"
+	redacted                     = "[REDACTED]"
+)
+
+// sensitiveHeaders hold credentials, e.g. basic auth, bearer tokens and SigV4 signatures.
+var sensitiveHeaders = map[string]struct{}{
+	"Authorization":        {},
+	"Proxy-Authorization":  {},
+	"Cookie":               {},
+	"X-Amz-Security-Token": {},
+}
+
+// sensitiveQueryParameters are parts of query parameter names which are likely to hold credentials.
+var sensitiveQueryParameters = []string{"token", "key", "secret", "password", "auth"}
+
+// RequestLogging logs the method, URL, headers, status and duration of every request at debug level.
+// Credentials in headers and query parameters are redacted, as are the headers set by queries.
+func RequestLogging(logger log.Logger) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(requestLoggingMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			res, err := next.RoundTrip(req)
+			duration := time.Since(start)
+
+			if err != nil {
+				logger.Debug("Prometheus request failed", "method", req.Method, "url", redactURL(req.URL),
+					"headers", redactHeaders(req.Header, headersFromContext(req.Context())), "duration", duration, "error", err)
+				return res, err
+			}
+
+			logger.Debug("Prometheus request", "method", req.Method, "url", redactURL(req.URL),
+				"headers", redactHeaders(req.Header, headersFromContext(req.Context())), "status", res.StatusCode, "duration", duration)
+			return res, err
+		})
+	})
+}
+
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	redactedURL.User = nil
+
+	q := u.Query()
+	for name := range q {
+		lowerName := strings.ToLower(name)
+		for _, sensitive := range sensitiveQueryParameters {
+			if strings.Contains(lowerName, sensitive) {
+				q.Set(name, redacted)
+				break
+			}
+		}
+	}
+	redactedURL.RawQuery = q.Encode()
+
+	return redactedURL.String()
+}
+
+// redactHeaders returns header with the values of sensitive headers, and of the headers set by queries, redacted.
+func redactHeaders(header http.Header, queryHeader http.Header) http.Header {
+	redactedHeader := make(http.Header, len(header))
+	for name, values := range header {
+		_, sensitive := sensitiveHeaders[http.CanonicalHeaderKey(name)]
+		if _, ok := queryHeader[http.CanonicalHeaderKey(name)]; sensitive || ok {
+			redactedHeader[name] = []string{redacted}
+			continue
+		}
+		redactedHeader[name] = values
+	}
+	return redactedHeader
+}
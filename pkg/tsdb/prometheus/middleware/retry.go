@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const retryMiddlewareName = "prom-retry"
+
+// maxRetryAfter is the longest Retry-After wait honored, longer waits fail the request instead of holding it
+const maxRetryAfter = time.Minute
+
+// Retry retries GET requests, and POST queries whose body can be sent again, failing with a network error or a
+// 502, 503 or 504 response, as returned by Prometheus or a proxy in front of it while it is restarting.
+// The wait before each new attempt doubles, starting at backoff, and is randomized by up to
+// half of its length. Requests are never retried past the deadline of their context.
+// Requests rejected with 429 Too Many Requests weren't processed, so they are retried whatever their method,
+// as long as their body can be sent again, after the wait of the Retry-After header if the response has one.
+func Retry(logger log.Logger, maxAttempts int, backoff time.Duration) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(retryMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method != http.MethodGet && req.GetBody == nil {
+				return next.RoundTrip(req)
+			}
+
+			ctx := req.Context()
+			wait := backoff
+			for attempt := 1; ; attempt++ {
+				res, err := next.RoundTrip(req)
+				if attempt >= maxAttempts || !shouldRetry(req, res, err) || ctx.Err() != nil {
+					return res, err
+				}
+
+				delay := wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+				if err == nil && res.StatusCode == http.StatusTooManyRequests {
+					if retryAfter := RetryAfter(res, time.Now()); retryAfter > maxRetryAfter {
+						return res, err
+					} else if retryAfter > 0 {
+						delay = retryAfter
+					}
+				}
+				if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+					return res, err
+				}
+
+				if res != nil {
+					logger.Debug("Retrying request", "url", req.URL.Path, "status", res.StatusCode, "attempt", attempt, "delay", delay)
+					if res.Body != nil {
+						if err := res.Body.Close(); err != nil {
+							logger.Warn("Failed to close response body", "error", err)
+						}
+					}
+				} else {
+					logger.Debug("Retrying request", "url", req.URL.Path, "error", err, "attempt", attempt, "delay", delay)
+				}
+
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+				wait *= 2
+
+				if req.GetBody != nil {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					req = req.Clone(ctx)
+					req.Body = body
+				}
+			}
+		})
+	})
+}
+
+// readOnlyEndpoints are the endpoints of the Prometheus API whose POST requests only read data, as the queries
+// are sent with POST when their parameters are too long for a URL
+var readOnlyEndpoints = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/series",
+	"/api/v1/labels",
+}
+
+// isIdempotent tells if req can be sent again after a failure which may have left it processed.
+func isIdempotent(req *http.Request) bool {
+	if req.Method == http.MethodGet {
+		return true
+	}
+	if req.Method != http.MethodPost || req.GetBody == nil {
+		return false
+	}
+	for _, endpoint := range readOnlyEndpoints {
+		if strings.HasSuffix(req.URL.Path, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+func shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if !isIdempotent(req) {
+		return err == nil && res.StatusCode == http.StatusTooManyRequests
+	}
+	if err != nil {
+		return true
+	}
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryAfter returns the wait the Retry-After header of res asks for at now, either a number of seconds or a date,
+// or zero if it has none.
+func RetryAfter(res *http.Response, now time.Time) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
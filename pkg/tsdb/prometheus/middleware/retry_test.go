@@ -0,0 +1,220 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryMiddleware(t *testing.T) {
+	newRoundTripper := func(calls *int, responses ...func() (*http.Response, error)) http.RoundTripper {
+		finalRoundTripper := httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			r := responses[*calls]
+			*calls++
+			return r()
+		})
+		return Retry(log.New("test"), 3, time.Millisecond).CreateMiddleware(httpclient.Options{}, finalRoundTripper)
+	}
+	status := func(code int) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{StatusCode: code}, nil
+		}
+	}
+
+	t.Run("Name should be correct", func(t *testing.T) {
+		mw := Retry(log.New("test"), 3, time.Millisecond)
+		middlewareName, ok := mw.(httpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, "prom-retry", middlewareName.MiddlewareName())
+	})
+
+	t.Run("Should retry transient errors until success", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, status(http.StatusServiceUnavailable), func() (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, status(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("Should stop after max attempts", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, status(http.StatusBadGateway), status(http.StatusBadGateway), status(http.StatusGatewayTimeout))
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("Should not retry client errors", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, status(http.StatusBadRequest), status(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, res.StatusCode)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Should not retry POST requests whose body can't be sent again", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, status(http.StatusServiceUnavailable), status(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Should retry POST queries with their body", func(t *testing.T) {
+		var bodies []string
+		rt := Retry(log.New("test"), 3, time.Millisecond).CreateMiddleware(httpclient.Options{}, httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			if len(bodies) == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/api/v1/query_range", strings.NewReader("query=up"))
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, []string{"query=up", "query=up"}, bodies)
+	})
+
+	t.Run("Should not retry POST requests to other endpoints", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, status(http.StatusServiceUnavailable), status(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/api/v1/admin/tsdb/delete_series", strings.NewReader("match[]=up"))
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Should not retry cancelled requests", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		rt := newRoundTripper(&calls, func() (*http.Response, error) {
+			cancel()
+			return nil, context.Canceled
+		}, status(http.StatusOK))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Should not wait past the request deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		calls := 0
+		rt := Retry(log.New("test"), 3, time.Hour).CreateMiddleware(httpclient.Options{}, httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{StatusCode: http.StatusServiceUnavailable}, nil
+		}))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Should retry rate limited requests after the wait of Retry-After", func(t *testing.T) {
+		calls := 0
+		rt := newRoundTripper(&calls, func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}}, nil
+		}, status(http.StatusOK))
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/api/v1/query", nil)
+		require.NoError(t, err)
+		start := time.Now()
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, 2, calls)
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Should not retry rate limited requests waiting past the request deadline or too long", func(t *testing.T) {
+		for _, retryAfter := range []string{"30", "3600"} {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			calls := 0
+			rt := newRoundTripper(&calls, func() (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{retryAfter}}}, nil
+			}, status(http.StatusOK))
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/api/v1/query", nil)
+			require.NoError(t, err)
+			res, err := rt.RoundTrip(req)
+			cancel()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+			require.Equal(t, 1, calls)
+		}
+	})
+
+	t.Run("Should retry rate limited POST requests with their body", func(t *testing.T) {
+		var bodies []string
+		rt := Retry(log.New("test"), 3, time.Millisecond).CreateMiddleware(httpclient.Options{}, httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(body))
+			if len(bodies) == 1 {
+				return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+
+		req, err := http.NewRequest(http.MethodPost, "http://example.com/api/v1/query", strings.NewReader("query=up"))
+		require.NoError(t, err)
+		res, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, []string{"query=up", "query=up"}, bodies)
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	retryAfter := func(value string) time.Duration {
+		return RetryAfter(&http.Response{Header: http.Header{"Retry-After": []string{value}}}, now)
+	}
+
+	require.Equal(t, 30*time.Second, retryAfter("30"))
+	require.Equal(t, 90*time.Second, retryAfter("Sat, 01 Jan 2022 12:01:30 GMT"))
+	require.Zero(t, retryAfter("Sat, 01 Jan 2022 11:59:00 GMT"))
+	require.Zero(t, retryAfter("-1"))
+	require.Zero(t, retryAfter("soon"))
+	require.Zero(t, RetryAfter(&http.Response{}, now))
+}
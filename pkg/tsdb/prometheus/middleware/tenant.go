@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const (
+	tenantMiddlewareName = "prom-tenant"
+	// TenantHeader selects the tenant of multi-tenant backends, e.g. Cortex and Mimir
+	TenantHeader = "X-Scope-OrgID"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx which makes the Tenant middleware send the requests sent with it for tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of ctx set with WithTenant, or an empty string if there is none.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// Tenant sets the X-Scope-OrgID header of requests to the tenant of their context, or to tenantID.
+// It runs before the default middlewares of the HTTP client, so the header is included in SigV4 signatures.
+func Tenant(logger log.Logger, tenantID string) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(tenantMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			tenant := tenantID
+			if contextTenant := TenantFromContext(req.Context()); contextTenant != "" {
+				tenant = contextTenant
+			}
+			if tenant != "" {
+				// The request of the caller must not be modified, e.g. when it is sent again for another tenant
+				req = req.Clone(req.Context())
+				req.Header.Set(TenantHeader, tenant)
+			}
+
+			return next.RoundTrip(req)
+		})
+	})
+}
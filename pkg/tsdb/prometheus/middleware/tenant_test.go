@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantMiddleware(t *testing.T) {
+	var tenant string
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		tenant = req.Header.Get("X-Scope-OrgID")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	send := func(t *testing.T, tenantID string, ctx context.Context) {
+		t.Helper()
+		tenant = ""
+
+		mw := Tenant(log.New("test"), tenantID)
+		middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+		require.True(t, ok)
+		require.Equal(t, tenantMiddlewareName, middlewareName.MiddlewareName())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper).RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	t.Run("should set the tenant of the datasource", func(t *testing.T) {
+		send(t, "team-a", context.Background())
+		require.Equal(t, "team-a", tenant)
+	})
+
+	t.Run("should prefer the tenant of the request context", func(t *testing.T) {
+		send(t, "team-a", WithTenant(context.Background(), "team-b"))
+		require.Equal(t, "team-b", tenant)
+	})
+
+	t.Run("should set the tenant of the request context without a tenant of the datasource", func(t *testing.T) {
+		send(t, "", WithTenant(context.Background(), "team-b"))
+		require.Equal(t, "team-b", tenant)
+	})
+
+	t.Run("should not modify the request of the caller", func(t *testing.T) {
+		req, err := http.NewRequestWithContext(WithTenant(context.Background(), "team-b"), http.MethodGet, "http://test.com/api/v1/query", nil)
+		require.NoError(t, err)
+		_, err = Tenant(log.New("test"), "team-a").CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper).RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, "team-b", tenant)
+		require.Empty(t, req.Header.Get("X-Scope-OrgID"))
+	})
+
+	t.Run("should not set a header without a tenant", func(t *testing.T) {
+		send(t, "", context.Background())
+		require.Empty(t, tenant)
+	})
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+)
+
+const userAgentMiddlewareName = "prom-user-agent"
+
+// UserAgent sets the User-Agent header of requests to userAgent. It runs before the default middlewares of the
+// HTTP client, whose user agent middleware keeps a header which is already set.
+func UserAgent(logger log.Logger, userAgent string) sdkhttpclient.Middleware {
+	return sdkhttpclient.NamedMiddlewareFunc(userAgentMiddlewareName, func(opts sdkhttpclient.Options, next http.RoundTripper) http.RoundTripper {
+		return sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("User-Agent", userAgent)
+			return next.RoundTrip(req)
+		})
+	})
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserAgentMiddleware(t *testing.T) {
+	var userAgent string
+	finalRoundTripper := sdkhttpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		userAgent = req.Header.Get("User-Agent")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	mw := UserAgent(log.New("test"), "Grafana-team-a/1.0")
+	middlewareName, ok := mw.(sdkhttpclient.MiddlewareName)
+	require.True(t, ok)
+	require.Equal(t, userAgentMiddlewareName, middlewareName.MiddlewareName())
+
+	req, err := http.NewRequest(http.MethodGet, "http://test.com/api/v1/query", nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "Go-http-client/1.1")
+	_, err = mw.CreateMiddleware(sdkhttpclient.Options{}, finalRoundTripper).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "Grafana-team-a/1.0", userAgent)
+	require.Equal(t, "Go-http-client/1.1", req.Header.Get("User-Agent"), "the request of the caller must not be modified")
+}
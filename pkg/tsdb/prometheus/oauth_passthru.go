@@ -0,0 +1,30 @@
+package prometheus
+
+import (
+	"context"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+)
+
+// withForwardedOAuth returns a copy of ctx sending requests with the OAuth token of the user among the forwarded
+// headers of a request, or ctx itself if OAuth pass-through is disabled or the request has no token.
+func withForwardedOAuth(ctx context.Context, dsInfo *DatasourceInfo, headers map[string]string) context.Context {
+	if !dsInfo.OAuthPassThru {
+		return ctx
+	}
+
+	var authorization, idToken string
+	for name, value := range headers {
+		switch {
+		case strings.EqualFold(name, "Authorization"):
+			authorization = value
+		case strings.EqualFold(name, middleware.IDTokenHeader):
+			idToken = value
+		}
+	}
+	if authorization == "" {
+		return ctx
+	}
+	return middleware.WithOAuthToken(ctx, authorization, idToken)
+}
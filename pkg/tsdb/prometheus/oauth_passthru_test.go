@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_oauthPassThru(t *testing.T) {
+	var tokens, idTokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v1/query_range":
+			tokens = append(tokens, req.Header.Get("Authorization"))
+			idTokens = append(idTokens, req.Header.Get("X-ID-Token"))
+		case "/api/v1/metadata":
+			tokens = append(tokens, req.Header.Get("Authorization"))
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"up":[{"type":"gauge","help":"","unit":""}]}}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	newDSInfo := func(t *testing.T, jsonData string) *DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+			ID:       1,
+			URL:      srv.URL,
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		dsInfo := instance.(DatasourceInfo)
+		return &dsInfo
+	}
+
+	// Queries ending in the past, which would be answered from the query cache
+	now := time.Now().Add(-time.Hour)
+	run := func(t *testing.T, dsInfo *DatasourceInfo, headers map[string]string) {
+		t.Helper()
+		req := queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{From: now.Add(-time.Hour), To: now})
+		req.Headers = headers
+		_, err := newTestServiceWithDSInfo(dsInfo).executeTimeSeriesQuery(context.Background(), req, dsInfo)
+		require.NoError(t, err)
+	}
+
+	t.Run("queries should be sent with the token of the user", func(t *testing.T) {
+		tokens, idTokens = nil, nil
+		dsInfo := newDSInfo(t, `{"oauthPassThru": true, "queryCacheTTL": "1m"}`)
+
+		run(t, dsInfo, map[string]string{"Authorization": "Bearer user-a", "X-ID-Token": "id-a"})
+		run(t, dsInfo, map[string]string{"authorization": "Bearer user-b"})
+		run(t, dsInfo, map[string]string{"Authorization": "Bearer user-a", "X-ID-Token": "id-a"})
+
+		require.Equal(t, []string{"Bearer user-a", "Bearer user-b"}, tokens)
+		require.Equal(t, []string{"id-a", ""}, idTokens)
+	})
+
+	t.Run("metadata should be cached for every user", func(t *testing.T) {
+		tokens = nil
+		dsInfo := newDSInfo(t, `{"oauthPassThru": true}`)
+
+		for _, token := range []string{"Bearer user-a", "Bearer user-b", "Bearer user-a"} {
+			ctx := withForwardedOAuth(context.Background(), dsInfo, map[string]string{"Authorization": token})
+			_, err := fetchMetadata(ctx, dsInfo, "up")
+			require.NoError(t, err)
+		}
+		require.Equal(t, []string{"Bearer user-a", "Bearer user-b"}, tokens)
+	})
+
+	t.Run("queries should not be sent with the token of the user if OAuth pass-through is disabled", func(t *testing.T) {
+		tokens, idTokens = nil, nil
+		dsInfo := newDSInfo(t, `{}`)
+
+		run(t, dsInfo, map[string]string{"Authorization": "Bearer user-a"})
+		require.Equal(t, []string{""}, tokens)
+	})
+}
@@ -5,13 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"github.com/grafana/grafana/pkg/infra/httpclient"
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/plugins"
@@ -23,11 +30,26 @@ import (
 
 var (
 	plog         = log.New("tsdb.prometheus")
-	legendFormat = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
+	legendFormat = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
 	safeRes      = 11000
+	// defaultMaxSeries is the number of series returned by a query if no limit is configured
+	defaultMaxSeries int64 = 10000
+	// defaultDedupEpsilon is how close together samples are collapsed by queries deduplicating timestamps
+	defaultDedupEpsilon = time.Millisecond
+	// queryConcurrency is the maximum number of queries of a single request sent at the same time
+	queryConcurrency = 10
+	// defaultDownsampleFactor is how many times the scrape interval the step of a query can be before it is warned
+	// about downsampling, if the datasource warns about it without a factor
+	defaultDownsampleFactor = 10.0
 )
 
-const pluginID = "prometheus"
+const (
+	pluginID = "prometheus"
+
+	timeSeriesQueryType = "timeSeriesQuery"
+	instantQueryType    = "instantQuery"
+	alertQueryType      = "alert"
+)
 
 type Service struct {
 	intervalCalculator intervalv2.Calculator
@@ -36,7 +58,7 @@ type Service struct {
 
 func ProvideService(cfg *setting.Cfg, httpClientProvider httpclient.Provider, pluginStore plugins.Store) (*Service, error) {
 	plog.Debug("initializing")
-	im := datasource.NewInstanceManager(newInstanceSettings(httpClientProvider))
+	im := datasource.NewInstanceManager(newInstanceSettings(cfg, httpClientProvider))
 
 	s := &Service{
 		intervalCalculator: intervalv2.NewCalculator(),
@@ -44,7 +66,9 @@ func ProvideService(cfg *setting.Cfg, httpClientProvider httpclient.Provider, pl
 	}
 
 	factory := coreplugin.New(backend.ServeOpts{
-		QueryDataHandler: s,
+		QueryDataHandler:    s,
+		CallResourceHandler: httpadapter.New(s.newResourceMux()),
+		CheckHealthHandler:  s,
 	})
 	resolver := plugins.CoreDataSourcePathResolver(cfg, pluginID)
 	if err := pluginStore.AddWithFactory(context.Background(), pluginID, factory, resolver); err != nil {
@@ -55,7 +79,7 @@ func ProvideService(cfg *setting.Cfg, httpClientProvider httpclient.Provider, pl
 	return s, nil
 }
 
-func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.InstanceFactoryFunc {
+func newInstanceSettings(cfg *setting.Cfg, httpClientProvider httpclient.Provider) datasource.InstanceFactoryFunc {
 	return func(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
 		jsonData := map[string]interface{}{}
 		err := json.Unmarshal(settings.JSONData, &jsonData)
@@ -67,9 +91,59 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			return nil, fmt.Errorf("error getting http options: %w", err)
 		}
 
-		// Set SigV4 service namespace
+		// Set SigV4 service namespace, and the region and role of cross-account access to Amazon Managed Prometheus
 		if httpCliOpts.SigV4 != nil {
 			httpCliOpts.SigV4.Service = "aps"
+			if err := applySigV4Settings(httpCliOpts.SigV4, jsonData); err != nil {
+				return nil, err
+			}
+		}
+
+		// Set Azure AD authentication, e.g. for Azure Monitor managed Prometheus
+		azureMiddleware, err := client.AzureMiddleware(cfg, jsonData, settings.DecryptedSecureJSONData)
+		if err != nil {
+			return nil, err
+		}
+		if azureMiddleware != nil {
+			httpCliOpts.Middlewares = append(httpCliOpts.Middlewares, azureMiddleware)
+		}
+
+		// Set OAuth2 authentication with client credentials, which can't be combined with SigV4 signing
+		oauth2Middleware, err := client.OAuth2Middleware(jsonData, settings.DecryptedSecureJSONData)
+		if err != nil {
+			return nil, err
+		}
+		if oauth2Middleware != nil {
+			if httpCliOpts.SigV4 != nil {
+				return nil, errors.New("OAuth2 and SigV4 authentication can't be enabled at the same time")
+			}
+			httpCliOpts.Middlewares = append(httpCliOpts.Middlewares, oauth2Middleware)
+		}
+
+		// oauthPassThru forwards the OAuth token of the user, which replaces any other authentication of the datasource
+		oauthPassThru, ok := jsonData["oauthPassThru"].(bool)
+		if !ok && jsonData["oauthPassThru"] != nil {
+			return nil, errors.New("invalid OAuth pass-through provided")
+		}
+		if oauthPassThru {
+			if httpCliOpts.BasicAuth != nil || httpCliOpts.SigV4 != nil || azureMiddleware != nil || oauth2Middleware != nil {
+				return nil, errors.New("OAuth pass-through can't be combined with another authentication method")
+			}
+			httpCliOpts.Middlewares = append(httpCliOpts.Middlewares, middleware.ForwardOAuth(plog))
+		}
+
+		// tenantId and tenantIdHeader are optional, they select the tenant of multi-tenant backends.
+		// The tenant in the forwarded tenantIdHeader of a request wins over the tenant of the datasource.
+		tenantID, ok := jsonData["tenantId"].(string)
+		if !ok && jsonData["tenantId"] != nil {
+			return nil, errors.New("invalid tenant ID provided")
+		}
+		tenantIDHeader, ok := jsonData["tenantIdHeader"].(string)
+		if !ok && jsonData["tenantIdHeader"] != nil {
+			return nil, errors.New("invalid tenant ID header provided")
+		}
+		if tenantID != "" || tenantIDHeader != "" {
+			httpCliOpts.Middlewares = append(httpCliOpts.Middlewares, middleware.Tenant(plog, tenantID))
 		}
 
 		// timeInterval can be a string or can be missing.
@@ -86,22 +160,207 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			}
 		}
 
+		// queryTimeout is optional, no timeout is applied if it is missing
+		var queryTimeout time.Duration
+		if queryTimeoutJson := jsonData["queryTimeout"]; queryTimeoutJson != nil {
+			queryTimeoutString, ok := queryTimeoutJson.(string)
+			if !ok {
+				return nil, errors.New("invalid query-timeout provided")
+			}
+			if queryTimeoutString != "" {
+				queryTimeout, err = intervalv2.ParseIntervalStringToTimeDuration(queryTimeoutString)
+				if err != nil {
+					return nil, fmt.Errorf("invalid query-timeout provided: %w", err)
+				}
+			}
+		}
+
+		// maxDataPoints is optional, safeRes is used if it is missing
+		var maxDataPoints int64
+		if maxDataPointsJson := jsonData["maxDataPoints"]; maxDataPointsJson != nil {
+			maxDataPointsFloat, ok := maxDataPointsJson.(float64)
+			if !ok || maxDataPointsFloat < 1 {
+				return nil, errors.New("invalid max data points provided, it must be a positive number")
+			}
+			maxDataPoints = int64(maxDataPointsFloat)
+		}
+
+		// maxSeries is optional, defaultMaxSeries is used for queries other than alert queries if it is missing
+		var maxSeries int64
+		if maxSeriesJson := jsonData["maxSeries"]; maxSeriesJson != nil {
+			maxSeriesFloat, ok := maxSeriesJson.(float64)
+			if !ok || maxSeriesFloat < 1 {
+				return nil, errors.New("invalid max series provided, it must be a positive number")
+			}
+			maxSeries = int64(maxSeriesFloat)
+		}
+
+		// maxConcurrentQueries is optional, the number of queries running at the same time isn't limited if it is missing
+		var querySlots chan struct{}
+		var maxConcurrentQueries int64
+		if maxConcurrentQueriesJson := jsonData["maxConcurrentQueries"]; maxConcurrentQueriesJson != nil {
+			maxConcurrentQueriesFloat, ok := maxConcurrentQueriesJson.(float64)
+			if !ok || maxConcurrentQueriesFloat < 1 {
+				return nil, errors.New("invalid max concurrent queries provided, it must be a positive number")
+			}
+			maxConcurrentQueries = int64(maxConcurrentQueriesFloat)
+			querySlots = make(chan struct{}, maxConcurrentQueries)
+		}
+
+		// validateQueries is optional and disabled by default
+		validateQueries := false
+		if validateQueriesJson := jsonData["validateQueries"]; validateQueriesJson != nil {
+			var ok bool
+			validateQueries, ok = validateQueriesJson.(bool)
+			if !ok {
+				return nil, errors.New("invalid validate-queries provided")
+			}
+		}
+
+		// disableMetricsLookup is optional, metrics lookup is enabled by default
+		disableMetricsLookup := false
+		if disableMetricsLookupJson := jsonData["disableMetricsLookup"]; disableMetricsLookupJson != nil {
+			var ok bool
+			disableMetricsLookup, ok = disableMetricsLookupJson.(bool)
+			if !ok {
+				return nil, errors.New("invalid disable-metrics-lookup provided")
+			}
+		}
+
+		// metadataCacheTTL is optional, a zero duration disables the caches of metadata and metric names
+		metadataCacheTTL := defaultMetadataCacheTTL
+		if metadataCacheTTLJson := jsonData["metadataCacheTTL"]; metadataCacheTTLJson != nil {
+			metadataCacheTTLString, ok := metadataCacheTTLJson.(string)
+			if !ok {
+				return nil, errors.New("invalid metadata cache TTL provided")
+			}
+			if metadataCacheTTLString != "" {
+				metadataCacheTTL, err = intervalv2.ParseIntervalStringToTimeDuration(metadataCacheTTLString)
+				if err != nil {
+					return nil, fmt.Errorf("invalid metadata cache TTL provided: %w", err)
+				}
+			}
+		}
+
+		// warnOnDownsample is optional and disabled by default, downsampleFactor is only used with it
+		warnOnDownsample, ok := jsonData["warnOnDownsample"].(bool)
+		if !ok && jsonData["warnOnDownsample"] != nil {
+			return nil, errors.New("invalid warn on downsample provided")
+		}
+		var downsampleFactor float64
+		if warnOnDownsample {
+			downsampleFactor = defaultDownsampleFactor
+			if downsampleFactorJson := jsonData["downsampleFactor"]; downsampleFactorJson != nil {
+				downsampleFactor, ok = downsampleFactorJson.(float64)
+				if !ok || downsampleFactor < 1 {
+					return nil, errors.New("invalid downsample factor provided, it must be a number of at least 1")
+				}
+			}
+		}
+
+		// customQueryParameters are appended to every request by the client, so make sure they can be parsed
+		var customQueryParameters url.Values
+		if customQueryParametersJson := jsonData["customQueryParameters"]; customQueryParametersJson != nil {
+			customQueryParametersString, ok := customQueryParametersJson.(string)
+			if !ok {
+				return nil, errors.New("invalid custom query parameters provided")
+			}
+			customQueryParameters, err = url.ParseQuery(customQueryParametersString)
+			if err != nil {
+				return nil, fmt.Errorf("invalid custom query parameters provided: %w", err)
+			}
+		}
+
+		// defaultLegendFormat is optional, it is used by queries without a legend format
+		defaultLegendFormat := ""
+		if defaultLegendFormatJson := jsonData["defaultLegendFormat"]; defaultLegendFormatJson != nil {
+			var ok bool
+			defaultLegendFormat, ok = defaultLegendFormatJson.(string)
+			if !ok {
+				return nil, errors.New("invalid default legend format provided")
+			}
+		}
+
+		// healthCheckQuery is optional, the health check evaluates a constant if it is empty
+		healthCheckQuery, ok := jsonData["healthCheckQuery"].(string)
+		if !ok && jsonData["healthCheckQuery"] != nil {
+			return nil, errors.New("invalid health check query provided")
+		}
+
+		// allowedMetricPrefixes is optional, all metrics can be queried if it is empty
+		var allowedMetricPrefixes []string
+		if allowedMetricPrefixesJson := jsonData["allowedMetricPrefixes"]; allowedMetricPrefixesJson != nil {
+			prefixes, ok := allowedMetricPrefixesJson.([]interface{})
+			if !ok {
+				return nil, errors.New("invalid allowed metric prefixes provided")
+			}
+			for _, prefix := range prefixes {
+				prefixString, ok := prefix.(string)
+				if !ok || prefixString == "" {
+					return nil, errors.New("invalid allowed metric prefixes provided")
+				}
+				allowedMetricPrefixes = append(allowedMetricPrefixes, prefixString)
+			}
+		}
+
 		client, err := client.Create(settings.URL, httpCliOpts, httpClientProvider, jsonData, plog)
 		if err != nil {
 			return nil, err
 		}
 
 		mdl := DatasourceInfo{
-			ID:           settings.ID,
-			URL:          settings.URL,
-			TimeInterval: timeInterval,
-			promClient:   client,
+			ID:                    settings.ID,
+			UID:                   settings.UID,
+			URL:                   settings.URL,
+			TimeInterval:          timeInterval,
+			QueryTimeout:          queryTimeout,
+			MaxDataPoints:         maxDataPoints,
+			MaxSeries:             maxSeries,
+			ValidateQueries:       validateQueries,
+			DisableMetricsLookup:  disableMetricsLookup,
+			CustomQueryParameters: customQueryParameters,
+			DefaultLegendFormat:   defaultLegendFormat,
+			TenantIDHeader:        tenantIDHeader,
+			OAuthPassThru:         oauthPassThru,
+			AllowedMetricPrefixes: allowedMetricPrefixes,
+			HealthCheckQuery:      strings.TrimSpace(healthCheckQuery),
+			MaxConcurrentQueries:  maxConcurrentQueries,
+			DownsampleFactor:      downsampleFactor,
+
+			promClient:       client,
+			querySlots:       querySlots,
+			metadataCache:    newTTLCache(metadataCacheTTL),
+			metricNamesCache: newTTLCache(metadataCacheTTL),
+			statusCache:      newTTLCache(statusCacheTTL),
+			flavor:           &backendFlavor{},
 		}
 
 		return mdl, nil
 	}
 }
 
+// applySigV4Settings sets the sigV4Region and sigV4AssumeRoleArn of jsonData on the SigV4 options which don't have
+// them yet, so that requests are signed for the region of the workspace instead of the default region of the
+// credentials, and with an assumed role of the account of the workspace.
+func applySigV4Settings(sigV4 *sdkhttpclient.SigV4Config, jsonData map[string]interface{}) error {
+	region, ok := jsonData["sigV4Region"].(string)
+	if !ok && jsonData["sigV4Region"] != nil {
+		return errors.New("invalid SigV4 region provided")
+	}
+	if sigV4.Region == "" {
+		sigV4.Region = strings.TrimSpace(region)
+	}
+
+	assumeRoleARN, ok := jsonData["sigV4AssumeRoleArn"].(string)
+	if !ok && jsonData["sigV4AssumeRoleArn"] != nil {
+		return errors.New("invalid SigV4 assume role ARN provided")
+	}
+	if sigV4.AssumeRoleARN == "" {
+		sigV4.AssumeRoleARN = strings.TrimSpace(assumeRoleARN)
+	}
+	return nil
+}
+
 func (s *Service) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	if len(req.Queries) == 0 {
 		return &backend.QueryDataResponse{}, fmt.Errorf("query contains no queries")
@@ -115,7 +374,7 @@ func (s *Service) QueryData(ctx context.Context, req *backend.QueryDataRequest)
 
 	var result *backend.QueryDataResponse
 	switch q.QueryType {
-	case "timeSeriesQuery":
+	case timeSeriesQueryType, instantQueryType, alertQueryType:
 		fallthrough
 	default:
 		result, err = s.executeTimeSeriesQuery(ctx, req, dsInfo)
@@ -142,10 +401,117 @@ func IsAPIError(err error) bool {
 	return errors.As(err, &e)
 }
 
+// APIError is an error returned by the Prometheus API, keeping its type, e.g. bad_data or timeout.
+type APIError struct {
+	Type   string
+	Msg    string
+	Detail string
+	// RetryAfter is the wait Prometheus asked for before sending rate limited requests again, if it asked for one
+	RetryAfter time.Duration
+
+	err *apiv1.Error
+}
+
+func (e *APIError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("%s: %s", e.Type, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Type, e.Msg, e.Detail)
+}
+
+// Unwrap returns the error of the Prometheus client, so IsAPIError also holds for converted errors.
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// ConvertAPIError converts a Prometheus error in the chain of err to an APIError, or returns err as is.
 func ConvertAPIError(err error) error {
 	var e *apiv1.Error
 	if errors.As(err, &e) {
-		return fmt.Errorf("%s: %s", e.Msg, e.Detail)
+		apiErr := &APIError{Type: string(e.Type), Msg: e.Msg, Detail: e.Detail, err: e}
+		var rateLimitErr *client.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			apiErr.RetryAfter = rateLimitErr.RetryAfter
+		}
+		return apiErr
 	}
 	return err
 }
+
+// APIErrorType returns the type of the Prometheus error in the chain of err, or an empty string if there is none.
+func APIErrorType(err error) string {
+	var e *apiv1.Error
+	if errors.As(err, &e) {
+		return string(e.Type)
+	}
+	return ""
+}
+
+// ErrorSource tells whether the error of a query is caused by the datasource itself or by Prometheus and the query.
+type ErrorSource string
+
+const (
+	// ErrorSourceDownstream errors come from Prometheus or the query, e.g. invalid PromQL, timeouts or connection errors
+	ErrorSourceDownstream ErrorSource = "downstream"
+	// ErrorSourcePlugin errors come from the datasource, e.g. failing to convert a response
+	ErrorSourcePlugin ErrorSource = "plugin"
+)
+
+// Statuses of query errors, besides the error types of the Prometheus API, e.g. execution
+const (
+	ErrorStatusBadData     = string(apiv1.ErrBadData)
+	ErrorStatusTimeout     = string(apiv1.ErrTimeout)
+	ErrorStatusCanceled    = string(apiv1.ErrCanceled)
+	ErrorStatusUnavailable = "unavailable"
+	ErrorStatusRateLimited = "rate_limited"
+	ErrorStatusInternal    = "internal"
+)
+
+// QueryError is the error of a query response, with its source and a machine-readable status.
+type QueryError struct {
+	Source ErrorSource
+	Status string
+
+	err error
+}
+
+func (e *QueryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.err
+}
+
+func newQueryError(source ErrorSource, status string, err error) *QueryError {
+	return &QueryError{Source: source, Status: status, err: err}
+}
+
+// categorizeError returns err as a QueryError, keeping the category if it already is one.
+func categorizeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return err
+	}
+
+	var netErr net.Error
+	var rateLimitErr *client.RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		return newQueryError(ErrorSourceDownstream, ErrorStatusRateLimited, err)
+	case IsAPIError(err):
+		return newQueryError(ErrorSourceDownstream, APIErrorType(err), err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return newQueryError(ErrorSourceDownstream, ErrorStatusTimeout, err)
+	case errors.Is(err, context.Canceled):
+		return newQueryError(ErrorSourceDownstream, ErrorStatusCanceled, err)
+	case errors.As(err, &netErr):
+		return newQueryError(ErrorSourceDownstream, ErrorStatusUnavailable, err)
+	default:
+		return newQueryError(ErrorSourcePlugin, ErrorStatusInternal, err)
+	}
+}
@@ -0,0 +1,381 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_newInstanceSettings(t *testing.T) {
+	t.Run("without query timeout should not set a timeout", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{}`)
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(0), dsInfo.QueryTimeout)
+	})
+
+	t.Run("with query timeout should parse the timeout", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"queryTimeout": "1m"}`)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, dsInfo.QueryTimeout)
+	})
+
+	t.Run("with invalid query timeout should fail", func(t *testing.T) {
+		_, err := newTestInstance(`{"queryTimeout": "soon"}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"queryTimeout": 60}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with max data points should parse the limit", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"maxDataPoints": 20000}`)
+		require.NoError(t, err)
+		require.Equal(t, int64(20000), dsInfo.MaxDataPoints)
+	})
+
+	t.Run("with invalid max data points should fail", func(t *testing.T) {
+		_, err := newTestInstance(`{"maxDataPoints": 0}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"maxDataPoints": "many"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with max series should parse the limit", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"maxSeries": 500}`)
+		require.NoError(t, err)
+		require.Equal(t, int64(500), dsInfo.MaxSeries)
+
+		_, err = newTestInstance(`{"maxSeries": 0}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"maxSeries": "many"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with max concurrent queries should limit the queries running at the same time", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{}`)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), dsInfo.MaxConcurrentQueries)
+		require.Nil(t, dsInfo.querySlots)
+
+		dsInfo, err = newTestInstance(`{"maxConcurrentQueries": 4}`)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), dsInfo.MaxConcurrentQueries)
+		require.Equal(t, 4, cap(dsInfo.querySlots))
+
+		_, err = newTestInstance(`{"maxConcurrentQueries": 0}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"maxConcurrentQueries": "many"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with validate queries should enable query validation", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"validateQueries": true}`)
+		require.NoError(t, err)
+		require.True(t, dsInfo.ValidateQueries)
+
+		_, err = newTestInstance(`{"validateQueries": "yes"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("metadata cache should use the configured TTL", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{}`)
+		require.NoError(t, err)
+		require.Equal(t, defaultMetadataCacheTTL, dsInfo.metadataCache.ttl)
+
+		dsInfo, err = newTestInstance(`{"metadataCacheTTL": "5m"}`)
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Minute, dsInfo.metadataCache.ttl)
+
+		_, err = newTestInstance(`{"metadataCacheTTL": "soon"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with disable metrics lookup should disable metrics lookup", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"disableMetricsLookup": true}`)
+		require.NoError(t, err)
+		require.True(t, dsInfo.DisableMetricsLookup)
+
+		_, err = newTestInstance(`{"disableMetricsLookup": "yes"}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with custom query parameters should parse the parameters", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"customQueryParameters": "tenant=team%20a&hint=1&hint=2"}`)
+		require.NoError(t, err)
+		require.Equal(t, url.Values{"tenant": {"team a"}, "hint": {"1", "2"}}, dsInfo.CustomQueryParameters)
+	})
+
+	t.Run("with invalid custom query parameters should fail", func(t *testing.T) {
+		_, err := newTestInstance(`{"customQueryParameters": "custom=%%abc"}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"customQueryParameters": 1}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with OAuth2 and SigV4 authentication should fail", func(t *testing.T) {
+		_, err := newTestInstance(`{"oauth2TokenUrl": "http://localhost:8080/token", "oauth2ClientId": "grafana"}`)
+		require.NoError(t, err)
+
+		_, err = newTestInstance(`{"oauth2TokenUrl": "http://localhost:8080/token", "oauth2ClientId": "grafana", "sigV4Auth": true}`)
+		require.EqualError(t, err, "OAuth2 and SigV4 authentication can't be enabled at the same time")
+	})
+
+	t.Run("with OAuth pass-through should forward the token of the user", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"oauthPassThru": true}`)
+		require.NoError(t, err)
+		require.True(t, dsInfo.OAuthPassThru)
+
+		_, err = newTestInstance(`{"oauthPassThru": "yes"}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"oauthPassThru": true, "oauth2TokenUrl": "http://localhost:8080/token", "oauth2ClientId": "grafana"}`)
+		require.EqualError(t, err, "OAuth pass-through can't be combined with another authentication method")
+	})
+
+	t.Run("with allowed metric prefixes should parse the prefixes", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"allowedMetricPrefixes": ["node_", "up"]}`)
+		require.NoError(t, err)
+		require.Equal(t, []string{"node_", "up"}, dsInfo.AllowedMetricPrefixes)
+
+		dsInfo, err = newTestInstance(`{"allowedMetricPrefixes": []}`)
+		require.NoError(t, err)
+		require.Empty(t, dsInfo.AllowedMetricPrefixes)
+
+		_, err = newTestInstance(`{"allowedMetricPrefixes": "node_"}`)
+		require.Error(t, err)
+
+		_, err = newTestInstance(`{"allowedMetricPrefixes": ["node_", ""]}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with default legend format should parse the format", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"defaultLegendFormat": "{{instance}}"}`)
+		require.NoError(t, err)
+		require.Equal(t, "{{instance}}", dsInfo.DefaultLegendFormat)
+
+		_, err = newTestInstance(`{"defaultLegendFormat": 1}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with health check query should parse the query", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{"healthCheckQuery": " up{job=\"api\"} "}`)
+		require.NoError(t, err)
+		require.Equal(t, `up{job="api"}`, dsInfo.HealthCheckQuery)
+
+		_, err = newTestInstance(`{"healthCheckQuery": 1}`)
+		require.Error(t, err)
+	})
+
+	t.Run("with warn on downsample should use the downsample factor", func(t *testing.T) {
+		dsInfo, err := newTestInstance(`{}`)
+		require.NoError(t, err)
+		require.Zero(t, dsInfo.DownsampleFactor)
+
+		dsInfo, err = newTestInstance(`{"warnOnDownsample": true}`)
+		require.NoError(t, err)
+		require.Equal(t, 10.0, dsInfo.DownsampleFactor)
+
+		dsInfo, err = newTestInstance(`{"warnOnDownsample": true, "downsampleFactor": 4}`)
+		require.NoError(t, err)
+		require.Equal(t, 4.0, dsInfo.DownsampleFactor)
+
+		dsInfo, err = newTestInstance(`{"warnOnDownsample": false, "downsampleFactor": 4}`)
+		require.NoError(t, err)
+		require.Zero(t, dsInfo.DownsampleFactor)
+
+		_, err = newTestInstance(`{"warnOnDownsample": "yes"}`)
+		require.EqualError(t, err, "invalid warn on downsample provided")
+
+		_, err = newTestInstance(`{"warnOnDownsample": true, "downsampleFactor": 0.5}`)
+		require.EqualError(t, err, "invalid downsample factor provided, it must be a number of at least 1")
+	})
+
+	t.Run("with invalid API prefix should fail", func(t *testing.T) {
+		_, err := newTestInstance(`{"apiPrefix": "/prometheus"}`)
+		require.NoError(t, err)
+
+		_, err = newTestInstance(`{"apiPrefix": "http://localhost:9091/prometheus"}`)
+		require.Error(t, err)
+	})
+}
+
+func TestApplySigV4Settings(t *testing.T) {
+	t.Run("should set the region and role of the settings", func(t *testing.T) {
+		sigV4 := &sdkhttpclient.SigV4Config{Service: "aps"}
+		err := applySigV4Settings(sigV4, map[string]interface{}{
+			"sigV4Region":        "eu-west-1",
+			"sigV4AssumeRoleArn": " arn:aws:iam::123456789012:role/grafana ",
+		})
+		require.NoError(t, err)
+		require.Equal(t, &sdkhttpclient.SigV4Config{Service: "aps", Region: "eu-west-1", AssumeRoleARN: "arn:aws:iam::123456789012:role/grafana"}, sigV4)
+	})
+
+	t.Run("should keep the region and role already set", func(t *testing.T) {
+		sigV4 := &sdkhttpclient.SigV4Config{Region: "us-east-1", AssumeRoleARN: "arn:aws:iam::123456789012:role/admin"}
+		err := applySigV4Settings(sigV4, map[string]interface{}{
+			"sigV4Region":        "eu-west-1",
+			"sigV4AssumeRoleArn": "arn:aws:iam::123456789012:role/grafana",
+		})
+		require.NoError(t, err)
+		require.Equal(t, "us-east-1", sigV4.Region)
+		require.Equal(t, "arn:aws:iam::123456789012:role/admin", sigV4.AssumeRoleARN)
+	})
+
+	t.Run("should keep the options without settings", func(t *testing.T) {
+		sigV4 := &sdkhttpclient.SigV4Config{Service: "aps"}
+		require.NoError(t, applySigV4Settings(sigV4, map[string]interface{}{}))
+		require.Equal(t, &sdkhttpclient.SigV4Config{Service: "aps"}, sigV4)
+	})
+
+	t.Run("should fail with invalid settings", func(t *testing.T) {
+		err := applySigV4Settings(&sdkhttpclient.SigV4Config{}, map[string]interface{}{"sigV4Region": 1})
+		require.EqualError(t, err, "invalid SigV4 region provided")
+
+		err = applySigV4Settings(&sdkhttpclient.SigV4Config{}, map[string]interface{}{"sigV4AssumeRoleArn": true})
+		require.EqualError(t, err, "invalid SigV4 assume role ARN provided")
+	})
+}
+
+func newTestInstance(jsonData string) (DatasourceInfo, error) {
+	instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+		ID:       1,
+		URL:      "http://localhost:9090",
+		JSONData: []byte(jsonData),
+	})
+	if err != nil {
+		return DatasourceInfo{}, err
+	}
+	return instance.(DatasourceInfo), nil
+}
+
+func TestConvertAPIError(t *testing.T) {
+	apiErr := &apiv1.Error{Type: apiv1.ErrBadData, Msg: "parse error", Detail: "unexpected end of input"}
+
+	t.Run("should keep the type of a Prometheus error", func(t *testing.T) {
+		err := ConvertAPIError(fmt.Errorf("query failed: %w", apiErr))
+		require.EqualError(t, err, "bad_data: parse error: unexpected end of input")
+
+		var e *APIError
+		require.True(t, errors.As(err, &e))
+		require.Equal(t, "bad_data", e.Type)
+		require.True(t, IsAPIError(err))
+		require.Equal(t, "bad_data", APIErrorType(err))
+	})
+
+	t.Run("should leave out an empty detail", func(t *testing.T) {
+		err := ConvertAPIError(&apiv1.Error{Type: apiv1.ErrTimeout, Msg: "query timed out"})
+		require.EqualError(t, err, "timeout: query timed out")
+		require.Equal(t, "timeout", APIErrorType(err))
+	})
+
+	t.Run("should keep the wait of a rate limit error", func(t *testing.T) {
+		rateLimitErr := rateLimitError(t, 30*time.Second)
+		err := ConvertAPIError(fmt.Errorf("query failed: %w", rateLimitErr))
+		require.EqualError(t, err, "client_error: Prometheus is rate limiting requests (429 Too Many Requests), try again in 30s")
+
+		var e *APIError
+		require.True(t, errors.As(err, &e))
+		require.Equal(t, 30*time.Second, e.RetryAfter)
+	})
+
+	t.Run("should return other errors as is", func(t *testing.T) {
+		err := errors.New("connection refused")
+		require.Equal(t, err, ConvertAPIError(err))
+		require.False(t, IsAPIError(err))
+		require.Empty(t, APIErrorType(err))
+	})
+}
+
+func TestCategorizeError(t *testing.T) {
+	categorize := func(t *testing.T, err error) *QueryError {
+		t.Helper()
+		var queryErr *QueryError
+		require.ErrorAs(t, categorizeError(err), &queryErr)
+		require.EqualError(t, queryErr, err.Error())
+		return queryErr
+	}
+
+	t.Run("should categorize Prometheus errors by their type", func(t *testing.T) {
+		err := categorize(t, fmt.Errorf("query failed: %w", &apiv1.Error{Type: apiv1.ErrBadData, Msg: "parse error"}))
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, ErrorStatusBadData, err.Status)
+		require.True(t, IsAPIError(err))
+
+		err = categorize(t, &apiv1.Error{Type: apiv1.ErrExec, Msg: "query processing would load too many samples"})
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, "execution", err.Status)
+	})
+
+	t.Run("should categorize rate limited requests", func(t *testing.T) {
+		err := categorize(t, fmt.Errorf("query failed: %w", rateLimitError(t, 0)))
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, ErrorStatusRateLimited, err.Status)
+		require.True(t, IsAPIError(err))
+	})
+
+	t.Run("should categorize timeouts and canceled requests", func(t *testing.T) {
+		err := categorize(t, &url.Error{Op: "Post", URL: "http://prometheus:9090", Err: context.DeadlineExceeded})
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, ErrorStatusTimeout, err.Status)
+
+		err = categorize(t, &url.Error{Op: "Post", URL: "http://prometheus:9090", Err: context.Canceled})
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, ErrorStatusCanceled, err.Status)
+	})
+
+	t.Run("should categorize connection errors", func(t *testing.T) {
+		err := categorize(t, &url.Error{Op: "Post", URL: "http://prometheus:9090", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}})
+		require.Equal(t, ErrorSourceDownstream, err.Source)
+		require.Equal(t, ErrorStatusUnavailable, err.Status)
+	})
+
+	t.Run("should categorize other errors as errors of the datasource", func(t *testing.T) {
+		err := categorize(t, errors.New("unexpected value type"))
+		require.Equal(t, ErrorSourcePlugin, err.Source)
+		require.Equal(t, ErrorStatusInternal, err.Status)
+	})
+
+	t.Run("should keep the category of categorized errors", func(t *testing.T) {
+		err := newQueryError(ErrorSourceDownstream, ErrorStatusTimeout, errors.New("query timed out after 10ms"))
+		require.Equal(t, err, categorizeError(err))
+		require.NoError(t, categorizeError(nil))
+	})
+}
+
+// rateLimitError returns the error of a query rejected by Prometheus with 429 Too Many Requests and retryAfter
+func rateLimitError(t *testing.T, retryAfter time.Duration) error {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if retryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		}
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := client.New(srv.URL, http.DefaultTransport)
+	require.NoError(t, err)
+	_, _, err = c.Query(context.Background(), "up", time.Now())
+	var rateLimitErr *client.RateLimitError
+	require.ErrorAs(t, err, &rateLimitErr)
+	return rateLimitErr
+}
@@ -0,0 +1,73 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// maxPointsPerRequest is the number of points per series Prometheus returns for a range query at most,
+// it rejects range queries with more
+const maxPointsPerRequest = 11000
+
+type rangeQuerier interface {
+	QueryRange(ctx context.Context, query string, r apiv1.Range) (model.Value, apiv1.Warnings, error)
+}
+
+// splitRange returns consecutive ranges covering r with at most maxPoints steps each, or r itself if it fits.
+// Each range starts one step after the end of the previous one, so that no sample is returned twice.
+func splitRange(r apiv1.Range, maxPoints int64) []apiv1.Range {
+	if r.Step <= 0 || int64(r.End.Sub(r.Start)/r.Step) < maxPoints {
+		return []apiv1.Range{r}
+	}
+
+	var ranges []apiv1.Range
+	for start := r.Start; !start.After(r.End); {
+		end := start.Add(time.Duration(maxPoints-1) * r.Step)
+		if end.After(r.End) {
+			end = r.End
+		}
+		ranges = append(ranges, apiv1.Range{Start: start, End: end, Step: r.Step})
+		start = end.Add(r.Step)
+	}
+	return ranges
+}
+
+// queryRangeSplit runs a range query with more points than Prometheus returns per request as several requests one
+// after the other, and stitches the samples of the same series together.
+func queryRangeSplit(ctx context.Context, client rangeQuerier, expr string, r apiv1.Range) (model.Value, apiv1.Warnings, error) {
+	ranges := splitRange(r, maxPointsPerRequest)
+	if len(ranges) == 1 {
+		return client.QueryRange(ctx, expr, r)
+	}
+
+	var warnings apiv1.Warnings
+	matrix := model.Matrix{}
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for _, subRange := range ranges {
+		value, subWarnings, err := client.QueryRange(ctx, expr, subRange)
+		warnings = append(warnings, subWarnings...)
+		if err != nil {
+			return nil, warnings, err
+		}
+
+		subMatrix, ok := value.(model.Matrix)
+		if !ok {
+			return nil, warnings, fmt.Errorf("unexpected result type %s of a range query", value.Type())
+		}
+		for _, s := range subMatrix {
+			fingerprint := s.Metric.Fingerprint()
+			if existing, ok := series[fingerprint]; ok {
+				existing.Values = append(existing.Values, s.Values...)
+				continue
+			}
+			series[fingerprint] = s
+			matrix = append(matrix, s)
+		}
+	}
+
+	return matrix, warnings, nil
+}
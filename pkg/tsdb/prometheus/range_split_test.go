@@ -0,0 +1,81 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_splitRange(t *testing.T) {
+	t.Run("ranges within the limit should not be split", func(t *testing.T) {
+		r := apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(9, 0), Step: time.Second}
+		require.Equal(t, []apiv1.Range{r}, splitRange(r, 10))
+	})
+
+	t.Run("ranges beyond the limit should be split without overlapping", func(t *testing.T) {
+		r := apiv1.Range{Start: time.Unix(0, 0), End: time.Unix(25, 0), Step: time.Second}
+		require.Equal(t, []apiv1.Range{
+			{Start: time.Unix(0, 0), End: time.Unix(9, 0), Step: time.Second},
+			{Start: time.Unix(10, 0), End: time.Unix(19, 0), Step: time.Second},
+			{Start: time.Unix(20, 0), End: time.Unix(25, 0), Step: time.Second},
+		}, splitRange(r, 10))
+	})
+}
+
+func TestPrometheus_queryRangeSplit(t *testing.T) {
+	var requests [][2]int64
+	var mu sync.Mutex
+	dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		start, err := strconv.ParseInt(req.Form.Get("start"), 10, 64)
+		require.NoError(t, err)
+		end, err := strconv.ParseInt(req.Form.Get("end"), 10, 64)
+		require.NoError(t, err)
+		require.Equal(t, "1", req.Form.Get("step"))
+		require.LessOrEqual(t, end-start+1, int64(maxPointsPerRequest))
+
+		mu.Lock()
+		requests = append(requests, [2]int64{start, end})
+		mu.Unlock()
+
+		// Series a has samples in every sub-range, series b only in the last one
+		values := make([]string, 0, end-start+1)
+		for ts := start; ts <= end; ts++ {
+			values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts, ts))
+		}
+		result := `{"metric":{"job":"a"},"values":[` + strings.Join(values, ",") + `]}`
+		if end == 15000 {
+			result += `,{"metric":{"job":"b"},"values":[[15000,"1"]]}`
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[` + result + `]}}`))
+	})
+	dsInfo.MaxDataPoints = 20000
+
+	service := Service{intervalCalculator: intervalv2.NewCalculator()}
+	query := queryContext(`{"expr": "up", "range": true, "step": "1s", "legendFormat": "{{job}}"}`, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(15000, 0)})
+	res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+	require.NoError(t, err)
+	require.NoError(t, res.Responses["A"].Error)
+
+	require.Equal(t, [][2]int64{{0, 10999}, {11000, 15000}}, requests)
+	frames := res.Responses["A"].Frames
+	require.Len(t, frames, 2)
+	require.Equal(t, "a", frames[0].Name)
+	require.Equal(t, 15001, frames[0].Fields[0].Len())
+	for _, i := range []int{0, 10999, 11000, 15000} {
+		require.Equal(t, time.Unix(int64(i), 0).UTC(), frames[0].Fields[0].At(i))
+		require.Equal(t, float64(i), *frames[0].Fields[1].At(i).(*float64))
+	}
+	require.Equal(t, "b", frames[1].Name)
+	require.Equal(t, 1, frames[1].Fields[0].Len())
+}
@@ -0,0 +1,783 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const labelValuesPathPrefix = "/api/v1/label/"
+
+// maxBatchLabels is the number of labels whose values a single label values batch request can look up
+const maxBatchLabels = 100
+
+// defaultSeriesTimeRange limits series requests without a start, as looking up series of all time is expensive
+const defaultSeriesTimeRange = time.Hour
+
+const (
+	alertingRuleType  = "alert"
+	recordingRuleType = "record"
+)
+
+type ruleGroup struct {
+	Name     string  `json:"name"`
+	File     string  `json:"file"`
+	Interval float64 `json:"interval"`
+	Rules    []rule  `json:"rules"`
+}
+
+type rule struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Query       string            `json:"query"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Duration    float64           `json:"duration,omitempty"`
+	State       string            `json:"state,omitempty"`
+	Health      string            `json:"health"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+// labelValuesBatchRequest is the body of label values batch requests, the values of all the labels are looked up for
+// the same series selectors and time range
+type labelValuesBatchRequest struct {
+	Labels []string `json:"labels"`
+	Match  []string `json:"match"`
+	Start  string   `json:"start"`
+	End    string   `json:"end"`
+}
+
+type metricNamesResponse struct {
+	Metrics []string `json:"metrics"`
+	// Total is the number of metric names matching the search, Truncated tells if not all of them are returned
+	Total     int  `json:"total"`
+	Truncated bool `json:"truncated"`
+}
+
+// queryResourceData is the data of instant query results as returned by the Prometheus API
+type queryResourceData struct {
+	ResultType model.ValueType `json:"resultType"`
+	Result     model.Value     `json:"result"`
+}
+
+type resourceResponse struct {
+	Status   string      `json:"status"`
+	Data     interface{} `json:"data,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+	// HasMore tells if a paginated response left out further results
+	HasMore bool `json:"hasMore,omitempty"`
+}
+
+func (s *Service) newResourceMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/labels", s.tenant(s.metricsLookup(s.handleLabelNames)))
+	mux.HandleFunc(labelValuesPathPrefix, s.tenant(s.metricsLookup(s.handleLabelValues)))
+	mux.HandleFunc("/labels/batch", s.tenant(s.metricsLookup(s.handleLabelValuesBatch)))
+	mux.HandleFunc("/metadata", s.tenant(s.metricsLookup(s.handleMetadata)))
+	mux.HandleFunc("/series", s.tenant(s.metricsLookup(s.handleSeries)))
+	mux.HandleFunc("/metrics", s.tenant(s.metricsLookup(s.handleMetricNames)))
+	mux.HandleFunc("/rules", s.tenant(s.handleRules))
+	mux.HandleFunc("/query", s.tenant(s.metricsLookup(s.handleQuery)))
+	mux.HandleFunc("/format-query", s.tenant(s.handleFormatQuery))
+	mux.HandleFunc("/buildinfo", s.tenant(s.handleStatus("buildinfo", func(ctx context.Context, dsInfo *DatasourceInfo) (interface{}, error) {
+		return dsInfo.promClient.Buildinfo(ctx)
+	})))
+	mux.HandleFunc("/flags", s.tenant(s.handleStatus("flags", func(ctx context.Context, dsInfo *DatasourceInfo) (interface{}, error) {
+		return dsInfo.promClient.Flags(ctx)
+	})))
+	mux.HandleFunc("/tsdb-status", s.tenant(s.metricsLookup(s.handleStatus("tsdb", func(ctx context.Context, dsInfo *DatasourceInfo) (interface{}, error) {
+		status, err := dsInfo.promClient.TSDB(ctx)
+		if err != nil || len(dsInfo.AllowedMetricPrefixes) == 0 {
+			return status, err
+		}
+		return filterTSDBStats(status, dsInfo.AllowedMetricPrefixes), nil
+	}))))
+	return mux
+}
+
+// tenant sends the requests of handler for the tenant in the forwarded tenant ID header of the request.
+func (s *Service) tenant(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+		if err != nil {
+			writeResourceError(rw, http.StatusInternalServerError, err)
+			return
+		}
+
+		if dsInfo.TenantIDHeader != "" {
+			if tenant := req.Header.Get(dsInfo.TenantIDHeader); tenant != "" {
+				req = req.WithContext(withTenant(req.Context(), tenant))
+			}
+		}
+
+		handler(rw, req)
+	}
+}
+
+// metricsLookup rejects requests to handler if browsing metrics and labels is disabled for the datasource.
+func (s *Service) metricsLookup(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+		if err != nil {
+			writeResourceError(rw, http.StatusInternalServerError, err)
+			return
+		}
+
+		if dsInfo.DisableMetricsLookup {
+			writeResourceError(rw, http.StatusForbidden, errors.New("metrics lookup is disabled for this data source"))
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+func (s *Service) handleLabelNames(rw http.ResponseWriter, req *http.Request) {
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end, err := parseTimeRangeParams(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	matches := req.URL.Query()["match[]"]
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		if err := checkAllowedSelectors(matches, dsInfo.AllowedMetricPrefixes); err != nil {
+			writeResourceError(rw, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	names, warnings, err := dsInfo.promClient.LabelNames(req.Context(), matches, start, end)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: names, Warnings: warnings})
+}
+
+func (s *Service) handleLabelValues(rw http.ResponseWriter, req *http.Request) {
+	// Path is in the form of /api/v1/label/<name>/values
+	label := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, labelValuesPathPrefix), "/values")
+	if label == "" || strings.Contains(label, "/") {
+		writeResourceError(rw, http.StatusNotFound, fmt.Errorf("unknown resource path %q", req.URL.Path))
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	start, end, err := parseTimeRangeParams(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	matches := req.URL.Query()["match[]"]
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		if err := checkAllowedSelectors(matches, dsInfo.AllowedMetricPrefixes); err != nil {
+			writeResourceError(rw, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	values, warnings, err := dsInfo.promClient.LabelValues(req.Context(), label, matches, start, end)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+	if label == model.MetricNameLabel && len(dsInfo.AllowedMetricPrefixes) > 0 {
+		values = filterMetricNames(values, dsInfo.AllowedMetricPrefixes)
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: values, Warnings: warnings})
+}
+
+// handleLabelValuesBatch returns the values of several labels by their name, e.g. for the label_values variables of a
+// dashboard, in a single response. The values of the labels are looked up in parallel, and the request fails if the
+// values of any of them can't be.
+func (s *Service) handleLabelValuesBatch(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeResourceError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, label values batches must be sent with POST", req.Method))
+		return
+	}
+
+	var batch labelValuesBatchRequest
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid label values batch: %w", err))
+		return
+	}
+	labels := make([]string, 0, len(batch.Labels))
+	seen := make(map[string]struct{}, len(batch.Labels))
+	for _, label := range batch.Labels {
+		if label == "" {
+			writeResourceError(rw, http.StatusBadRequest, errors.New("invalid label values batch: empty label name"))
+			return
+		}
+		// The name is part of the path of the request to Prometheus
+		if !model.LabelName(label).IsValid() {
+			writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid label values batch: invalid label name %q", label))
+			return
+		}
+		if _, ok := seen[label]; !ok {
+			seen[label] = struct{}{}
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		writeResourceError(rw, http.StatusBadRequest, errors.New("invalid label values batch: no labels provided"))
+		return
+	}
+	if len(labels) > maxBatchLabels {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid label values batch: more than %d labels provided", maxBatchLabels))
+		return
+	}
+
+	start, err := parseTimeParam(batch.Start)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid start: %w", err))
+		return
+	}
+	end, err := parseTimeParam(batch.End)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid end: %w", err))
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		if err := checkAllowedSelectors(batch.Match, dsInfo.AllowedMetricPrefixes); err != nil {
+			writeResourceError(rw, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	type labelValuesResult struct {
+		values   model.LabelValues
+		warnings apiv1.Warnings
+		err      error
+	}
+
+	// The lookups still running are canceled once one of them fails
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	results := make([]labelValuesResult, len(labels))
+	workers := make(chan struct{}, queryConcurrency)
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			if ctx.Err() != nil {
+				results[i] = labelValuesResult{err: ctx.Err()}
+				return
+			}
+			values, warnings, err := dsInfo.promClient.LabelValues(ctx, label, batch.Match, start, end)
+			if err != nil {
+				cancel()
+			}
+			results[i] = labelValuesResult{values: values, warnings: warnings, err: err}
+		}(i, label)
+	}
+	wg.Wait()
+
+	// The error of a failed lookup is returned, rather than the cancellation of the others
+	for i, result := range results {
+		if result.err != nil && !errors.Is(result.err, context.Canceled) {
+			writeResourceError(rw, http.StatusBadGateway, fmt.Errorf("label %s: %w", labels[i], ConvertAPIError(result.err)))
+			return
+		}
+	}
+	if err := req.Context().Err(); err != nil {
+		writeResourceError(rw, http.StatusBadGateway, err)
+		return
+	}
+
+	values := make(map[string]model.LabelValues, len(labels))
+	var warnings []string
+	seenWarnings := map[string]struct{}{}
+	for i, result := range results {
+		if result.values == nil {
+			result.values = model.LabelValues{}
+		}
+		if labels[i] == model.MetricNameLabel && len(dsInfo.AllowedMetricPrefixes) > 0 {
+			result.values = filterMetricNames(result.values, dsInfo.AllowedMetricPrefixes)
+		}
+		values[labels[i]] = result.values
+		for _, warning := range result.warnings {
+			if _, ok := seenWarnings[warning]; !ok {
+				seenWarnings[warning] = struct{}{}
+				warnings = append(warnings, warning)
+			}
+		}
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: values, Warnings: warnings})
+}
+
+// handleSeries returns the label sets of the series matching the match[] selectors.
+// Without a time range, the series of the last hour are returned. The optional limit and offset query parameters
+// return a page of the series, sorted by their labels so that pages don't overlap.
+func (s *Service) handleSeries(rw http.ResponseWriter, req *http.Request) {
+	matches := req.URL.Query()["match[]"]
+	if len(matches) == 0 {
+		writeResourceError(rw, http.StatusBadRequest, errors.New("no match[] parameter provided"))
+		return
+	}
+
+	limit, offset, err := parsePaginationParams(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		if err := checkAllowedSelectors(matches, dsInfo.AllowedMetricPrefixes); err != nil {
+			writeResourceError(rw, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	start, end, err := parseTimeRangeParams(req)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	if start.IsZero() {
+		start = end.Add(-defaultSeriesTimeRange)
+	}
+
+	series, warnings, err := dsInfo.promClient.Series(req.Context(), matches, start, end)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		series = filterSeries(series, dsInfo.AllowedMetricPrefixes)
+	}
+
+	hasMore := false
+	if limit > 0 || offset > 0 {
+		series, hasMore = paginateSeries(series, limit, offset)
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: series, Warnings: warnings, HasMore: hasMore})
+}
+
+// paginateSeries returns the series from offset on, at most limit of them unless limit is zero, and if there are more.
+func paginateSeries(series []model.LabelSet, limit int, offset int) ([]model.LabelSet, bool) {
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].String() < series[j].String()
+	})
+
+	if offset >= len(series) {
+		return []model.LabelSet{}, false
+	}
+	series = series[offset:]
+	if limit > 0 && len(series) > limit {
+		return series[:limit], true
+	}
+	return series, false
+}
+
+// handleMetricNames returns the metric names matching the optional search query parameter, best matches first.
+// At most limit names are returned, defaultMetricNamesLimit if it isn't set. All metric names are fetched once
+// and cached, so that searching them is fast.
+func (s *Service) handleMetricNames(rw http.ResponseWriter, req *http.Request) {
+	limit := defaultMetricNamesLimit
+	if limitParam := req.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid limit parameter %q, it must be a positive integer", limitParam))
+			return
+		}
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Tenants of multi-tenant backends and users whose token is forwarded may see different metrics
+	cacheKey := middleware.UserKey(req.Context())
+	var names []string
+	var warnings apiv1.Warnings
+	if cached, ok := dsInfo.metricNamesCache.get(cacheKey); ok {
+		names = cached.([]string)
+	} else {
+		var values model.LabelValues
+		values, warnings, err = dsInfo.promClient.LabelValues(req.Context(), model.MetricNameLabel, nil, time.Time{}, time.Time{})
+		if err != nil {
+			writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+			return
+		}
+		if len(dsInfo.AllowedMetricPrefixes) > 0 {
+			values = filterMetricNames(values, dsInfo.AllowedMetricPrefixes)
+		}
+		names = make([]string, 0, len(values))
+		for _, value := range values {
+			names = append(names, string(value))
+		}
+		// Partial results are not cached, so that the next search gets all names
+		if len(warnings) == 0 {
+			dsInfo.metricNamesCache.set(cacheKey, names)
+		}
+	}
+
+	metrics, total := searchMetricNames(names, req.URL.Query().Get("search"), limit)
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{
+		Status:   "success",
+		Data:     metricNamesResponse{Metrics: metrics, Total: total, Truncated: len(metrics) < total},
+		Warnings: warnings,
+	})
+}
+
+// handleQuery runs the instant query in the expr query parameter at the optional time parameter, now by default,
+// and returns the result as the Prometheus API does instead of as data frames. Only PromQL expressions are accepted,
+// which can't modify anything, and they are checked against the allowed metric prefixes of the datasource.
+func (s *Service) handleQuery(rw http.ResponseWriter, req *http.Request) {
+	expr := strings.TrimSpace(req.URL.Query().Get("expr"))
+	if expr == "" {
+		writeResourceError(rw, http.StatusBadRequest, errors.New("no expr parameter provided"))
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := validateQuery(expr); err != nil {
+		writeResourceError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		if err := checkAllowedMetrics(expr, dsInfo.AllowedMetricPrefixes); err != nil {
+			writeResourceError(rw, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	ts, err := parseTimeParam(req.URL.Query().Get("time"))
+	if err != nil {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid time parameter: %w", err))
+		return
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	ctx := req.Context()
+	if dsInfo.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dsInfo.QueryTimeout)
+		defer cancel()
+	}
+
+	value, warnings, err := dsInfo.promClient.Query(ctx, expr, ts)
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{
+		Status:   "success",
+		Data:     queryResourceData{ResultType: value.Type(), Result: value},
+		Warnings: warnings,
+	})
+}
+
+// queryFormatter is implemented by clients which can have Prometheus format queries.
+type queryFormatter interface {
+	FormatQuery(ctx context.Context, query string) (string, error)
+}
+
+// handleFormatQuery returns the expr query parameter formatted by Prometheus. Prometheus versions without the
+// format_query endpoint return the expression as is, with a warning.
+func (s *Service) handleFormatQuery(rw http.ResponseWriter, req *http.Request) {
+	expr := strings.TrimSpace(req.URL.Query().Get("expr"))
+	if expr == "" {
+		writeResourceError(rw, http.StatusBadRequest, errors.New("no expr parameter provided"))
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	formatter, ok := dsInfo.promClient.(queryFormatter)
+	if !ok {
+		writeResourceError(rw, http.StatusInternalServerError, errors.New("the client of the datasource can't format queries"))
+		return
+	}
+
+	formatted, err := formatter.FormatQuery(req.Context(), expr)
+	if isNotFoundError(err) {
+		writeResourceResponse(rw, http.StatusOK, resourceResponse{
+			Status:   "success",
+			Data:     expr,
+			Warnings: []string{notSupportedWarning(req.Context(), dsInfo, "format_query")},
+		})
+		return
+	}
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: formatted})
+}
+
+// handleMetadata returns the type, help and unit of metrics by their name.
+// The optional metric query parameter limits the result to a single metric.
+func (s *Service) handleMetadata(rw http.ResponseWriter, req *http.Request) {
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	metadata, err := fetchMetadata(req.Context(), dsInfo, req.URL.Query().Get("metric"))
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+	if len(dsInfo.AllowedMetricPrefixes) > 0 {
+		metadata = filterMetadata(metadata, dsInfo.AllowedMetricPrefixes)
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: metadata})
+}
+
+// handleStatus returns a handler for the status endpoint of Prometheus, e.g. buildinfo, which fetch gets.
+// Older Prometheus versions without the endpoint return an empty object with a warning, instead of an error.
+func (s *Service) handleStatus(endpoint string, fetch func(ctx context.Context, dsInfo *DatasourceInfo) (interface{}, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+		if err != nil {
+			writeResourceError(rw, http.StatusInternalServerError, err)
+			return
+		}
+
+		status, err := fetchStatus(req.Context(), dsInfo, endpoint, func(ctx context.Context) (interface{}, error) {
+			return fetch(ctx, dsInfo)
+		})
+		if isNotFoundError(err) {
+			writeResourceResponse(rw, http.StatusOK, resourceResponse{
+				Status:   "success",
+				Data:     map[string]string{},
+				Warnings: []string{notSupportedWarning(req.Context(), dsInfo, endpoint)},
+			})
+			return
+		}
+		if err != nil {
+			writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+			return
+		}
+
+		writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: status})
+	}
+}
+
+// notSupportedWarning tells that Prometheus doesn't have the status endpoint, and which version it runs if the build
+// info endpoint tells it.
+func notSupportedWarning(ctx context.Context, dsInfo *DatasourceInfo, endpoint string) string {
+	if endpoint != "buildinfo" {
+		buildInfo, err := fetchStatus(ctx, dsInfo, "buildinfo", func(ctx context.Context) (interface{}, error) {
+			return dsInfo.promClient.Buildinfo(ctx)
+		})
+		if info, ok := buildInfo.(apiv1.BuildinfoResult); ok && err == nil && info.Version != "" {
+			return fmt.Sprintf("the %s endpoint is not supported by Prometheus %s", endpoint, info.Version)
+		}
+	}
+	return fmt.Sprintf("the %s endpoint is not supported by this Prometheus version", endpoint)
+}
+
+// handleRules returns the rule groups of Prometheus.
+// The optional type query parameter, alert or record, limits the result to one kind of rules.
+func (s *Service) handleRules(rw http.ResponseWriter, req *http.Request) {
+	ruleType := req.URL.Query().Get("type")
+	if ruleType != "" && ruleType != alertingRuleType && ruleType != recordingRuleType {
+		writeResourceError(rw, http.StatusBadRequest, fmt.Errorf("invalid rule type %q, must be %s or %s", ruleType, alertingRuleType, recordingRuleType))
+		return
+	}
+
+	dsInfo, err := s.getDSInfo(httpadapter.PluginConfigFromContext(req.Context()))
+	if err != nil {
+		writeResourceError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	res, err := dsInfo.promClient.Rules(req.Context())
+	if err != nil {
+		writeResourceError(rw, http.StatusBadGateway, ConvertAPIError(err))
+		return
+	}
+
+	groups := make([]ruleGroup, 0, len(res.Groups))
+	for _, g := range res.Groups {
+		group := ruleGroup{Name: g.Name, File: g.File, Interval: g.Interval, Rules: []rule{}}
+		for _, r := range g.Rules {
+			var converted rule
+			switch v := r.(type) {
+			case apiv1.AlertingRule:
+				converted = rule{
+					Type:        alertingRuleType,
+					Name:        v.Name,
+					Query:       v.Query,
+					Labels:      labelSetToMap(v.Labels),
+					Annotations: labelSetToMap(v.Annotations),
+					Duration:    v.Duration,
+					State:       v.State,
+					Health:      string(v.Health),
+					LastError:   v.LastError,
+				}
+			case apiv1.RecordingRule:
+				converted = rule{
+					Type:      recordingRuleType,
+					Name:      v.Name,
+					Query:     v.Query,
+					Labels:    labelSetToMap(v.Labels),
+					Health:    string(v.Health),
+					LastError: v.LastError,
+				}
+			default:
+				continue
+			}
+			if ruleType == "" || converted.Type == ruleType {
+				group.Rules = append(group.Rules, converted)
+			}
+		}
+		if len(group.Rules) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	writeResourceResponse(rw, http.StatusOK, resourceResponse{Status: "success", Data: groups})
+}
+
+func labelSetToMap(labels model.LabelSet) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(labels))
+	for k, v := range labels {
+		m[string(k)] = string(v)
+	}
+	return m
+}
+
+// parsePaginationParams reads the optional limit and offset query parameters, zero if they aren't set.
+func parsePaginationParams(req *http.Request) (int, int, error) {
+	limit, offset := 0, 0
+	if limitParam := req.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit parameter %q, it must be a positive integer", limitParam)
+		}
+	}
+	if offsetParam := req.URL.Query().Get("offset"); offsetParam != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset parameter %q, it must be a non-negative integer", offsetParam)
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseTimeRangeParams reads the optional start and end query parameters.
+// Both Unix timestamps and RFC3339 are accepted, same as in the Prometheus HTTP API.
+func parseTimeRangeParams(req *http.Request) (time.Time, time.Time, error) {
+	start, err := parseTimeParam(req.URL.Query().Get("start"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start parameter: %w", err)
+	}
+
+	end, err := parseTimeParam(req.URL.Query().Get("end"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end parameter: %w", err)
+	}
+
+	return start, end, nil
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if ts, err := strconv.ParseFloat(value, 64); err == nil {
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+func writeResourceError(rw http.ResponseWriter, code int, err error) {
+	writeResourceResponse(rw, code, resourceResponse{Status: "error", Error: err.Error()})
+}
+
+func writeResourceResponse(rw http.ResponseWriter, code int, res resourceResponse) {
+	body, err := json.Marshal(res)
+	if err != nil {
+		plog.Error("Failed to marshal resource response", "error", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if _, err := rw.Write(body); err != nil {
+		plog.Error("Failed to write resource response", "error", err)
+	}
+}
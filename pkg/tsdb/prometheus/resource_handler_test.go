@@ -0,0 +1,605 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_resourceHandler(t *testing.T) {
+	t.Run("label names should be proxied with time range and matchers", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			require.NoError(t, req.ParseForm())
+			_, _ = rw.Write([]byte(`{"status":"success","data":["__name__","job"]}`))
+		})
+
+		res := callResource(t, service, "api/v1/labels?start=1600000000&end=1600003600&match[]=up")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "/api/v1/labels", received.URL.Path)
+		require.Equal(t, "1600000000", received.Form.Get("start"))
+		require.Equal(t, "1600003600", received.Form.Get("end"))
+		require.Equal(t, []string{"up"}, received.Form["match[]"])
+
+		body := resourceResponse{}
+		require.NoError(t, json.Unmarshal(res.Body, &body))
+		require.Equal(t, "success", body.Status)
+		require.Equal(t, []interface{}{"__name__", "job"}, body.Data)
+	})
+
+	t.Run("label values should be proxied", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			_, _ = rw.Write([]byte(`{"status":"success","data":["grafana","prometheus"]}`))
+		})
+
+		res := callResource(t, service, "api/v1/label/job/values")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "/api/v1/label/job/values", received.URL.Path)
+		require.JSONEq(t, `{"status":"success","data":["grafana","prometheus"]}`, string(res.Body))
+	})
+
+	t.Run("metadata should be returned by metric name and cached", func(t *testing.T) {
+		requests := 0
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			received = req
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"up":[{"type":"gauge","help":"Whether the target is up.","unit":""}]}}`))
+		})
+
+		for i := 0; i < 2; i++ {
+			res := callResource(t, service, "metadata?metric=up")
+			require.Equal(t, http.StatusOK, res.Status)
+			require.JSONEq(t, `{"status":"success","data":{"up":{"type":"gauge","help":"Whether the target is up.","unit":""}}}`, string(res.Body))
+		}
+		require.Equal(t, 1, requests)
+		require.Equal(t, "/api/v1/metadata", received.URL.Path)
+		require.Equal(t, "up", received.URL.Query().Get("metric"))
+
+		res := callResource(t, service, "metadata")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, 2, requests)
+		require.Empty(t, received.URL.Query().Get("metric"))
+	})
+
+	t.Run("series should be proxied with time range and matchers", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			require.NoError(t, req.ParseForm())
+			_, _ = rw.Write([]byte(`{"status":"success","data":[{"__name__":"up","job":"grafana"},{"__name__":"up","job":"prometheus"}]}`))
+		})
+
+		res := callResource(t, service, "series?start=1600000000&end=1600003600&match[]=up&match[]=go_goroutines")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "/api/v1/series", received.URL.Path)
+		require.Equal(t, "1600000000", received.Form.Get("start"))
+		require.Equal(t, "1600003600", received.Form.Get("end"))
+		require.Equal(t, []string{"up", "go_goroutines"}, received.Form["match[]"])
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"up","job":"grafana"},{"__name__":"up","job":"prometheus"}]}`, string(res.Body))
+	})
+
+	t.Run("series without time range should be requested for the last hour", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			require.NoError(t, req.ParseForm())
+			_, _ = rw.Write([]byte(`{"status":"success","data":[]}`))
+		})
+
+		res := callResource(t, service, "series?match[]=up")
+		require.Equal(t, http.StatusOK, res.Status)
+
+		start, err := strconv.ParseFloat(received.Form.Get("start"), 64)
+		require.NoError(t, err)
+		end, err := strconv.ParseFloat(received.Form.Get("end"), 64)
+		require.NoError(t, err)
+		require.InDelta(t, float64(time.Now().Unix()), end, 5)
+		require.InDelta(t, defaultSeriesTimeRange.Seconds(), end-start, 1)
+	})
+
+	t.Run("series should be paginated with limit and offset", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":[{"__name__":"up","job":"c"},{"__name__":"up","job":"a"},{"__name__":"up","job":"b"}]}`))
+		})
+
+		res := callResource(t, service, "series?match[]=up&limit=2")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"up","job":"a"},{"__name__":"up","job":"b"}],"hasMore":true}`, string(res.Body))
+
+		res = callResource(t, service, "series?match[]=up&limit=2&offset=2")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"up","job":"c"}]}`, string(res.Body))
+
+		res = callResource(t, service, "series?match[]=up&offset=5")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":[]}`, string(res.Body))
+
+		for _, params := range []string{"limit=0", "limit=many", "offset=-1"} {
+			res = callResource(t, service, "series?match[]=up&"+params)
+			require.Equal(t, http.StatusBadRequest, res.Status, params)
+		}
+	})
+
+	t.Run("series without matchers should return bad request", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		res := callResource(t, service, "series")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("metric names should be searched and cached", func(t *testing.T) {
+		requests := 0
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			require.Equal(t, "/api/v1/label/__name__/values", req.URL.Path)
+			_, _ = rw.Write([]byte(`{"status":"success","data":["go_goroutines","http_requests_total","prometheus_http_requests_total","up"]}`))
+		})
+
+		res := callResource(t, service, "metrics?search=http&limit=1")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"metrics":["http_requests_total"],"total":2,"truncated":true}}`, string(res.Body))
+
+		res = callResource(t, service, "metrics?search=gorout")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"metrics":["go_goroutines"],"total":1,"truncated":false}}`, string(res.Body))
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("metric names with invalid limit should return bad request", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		res := callResource(t, service, "metrics?limit=0")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("build info and flags should be returned and cached", func(t *testing.T) {
+		requests := map[string]int{}
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			requests[req.URL.Path]++
+			switch req.URL.Path {
+			case "/api/v1/status/buildinfo":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.32.1","revision":"41f1a8125e664985dd30674e5bdf6b683eff5d32","branch":"HEAD","buildUser":"root@54b6dbd48b97","buildDate":"20211217-22:08:06","goVersion":"go1.17.5"}}`))
+			case "/api/v1/status/flags":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"storage.tsdb.retention.time":"15d"}}`))
+			}
+		})
+
+		for i := 0; i < 2; i++ {
+			res := callResource(t, service, "buildinfo")
+			require.Equal(t, http.StatusOK, res.Status)
+			require.JSONEq(t, `{"status":"success","data":{"version":"2.32.1","revision":"41f1a8125e664985dd30674e5bdf6b683eff5d32","branch":"HEAD","buildUser":"root@54b6dbd48b97","buildDate":"20211217-22:08:06","goVersion":"go1.17.5"}}`, string(res.Body))
+
+			res = callResource(t, service, "flags")
+			require.Equal(t, http.StatusOK, res.Status)
+			require.JSONEq(t, `{"status":"success","data":{"storage.tsdb.retention.time":"15d"}}`, string(res.Body))
+		}
+		require.Equal(t, map[string]int{"/api/v1/status/buildinfo": 1, "/api/v1/status/flags": 1}, requests)
+	})
+
+	t.Run("build info of Prometheus without the endpoint should be empty", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusNotFound)
+			_, _ = rw.Write([]byte(`404 page not found`))
+		})
+
+		res := callResource(t, service, "buildinfo")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{},"warnings":["the buildinfo endpoint is not supported by this Prometheus version"]}`, string(res.Body))
+	})
+
+	t.Run("TSDB status should be returned and cached", func(t *testing.T) {
+		requests := 0
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			requests++
+			require.Equal(t, "/api/v1/status/tsdb", req.URL.Path)
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"seriesCountByMetricName":[{"name":"http_requests_total","value":1200}],
+				"labelValueCountByLabelName":[{"name":"path","value":800}],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[]}}`))
+		})
+
+		for i := 0; i < 2; i++ {
+			res := callResource(t, service, "tsdb-status")
+			require.Equal(t, http.StatusOK, res.Status)
+			require.JSONEq(t, `{"status":"success","data":{"seriesCountByMetricName":[{"name":"http_requests_total","value":1200}],
+				"labelValueCountByLabelName":[{"name":"path","value":800}],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[]}}`, string(res.Body))
+		}
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("TSDB status should only tell the statistics of allowed metrics", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"seriesCountByMetricName":[{"name":"app_requests_total","value":1200},{"name":"node_cpu_seconds_total","value":300}],
+				"labelValueCountByLabelName":[],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[{"name":"__name__=node_cpu_seconds_total","value":300}]}}`))
+		})
+		dsInfo.AllowedMetricPrefixes = []string{"app_"}
+
+		res := callResource(t, newTestServiceWithDSInfo(dsInfo), "tsdb-status")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"seriesCountByMetricName":[{"name":"app_requests_total","value":1200}],
+			"labelValueCountByLabelName":[],"memoryInBytesByLabelName":[],"seriesCountByLabelValuePair":[]}}`, string(res.Body))
+	})
+
+	t.Run("metrics lookups should only tell the allowed metrics", func(t *testing.T) {
+		var received []string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = append(received, req.URL.Path)
+			switch req.URL.Path {
+			case "/api/v1/label/__name__/values":
+				_, _ = rw.Write([]byte(`{"status":"success","data":["app_requests_total","node_cpu_seconds_total"]}`))
+			case "/api/v1/label/job/values":
+				_, _ = rw.Write([]byte(`{"status":"success","data":["api"]}`))
+			case "/api/v1/series":
+				_, _ = rw.Write([]byte(`{"status":"success","data":[{"__name__":"app_requests_total","job":"api"},{"__name__":"node_cpu_seconds_total","job":"node"}]}`))
+			case "/api/v1/metadata":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"app_requests_total":[{"type":"counter","help":"Requests.","unit":""}],"node_cpu_seconds_total":[{"type":"counter","help":"CPU.","unit":""}]}}`))
+			default:
+				_, _ = rw.Write([]byte(`{"status":"success","data":["job"]}`))
+			}
+		})
+		dsInfo.AllowedMetricPrefixes = []string{"app_"}
+		service := newTestServiceWithDSInfo(dsInfo)
+
+		res := callResource(t, service, "api/v1/label/__name__/values")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":["app_requests_total"]}`, string(res.Body))
+
+		res = sendResource(t, service, http.MethodPost, "labels/batch", []byte(`{"labels": ["__name__", "job"], "match": ["app_requests_total"]}`))
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"__name__":["app_requests_total"],"job":["api"]}}`, string(res.Body))
+
+		res = callResource(t, service, "series?match[]=app_requests_total")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":[{"__name__":"app_requests_total","job":"api"}]}`, string(res.Body))
+
+		res = callResource(t, service, "metadata")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"app_requests_total":{"type":"counter","help":"Requests.","unit":""}}}`, string(res.Body))
+
+		res = callResource(t, service, "metrics")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{"metrics":["app_requests_total"],"total":1,"truncated":false}}`, string(res.Body))
+
+		// Selectors of metrics which are not allowed are rejected before being sent
+		received = nil
+		for _, path := range []string{"api/v1/labels?match[]=node_cpu_seconds_total", "api/v1/label/job/values?match[]=node_cpu_seconds_total", "series?match[]=" + url.QueryEscape(`{job="node"}`)} {
+			res = callResource(t, service, path)
+			require.Equal(t, http.StatusForbidden, res.Status, path)
+		}
+		res = sendResource(t, service, http.MethodPost, "labels/batch", []byte(`{"labels": ["job"], "match": ["node_cpu_seconds_total"]}`))
+		require.Equal(t, http.StatusForbidden, res.Status)
+		require.Empty(t, received)
+	})
+
+	t.Run("TSDB status of Prometheus without the endpoint should tell its version", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/status/buildinfo" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.14.0"}}`))
+				return
+			}
+			rw.WriteHeader(http.StatusNotFound)
+		})
+
+		res := callResource(t, service, "tsdb-status")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":{},"warnings":["the tsdb endpoint is not supported by Prometheus 2.14.0"]}`, string(res.Body))
+	})
+
+	t.Run("rules should be returned by group and filtered by type", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"groups":[
+				{"name":"api","file":"api.yml","interval":60,"rules":[
+					{"type":"recording","name":"job:up:sum","query":"sum by (job) (up)","health":"ok"},
+					{"type":"alerting","name":"ApiDown","query":"up == 0","duration":300,"labels":{"severity":"page"},"annotations":{"summary":"API is down"},"alerts":[],"health":"ok","state":"firing"}
+				]},
+				{"name":"recorded","file":"rec.yml","interval":30,"rules":[
+					{"type":"recording","name":"job:requests:rate5m","query":"sum by (job) (rate(requests_total[5m]))","health":"err","lastError":"oops"}
+				]}
+			]}}`))
+		})
+
+		res := callResource(t, service, "rules")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "/api/v1/rules", received.URL.Path)
+		require.JSONEq(t, `{"status":"success","data":[
+			{"name":"api","file":"api.yml","interval":60,"rules":[
+				{"type":"record","name":"job:up:sum","query":"sum by (job) (up)","health":"ok"},
+				{"type":"alert","name":"ApiDown","query":"up == 0","duration":300,"labels":{"severity":"page"},"annotations":{"summary":"API is down"},"health":"ok","state":"firing"}
+			]},
+			{"name":"recorded","file":"rec.yml","interval":30,"rules":[
+				{"type":"record","name":"job:requests:rate5m","query":"sum by (job) (rate(requests_total[5m]))","health":"err","lastError":"oops"}
+			]}
+		]}`, string(res.Body))
+
+		res = callResource(t, service, "rules?type=alert")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":[
+			{"name":"api","file":"api.yml","interval":60,"rules":[
+				{"type":"alert","name":"ApiDown","query":"up == 0","duration":300,"labels":{"severity":"page"},"annotations":{"summary":"API is down"},"health":"ok","state":"firing"}
+			]}
+		]}`, string(res.Body))
+	})
+
+	t.Run("invalid rule type should return bad request", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		res := callResource(t, service, "rules?type=all")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("query should return the result as returned by Prometheus", func(t *testing.T) {
+		var received *http.Request
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			received = req
+			require.NoError(t, req.ParseForm())
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"grafana"},"value":[1600000000,"1"]}]}}`))
+		})
+
+		res := callResource(t, service, "query?expr=up&time=1600000000")
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "/api/v1/query", received.URL.Path)
+		require.Equal(t, "up", received.Form.Get("query"))
+		require.Equal(t, "1600000000", received.Form.Get("time"))
+		require.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"grafana"},"value":[1600000000,"1"]}]}}`, string(res.Body))
+	})
+
+	t.Run("query should reject anything but PromQL and metrics which are not allowed", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+		dsInfo.AllowedMetricPrefixes = []string{"node_"}
+		service := newTestServiceWithDSInfo(dsInfo)
+
+		for _, url := range []string{"query", "query?expr=" + url.QueryEscape("/api/v1/admin/tsdb/delete_series"), "query?expr=node_load1&time=yesterday"} {
+			res := callResource(t, service, url)
+			require.Equal(t, http.StatusBadRequest, res.Status, url)
+		}
+
+		res := callResource(t, service, "query?expr=up")
+		require.Equal(t, http.StatusForbidden, res.Status)
+		require.Contains(t, string(res.Body), `the metric \"up\" is not allowed`)
+	})
+
+	t.Run("metrics lookup should be rejected if disabled", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"groups":[]}}`))
+		})
+		dsInfo.DisableMetricsLookup = true
+		service := newTestServiceWithDSInfo(dsInfo)
+
+		for _, url := range []string{"api/v1/labels", "api/v1/label/job/values", "metadata", "series?match[]=up", "query?expr=up"} {
+			res := callResource(t, service, url)
+			require.Equal(t, http.StatusForbidden, res.Status)
+			require.Contains(t, string(res.Body), "metrics lookup is disabled")
+		}
+
+		res := callResource(t, service, "rules")
+		require.Equal(t, http.StatusOK, res.Status)
+	})
+
+	t.Run("invalid time range should return bad request", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		res := callResource(t, service, "api/v1/labels?start=yesterday")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("Prometheus errors should be returned", func(t *testing.T) {
+		service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"invalid matcher"}`))
+		})
+
+		res := callResource(t, service, "api/v1/label/job/values?match[]={")
+		require.Equal(t, http.StatusBadGateway, res.Status)
+		require.Contains(t, string(res.Body), "invalid matcher")
+	})
+}
+
+type fakeSender struct {
+	response *backend.CallResourceResponse
+}
+
+func (s *fakeSender) Send(res *backend.CallResourceResponse) error {
+	s.response = res
+	return nil
+}
+
+func newTestService(t *testing.T, handler http.HandlerFunc) *Service {
+	t.Helper()
+
+	return newTestServiceWithDSInfo(newTestDSInfo(t, handler))
+}
+
+func newTestServiceWithDSInfo(dsInfo *DatasourceInfo) *Service {
+	return &Service{
+		intervalCalculator: intervalv2.NewCalculator(),
+		im: datasource.NewInstanceManager(func(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			return *dsInfo, nil
+		}),
+	}
+}
+
+func callResource(t *testing.T, s *Service, url string) *backend.CallResourceResponse {
+	t.Helper()
+
+	return sendResource(t, s, http.MethodGet, url, nil)
+}
+
+func sendResource(t *testing.T, s *Service, method string, url string, body []byte) *backend.CallResourceResponse {
+	t.Helper()
+
+	path := strings.SplitN(url, "?", 2)[0]
+
+	sender := &fakeSender{}
+	err := httpadapter.New(s.newResourceMux()).CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1},
+		},
+		Path:   path,
+		Method: method,
+		URL:    url,
+		Body:   body,
+	}, sender)
+	require.NoError(t, err)
+	require.NotNil(t, sender.response)
+
+	return sender.response
+}
+
+func TestPrometheus_labelValuesBatch(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	service := newTestService(t, func(rw http.ResponseWriter, req *http.Request) {
+		require.NoError(t, req.ParseForm())
+		mu.Lock()
+		received = append(received, req)
+		mu.Unlock()
+
+		switch req.URL.Path {
+		case "/api/v1/label/job/values":
+			_, _ = rw.Write([]byte(`{"status":"success","data":["grafana","prometheus"],"warnings":["partial response"]}`))
+		case "/api/v1/label/instance/values":
+			_, _ = rw.Write([]byte(`{"status":"success","data":["localhost:9090"],"warnings":["partial response"]}`))
+		case "/api/v1/label/missing/values":
+			_, _ = rw.Write([]byte(`{"status":"success","data":[]}`))
+		default:
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"invalid matcher"}`))
+		}
+	})
+
+	t.Run("values of all labels should be returned in a single response", func(t *testing.T) {
+		received = nil
+		res := sendResource(t, service, http.MethodPost, "labels/batch", []byte(`{
+			"labels": ["job", "instance", "missing", "job"],
+			"match": ["up"],
+			"start": "1600000000",
+			"end": "1600003600"
+		}`))
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{
+			"status": "success",
+			"data": {"job": ["grafana", "prometheus"], "instance": ["localhost:9090"], "missing": []},
+			"warnings": ["partial response"]
+		}`, string(res.Body))
+
+		// Labels are only looked up once, with the shared selectors and time range
+		require.Len(t, received, 3)
+		for _, req := range received {
+			require.Equal(t, []string{"up"}, req.Form["match[]"])
+			require.Equal(t, "1600000000", req.Form.Get("start"))
+			require.Equal(t, "1600003600", req.Form.Get("end"))
+		}
+	})
+
+	t.Run("failing lookups should fail the batch", func(t *testing.T) {
+		res := sendResource(t, service, http.MethodPost, "labels/batch", []byte(`{"labels": ["job", "broken"]}`))
+		require.Equal(t, http.StatusBadGateway, res.Status)
+		require.Contains(t, string(res.Body), "label broken: bad_data: invalid matcher")
+	})
+
+	t.Run("invalid batches should return bad request", func(t *testing.T) {
+		for _, body := range []string{`{`, `{"labels": []}`, `{"labels": [""]}`, `{"labels": ["../../admin/tsdb/snapshot"]}`, `{"labels": ["job?match[]=up"]}`, `{"labels": ["job"], "start": "yesterday"}`} {
+			res := sendResource(t, service, http.MethodPost, "labels/batch", []byte(body))
+			require.Equal(t, http.StatusBadRequest, res.Status, body)
+		}
+
+		labels := make([]string, maxBatchLabels+1)
+		for i := range labels {
+			labels[i] = fmt.Sprintf("label%d", i)
+		}
+		body, err := json.Marshal(labelValuesBatchRequest{Labels: labels})
+		require.NoError(t, err)
+		res := sendResource(t, service, http.MethodPost, "labels/batch", body)
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+
+	t.Run("batches should be sent with POST", func(t *testing.T) {
+		res := callResource(t, service, "labels/batch")
+		require.Equal(t, http.StatusMethodNotAllowed, res.Status)
+	})
+}
+
+func TestPrometheus_formatQuery(t *testing.T) {
+	newService := func(t *testing.T, handler http.HandlerFunc) *Service {
+		t.Helper()
+		dsInfo := newTestDSInfo(t, handler)
+		promClient, err := client.New(dsInfo.URL, http.DefaultTransport)
+		require.NoError(t, err)
+		dsInfo.promClient = promClient
+		return newTestServiceWithDSInfo(dsInfo)
+	}
+
+	t.Run("query should be formatted by Prometheus", func(t *testing.T) {
+		var received url.Values
+		service := newService(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			received = req.PostForm
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = rw.Write([]byte(`{"status":"success","data":"sum by (job) (up)"}`))
+		})
+
+		res := callResource(t, service, "format-query?expr="+url.QueryEscape("sum(up)by(job)"))
+		require.Equal(t, http.StatusOK, res.Status)
+		require.Equal(t, "sum(up)by(job)", received.Get("query"))
+		require.JSONEq(t, `{"status":"success","data":"sum by (job) (up)"}`, string(res.Body))
+	})
+
+	t.Run("query should be returned as is by Prometheus without the endpoint", func(t *testing.T) {
+		service := newService(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/status/buildinfo" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.37.0"}}`))
+				return
+			}
+			rw.WriteHeader(http.StatusNotFound)
+		})
+
+		res := callResource(t, service, "format-query?expr="+url.QueryEscape("sum(up)by(job)"))
+		require.Equal(t, http.StatusOK, res.Status)
+		require.JSONEq(t, `{"status":"success","data":"sum(up)by(job)","warnings":["the format_query endpoint is not supported by Prometheus 2.37.0"]}`, string(res.Body))
+	})
+
+	t.Run("invalid query should return the error of Prometheus", func(t *testing.T) {
+		service := newService(t, func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"1:6: parse error: unclosed left parenthesis"}`))
+		})
+
+		res := callResource(t, service, "format-query?expr="+url.QueryEscape("sum(up"))
+		require.Equal(t, http.StatusBadGateway, res.Status)
+	})
+
+	t.Run("missing expr should fail", func(t *testing.T) {
+		res := callResource(t, newService(t, nil), "format-query")
+		require.Equal(t, http.StatusBadRequest, res.Status)
+	})
+}
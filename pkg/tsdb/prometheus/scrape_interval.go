@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+)
+
+// inferScrapeInterval returns the most common interval between consecutive samples of the series of matrix, rounded
+// to the second to ignore the jitter of scrapes, or zero if no series has two samples. Gaps, e.g. of targets which were
+// down for a while, are rarer than the scrape interval and don't change the result. Ties go to the shorter interval.
+// Only the raw samples of range vector selectors tell the scrape interval, the ones of range queries are a step apart.
+func inferScrapeInterval(matrix model.Matrix) time.Duration {
+	counts := map[time.Duration]int{}
+	for _, series := range matrix {
+		for i := 1; i < len(series.Values); i++ {
+			delta := series.Values[i].Timestamp.Sub(series.Values[i-1].Timestamp).Round(time.Second)
+			if delta > 0 {
+				counts[delta]++
+			}
+		}
+	}
+
+	var interval time.Duration
+	for delta, count := range counts {
+		if count > counts[interval] || (count == counts[interval] && delta < interval) {
+			interval = delta
+		}
+	}
+	return interval
+}
+
+// setScrapeInterval records the inferred scrape interval in the custom metadata of frames, e.g. 15s or 1m30s.
+func setScrapeInterval(frames data.Frames, interval time.Duration) {
+	for _, frame := range frames {
+		if custom, ok := frame.Meta.Custom.(map[string]interface{}); ok {
+			custom["scrapeInterval"] = model.Duration(interval).String()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_inferScrapeInterval(t *testing.T) {
+	series := func(timestamps ...p.Time) *p.SampleStream {
+		stream := &p.SampleStream{Metric: p.Metric{"job": "node"}}
+		for _, ts := range timestamps {
+			stream.Values = append(stream.Values, p.SamplePair{Value: 1, Timestamp: ts})
+		}
+		return stream
+	}
+
+	t.Run("should return the most common interval, ignoring gaps and jitter", func(t *testing.T) {
+		matrix := p.Matrix{
+			series(0, 15000, 30010, 44990, 120000, 135000),
+			series(5000, 20000),
+		}
+		require.Equal(t, 15*time.Second, inferScrapeInterval(matrix))
+	})
+
+	t.Run("should return the shorter interval on a tie", func(t *testing.T) {
+		require.Equal(t, 30*time.Second, inferScrapeInterval(p.Matrix{series(0, 60000, 90000)}))
+	})
+
+	t.Run("should return zero without two samples in a series", func(t *testing.T) {
+		require.Zero(t, inferScrapeInterval(p.Matrix{series(0), series(1000)}))
+		require.Zero(t, inferScrapeInterval(p.Matrix{}))
+	})
+
+	t.Run("should be recorded in the metadata of instant query frames", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			InstantQueryType: p.Matrix{series(0, 90000, 180000)},
+		}
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{InferScrapeInterval: true})
+		require.NoError(t, err)
+		require.Equal(t, "1m30s", res[0].Meta.Custom.(map[string]interface{})["scrapeInterval"])
+
+		// Samples of range queries are a step apart
+		value = map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{series(0, 90000, 180000)},
+		}
+		res, err = parseTimeSeriesResponse(value, &PrometheusQuery{InferScrapeInterval: true})
+		require.NoError(t, err)
+		require.NotContains(t, res[0].Meta.Custom, "scrapeInterval")
+	})
+}
@@ -0,0 +1,71 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/infra/httpclient/httpclientprovider"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_sigV4(t *testing.T) {
+	var authorizations []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v1/query_range" {
+			authorizations = append(authorizations, req.Header.Get("Authorization"))
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	// The provider of Grafana adds the signing middleware only if SigV4 authentication is enabled in its configuration
+	provider := httpclient.NewProvider(sdkhttpclient.ProviderOptions{
+		Middlewares: []sdkhttpclient.Middleware{httpclientprovider.SigV4Middleware()},
+	})
+	newDSInfo := func(t *testing.T, jsonData string) *DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(setting.NewCfg(), provider)(backend.DataSourceInstanceSettings{
+			ID:       1,
+			URL:      srv.URL,
+			JSONData: []byte(jsonData),
+			DecryptedSecureJSONData: map[string]string{
+				"sigV4AccessKey": "AKIDEXAMPLE",
+				"sigV4SecretKey": "secret",
+			},
+		})
+		require.NoError(t, err)
+		dsInfo := instance.(DatasourceInfo)
+		return &dsInfo
+	}
+
+	run := func(t *testing.T, dsInfo *DatasourceInfo) {
+		t.Helper()
+		req := queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()})
+		_, err := newTestServiceWithDSInfo(dsInfo).executeTimeSeriesQuery(context.Background(), req, dsInfo)
+		require.NoError(t, err)
+	}
+
+	t.Run("queries should be signed for the aps service of the region", func(t *testing.T) {
+		authorizations = nil
+		dsInfo := newDSInfo(t, `{"sigV4Auth": true, "sigV4AuthType": "keys", "sigV4Region": "eu-west-1"}`)
+
+		run(t, dsInfo)
+		require.Len(t, authorizations, 1)
+		require.Regexp(t, `^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/\d{8}/eu-west-1/aps/aws4_request, SignedHeaders=\S+, Signature=[0-9a-f]{64}$`, authorizations[0])
+	})
+
+	t.Run("queries should not be signed if SigV4 authentication is disabled", func(t *testing.T) {
+		authorizations = nil
+		dsInfo := newDSInfo(t, `{"sigV4Region": "eu-west-1"}`)
+
+		run(t, dsInfo)
+		require.Equal(t, []string{""}, authorizations)
+	})
+}
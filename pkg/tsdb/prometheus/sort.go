@@ -0,0 +1,119 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+)
+
+// seriesSort orders the series of a query result by the value of a label or by their latest value
+type seriesSort struct {
+	// label is the label series are sorted by, in ascending order of its values, if they aren't sorted by value
+	label string
+	// byValue sorts series by their latest non-null value, in descending order if desc is set
+	byValue bool
+	desc    bool
+}
+
+// parseSortBy parses the sortBy option of a query, which is label:<name>, value:asc or value:desc.
+// An empty option doesn't sort the series, which keep the order of Prometheus.
+func parseSortBy(sortBy string) (*seriesSort, error) {
+	if sortBy == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(sortBy, ":", 2)
+	switch {
+	case len(parts) == 2 && parts[0] == "label" && model.LabelName(parts[1]).IsValid():
+		return &seriesSort{label: parts[1]}, nil
+	case len(parts) == 2 && parts[0] == "value" && (parts[1] == "asc" || parts[1] == "desc"):
+		return &seriesSort{byValue: true, desc: parts[1] == "desc"}, nil
+	}
+	return nil, fmt.Errorf("invalid sort %q, it must be label:<name>, value:asc or value:desc", sortBy)
+}
+
+// MarshalJSON encodes the sort as its sortBy option, so that queries sorted differently don't have the same key.
+func (s seriesSort) MarshalJSON() ([]byte, error) {
+	switch {
+	case s.byValue && s.desc:
+		return json.Marshal("value:desc")
+	case s.byValue:
+		return json.Marshal("value:asc")
+	}
+	return json.Marshal("label:" + s.label)
+}
+
+// sortFrames orders the frames of series, each with its values in the second field. The sort is stable, and series
+// sorting the same are ordered by their metric, e.g. up{instance="a"}, so that the order doesn't change from one run
+// of the query to the next. Series without the label, or without a value, sort last.
+func sortFrames(frames data.Frames, s *seriesSort) {
+	if s == nil {
+		return
+	}
+
+	type sortKey struct {
+		metric string
+		label  string
+		hasKey bool
+		value  float64
+	}
+	keys := make(map[*data.Frame]sortKey, len(frames))
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 {
+			keys[frame] = sortKey{}
+			continue
+		}
+		field := frame.Fields[1]
+		key := sortKey{metric: metricString(field.Labels)}
+		if s.byValue {
+			key.value, key.hasKey = latestValue(field)
+		} else {
+			key.label, key.hasKey = field.Labels[s.label]
+		}
+		keys[frame] = key
+	}
+
+	sort.SliceStable(frames, func(i, j int) bool {
+		a, b := keys[frames[i]], keys[frames[j]]
+		if a.hasKey != b.hasKey {
+			return a.hasKey
+		}
+		if a.hasKey {
+			switch {
+			case s.byValue && a.value != b.value:
+				return a.value < b.value != s.desc
+			case !s.byValue && a.label != b.label:
+				return a.label < b.label
+			}
+		}
+		return a.metric < b.metric
+	})
+}
+
+// metricString formats labels like Prometheus formats a metric, with the labels ordered by name.
+func metricString(labels data.Labels) string {
+	metric := make(model.Metric, len(labels))
+	for k, v := range labels {
+		metric[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return metric.String()
+}
+
+// latestValue returns the last value of field which is a number, skipping nulls and NaN.
+func latestValue(field *data.Field) (float64, bool) {
+	for i := field.Len() - 1; i >= 0; i-- {
+		value, ok := field.ConcreteAt(i)
+		if !ok {
+			continue
+		}
+		if v, ok := value.(float64); ok && !math.IsNaN(v) {
+			return v, true
+		}
+	}
+	return 0, false
+}
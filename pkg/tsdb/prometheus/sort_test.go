@@ -0,0 +1,113 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_parseSortBy(t *testing.T) {
+	sortBy, err := parseSortBy("")
+	require.NoError(t, err)
+	require.Nil(t, sortBy)
+
+	sortBy, err = parseSortBy("label:instance")
+	require.NoError(t, err)
+	require.Equal(t, &seriesSort{label: "instance"}, sortBy)
+
+	sortBy, err = parseSortBy("value:desc")
+	require.NoError(t, err)
+	require.Equal(t, &seriesSort{byValue: true, desc: true}, sortBy)
+
+	sortBy, err = parseSortBy("value:asc")
+	require.NoError(t, err)
+	require.Equal(t, &seriesSort{byValue: true}, sortBy)
+
+	for _, invalid := range []string{"instance", "label:", "label:host-name", "value:latest", "name:asc"} {
+		_, err = parseSortBy(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestPrometheus_sortFrames(t *testing.T) {
+	series := func(metric p.Metric, values ...p.SampleValue) *p.SampleStream {
+		stream := &p.SampleStream{Metric: metric}
+		for i, v := range values {
+			stream.Values = append(stream.Values, p.SamplePair{Value: v, Timestamp: p.Time(1000 * (i + 1))})
+		}
+		return stream
+	}
+	matrix := p.Matrix{
+		series(p.Metric{"__name__": "up", "instance": "c", "job": "api"}, 5, 1),
+		series(p.Metric{"__name__": "up", "instance": "a", "job": "db"}, 3),
+		series(p.Metric{"__name__": "up", "job": "cron"}, 7, p.SampleValue(math.NaN())),
+		series(p.Metric{"__name__": "up", "instance": "a", "job": "api"}, 3),
+		series(p.Metric{"__name__": "up", "instance": "b", "job": "api"}, p.SampleValue(math.NaN())),
+	}
+	names := func(t *testing.T, sortBy string) []string {
+		t.Helper()
+		s, err := parseSortBy(sortBy)
+		require.NoError(t, err)
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{RangeQueryType: matrix}, &PrometheusQuery{Expr: "up", SortBy: s})
+		require.NoError(t, err)
+		var names []string
+		for _, frame := range res {
+			names = append(names, frame.Name)
+		}
+		return names
+	}
+
+	t.Run("without sort should keep the order of Prometheus", func(t *testing.T) {
+		require.Equal(t, []string{
+			`up{instance="c", job="api"}`,
+			`up{instance="a", job="db"}`,
+			`up{job="cron"}`,
+			`up{instance="a", job="api"}`,
+			`up{instance="b", job="api"}`,
+		}, names(t, ""))
+	})
+
+	t.Run("sorting by label should order series by the label and then by their metric", func(t *testing.T) {
+		require.Equal(t, []string{
+			`up{instance="a", job="api"}`,
+			`up{instance="a", job="db"}`,
+			`up{instance="b", job="api"}`,
+			`up{instance="c", job="api"}`,
+			`up{job="cron"}`,
+		}, names(t, "label:instance"))
+	})
+
+	t.Run("sorting by value should order series by their latest value and then by their metric", func(t *testing.T) {
+		require.Equal(t, []string{
+			`up{job="cron"}`,
+			`up{instance="a", job="api"}`,
+			`up{instance="a", job="db"}`,
+			`up{instance="c", job="api"}`,
+			`up{instance="b", job="api"}`,
+		}, names(t, "value:desc"))
+
+		require.Equal(t, []string{
+			`up{instance="c", job="api"}`,
+			`up{instance="a", job="api"}`,
+			`up{instance="a", job="db"}`,
+			`up{job="cron"}`,
+			`up{instance="b", job="api"}`,
+		}, names(t, "value:asc"))
+	})
+
+	t.Run("sorting should apply to instant query results", func(t *testing.T) {
+		s, err := parseSortBy("value:desc")
+		require.NoError(t, err)
+		vector := p.Vector{
+			{Metric: p.Metric{"__name__": "up", "instance": "a"}, Value: 1},
+			{Metric: p.Metric{"__name__": "up", "instance": "b"}, Value: 2},
+		}
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{InstantQueryType: vector}, &PrometheusQuery{Expr: "up", SortBy: s})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		require.Equal(t, `up{instance="b"}`, res[0].Name)
+		require.Equal(t, `up{instance="a"}`, res[1].Name)
+	})
+}
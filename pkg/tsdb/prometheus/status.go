@@ -0,0 +1,35 @@
+package prometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+)
+
+// statusCacheTTL is how long the build information and flags of Prometheus are cached, they only change on restarts
+const statusCacheTTL = 5 * time.Minute
+
+// statusCacheTTLs are the shorter TTLs of status endpoints whose responses change while Prometheus runs,
+// e.g. the cardinality statistics of tsdb change with the ingested series
+var statusCacheTTLs = map[string]time.Duration{
+	"tsdb": time.Minute,
+}
+
+// fetchStatus returns the response of the status endpoint from the cache, or calls fetch to get it from Prometheus.
+// Tenants of multi-tenant backends may run on different configurations, and users whose token is forwarded may not be
+// allowed to see them, so they are cached separately.
+func fetchStatus(ctx context.Context, dsInfo *DatasourceInfo, endpoint string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	cacheKey := middleware.UserKey(ctx) + "\x00" + endpoint
+	if status, ok := dsInfo.statusCache.get(cacheKey); ok {
+		return status, nil
+	}
+
+	status, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dsInfo.statusCache.setWithTTL(cacheKey, status, statusCacheTTLs[endpoint])
+
+	return status, nil
+}
@@ -0,0 +1,93 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// TemplateVariable is the value of a dashboard template variable, sent with queries which are not interpolated by the
+// frontend, e.g. of alert rules. Text and value are either a string or a list of strings.
+type TemplateVariable struct {
+	Text  stringList `json:"text"`
+	Value stringList `json:"value"`
+	// Multi tells that several values can be selected, these are always formatted as a regex
+	Multi bool `json:"multi"`
+}
+
+// stringList decodes a JSON string or list of strings.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// templateVariableRegexp matches $var, ${var}, ${var.__text}, ${var.__value} and [[var]]
+var templateVariableRegexp = regexp.MustCompile(`\$(\w+)|\$\{(\w+)(?:\.(__text|__value))?\}|\[\[(\w+)\]\]`)
+
+// regexSpecialChars are escaped in the values of multi-value variables
+var regexSpecialChars = regexp.MustCompile(`[$^*{}\[\]'+?.()|]`)
+
+// interpolateTemplateVariables replaces the template variables of expr by their values, the way the Prometheus
+// datasource of the frontend does, so that queries interpolated by the backend match the same series:
+//   - a single value of a variable which isn't multi-value is only escaped for a PromQL string
+//   - the values of a multi-value variable are escaped for a regex and joined as (v1|v2|v3), to be used with =~ or !~
+//   - ${var.__text} is replaced by the texts of the values, joined with " + "
+//
+// Variables which aren't in variables, e.g. the built-in $__interval, are left as they are.
+func interpolateTemplateVariables(expr string, variables map[string]TemplateVariable) string {
+	if len(variables) == 0 {
+		return expr
+	}
+
+	return templateVariableRegexp.ReplaceAllStringFunc(expr, func(match string) string {
+		groups := templateVariableRegexp.FindStringSubmatch(match)
+		name := groups[1] + groups[2] + groups[4]
+		variable, ok := variables[name]
+		if !ok || strings.HasPrefix(name, "__") {
+			return match
+		}
+		if groups[3] == "__text" {
+			return strings.Join(variable.Text, " + ")
+		}
+		return formatTemplateVariable(variable)
+	})
+}
+
+func formatTemplateVariable(variable TemplateVariable) string {
+	if !variable.Multi && len(variable.Value) == 1 {
+		return prometheusRegularEscape(variable.Value[0])
+	}
+
+	escaped := make([]string, 0, len(variable.Value))
+	for _, value := range variable.Value {
+		escaped = append(escaped, prometheusSpecialRegexEscape(value))
+	}
+	if len(escaped) == 1 {
+		return escaped[0]
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+// prometheusRegularEscape escapes backslashes and single quotes of a value used in a PromQL string, like the frontend.
+func prometheusRegularEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, `'`, `\\'`)
+}
+
+// prometheusSpecialRegexEscape escapes the special characters of regexes, doubling the backslashes, so that the value
+// matches itself in a regex of a PromQL string.
+func prometheusSpecialRegexEscape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\\\`)
+	return regexSpecialChars.ReplaceAllString(value, `\\$0`)
+}
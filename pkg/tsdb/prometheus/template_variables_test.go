@@ -0,0 +1,59 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_interpolateTemplateVariables(t *testing.T) {
+	variables := map[string]TemplateVariable{
+		"job":      {Text: stringList{"API"}, Value: stringList{"api"}},
+		"jobs":     {Text: stringList{"API", "DB"}, Value: stringList{"api", "db"}, Multi: true},
+		"instance": {Text: stringList{"a.example.com:9090"}, Value: stringList{"a.example.com:9090"}, Multi: true},
+		"path":     {Text: stringList{`C:\data`}, Value: stringList{`C:\data`}},
+	}
+
+	tcs := []struct {
+		expr     string
+		expected string
+	}{
+		{expr: `up{job="$job"}`, expected: `up{job="api"}`},
+		{expr: `up{job=~"$jobs"}`, expected: `up{job=~"(api|db)"}`},
+		{expr: `up{job!~"${jobs}"}`, expected: `up{job!~"(api|db)"}`},
+		{expr: `up{job=~"[[jobs]]"}`, expected: `up{job=~"(api|db)"}`},
+		{expr: `up{instance=~"$instance"}`, expected: `up{instance=~"a\\.example\\.com:9090"}`},
+		{expr: `disk_free{path="$path"}`, expected: `disk_free{path="C:\\data"}`},
+		{expr: `label_replace(up, "name", "${jobs.__text}", "", "")`, expected: `label_replace(up, "name", "API + DB", "", "")`},
+		{expr: `up{job=~"${jobs.__value}"}`, expected: `up{job=~"(api|db)"}`},
+		// Unknown and built-in variables are interpolated later, if at all
+		{expr: `rate(up{job="$job", env="$env"}[$__interval])`, expected: `rate(up{job="api", env="$env"}[$__interval])`},
+	}
+	for _, tc := range tcs {
+		require.Equal(t, tc.expected, interpolateTemplateVariables(tc.expr, variables), tc.expr)
+	}
+}
+
+func TestPrometheus_templateVariablesQueryModel(t *testing.T) {
+	var model QueryModel
+	err := json.Unmarshal([]byte(`{"variables": {"job": {"text": "API", "value": "api"}, "jobs": {"text": ["All"], "value": ["api", "db"], "multi": true}}}`), &model)
+	require.NoError(t, err)
+	require.Equal(t, map[string]TemplateVariable{
+		"job":  {Text: stringList{"API"}, Value: stringList{"api"}},
+		"jobs": {Text: stringList{"All"}, Value: stringList{"api", "db"}, Multi: true},
+	}, model.Variables)
+
+	service := Service{intervalCalculator: intervalv2.NewCalculator()}
+	now := time.Now()
+	query := queryContext(`{
+		"expr": "sum by (job) (rate(http_requests_total{job=~\"$jobs\"}[$__interval]))",
+		"variables": {"jobs": {"text": ["API", "DB"], "value": ["api", "db"], "multi": true}}
+	}`, backend.TimeRange{From: now, To: now.Add(48 * time.Hour)})
+	models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+	require.NoError(t, err)
+	require.Equal(t, `sum by (job) (rate(http_requests_total{job=~"(api|db)"}[2m]))`, models[0].Expr)
+}
@@ -0,0 +1,30 @@
+package prometheus
+
+import (
+	"context"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+)
+
+// forwardedTenant returns the tenant in the tenant ID header of the datasource among the forwarded
+// headers of a request, or an empty string if it isn't set.
+func forwardedTenant(dsInfo *DatasourceInfo, headers map[string]string) string {
+	if dsInfo.TenantIDHeader == "" {
+		return ""
+	}
+	for name, value := range headers {
+		if strings.EqualFold(name, dsInfo.TenantIDHeader) {
+			return value
+		}
+	}
+	return ""
+}
+
+// withTenant returns a copy of ctx sending requests for tenant, or ctx itself if tenant is empty.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return middleware.WithTenant(ctx, tenant)
+}
@@ -0,0 +1,77 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_tenant(t *testing.T) {
+	var tenants []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		tenant := req.Header.Get("X-Scope-OrgID")
+		if req.URL.Path != "/api/v1/status/buildinfo" && req.URL.Path != "/api/v1/stores" {
+			tenants = append(tenants, tenant)
+		}
+		if req.URL.Path == "/api/v1/metadata" {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"up":[{"type":"gauge","help":"` + tenant + `","unit":""}]}}`))
+			return
+		}
+		_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{
+		ID:       1,
+		URL:      srv.URL,
+		JSONData: []byte(`{"tenantId": "team-a", "tenantIdHeader": "X-Grafana-Tenant"}`),
+	})
+	require.NoError(t, err)
+	dsInfo := instance.(DatasourceInfo)
+	s := newTestServiceWithDSInfo(&dsInfo)
+
+	t.Run("queries should be sent for the forwarded tenant or the tenant of the datasource", func(t *testing.T) {
+		tenants = nil
+		now := time.Now()
+		req := queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{From: now.Add(-time.Hour), To: now})
+
+		_, err := s.executeTimeSeriesQuery(context.Background(), req, &dsInfo)
+		require.NoError(t, err)
+
+		req.Headers = map[string]string{"x-grafana-tenant": "team-b"}
+		_, err = s.executeTimeSeriesQuery(context.Background(), req, &dsInfo)
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"team-a", "team-b"}, tenants)
+	})
+
+	t.Run("resources should be requested and cached for the forwarded tenant", func(t *testing.T) {
+		tenants = nil
+		call := func(tenant string) string {
+			sender := &fakeSender{}
+			err := httpadapter.New(s.newResourceMux()).CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1}},
+				Path:          "metadata",
+				Method:        http.MethodGet,
+				URL:           "/metadata",
+				Headers:       map[string][]string{"X-Grafana-Tenant": {tenant}},
+			}, sender)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, sender.response.Status)
+			return string(sender.response.Body)
+		}
+
+		require.Contains(t, call("team-b"), `"help":"team-b"`)
+		require.Contains(t, call("team-c"), `"help":"team-c"`)
+		require.Contains(t, call("team-b"), `"help":"team-b"`)
+		require.Equal(t, []string{"team-b", "team-c"}, tenants)
+	})
+}
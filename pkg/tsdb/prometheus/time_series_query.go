@@ -3,19 +3,27 @@ package prometheus
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"net/http"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
 	"github.com/opentracing/opentracing-go"
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
 )
 
 //Internal interval and range variables
@@ -39,6 +47,21 @@ const (
 	varRateIntervalAlt = "${__rate_interval}"
 )
 
+// Time range variables, interpolated to the start and end of the time range in epoch seconds, as the timestamps of
+// the @ modifier are, e.g. up @ $__to
+const (
+	varFrom    = "$__from"
+	varTo      = "$__to"
+	varFromAlt = "${__from}"
+	varToAlt   = "${__to}"
+)
+
+// stepModeAligned rounds the step up to a multiple of the scrape interval
+const stepModeAligned = "aligned"
+
+// rawResolution sets the step to the scrape interval, so that every sample of the series is returned
+const rawResolution = "raw"
+
 type TimeSeriesQueryType string
 
 const (
@@ -48,77 +71,522 @@ const (
 )
 
 func (s *Service) executeTimeSeriesQuery(ctx context.Context, req *backend.QueryDataRequest, dsInfo *DatasourceInfo) (*backend.QueryDataResponse, error) {
-	client := dsInfo.promClient
-
 	result := backend.QueryDataResponse{
 		Responses: backend.Responses{},
 	}
 
-	queries, err := s.parseTimeSeriesQuery(req, dsInfo)
-	if err != nil {
-		return &result, err
+	ctx = withTenant(ctx, forwardedTenant(dsInfo, req.Headers))
+	ctx = withForwardedOAuth(ctx, dsInfo, req.Headers)
+
+	// Backend specific parameters are added to all queries, unless they are set as custom query parameters
+	alerting := false
+	for _, q := range req.Queries {
+		if q.QueryType == alertQueryType {
+			alerting = true
+		}
+	}
+	if params := flavorQueryParameters(dsInfo.flavor.get(ctx, dsInfo.promClient), dsInfo.CustomQueryParameters, alerting); len(params) > 0 {
+		ctx = middleware.WithQueryParameters(ctx, params)
 	}
 
-	for _, query := range queries {
-		plog.Debug("Sending query", "start", query.Start, "end", query.End, "step", query.Step, "query", query.Expr)
+	ch := make(chan queryResult, len(req.Queries))
+	// Limits the number of queries sent to Prometheus at the same time
+	workers := make(chan struct{}, queryConcurrency)
+	var wg sync.WaitGroup
 
-		span, ctx := opentracing.StartSpanFromContext(ctx, "datasource.prometheus")
-		span.SetTag("expr", query.Expr)
-		span.SetTag("start_unixnano", query.Start.UnixNano())
-		span.SetTag("stop_unixnano", query.End.UnixNano())
-		defer span.Finish()
+	// Identical queries, e.g. of repeated panels, are run once and their response is shared
+	firstRefIDs := map[string]string{}
+	sharedRefIDs := map[string][]string{}
 
-		response := make(map[TimeSeriesQueryType]interface{})
+	for _, q := range req.Queries {
+		query, err := s.parseQuery(req, q, dsInfo)
+		if err != nil {
+			result.Responses[q.RefID] = backend.DataResponse{Error: newQueryError(ErrorSourceDownstream, ErrorStatusBadData, err)}
+			continue
+		}
 
-		timeRange := apiv1.Range{
-			Step: query.Step,
-			// Align query range to step. It rounds start and end down to a multiple of step.
-			Start: time.Unix(int64(math.Floor((float64(query.Start.Unix()+query.UtcOffsetSec)/query.Step.Seconds()))*query.Step.Seconds()-float64(query.UtcOffsetSec)), 0),
-			End:   time.Unix(int64(math.Floor((float64(query.End.Unix()+query.UtcOffsetSec)/query.Step.Seconds()))*query.Step.Seconds()-float64(query.UtcOffsetSec)), 0),
+		// Expressions are empty if e.g. they only consist of a template variable without value
+		if strings.TrimSpace(query.Expr) == "" {
+			result.Responses[q.RefID] = backend.DataResponse{Frames: data.Frames{emptyQueryFrame()}}
+			continue
 		}
 
-		if query.RangeQuery {
-			rangeResponse, _, err := client.QueryRange(ctx, query.Expr, timeRange)
-			if err != nil {
-				plog.Error("Range query failed", "query", query.Expr, "err", err)
-				result.Responses[query.RefId] = backend.DataResponse{Error: err}
+		if dsInfo.ValidateQueries {
+			if err := validateQuery(query.Expr); err != nil {
+				result.Responses[q.RefID] = backend.DataResponse{Error: newQueryError(ErrorSourceDownstream, ErrorStatusBadData, err)}
 				continue
 			}
-			response[RangeQueryType] = rangeResponse
 		}
 
-		if query.InstantQuery {
-			instantResponse, _, err := client.Query(ctx, query.Expr, query.End)
-			if err != nil {
-				plog.Error("Instant query failed", "query", query.Expr, "err", err)
-				result.Responses[query.RefId] = backend.DataResponse{Error: err}
+		if len(dsInfo.AllowedMetricPrefixes) > 0 {
+			if err := checkAllowedMetrics(query.Expr, dsInfo.AllowedMetricPrefixes); err != nil {
+				result.Responses[q.RefID] = backend.DataResponse{Error: newQueryError(ErrorSourceDownstream, ErrorStatusBadData, err)}
 				continue
 			}
-			response[InstantQueryType] = instantResponse
 		}
 
-		// This is a special case
-		// If exemplar query returns error, we want to only log it and continue with other results processing
-		if query.ExemplarQuery {
-			exemplarResponse, err := client.QueryExemplars(ctx, query.Expr, timeRange.Start, timeRange.End)
-			if err != nil {
-				plog.Error("Exemplar query failed", "query", query.Expr, "err", err)
-			} else {
-				response[ExemplarQueryType] = exemplarResponse
+		key := queryKey(query)
+		if refID, exists := firstRefIDs[key]; exists {
+			sharedRefIDs[refID] = append(sharedRefIDs[refID], q.RefID)
+			continue
+		}
+		firstRefIDs[key] = q.RefID
+
+		wg.Add(1)
+		go func(query *PrometheusQuery) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+
+			// The limit of the datasource is shared by all requests, queries waiting for it give up when their
+			// request is canceled
+			if dsInfo.querySlots != nil {
+				select {
+				case dsInfo.querySlots <- struct{}{}:
+					defer func() { <-dsInfo.querySlots }()
+				case <-ctx.Done():
+					ch <- queryResult{refID: query.RefId, response: backend.DataResponse{Error: categorizeError(ctx.Err())}}
+					return
+				}
+			}
+
+			ch <- s.executeQuery(ctx, query, dsInfo)
+		}(query)
+	}
+
+	wg.Wait()
+	close(ch)
+
+	for r := range ch {
+		result.Responses[r.refID] = r.response
+		if shared := sharedRefIDs[r.refID]; len(shared) > 0 {
+			result.Responses[r.refID] = withRefID(r.response, r.refID)
+			for _, refID := range shared {
+				result.Responses[refID] = withRefID(r.response, refID)
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// withRefID returns a copy of the response of a query for a query with the same key, its frames are copied and
+// carry the ref ID as they would otherwise all get the ref ID of the first response they are returned in.
+func withRefID(response backend.DataResponse, refID string) backend.DataResponse {
+	if len(response.Frames) == 0 {
+		return response
+	}
+	frames := make(data.Frames, len(response.Frames))
+	for i, frame := range response.Frames {
+		f := *frame
+		f.RefID = refID
+		frames[i] = &f
+	}
+	response.Frames = frames
+	return response
+}
+
+// queryKey identifies the queries which are sent to Prometheus and return their result in the same way.
+// It covers all options of the query, such as the interpolated expression, the time range, the step and
+// the query types, except its ref ID unless the names of the result are prefixed with it.
+func queryKey(query *PrometheusQuery) string {
+	q := *query
+	if !q.PrefixRefID {
+		q.RefId = ""
+	}
+	key, err := json.Marshal(q)
+	if err != nil {
+		// Can't happen, but then the query is never deduplicated
+		return query.RefId
+	}
+	return string(key)
+}
+
+// emptyQueryFrame is returned for queries with an empty expression instead of sending them to Prometheus.
+func emptyQueryFrame() *data.Frame {
+	frame := data.NewFrame("")
+	frame.Meta = &data.FrameMeta{
+		Notices: []data.Notice{{Severity: data.NoticeSeverityInfo, Text: "query is empty, skipping"}},
+	}
+	return frame
+}
+
+// rangeQueryStreamer is implemented by clients which can decode range query responses series by series.
+type rangeQueryStreamer interface {
+	QueryRangeStream(ctx context.Context, query string, r apiv1.Range, onSeries func(*model.SampleStream) error) (apiv1.Warnings, error)
+}
+
+type queryResult struct {
+	refID    string
+	response backend.DataResponse
+}
+
+// executeQuery runs a single query and recovers from panics so that a failing query doesn't affect the others.
+func (s *Service) executeQuery(ctx context.Context, query *PrometheusQuery, dsInfo *DatasourceInfo) (result queryResult) {
+	result.refID = query.RefId
+
+	defer func() {
+		if r := recover(); r != nil {
+			plog.Error("Query panic", "error", r, "stack", log.Stack(1))
+			result.response = backend.DataResponse{Error: newQueryError(ErrorSourcePlugin, ErrorStatusInternal, fmt.Errorf("unexpected error, see the server log for details"))}
+		}
+	}()
+
+	response, err := s.runQuery(ctx, query, dsInfo)
+	if err != nil {
+		response = backend.DataResponse{Error: err}
+	}
+	// Errors are categorized, so that the user can tell errors of the query from errors of the datasource
+	response.Error = categorizeError(response.Error)
+	result.response = response
+
+	return result
+}
+
+func (s *Service) runQuery(ctx context.Context, query *PrometheusQuery, dsInfo *DatasourceInfo) (backend.DataResponse, error) {
+	if query.Explain {
+		return backend.DataResponse{Frames: data.Frames{explainFrame(query)}}, nil
+	}
+
+	client := dsInfo.promClient
+
+	plog.Debug("Sending query", "start", query.Start, "end", query.End, "step", query.Step, "query", query.Expr)
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "datasource.prometheus")
+	span.SetTag("expr", query.Expr)
+	span.SetTag("start_unixnano", query.Start.UnixNano())
+	span.SetTag("stop_unixnano", query.End.UnixNano())
+	defer span.Finish()
+
+	if query.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, query.Timeout)
+		defer cancel()
+	}
+
+	// The headers of the query are sent with all its requests, including the exemplars one
+	if len(query.Headers) > 0 {
+		ctx = middleware.WithHeaders(ctx, query.Headers)
+	}
+
+	response := make(map[TimeSeriesQueryType]interface{})
+
+	timeRange := queryRange(query)
+
+	// Statistics are only requested for the range and instant queries, the exemplars API doesn't return them
+	queryCtx := ctx
+	var stats *middleware.QueryStats
+	if query.ShowStats {
+		stats = &middleware.QueryStats{}
+		queryCtx = middleware.WithQueryStats(ctx, stats)
+	}
+	// The timeout is also sent to Prometheus, which stops evaluating the query instead of only the client giving up
+	if query.Timeout > 0 {
+		timeout := strconv.FormatFloat(query.Timeout.Seconds(), 'f', -1, 64)
+		queryCtx = middleware.WithQueryParameters(queryCtx, url.Values{"timeout": {timeout}})
+	}
+
+	var streamedFrames data.Frames
+	// Series beyond the limit of the query are dropped before frames are created for them
+	var droppedSeries int
+	// Warnings come with partial results, e.g. of Thanos when some stores are unavailable
+	var warnings apiv1.Warnings
+	// The range and instant query of a query running both don't fail each other, the result of the other one is
+	// returned with a warning. Alert queries fail as a whole, so that alerts aren't evaluated on half of the result.
+	partial := query.RangeQuery && query.InstantQuery && !query.Alerting
+	var failedQuery TimeSeriesQueryType
+	var failedErr error
+	streamer, canStream := client.(rangeQueryStreamer)
+	// Range queries with more points than Prometheus returns at once are split, their series can't be streamed
+	splitRangeQuery := len(splitRange(timeRange, maxPointsPerRequest)) > 1
+	if query.RangeQuery && query.Streaming && canStream && !splitRangeQuery {
+		// Frames are created while the response is decoded, the matrix is never kept in memory as a whole
+		streamedSeries := int64(0)
+		start := time.Now()
+		rangeWarnings, err := streamer.QueryRangeStream(queryCtx, query.Expr, timeRange, func(series *model.SampleStream) error {
+			if query.MaxSeries > 0 && streamedSeries >= query.MaxSeries {
+				droppedSeries++
+				return nil
+			}
+			streamedSeries++
+			streamedFrames = matrixToDataFrames(model.Matrix{series}, query, streamedFrames)
+			return nil
+		})
+		observeQuery(dsInfo, RangeQueryType, start, err)
+		if err != nil {
+			plog.Error("Range query failed", "query", query.Expr, "err", err)
+			if !partial {
+				return backend.DataResponse{Error: queryError(ctx, err, query.Timeout)}, nil
+			}
+			failedQuery, failedErr = RangeQueryType, queryError(ctx, err, query.Timeout)
+			streamedFrames = nil
+		}
+		warnings = append(warnings, rangeWarnings...)
+	} else if query.RangeQuery {
+		start := time.Now()
+		rangeResponse, rangeWarnings, err := queryRangeSplit(queryCtx, client, query.Expr, timeRange)
+		observeQuery(dsInfo, RangeQueryType, start, err)
+		if err != nil {
+			plog.Error("Range query failed", "query", query.Expr, "err", err)
+			if !partial {
+				return backend.DataResponse{Error: queryError(ctx, err, query.Timeout)}, nil
 			}
+			failedQuery, failedErr = RangeQueryType, queryError(ctx, err, query.Timeout)
+		} else {
+			response[RangeQueryType] = limitSeries(rangeResponse, query.MaxSeries, &droppedSeries)
 		}
+		warnings = append(warnings, rangeWarnings...)
+	}
 
-		frames, err := parseTimeSeriesResponse(response, query)
+	if query.InstantQuery {
+		instantCtx := queryCtx
+		if query.LookbackDelta > 0 {
+			lookbackDelta := strconv.FormatFloat(query.LookbackDelta.Seconds(), 'f', -1, 64)
+			instantCtx = middleware.WithQueryParameters(queryCtx, url.Values{"lookback_delta": {lookbackDelta}})
+		}
+		start := time.Now()
+		instantResponse, instantWarnings, err := client.Query(instantCtx, query.Expr, instantQueryTime(query))
+		observeQuery(dsInfo, InstantQueryType, start, err)
 		if err != nil {
-			return &result, err
+			plog.Error("Instant query failed", "query", query.Expr, "err", err)
+			if !partial {
+				return backend.DataResponse{Error: queryError(ctx, err, query.Timeout)}, nil
+			}
+			if failedErr != nil {
+				// Both failed, the error of the range query is returned
+				return backend.DataResponse{Error: failedErr}, nil
+			}
+			failedQuery, failedErr = InstantQueryType, queryError(ctx, err, query.Timeout)
+		} else {
+			response[InstantQueryType] = limitSeries(instantResponse, query.MaxSeries, &droppedSeries)
 		}
+		warnings = append(warnings, instantWarnings...)
+	}
 
-		result.Responses[query.RefId] = backend.DataResponse{
-			Frames: frames,
+	// This is a special case
+	// If exemplar query returns error, we want to only log it and continue with other results processing
+	if query.ExemplarQuery {
+		start := time.Now()
+		exemplarResponse, err := client.QueryExemplars(ctx, query.Expr, timeRange.Start, timeRange.End)
+		if !isNotFoundError(err) {
+			observeQuery(dsInfo, ExemplarQueryType, start, err)
+		}
+		if err != nil {
+			if isNotFoundError(err) {
+				// Older Prometheus versions don't have the exemplars endpoint
+				plog.Debug("Exemplar query is not supported", "query", query.Expr, "err", err)
+			} else {
+				plog.Error("Exemplar query failed", "query", query.Expr, "err", err)
+			}
+		} else {
+			response[ExemplarQueryType] = exemplarResponse
 		}
 	}
 
-	return &result, nil
+	if query.Alerting {
+		// Alerts aren't evaluated on a part of the series, the query fails instead of dropping the others
+		if droppedSeries > 0 {
+			return backend.DataResponse{Error: newQueryError(ErrorSourceDownstream, ErrorStatusBadData,
+				fmt.Errorf("the query returned more than the limit of %d series", query.MaxSeries))}, nil
+		}
+		if err := validateAlertingResult(response); err != nil {
+			return backend.DataResponse{Error: newQueryError(ErrorSourceDownstream, ErrorStatusBadData, err)}, nil
+		}
+	}
+
+	frames, err := parseTimeSeriesResponse(response, query)
+	if err != nil {
+		return backend.DataResponse{}, err
+	}
+	if len(streamedFrames) > 0 {
+		frames = append(transformMatrixFrames(streamedFrames, query), frames...)
+	}
+
+	if query.PrefixRefID {
+		prefixRefID(frames, query.RefId)
+	}
+	setExecutedQueryString(frames, query)
+	if stats != nil && stats.Received {
+		addQueryStats(frames, stats)
+	}
+	if query.FetchMetricType {
+		addMetricTypes(ctx, frames, dsInfo)
+	}
+	notices := query.Notices
+	if droppedSeries > 0 {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Dropped %d series to stay within the limit of %d series per query.", droppedSeries, query.MaxSeries),
+		})
+	}
+	if failedErr != nil {
+		// Without frames of the other query, the warning would be lost
+		if len(frames) == 0 {
+			return backend.DataResponse{Error: failedErr}, nil
+		}
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The %s query failed, only the result of the other query is returned: %s", failedQuery, failedErr),
+		})
+	}
+	for _, warning := range warnings {
+		notices = append(notices, data.Notice{Severity: data.NoticeSeverityWarning, Text: warning})
+	}
+	if len(notices) > 0 {
+		addNotices(frames, notices)
+	}
+
+	return backend.DataResponse{
+		Frames: frames,
+	}, nil
+}
+
+// limitSeries returns the first limit series of a matrix or vector, and adds the number of the others to dropped.
+// Other values and a limit of zero are returned as is.
+func limitSeries(value model.Value, limit int64, dropped *int) model.Value {
+	if limit <= 0 {
+		return value
+	}
+	switch v := value.(type) {
+	case model.Matrix:
+		if int64(len(v)) > limit {
+			*dropped += len(v) - int(limit)
+			return v[:limit]
+		}
+	case model.Vector:
+		if int64(len(v)) > limit {
+			*dropped += len(v) - int(limit)
+			return v[:limit]
+		}
+	}
+	return value
+}
+
+// validateAlertingResult returns an error if the range or instant query result isn't a matrix or vector, the numeric
+// series alert rules reduce to a value. Scalar and string results would otherwise fail the evaluation without a hint.
+func validateAlertingResult(response map[TimeSeriesQueryType]interface{}) error {
+	for _, queryType := range []TimeSeriesQueryType{RangeQueryType, InstantQueryType} {
+		value, ok := response[queryType].(model.Value)
+		if !ok {
+			continue
+		}
+		switch value.Type() {
+		case model.ValMatrix, model.ValVector:
+		default:
+			return fmt.Errorf("alert rules need a query returning numeric series, but the %s query returned a %s, use e.g. vector(...) to turn it into a series", queryType, value.Type())
+		}
+	}
+	return nil
+}
+
+// queryRange returns the range of a range query, aligned to its step.
+func queryRange(query *PrometheusQuery) apiv1.Range {
+	return apiv1.Range{
+		Step: query.Step,
+		// Align query range to step. It rounds start and end down to a multiple of step.
+		Start: time.Unix(int64(math.Floor((float64(query.Start.Unix()+query.UtcOffsetSec)/query.Step.Seconds()))*query.Step.Seconds()-float64(query.UtcOffsetSec)), 0),
+		End:   time.Unix(int64(math.Floor((float64(query.End.Unix()+query.UtcOffsetSec)/query.Step.Seconds()))*query.Step.Seconds()-float64(query.UtcOffsetSec)), 0),
+	}
+}
+
+// explainFrame returns the expression, range and step the query would be sent with, instead of running it.
+// Instant queries are evaluated at the end of the range.
+func explainFrame(query *PrometheusQuery) *data.Frame {
+	start, end := query.Start, instantQueryTime(query)
+	if query.RangeQuery {
+		timeRange := queryRange(query)
+		start, end = timeRange.Start, timeRange.End
+	}
+
+	frame := data.NewFrame("explain",
+		data.NewField("expr", nil, []string{query.Expr}),
+		data.NewField("step", nil, []float64{query.Step.Seconds()}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("start", nil, []time.Time{start.UTC()}),
+		data.NewField("end", nil, []time.Time{end.UTC()}),
+	)
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString: query.Expr,
+		Notices:             append([]data.Notice{{Severity: data.NoticeSeverityInfo, Text: "The query was not executed."}}, query.Notices...),
+	}
+	return frame
+}
+
+// setExecutedQueryString records the interpolated expression of the query, and the range, step and evaluation time
+// it was sent with, in the metadata of frames, which Grafana shows in the query inspector.
+func setExecutedQueryString(frames data.Frames, query *PrometheusQuery) {
+	lines := []string{"Expr: " + query.Expr}
+	if query.RangeQuery {
+		timeRange := queryRange(query)
+		lines = append(lines,
+			"Step: "+query.Step.String(),
+			"Start: "+timeRange.Start.UTC().Format(time.RFC3339),
+			"End: "+timeRange.End.UTC().Format(time.RFC3339),
+		)
+	}
+	if query.InstantQuery {
+		lines = append(lines, "Time: "+instantQueryTime(query).UTC().Format(time.RFC3339))
+	}
+	executed := strings.Join(lines, "\n")
+
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.ExecutedQueryString = executed
+	}
+}
+
+// addQueryStats adds the statistics returned by Prometheus to the custom metadata of frames.
+func addQueryStats(frames data.Frames, stats *middleware.QueryStats) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, ok := frame.Meta.Custom.(map[string]interface{})
+		if !ok {
+			custom = map[string]interface{}{}
+			frame.Meta.Custom = custom
+		}
+		custom["totalQueryableSamples"] = stats.TotalQueryableSamples
+		custom["execTotalTime"] = stats.ExecTotalTime
+	}
+}
+
+func addNotices(frames data.Frames, notices []data.Notice) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Notices = append(frame.Meta.Notices, notices...)
+	}
+}
+
+// validateQuery parses the interpolated expression so that syntax errors are returned
+// with their position instead of the less helpful error of the Prometheus server.
+// The returned error wraps parser.ParseErrors.
+func validateQuery(expr string) error {
+	if _, err := parser.ParseExpr(expr); err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+	return nil
+}
+
+// queryError replaces the generic context error of a query which ran out of time
+// with one telling the user which timeout was hit.
+func queryError(ctx context.Context, err error, timeout time.Duration) error {
+	if timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return newQueryError(ErrorSourceDownstream, ErrorStatusTimeout, fmt.Errorf("query timed out after %s", timeout))
+	}
+	return err
+}
+
+// isNotFoundError returns whether err is a Prometheus client error caused by a 404 response.
+func isNotFoundError(err error) bool {
+	var e *apiv1.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Type == apiv1.ErrClient && e.Msg == fmt.Sprintf("client error: %d", http.StatusNotFound)
 }
 
 func formatLegend(metric model.Metric, query *PrometheusQuery) string {
@@ -127,16 +595,11 @@ func formatLegend(metric model.Metric, query *PrometheusQuery) string {
 	if query.LegendFormat == "" {
 		legend = metric.String()
 	} else {
-		result := legendFormat.ReplaceAllFunc([]byte(query.LegendFormat), func(in []byte) []byte {
-			labelName := strings.Replace(string(in), "{{", "", 1)
-			labelName = strings.Replace(labelName, "}}", "", 1)
-			labelName = strings.TrimSpace(labelName)
-			if val, exists := metric[model.LabelName(labelName)]; exists {
-				return []byte(val)
-			}
-			return []byte{}
+		legend = legendFormat.ReplaceAllStringFunc(query.LegendFormat, func(in string) string {
+			// The metric name is part of the metric as the __name__ label, so {{__name__}} is looked up like any label
+			labelName := strings.TrimSpace(legendFormat.FindStringSubmatch(in)[1])
+			return string(metric[model.LabelName(labelName)])
 		})
-		legend = string(result)
 	}
 
 	// If legend is empty brackets, use query expression
@@ -147,83 +610,347 @@ func formatLegend(metric model.Metric, query *PrometheusQuery) string {
 	return legend
 }
 
+// valueFieldName returns the name of the value field of a series, the raw metric and labels if the query asks for it,
+// or Value otherwise. Series without labels are named after the expression of the query.
+func valueFieldName(metric model.Metric, query *PrometheusQuery) string {
+	if !query.RawFieldNames {
+		return data.TimeSeriesValueFieldName
+	}
+	if len(metric) == 0 {
+		return query.Expr
+	}
+	return metric.String()
+}
+
+// downsampleNotice returns a notice telling that the data of a query is downsampled, if its step is more than factor
+// times the scrape interval, e.g. for long time ranges. There is no notice without a scrape interval.
+func downsampleNotice(step time.Duration, scrapeInterval string, factor float64) (data.Notice, bool) {
+	if scrapeInterval == "" {
+		return data.Notice{}, false
+	}
+	scrapeIntervalDuration, err := intervalv2.ParseIntervalStringToTimeDuration(scrapeInterval)
+	if err != nil || scrapeIntervalDuration <= 0 || float64(step) <= float64(scrapeIntervalDuration)*factor {
+		return data.Notice{}, false
+	}
+	return data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     fmt.Sprintf("Data downsampled: step %s vs scrape interval %s, narrow the time range to see every sample.", intervalv2.FormatDuration(step), intervalv2.FormatDuration(scrapeIntervalDuration)),
+	}, true
+}
+
+// alignStep rounds step up to the nearest multiple of the scrape interval, so that every step
+// covers the same number of samples and graphs don't show aliasing.
+// The step is only ever increased, so it stays within the safe resolution.
+func alignStep(step time.Duration, scrapeInterval string) time.Duration {
+	if scrapeInterval == "" {
+		return step
+	}
+
+	scrapeIntervalDuration, err := intervalv2.ParseIntervalStringToTimeDuration(scrapeInterval)
+	if err != nil || scrapeIntervalDuration <= 0 {
+		return step
+	}
+
+	if remainder := step % scrapeIntervalDuration; remainder != 0 {
+		step += scrapeIntervalDuration - remainder
+	}
+	return step
+}
+
 func (s *Service) parseTimeSeriesQuery(queryContext *backend.QueryDataRequest, dsInfo *DatasourceInfo) ([]*PrometheusQuery, error) {
 	qs := []*PrometheusQuery{}
 	for _, query := range queryContext.Queries {
-		model := &QueryModel{}
-		err := json.Unmarshal(query.JSON, model)
+		q, err := s.parseQuery(queryContext, query, dsInfo)
 		if err != nil {
 			return nil, err
 		}
-		//Final interval value
-		var interval time.Duration
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+func (s *Service) parseQuery(queryContext *backend.QueryDataRequest, query backend.DataQuery, dsInfo *DatasourceInfo) (*PrometheusQuery, error) {
+	model := &QueryModel{}
+	err := json.Unmarshal(query.JSON, model)
+	if err != nil {
+		return nil, err
+	}
+	if model.IntervalFactor < 0 {
+		return nil, fmt.Errorf("invalid interval factor %d, it must be a positive integer", model.IntervalFactor)
+	}
+	if query.TimeRange.From.IsZero() && query.TimeRange.To.IsZero() {
+		return nil, errors.New("invalid time range, it is not set")
+	}
+	if query.TimeRange.To.Before(query.TimeRange.From) {
+		return nil, fmt.Errorf("invalid time range, the end %s is before the start %s",
+			query.TimeRange.To.UTC().Format(time.RFC3339), query.TimeRange.From.UTC().Format(time.RFC3339))
+	}
+	//Final interval value
+	var interval time.Duration
+
+	//Calculate interval
+	queryInterval := model.Interval
+	//If we are using variable or interval/step, we will replace it with calculated interval
+	if queryInterval == varInterval || queryInterval == varIntervalMs || queryInterval == varRateInterval {
+		queryInterval = ""
+	}
+	//If we are using variable or interval/step with {} syntax, we will replace it with calculated interval
+	//Repetitive code, we should have functionality to unify these
+	if queryInterval == varIntervalAlt || queryInterval == varIntervalMsAlt || queryInterval == varRateIntervalAlt {
+		queryInterval = ""
+	}
+
+	minInterval, err := intervalv2.GetIntervalFrom(dsInfo.TimeInterval, queryInterval, model.IntervalMS, 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
 
-		//Calculate interval
-		queryInterval := model.Interval
-		//If we are using variable or interval/step, we will replace it with calculated interval
-		if queryInterval == varInterval || queryInterval == varIntervalMs || queryInterval == varRateInterval {
-			queryInterval = ""
+	// The min step of the query floors the step, independently of the scrape interval of the datasource
+	if model.MinStep != "" {
+		minStep, err := intervalv2.ParseIntervalStringToTimeDuration(model.MinStep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min step %q: %w", model.MinStep, err)
 		}
-		//If we are using variable or interval/step with {} syntax, we will replace it with calculated interval
-		//Repetitive code, we should have functionality to unify these
-		if queryInterval == varIntervalAlt || queryInterval == varIntervalMsAlt || queryInterval == varRateIntervalAlt {
-			queryInterval = ""
+		if minStep > minInterval {
+			minInterval = minStep
 		}
+	}
 
-		minInterval, err := intervalv2.GetIntervalFrom(dsInfo.TimeInterval, queryInterval, model.IntervalMS, 15*time.Second)
-		if err != nil {
-			return nil, err
+	calculatedInterval := s.intervalCalculator.Calculate(query.TimeRange, minInterval, query.MaxDataPoints)
+	maxDataPoints := int64(safeRes)
+	if dsInfo.MaxDataPoints > 0 {
+		maxDataPoints = dsInfo.MaxDataPoints
+	}
+	safeInterval := s.intervalCalculator.CalculateSafeInterval(query.TimeRange, maxDataPoints)
+	adjustedInterval := safeInterval.Value
+
+	var notices []data.Notice
+	if calculatedInterval.Value > safeInterval.Value {
+		adjustedInterval = calculatedInterval.Value
+	} else if calculatedInterval.Value < safeInterval.Value {
+		notices = append(notices, data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The step was increased from %s to %s to stay within the limit of %d data points per series.", calculatedInterval.Text, safeInterval.Text, maxDataPoints),
+		})
+	}
+
+	if queryInterval == varRateInterval || queryInterval == varRateIntervalAlt {
+		// Rate interval is final and is not affected by resolution
+		interval = calculateRateInterval(adjustedInterval, dsInfo.TimeInterval, s.intervalCalculator)
+	} else {
+		// The interval factor only lowers the resolution, the step never gets below the safe interval
+		intervalFactor := model.IntervalFactor
+		if intervalFactor == 0 {
+			intervalFactor = 1
+		}
+		interval = time.Duration(int64(adjustedInterval) * intervalFactor)
+
+		if model.StepMode == stepModeAligned {
+			interval = alignStep(interval, dsInfo.TimeInterval)
 		}
+	}
 
-		calculatedInterval := s.intervalCalculator.Calculate(query.TimeRange, minInterval, query.MaxDataPoints)
-		safeInterval := s.intervalCalculator.CalculateSafeInterval(query.TimeRange, int64(safeRes))
-		adjustedInterval := safeInterval.Value
+	timeRange := query.TimeRange.To.Sub(query.TimeRange.From)
 
-		if calculatedInterval.Value > safeInterval.Value {
-			adjustedInterval = calculatedInterval.Value
+	// A fixed step replaces the calculated one as is, it is never increased to stay within the limit of data points
+	if model.Step != "" {
+		step, err := intervalv2.ParseIntervalStringToTimeDuration(model.Step)
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", model.Step)
+		}
+		if int64(timeRange/step) > maxDataPoints {
+			return nil, fmt.Errorf("the step %s would return more than %d data points per series, use a wider step", model.Step, maxDataPoints)
+		}
+		interval = step
+		notices = nil
+	} else if model.Resolution != "" {
+		// The raw resolution replaces the calculated step whatever the width of the panel
+		if model.Resolution != rawResolution {
+			return nil, fmt.Errorf("invalid resolution %q, it must be raw", model.Resolution)
 		}
+		if dsInfo.TimeInterval == "" {
+			return nil, errors.New("the raw resolution needs the scrape interval of the datasource to be configured")
+		}
+		step, err := intervalv2.ParseIntervalStringToTimeDuration(dsInfo.TimeInterval)
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid scrape interval %q of the datasource", dsInfo.TimeInterval)
+		}
+		if int64(timeRange/step) > maxDataPoints {
+			return nil, fmt.Errorf("the raw resolution of %s would return more than %d data points per series, narrow the time range", dsInfo.TimeInterval, maxDataPoints)
+		}
+		interval = step
+		notices = nil
+	}
 
-		if queryInterval == varRateInterval || queryInterval == varRateIntervalAlt {
-			// Rate interval is final and is not affected by resolution
-			interval = calculateRateInterval(adjustedInterval, dsInfo.TimeInterval, s.intervalCalculator)
-		} else {
-			intervalFactor := model.IntervalFactor
-			if intervalFactor == 0 {
-				intervalFactor = 1
-			}
-			interval = time.Duration(int64(adjustedInterval) * intervalFactor)
+	// Steps fixed by the query don't lower the resolution without the user knowing
+	if dsInfo.DownsampleFactor > 0 && model.Step == "" && model.Resolution == "" {
+		if notice, ok := downsampleNotice(interval, dsInfo.TimeInterval, dsInfo.DownsampleFactor); ok {
+			notices = append(notices, notice)
 		}
+	}
 
-		// Interpolate variables in expr
-		timeRange := query.TimeRange.To.Sub(query.TimeRange.From)
-		expr := interpolateVariables(model.Expr, interval, timeRange, s.intervalCalculator, dsInfo.TimeInterval)
+	// Interpolate variables in expr
+	expr := interpolateTemplateVariables(model.Expr, model.Variables)
+	expr = interpolateVariables(expr, interval, timeRange, s.intervalCalculator, dsInfo.TimeInterval)
+	expr = interpolateTimeRangeVariables(expr, query.TimeRange.From, query.TimeRange.To)
+
+	rangeQuery := model.RangeQuery || model.RangeAndInstant
+	instantQuery := model.InstantQuery || model.RangeAndInstant
+	if query.QueryType == instantQueryType {
+		// Instant query type is evaluated once, at the end of the time range
+		rangeQuery = false
+		instantQuery = true
+	}
+	if !instantQuery && !rangeQuery {
+		// In older dashboards, we were not setting range query param and !range && !instant was run as range query
+		rangeQuery = true
+	}
+	if timeRange == 0 {
+		// A time range without duration has no steps, the query is evaluated once at its time
+		rangeQuery = false
+		instantQuery = true
+	}
 
-		rangeQuery := model.RangeQuery
-		if !model.InstantQuery && !model.RangeQuery {
-			// In older dashboards, we were not setting range query param and !range && !instant was run as range query
-			rangeQuery = true
+	var timeShift time.Duration
+	if model.TimeShift != "" {
+		timeShift, err = intervalv2.ParseIntervalStringToTimeDuration(model.TimeShift)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time shift %q: %w", model.TimeShift, err)
 		}
+	}
 
-		// We never want to run exemplar query for alerting
-		exemplarQuery := model.ExemplarQuery
-		if queryContext.Headers["FromAlert"] == "true" {
-			exemplarQuery = false
+	// The series limit of the query replaces the one of the datasource
+	if model.MaxSeries < 0 {
+		return nil, fmt.Errorf("invalid max series %d, it must be a positive integer", model.MaxSeries)
+	}
+	maxSeries := model.MaxSeries
+	if maxSeries == 0 {
+		maxSeries = dsInfo.MaxSeries
+	}
+	// Alert queries are evaluated on all series, unless a limit is configured
+	if maxSeries == 0 && query.QueryType != alertQueryType {
+		maxSeries = defaultMaxSeries
+	}
+
+	var lookbackDelta time.Duration
+	if model.LookbackDelta != "" {
+		lookbackDelta, err = intervalv2.ParseIntervalStringToTimeDuration(model.LookbackDelta)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lookback delta %q: %w", model.LookbackDelta, err)
+		}
+		if lookbackDelta <= 0 {
+			return nil, fmt.Errorf("invalid lookback delta %q, it must be a positive duration", model.LookbackDelta)
 		}
+	}
 
-		qs = append(qs, &PrometheusQuery{
-			Expr:          expr,
-			Step:          interval,
-			LegendFormat:  model.LegendFormat,
-			Start:         query.TimeRange.From,
-			End:           query.TimeRange.To,
-			RefId:         query.RefID,
-			InstantQuery:  model.InstantQuery,
-			RangeQuery:    rangeQuery,
-			ExemplarQuery: exemplarQuery,
-			UtcOffsetSec:  model.UtcOffsetSec,
-		})
+	var dedupEpsilon time.Duration
+	if model.DedupTimestamps {
+		dedupEpsilon = defaultDedupEpsilon
+		if model.DedupEpsilon != "" {
+			dedupEpsilon, err = intervalv2.ParseIntervalStringToTimeDuration(model.DedupEpsilon)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dedup epsilon %q: %w", model.DedupEpsilon, err)
+			}
+			if dedupEpsilon <= 0 {
+				return nil, fmt.Errorf("invalid dedup epsilon %q, it must be a positive duration", model.DedupEpsilon)
+			}
+		}
 	}
-	return qs, nil
+
+	// The timeout of the query replaces the one of the datasource
+	timeout := dsInfo.QueryTimeout
+	if model.QueryTimeout != "" {
+		timeout, err = intervalv2.ParseIntervalStringToTimeDuration(model.QueryTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query timeout %q: %w", model.QueryTimeout, err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid query timeout %q, it must be a positive duration", model.QueryTimeout)
+		}
+	}
+
+	if model.RoundTo != nil && *model.RoundTo < 0 {
+		return nil, fmt.Errorf("invalid round to %d, it must be a non-negative number of decimal places", *model.RoundTo)
+	}
+
+	if model.LastN < 0 {
+		return nil, fmt.Errorf("invalid last N %d, it must be a non-negative number of samples", model.LastN)
+	}
+
+	switch model.StaleHandling {
+	case "", staleHandlingGap, staleHandlingZero, staleHandlingPrevious:
+	default:
+		return nil, fmt.Errorf("invalid stale handling %q, it must be gap, zero or previous", model.StaleHandling)
+	}
+
+	if err := validateValueTransform(model.ValueTransform); err != nil {
+		return nil, err
+	}
+	if err := validateDuplicateSeries(model.DuplicateSeries); err != nil {
+		return nil, err
+	}
+	if err := middleware.ValidateHeaders(model.Headers); err != nil {
+		return nil, err
+	}
+
+	sortBy, err := parseSortBy(model.SortBy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Queries asking for an automatic legend don't get the default legend format of the datasource
+	legendFormat := model.LegendFormat
+	if legendFormat == "" && !model.AutoLegend {
+		legendFormat = dsInfo.DefaultLegendFormat
+	}
+
+	// We never want to run exemplar query for alerting, and exemplars only make sense for range queries
+	exemplarQuery := model.ExemplarQuery && rangeQuery
+	if queryContext.Headers["FromAlert"] == "true" {
+		exemplarQuery = false
+	}
+
+	return &PrometheusQuery{
+		Expr:            expr,
+		Step:            interval,
+		LegendFormat:    legendFormat,
+		Format:          model.Format,
+		PivotLabel:      model.PivotLabel,
+		Start:           query.TimeRange.From,
+		End:             query.TimeRange.To,
+		RefId:           query.RefID,
+		InstantQuery:    instantQuery,
+		RangeQuery:      rangeQuery,
+		ExemplarQuery:   exemplarQuery,
+		ShowStats:       model.ShowStats,
+		AutoLegend:      model.AutoLegend,
+		Streaming:       model.Streaming,
+		Explain:         model.Explain,
+		AlignTimestamps: model.AlignTimestamps,
+		FetchMetricType: model.FetchMetricType,
+		MaxSeries:       maxSeries,
+		TimeShift:       timeShift,
+		LookbackDelta:   lookbackDelta,
+		DedupEpsilon:    dedupEpsilon,
+		PrefixRefID:     model.PrefixRefID,
+		RangeAndInstant: model.RangeAndInstant && rangeQuery && instantQuery,
+		SortBy:          sortBy,
+		Timeout:         timeout,
+		RoundTo:         model.RoundTo,
+		InstantAsRange:  model.InstantAsRange,
+		LastN:           model.LastN,
+		StaleHandling:   model.StaleHandling,
+		ValueTransform:  model.ValueTransform,
+		DuplicateSeries: model.DuplicateSeries,
+		RawFieldNames:   model.RawFieldNames,
+		Alerting:        query.QueryType == alertQueryType,
+		Notices:         notices,
+		UtcOffsetSec:    model.UtcOffsetSec,
+		// The scrape interval of the datasource, if configured, is the one the interval variables are computed from
+		InferScrapeInterval: model.InferScrapeInterval && dsInfo.TimeInterval == "",
+		Headers:             model.Headers,
+		IncludeLabelsMeta:   model.IncludeLabelsMeta,
+	}, nil
 }
 
 func parseTimeSeriesResponse(value map[TimeSeriesQueryType]interface{}, query *PrometheusQuery) (data.Frames, error) {
@@ -232,17 +959,36 @@ func parseTimeSeriesResponse(value map[TimeSeriesQueryType]interface{}, query *P
 		nextFrames = data.Frames{}
 	)
 
-	for _, value := range value {
+	for queryType, value := range value {
 		// Zero out the slice to prevent data corruption.
 		nextFrames = nextFrames[:0]
 
 		switch v := value.(type) {
 		case model.Matrix:
-			nextFrames = matrixToDataFrames(v, query, nextFrames)
+			nextFrames = transformMatrixFrames(matrixToDataFrames(v, query, nextFrames), query)
+			if query.InferScrapeInterval && queryType == InstantQueryType {
+				if interval := inferScrapeInterval(v); interval > 0 {
+					setScrapeInterval(nextFrames, interval)
+				}
+			}
 		case model.Vector:
 			nextFrames = vectorToDataFrames(v, query, nextFrames)
+			transformValues(nextFrames, query.ValueTransform)
+			sortFrames(nextFrames, query.SortBy)
+			if query.AutoLegend && query.LegendFormat == "" {
+				applyAutoLegend(nextFrames, query)
+			}
+			if query.InstantAsRange {
+				spanTimeRange(nextFrames, query)
+			}
+			if query.Format == longFormat {
+				nextFrames = transformToLong(nextFrames)
+			}
+			setEvaluationTime(nextFrames, instantQueryTime(query))
 		case *model.Scalar:
 			nextFrames = scalarToDataFrames(v, query, nextFrames)
+			transformValues(nextFrames, query.ValueTransform)
+			setEvaluationTime(nextFrames, instantQueryTime(query))
 		case []apiv1.ExemplarQueryResult:
 			nextFrames = exemplarToDataFrames(v, query, nextFrames)
 		default:
@@ -256,13 +1002,76 @@ func parseTimeSeriesResponse(value map[TimeSeriesQueryType]interface{}, query *P
 	return frames, nil
 }
 
+// instantQueryTime returns the time instant queries are evaluated at, the end of the time range shifted back by the time shift.
+// Queries running both a range and an instant query evaluate the instant query at the end of the range aligned to the step,
+// so that its value is the one of the last step of the range query.
+func instantQueryTime(query *PrometheusQuery) time.Time {
+	end := query.End
+	if query.RangeAndInstant {
+		end = queryRange(query).End
+	}
+	return end.Add(-query.TimeShift)
+}
+
+// spanTimeRange replaces the single sample of the instant query series of frames by two samples with its value, at the
+// start and the end of the time range, so that time series panels draw a flat line across the range.
+// Series of queries without time range, or with an empty one, are kept as they are.
+func spanTimeRange(frames data.Frames, query *PrometheusQuery) {
+	if !query.End.After(query.Start) {
+		return
+	}
+	times := []time.Time{query.Start.UTC(), query.End.UTC()}
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 || frame.Fields[1].Len() != 1 {
+			continue
+		}
+		value, ok := frame.Fields[1].At(0).(float64)
+		if !ok {
+			continue
+		}
+		frame.Fields[0] = data.NewField(frame.Fields[0].Name, frame.Fields[0].Labels, times)
+		valueField := data.NewField(frame.Fields[1].Name, frame.Fields[1].Labels, []float64{value, value})
+		valueField.Config = frame.Fields[1].Config
+		frame.Fields[1] = valueField
+	}
+}
+
+// setEvaluationTime records the evaluation time of an instant query in the custom metadata of frames.
+func setEvaluationTime(frames data.Frames, t time.Time) {
+	for _, frame := range frames {
+		if custom, ok := frame.Meta.Custom.(map[string]interface{}); ok {
+			custom["evaluationTime"] = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+}
+
+// transformMatrixFrames applies the sort, legend and format options of query to the frames of a range query result.
+func transformMatrixFrames(frames data.Frames, query *PrometheusQuery) data.Frames {
+	frames = handleDuplicateSeries(frames, query.DuplicateSeries)
+	transformValues(frames, query.ValueTransform)
+	sortFrames(frames, query.SortBy)
+	if query.AutoLegend && query.LegendFormat == "" {
+		applyAutoLegend(frames, query)
+	}
+	switch query.Format {
+	case heatmapFormat:
+		frames = transformToHeatmap(frames)
+	case wideFormat:
+		frames = transformToWide(frames, query.PivotLabel)
+	case longFormat:
+		frames = transformToLong(frames)
+	}
+	return frames
+}
+
+// calculateRateInterval returns max(4 * scrapeInterval, interval + scrapeInterval),
+// or interval itself if the scrape interval of the data source is not configured.
 func calculateRateInterval(interval time.Duration, scrapeInterval string, intervalCalculator intervalv2.Calculator) time.Duration {
-	scrape := scrapeInterval
-	if scrape == "" {
-		scrape = "15s"
+	if scrapeInterval == "" {
+		return interval
 	}
 
-	scrapeIntervalDuration, err := intervalv2.ParseIntervalStringToTimeDuration(scrape)
+	scrapeIntervalDuration, err := intervalv2.ParseIntervalStringToTimeDuration(scrapeInterval)
 	if err != nil {
 		return time.Duration(0)
 	}
@@ -271,27 +1080,74 @@ func calculateRateInterval(interval time.Duration, scrapeInterval string, interv
 	return rateInterval
 }
 
+// subqueryStepRegexp matches the interval variables used as the resolution of a subquery, e.g. [1h:$__interval]
+var subqueryStepRegexp = regexp.MustCompile(`:(\s*)(\$__interval|\$\{__interval\}|\$__rate_interval|\$\{__rate_interval\})(\s*)\]`)
+
+// minSubqueryStep is the smallest resolution interpolated into a subquery, finer ones evaluate the inner query far
+// more often than any panel can show
+const minSubqueryStep = time.Second
+
+// interpolateSubqueryStep replaces the interval variables used as the resolution of a subquery by the interval,
+// rounded up to minSubqueryStep, so that the resolution is always a valid positive duration.
+func interpolateSubqueryStep(expr string, interval time.Duration, rateInterval time.Duration) string {
+	return subqueryStepRegexp.ReplaceAllStringFunc(expr, func(match string) string {
+		groups := subqueryStepRegexp.FindStringSubmatch(match)
+		step := interval
+		if groups[2] == varRateInterval || groups[2] == varRateIntervalAlt {
+			step = rateInterval
+		}
+		if step < minSubqueryStep {
+			step = minSubqueryStep
+		}
+		return ":" + groups[1] + intervalv2.FormatDuration(step) + groups[3] + "]"
+	})
+}
+
 func interpolateVariables(expr string, interval time.Duration, timeRange time.Duration, intervalCalculator intervalv2.Calculator, timeInterval string) string {
+	expr = interpolateSubqueryStep(expr, interval, calculateRateInterval(interval, timeInterval, intervalCalculator))
+
+	// The range is floored to whole seconds, so a range of 1.9s is 1s and sub-second ranges are 0s
 	rangeMs := timeRange.Milliseconds()
-	rangeSRounded := int64(math.Round(float64(rangeMs) / 1000.0))
+	rangeS := rangeMs / 1000
 
 	expr = strings.ReplaceAll(expr, varIntervalMs, strconv.FormatInt(int64(interval/time.Millisecond), 10))
 	expr = strings.ReplaceAll(expr, varInterval, intervalv2.FormatDuration(interval))
 	expr = strings.ReplaceAll(expr, varRangeMs, strconv.FormatInt(rangeMs, 10))
-	expr = strings.ReplaceAll(expr, varRangeS, strconv.FormatInt(rangeSRounded, 10))
-	expr = strings.ReplaceAll(expr, varRange, strconv.FormatInt(rangeSRounded, 10)+"s")
+	expr = strings.ReplaceAll(expr, varRangeS, strconv.FormatInt(rangeS, 10))
+	expr = strings.ReplaceAll(expr, varRange, strconv.FormatInt(rangeS, 10)+"s")
 	expr = strings.ReplaceAll(expr, varRateInterval, intervalv2.FormatDuration(calculateRateInterval(interval, timeInterval, intervalCalculator)))
 
 	// Repetitive code, we should have functionality to unify these
 	expr = strings.ReplaceAll(expr, varIntervalMsAlt, strconv.FormatInt(int64(interval/time.Millisecond), 10))
 	expr = strings.ReplaceAll(expr, varIntervalAlt, intervalv2.FormatDuration(interval))
 	expr = strings.ReplaceAll(expr, varRangeMsAlt, strconv.FormatInt(rangeMs, 10))
-	expr = strings.ReplaceAll(expr, varRangeSAlt, strconv.FormatInt(rangeSRounded, 10))
-	expr = strings.ReplaceAll(expr, varRangeAlt, strconv.FormatInt(rangeSRounded, 10)+"s")
+	expr = strings.ReplaceAll(expr, varRangeSAlt, strconv.FormatInt(rangeS, 10))
+	expr = strings.ReplaceAll(expr, varRangeAlt, strconv.FormatInt(rangeS, 10)+"s")
 	expr = strings.ReplaceAll(expr, varRateIntervalAlt, intervalv2.FormatDuration(calculateRateInterval(interval, timeInterval, intervalCalculator)))
 	return expr
 }
 
+// interpolateTimeRangeVariables replaces the time range variables of expr by the start and end of the time range,
+// floored to whole epoch seconds.
+func interpolateTimeRangeVariables(expr string, from time.Time, to time.Time) string {
+	fromS := strconv.FormatInt(from.Unix(), 10)
+	toS := strconv.FormatInt(to.Unix(), 10)
+
+	expr = strings.ReplaceAll(expr, varFrom, fromS)
+	expr = strings.ReplaceAll(expr, varTo, toS)
+	expr = strings.ReplaceAll(expr, varFromAlt, fromS)
+	expr = strings.ReplaceAll(expr, varToAlt, toS)
+	return expr
+}
+
+// Ways of showing the NaN values of range query series, which Prometheus returns e.g. for the stale samples of
+// series which disappeared and came back, or for divisions by zero
+const (
+	staleHandlingGap      = "gap"
+	staleHandlingZero     = "zero"
+	staleHandlingPrevious = "previous"
+)
+
 func matrixToDataFrames(matrix model.Matrix, query *PrometheusQuery, frames data.Frames) data.Frames {
 	for _, v := range matrix {
 		tags := make(map[string]string, len(v.Metric))
@@ -299,24 +1155,58 @@ func matrixToDataFrames(matrix model.Matrix, query *PrometheusQuery, frames data
 			tags[string(k)] = string(v)
 		}
 
-		timeField := data.NewFieldFromFieldType(data.FieldTypeTime, len(v.Values))
-		valueField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, len(v.Values))
+		samples := v.Values
+		if query.DedupEpsilon > 0 {
+			samples = dedupSamples(samples, query.DedupEpsilon)
+		}
+		if query.LastN > 0 && len(samples) > query.LastN {
+			samples = samples[len(samples)-query.LastN:]
+		}
+
+		timeField := data.NewFieldFromFieldType(data.FieldTypeTime, len(samples))
+		valueField := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, len(samples))
 
-		for i, k := range v.Values {
-			timeField.Set(i, time.Unix(k.Timestamp.Unix(), 0).UTC())
-			value := float64(k.Value)
-			if !math.IsNaN(value) {
-				valueField.Set(i, &value)
+		aligned, alignable := alignedTimestamps(samples, query)
+		var previous *float64
+		for i, k := range samples {
+			if alignable {
+				timeField.Set(i, aligned[i])
+			} else {
+				timeField.Set(i, time.Unix(k.Timestamp.Unix(), 0).UTC())
+			}
+			value := roundValue(float64(k.Value), query.RoundTo)
+			if math.IsNaN(value) {
+				switch {
+				case query.StaleHandling == staleHandlingZero:
+					value = 0
+				case query.StaleHandling == staleHandlingPrevious && previous != nil:
+					value = *previous
+				default:
+					// Leading NaN values don't have a previous value and are shown as gaps as well
+					continue
+				}
 			}
+			valueField.Set(i, &value)
+			previous = &value
 		}
 
 		name := formatLegend(v.Metric, query)
 		timeField.Name = data.TimeSeriesTimeFieldName
-		valueField.Name = data.TimeSeriesValueFieldName
+		valueField.Name = valueFieldName(v.Metric, query)
 		valueField.Config = &data.FieldConfig{DisplayNameFromDS: name}
 		valueField.Labels = tags
 
-		frames = append(frames, newDataFrame(name, "matrix", timeField, valueField))
+		frame := newDataFrame(name, "matrix", timeField, valueField)
+		if query.IncludeLabelsMeta {
+			setLabelsMeta(frame, tags)
+		}
+		if query.AlignTimestamps && !alignable {
+			frame.AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("timestamps of %s are not aligned to the step, as several samples are closest to the same step", name),
+			})
+		}
+		frames = append(frames, frame)
 	}
 
 	return frames
@@ -324,7 +1214,7 @@ func matrixToDataFrames(matrix model.Matrix, query *PrometheusQuery, frames data
 
 func scalarToDataFrames(scalar *model.Scalar, query *PrometheusQuery, frames data.Frames) data.Frames {
 	timeVector := []time.Time{time.Unix(scalar.Timestamp.Unix(), 0).UTC()}
-	values := []float64{float64(scalar.Value)}
+	values := []float64{roundValue(float64(scalar.Value), query.RoundTo)}
 	name := fmt.Sprintf("%g", values[0])
 
 	return append(
@@ -338,26 +1228,83 @@ func scalarToDataFrames(scalar *model.Scalar, query *PrometheusQuery, frames dat
 	)
 }
 
+// alignedTimestamps returns the times of the samples snapped to the closest multiple of the step from the start of
+// the query, if the query asks for aligned timestamps. Samples are not aligned, and false is returned, if two of them
+// would be snapped to the same time.
+func alignedTimestamps(samples []model.SamplePair, query *PrometheusQuery) ([]time.Time, bool) {
+	if !query.AlignTimestamps || query.Step <= 0 {
+		return nil, false
+	}
+
+	start := queryRange(query).Start
+	aligned := make([]time.Time, len(samples))
+	for i, sample := range samples {
+		steps := math.Round(float64(sample.Timestamp.Time().Sub(start)) / float64(query.Step))
+		aligned[i] = start.Add(time.Duration(steps) * query.Step).UTC()
+		if i > 0 && !aligned[i].After(aligned[i-1]) {
+			return nil, false
+		}
+	}
+	return aligned, true
+}
+
+// dedupSamples sorts samples by time and collapses each run of samples within epsilon of the first sample of the run
+// into the last sample of the run, so that the latest value wins. Runs are measured from their first sample, so that
+// samples only every epsilon apart are kept.
+func dedupSamples(samples []model.SamplePair, epsilon time.Duration) []model.SamplePair {
+	sorted := make([]model.SamplePair, len(samples))
+	copy(sorted, samples)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	deduped := make([]model.SamplePair, 0, len(sorted))
+	var runStart model.Time
+	for i, sample := range sorted {
+		if i > 0 && sample.Timestamp.Sub(runStart) <= epsilon {
+			deduped[len(deduped)-1] = sample
+			continue
+		}
+		runStart = sample.Timestamp
+		deduped = append(deduped, sample)
+	}
+	return deduped
+}
+
+// roundValue rounds value half away from zero to the given number of decimal places, or returns it as is if decimals
+// is nil. NaN and infinite values are returned as is, as are values too large to be rounded.
+func roundValue(value float64, decimals *int) float64 {
+	if decimals == nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return value
+	}
+	pow := math.Pow(10, float64(*decimals))
+	if math.IsInf(value*pow, 0) {
+		return value
+	}
+	return math.Round(value*pow) / pow
+}
+
 func vectorToDataFrames(vector model.Vector, query *PrometheusQuery, frames data.Frames) data.Frames {
 	for _, v := range vector {
 		name := formatLegend(v.Metric, query)
 		tags := make(map[string]string, len(v.Metric))
 		timeVector := []time.Time{time.Unix(v.Timestamp.Unix(), 0).UTC()}
-		values := []float64{float64(v.Value)}
+		values := []float64{roundValue(float64(v.Value), query.RoundTo)}
 
 		for k, v := range v.Metric {
 			tags[string(k)] = string(v)
 		}
 
-		frames = append(
-			frames,
-			newDataFrame(
-				name,
-				"vector",
-				data.NewField("Time", nil, timeVector),
-				data.NewField("Value", tags, values).SetConfig(&data.FieldConfig{DisplayNameFromDS: name}),
-			),
+		frame := newDataFrame(
+			name,
+			"vector",
+			data.NewField("Time", nil, timeVector),
+			data.NewField(valueFieldName(v.Metric, query), tags, values).SetConfig(&data.FieldConfig{DisplayNameFromDS: name}),
 		)
+		if query.IncludeLabelsMeta {
+			setLabelsMeta(frame, tags)
+		}
+		frames = append(frames, frame)
 	}
 
 	return frames
@@ -493,10 +1440,25 @@ func deviation(values []float64) float64 {
 	return math.Sqrt(sd / (valuesLen - 1))
 }
 
+// setLabelsMeta records the full label set of the series of frame in its custom metadata, as labels, so that
+// consumers don't have to find the labels in the fields. Frames joining several series, e.g. in the wide or long
+// format, are created anew and don't have it.
+func setLabelsMeta(frame *data.Frame, labels map[string]string) {
+	custom, ok := frame.Meta.Custom.(map[string]interface{})
+	if !ok {
+		return
+	}
+	labelsMeta := make(map[string]string, len(labels))
+	for name, value := range labels {
+		labelsMeta[name] = value
+	}
+	custom["labels"] = labelsMeta
+}
+
 func newDataFrame(name string, typ string, fields ...*data.Field) *data.Frame {
 	frame := data.NewFrame(name, fields...)
 	frame.Meta = &data.FrameMeta{
-		Custom: map[string]string{
+		Custom: map[string]interface{}{
 			"resultType": typ,
 		},
 	}
@@ -1,14 +1,29 @@
 package prometheus
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/client"
+	"github.com/grafana/grafana/pkg/tsdb/prometheus/middleware"
+	"github.com/prometheus/client_golang/api"
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	p "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,6 +43,44 @@ func TestPrometheus_timeSeriesQuery_formatLeged(t *testing.T) {
 		require.Equal(t, "legend backend mobile ", formatLegend(metric, query))
 	})
 
+	t.Run("converting metric name label", func(t *testing.T) {
+		metric := map[p.LabelName]p.LabelValue{
+			p.LabelName(p.MetricNameLabel): p.LabelValue("http_request_total"),
+			p.LabelName("app"):             p.LabelValue("backend"),
+		}
+
+		query := &PrometheusQuery{
+			LegendFormat: "{{__name__}} {{ __name__ }}: {{app}}",
+		}
+
+		require.Equal(t, "http_request_total http_request_total: backend", formatLegend(metric, query))
+	})
+
+	t.Run("missing labels should be empty", func(t *testing.T) {
+		metric := map[p.LabelName]p.LabelValue{
+			p.LabelName("app"): p.LabelValue("backend"),
+		}
+
+		query := &PrometheusQuery{
+			LegendFormat: "{{__name__}}-{{ device }}-{{app}}",
+		}
+
+		require.Equal(t, "--backend", formatLegend(metric, query))
+	})
+
+	t.Run("braces around labels should be kept", func(t *testing.T) {
+		metric := map[p.LabelName]p.LabelValue{
+			p.LabelName("app"):    p.LabelValue("backend"),
+			p.LabelName("device"): p.LabelValue("mobile"),
+		}
+
+		query := &PrometheusQuery{
+			LegendFormat: "{{{app}}} {device} {{ {{device}} }}",
+		}
+
+		require.Equal(t, "{backend} {device} {{ mobile }}", formatLegend(metric, query))
+	})
+
 	t.Run("build full series name", func(t *testing.T) {
 		metric := map[p.LabelName]p.LabelValue{
 			p.LabelName(p.MetricNameLabel): p.LabelValue("http_request_total"),
@@ -90,6 +143,25 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, false, models[0].ExemplarQuery)
 	})
 
+	t.Run("parsing exemplar query of instant query", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(12 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"refId": "A",
+			"instant": true,
+			"exemplar": true
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, false, models[0].ExemplarQuery)
+	})
+
 	t.Run("parsing query model with step", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
@@ -165,6 +237,179 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, time.Minute*2, models[0].Step)
 	})
 
+	t.Run("parsing query model with intervalFactor should keep the step above the safe interval", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"intervalFactor": 2,
+			"intervalMs": 1000,
+			"refId": "A"
+		}`, timeRange)
+		query.Queries[0].MaxDataPoints = 1000000
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		safeInterval := service.intervalCalculator.CalculateSafeInterval(timeRange, int64(safeRes))
+		require.Equal(t, 2*safeInterval.Value, models[0].Step)
+	})
+
+	t.Run("parsing query model without legend format should use the default legend format", func(t *testing.T) {
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: backend.TimeRange{From: now, To: now.Add(time.Hour)}, JSON: []byte(`{"expr": "up"}`)},
+				{RefID: "B", TimeRange: backend.TimeRange{From: now, To: now.Add(time.Hour)}, JSON: []byte(`{"expr": "up", "legendFormat": "{{job}}"}`)},
+				{RefID: "C", TimeRange: backend.TimeRange{From: now, To: now.Add(time.Hour)}, JSON: []byte(`{"expr": "up", "autoLegend": true}`)},
+			},
+		}
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{DefaultLegendFormat: "{{instance}}"})
+		require.NoError(t, err)
+		require.Equal(t, "{{instance}}", models[0].LegendFormat)
+		require.Equal(t, "{{job}}", models[1].LegendFormat)
+		require.Equal(t, "", models[2].LegendFormat)
+
+		metric := p.Metric{"__name__": "up", "instance": "localhost:9090", "job": "prometheus"}
+		require.Equal(t, "localhost:9090", formatLegend(metric, models[0]))
+	})
+
+	t.Run("parsing query model with min step should floor the step", func(t *testing.T) {
+		timeRange := backend.TimeRange{From: now, To: now.Add(time.Hour)}
+
+		query := queryContext(`{
+			"expr": "rate(up[$__interval])",
+			"minStep": "5m",
+			"refId": "A"
+		}`, timeRange)
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Minute, models[0].Step)
+		require.Equal(t, "rate(up[5m])", models[0].Expr)
+
+		query = queryContext(`{
+			"expr": "up",
+			"minStep": "1s",
+			"refId": "A"
+		}`, timeRange)
+
+		models, err = service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.NoError(t, err)
+		require.Equal(t, 15*time.Second, models[0].Step)
+	})
+
+	t.Run("parsing query model with invalid min step should fail", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "up",
+			"minStep": "sometimes",
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `invalid min step "sometimes"`)
+	})
+
+	t.Run("parsing query model with step should use the step as is", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "rate(up[$__interval])",
+			"step": "15s",
+			"intervalFactor": 2,
+			"stepMode": "aligned",
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(12 * time.Hour)})
+		query.Queries[0].MaxDataPoints = 100
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "1m"})
+		require.NoError(t, err)
+		require.Equal(t, 15*time.Second, models[0].Step)
+		require.Equal(t, "rate(up[15s])", models[0].Expr)
+		require.Empty(t, models[0].Notices)
+	})
+
+	t.Run("parsing query model with step returning too many data points should fail", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "up",
+			"step": "1s",
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(48 * time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, "the step 1s would return more than 11000 data points per series, use a wider step")
+	})
+
+	t.Run("parsing query model with raw resolution should use the scrape interval as step", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "rate(up[$__interval])",
+			"resolution": "raw",
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(12 * time.Hour)})
+		query.Queries[0].MaxDataPoints = 100
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.NoError(t, err)
+		require.Equal(t, 15*time.Second, models[0].Step)
+		require.Equal(t, "rate(up[15s])", models[0].Expr)
+		require.Empty(t, models[0].Notices)
+	})
+
+	t.Run("parsing query model with raw resolution returning too many data points should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "resolution": "raw"}`, backend.TimeRange{From: now, To: now.Add(48 * time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.EqualError(t, err, "the raw resolution of 15s would return more than 11000 data points per series, narrow the time range")
+	})
+
+	t.Run("parsing query model with raw resolution should fail without scrape interval", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "resolution": "raw"}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, "the raw resolution needs the scrape interval of the datasource to be configured")
+	})
+
+	t.Run("parsing query model with invalid resolution should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "resolution": "high"}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.EqualError(t, err, `invalid resolution "high", it must be raw`)
+	})
+
+	t.Run("parsing query model with invalid step should fail", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "up",
+			"step": "often",
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, `invalid step "often"`)
+	})
+
+	t.Run("parsing query model with negative intervalFactor should fail", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"intervalFactor": -1,
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, "invalid interval factor -1, it must be a positive integer")
+	})
+
+	t.Run("parsing query model with fractional intervalFactor should fail", func(t *testing.T) {
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"intervalFactor": 1.5,
+			"refId": "A"
+		}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.Error(t, err)
+	})
+
 	t.Run("parsing query model specified scrape-interval in the data source", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
@@ -186,6 +431,88 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, time.Minute*4, models[0].Step)
 	})
 
+	t.Run("parsing query model with aligned step mode", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"stepMode": "aligned",
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{
+			TimeInterval: "45s",
+		}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, 135*time.Second, models[0].Step)
+	})
+
+	t.Run("parsing query model with aligned step mode without scrape-interval", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"format": "time_series",
+			"stepMode": "aligned",
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute*2, models[0].Step)
+	})
+
+	t.Run("parsing query model exceeding max data points of the data source", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"format": "time_series",
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{
+			MaxDataPoints: 100,
+		}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute*30, models[0].Step)
+		require.Len(t, models[0].Notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, models[0].Notices[0].Severity)
+		require.Equal(t, "The step was increased from 2m to 30m to stay within the limit of 100 data points per series.", models[0].Notices[0].Text)
+	})
+
+	t.Run("parsing query model within max data points should not add notices", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"format": "time_series",
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Empty(t, models[0].Notices)
+	})
+
 	t.Run("parsing query model with $__interval variable", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
@@ -205,6 +532,51 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, "rate(ALERTS{job=\"test\" [2m]})", models[0].Expr)
 	})
 
+	t.Run("parsing query model with a step much wider than the scrape interval should warn about downsampling", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+		query := queryContext(`{"expr": "up", "intervalFactor": 1, "refId": "A"}`, timeRange)
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s", DownsampleFactor: 5})
+		require.NoError(t, err)
+		require.Equal(t, 2*time.Minute, models[0].Step)
+		require.Equal(t, []data.Notice{{
+			Severity: data.NoticeSeverityInfo,
+			Text:     "Data downsampled: step 2m vs scrape interval 15s, narrow the time range to see every sample.",
+		}}, models[0].Notices)
+
+		// The step is within the factor
+		models, err = service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s", DownsampleFactor: 10})
+		require.NoError(t, err)
+		require.Empty(t, models[0].Notices)
+
+		// The step is fixed by the query
+		query = queryContext(`{"expr": "up", "step": "10m", "refId": "A"}`, timeRange)
+		models, err = service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s", DownsampleFactor: 5})
+		require.NoError(t, err)
+		require.Empty(t, models[0].Notices)
+	})
+
+	t.Run("parsing query model with $__from and $__to variables for the @ modifier", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: time.Unix(1640995200, 500*int64(time.Millisecond)),
+			To:   time.Unix(1640995200, 0).Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "rate(up[5m] @ $__to) - rate(up[5m] @ ${__from} offset $__interval) + up @ ${__to}",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.NoError(t, err)
+		require.Equal(t, "rate(up[5m] @ 1641168000) - rate(up[5m] @ 1640995200 offset 2m) + up @ 1641168000", models[0].Expr)
+		require.NoError(t, validateQuery(models[0].Expr))
+	})
+
 	t.Run("parsing query model with ${__interval} variable", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
@@ -243,6 +615,27 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, "rate(ALERTS{job=\"test\" [120000]})", models[0].Expr)
 	})
 
+	t.Run("parsing query model with $__interval_ms variable and sub-second interval", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(5 * time.Minute),
+		}
+
+		query := queryContext(`{
+			"expr": "rate(ALERTS{job=\"test\" [$__interval]}) / $__interval_ms",
+			"format": "time_series",
+			"interval": "100ms",
+			"refId": "A"
+		}`, timeRange)
+		query.Queries[0].MaxDataPoints = 10000
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, 100*time.Millisecond, models[0].Step)
+		require.Equal(t, "rate(ALERTS{job=\"test\" [100ms]}) / 100", models[0].Expr)
+	})
+
 	t.Run("parsing query model with $__interval_ms and $__interval variable", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
@@ -373,7 +766,26 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		dsInfo := &DatasourceInfo{}
 		models, err := service.parseTimeSeriesQuery(query, dsInfo)
 		require.NoError(t, err)
-		require.Equal(t, "rate(ALERTS{job=\"test\" [1]})", models[0].Expr)
+		require.Equal(t, "rate(ALERTS{job=\"test\" [0]})", models[0].Expr)
+	})
+
+	t.Run("parsing query model with $__range_s and $__range variables floors the range", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(1900 * time.Millisecond),
+		}
+
+		query := queryContext(`{
+			"expr": "increase(ALERTS{job=\"test\"}[$__range]) / $__range_s / ${__range_s}",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "increase(ALERTS{job=\"test\"}[1s]) / 1 / 1", models[0].Expr)
 	})
 
 	t.Run("parsing query model with $__range_ms variable", func(t *testing.T) {
@@ -414,14 +826,14 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.Equal(t, "rate(ALERTS{job=\"test\" [20]})", models[0].Expr)
 	})
 
-	t.Run("parsing query model with $__rate_interval variable", func(t *testing.T) {
+	t.Run("parsing query model with ${__range_ms} variable in a subquery", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
-			To:   now.Add(5 * time.Minute),
+			To:   now.Add(1500*time.Millisecond + 900*time.Microsecond),
 		}
 
 		query := queryContext(`{
-			"expr": "rate(ALERTS{job=\"test\" [$__rate_interval]})",
+			"expr": "max_over_time(up[${__range_ms}ms:${__range_s}s]) / $__range_ms",
 			"format": "time_series",
 			"intervalFactor": 1,
 			"refId": "A"
@@ -430,17 +842,167 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		dsInfo := &DatasourceInfo{}
 		models, err := service.parseTimeSeriesQuery(query, dsInfo)
 		require.NoError(t, err)
-		require.Equal(t, "rate(ALERTS{job=\"test\" [1m]})", models[0].Expr)
+		require.Equal(t, "max_over_time(up[1500ms:1s]) / 1500", models[0].Expr)
 	})
 
-	t.Run("parsing query model of range query", func(t *testing.T) {
+	t.Run("parsing query model with $__interval variable as the resolution of a subquery", func(t *testing.T) {
 		timeRange := backend.TimeRange{
 			From: now,
 			To:   now.Add(48 * time.Hour),
 		}
 
 		query := queryContext(`{
-			"expr": "go_goroutines",
+			"expr": "max_over_time(rate(up[5m])[1h:$__interval]) + max_over_time(up[1h: ${__rate_interval} ]) + rate(up[$__interval])",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{TimeInterval: "15s"}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "max_over_time(rate(up[5m])[1h:2m]) + max_over_time(up[1h: 2m ]) + rate(up[2m])", models[0].Expr)
+		require.NoError(t, validateQuery(models[0].Expr))
+	})
+
+	t.Run("parsing query model with a sub-second $__interval variable as the resolution of a subquery", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(time.Minute),
+		}
+
+		query := queryContext(`{
+			"expr": "max_over_time(rate(up[5m])[1h:$__interval]) / ${__interval_ms} + max_over_time(up[${__interval}:${__interval}])",
+			"format": "time_series",
+			"step": "200ms",
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "max_over_time(rate(up[5m])[1h:1s]) / 200 + max_over_time(up[200ms:1s])", models[0].Expr)
+		require.NoError(t, validateQuery(models[0].Expr))
+	})
+
+	t.Run("parsing query model with negative round to should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "roundTo": -1}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, "invalid round to -1, it must be a non-negative number of decimal places")
+	})
+
+	t.Run("parsing query model with negative last N should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "lastN": -1}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, "invalid last N -1, it must be a non-negative number of samples")
+	})
+
+	t.Run("parsing query model with unknown stale handling should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "staleHandling": "interpolate"}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, `invalid stale handling "interpolate", it must be gap, zero or previous`)
+	})
+
+	t.Run("parsing query model with headers should keep them", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "headers": {"X-Backend": "eu-west"}}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"X-Backend": "eu-west"}, models[0].Headers)
+	})
+
+	t.Run("parsing query model with a credentials header should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "headers": {"Authorization": "Bearer token"}}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, `invalid header "Authorization", it can't be set by a query`)
+	})
+
+	t.Run("parsing query model should only infer the scrape interval if the datasource doesn't configure it", func(t *testing.T) {
+		query := queryContext(`{"expr": "up[5m]", "instant": true, "inferScrapeInterval": true}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		models, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.NoError(t, err)
+		require.True(t, models[0].InferScrapeInterval)
+
+		models, err = service.parseTimeSeriesQuery(query, &DatasourceInfo{TimeInterval: "15s"})
+		require.NoError(t, err)
+		require.False(t, models[0].InferScrapeInterval)
+	})
+
+	t.Run("parsing query model with unknown value transform should fail", func(t *testing.T) {
+		query := queryContext(`{"expr": "up", "valueTransform": "log"}`, backend.TimeRange{From: now, To: now.Add(time.Hour)})
+		_, err := service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.EqualError(t, err, `invalid value transform "log", it must be negate, abs, cumsum or derivative`)
+	})
+
+	t.Run("parsing query model with $__rate_interval variable", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(5 * time.Minute),
+		}
+
+		query := queryContext(`{
+			"expr": "rate(ALERTS{job=\"test\" [$__rate_interval]})",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{
+			TimeInterval: "15s",
+		}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "rate(ALERTS{job=\"test\" [1m]})", models[0].Expr)
+	})
+
+	t.Run("parsing query model with $__rate_interval variable and long range", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(7 * 24 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "rate(ALERTS{job=\"test\" [$__rate_interval]})",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		// $__interval is 5m, so $__interval + scrape interval is greater than 4 * scrape interval
+		dsInfo := &DatasourceInfo{
+			TimeInterval: "1m",
+		}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "rate(ALERTS{job=\"test\" [6m]})", models[0].Expr)
+	})
+
+	t.Run("parsing query model with $__rate_interval variable without scrape interval", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "rate(ALERTS{job=\"test\" [$__rate_interval]})",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A"
+		}`, timeRange)
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "rate(ALERTS{job=\"test\" [2m]})", models[0].Expr)
+	})
+
+	t.Run("parsing query model of range query", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
 			"format": "time_series",
 			"intervalFactor": 1,
 			"refId": "A",
@@ -493,6 +1055,29 @@ func TestPrometheus_timeSeriesQuery_parseTimeSeriesQuery(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, true, models[0].RangeQuery)
 	})
+
+	t.Run("parsing query model of instant query type", func(t *testing.T) {
+		timeRange := backend.TimeRange{
+			From: now,
+			To:   now.Add(48 * time.Hour),
+		}
+
+		query := queryContext(`{
+			"expr": "go_goroutines",
+			"format": "time_series",
+			"intervalFactor": 1,
+			"refId": "A",
+			"range": true
+		}`, timeRange)
+		query.Queries[0].QueryType = "instantQuery"
+
+		dsInfo := &DatasourceInfo{}
+		models, err := service.parseTimeSeriesQuery(query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, false, models[0].RangeQuery)
+		require.Equal(t, true, models[0].InstantQuery)
+		require.Equal(t, timeRange.To, models[0].End)
+	})
 }
 
 func TestPrometheus_parseTimeSeriesResponse(t *testing.T) {
@@ -607,6 +1192,41 @@ func TestPrometheus_parseTimeSeriesResponse(t *testing.T) {
 		require.Equal(t, res[0].Fields[1].At(0), nilPointer)
 	})
 
+	t.Run("matrix response with near-duplicate timestamps should be deduplicated", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				&p.SampleStream{
+					Metric: p.Metric{"app": "Application"},
+					Values: []p.SamplePair{
+						{Value: 3, Timestamp: 2000},
+						{Value: 2, Timestamp: 1001},
+						{Value: 1, Timestamp: 1000},
+						{Value: 4, Timestamp: 2001},
+						{Value: 5, Timestamp: 3000},
+					},
+				},
+			},
+		}
+
+		query := &PrometheusQuery{DedupEpsilon: time.Millisecond}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+		require.Equal(t, 3, res[0].Fields[0].Len())
+		for i, expected := range []float64{2, 4, 5} {
+			require.Equal(t, time.Unix(int64(i+1), 0).UTC(), res[0].Fields[0].At(i))
+			require.Equal(t, expected, *res[0].Fields[1].At(i).(*float64))
+		}
+
+		// Runs are measured from their first sample, so samples spread further than epsilon are kept
+		samples := dedupSamples([]p.SamplePair{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 1001}, {Value: 3, Timestamp: 1002}}, time.Millisecond)
+		require.Equal(t, []p.SamplePair{{Value: 2, Timestamp: 1001}, {Value: 3, Timestamp: 1002}}, samples)
+
+		query = &PrometheusQuery{}
+		res, err = parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+		require.Equal(t, 5, res[0].Fields[0].Len())
+	})
+
 	t.Run("vector response should be parsed normally", func(t *testing.T) {
 		value := make(map[TimeSeriesQueryType]interface{})
 		value[RangeQueryType] = p.Vector{
@@ -661,6 +1281,1088 @@ func TestPrometheus_parseTimeSeriesResponse(t *testing.T) {
 		testValue := res[0].Fields[0].At(0)
 		require.Equal(t, "UTC", testValue.(time.Time).Location().String())
 	})
+	t.Run("values should be rounded to the decimal places of the query", func(t *testing.T) {
+		decimals := func(n int) *int { return &n }
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				{
+					Metric: p.Metric{"__name__": "up"},
+					Values: []p.SamplePair{
+						{Value: 1.23456, Timestamp: 1000},
+						{Value: -1.23556, Timestamp: 2000},
+						{Value: p.SampleValue(math.Inf(-1)), Timestamp: 3000},
+						{Value: p.SampleValue(math.NaN()), Timestamp: 4000},
+						{Value: 1e308, Timestamp: 5000},
+					},
+				},
+			},
+			InstantQueryType: p.Vector{
+				{Metric: p.Metric{"__name__": "up"}, Value: -2.5, Timestamp: 1000},
+				{Metric: p.Metric{"__name__": "down"}, Value: p.SampleValue(math.Inf(1)), Timestamp: 1000},
+			},
+		}
+
+		query := &PrometheusQuery{RoundTo: decimals(2)}
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{RangeQueryType: value[RangeQueryType]}, query)
+		require.NoError(t, err)
+		matrix := res[0]
+		vector, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{InstantQueryType: value[InstantQueryType]}, query)
+		require.NoError(t, err)
+		require.Equal(t, 1.23, *matrix.Fields[1].At(0).(*float64))
+		require.Equal(t, -1.24, *matrix.Fields[1].At(1).(*float64))
+		require.True(t, math.IsInf(*matrix.Fields[1].At(2).(*float64), -1))
+		require.Nil(t, matrix.Fields[1].At(3))
+		require.Equal(t, 1e308, *matrix.Fields[1].At(4).(*float64))
+		require.Equal(t, -2.5, vector[0].Fields[1].At(0))
+		require.True(t, math.IsInf(vector[1].Fields[1].At(0).(float64), 1))
+
+		res, err = parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{InstantQueryType: value[InstantQueryType]}, &PrometheusQuery{RoundTo: decimals(0)})
+		require.NoError(t, err)
+		require.Equal(t, -3.0, res[0].Fields[1].At(0))
+
+		res, err = parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{RangeQueryType: value[RangeQueryType]}, &PrometheusQuery{})
+		require.NoError(t, err)
+		require.Equal(t, 1.23456, *res[0].Fields[1].At(0).(*float64))
+	})
+
+	t.Run("matrix response should keep the last N samples of every series", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				{
+					Metric: p.Metric{"app": "long"},
+					Values: []p.SamplePair{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: 3, Timestamp: 3000}, {Value: 4, Timestamp: 4000}},
+				},
+				{
+					Metric: p.Metric{"app": "short"},
+					Values: []p.SamplePair{{Value: 5, Timestamp: 3000}},
+				},
+			},
+		}
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{LastN: 2})
+		require.NoError(t, err)
+
+		require.Len(t, res, 2)
+		require.Equal(t, 2, res[0].Fields[0].Len())
+		require.Equal(t, time.Unix(3, 0).UTC(), res[0].Fields[0].At(0))
+		require.Equal(t, 3.0, *res[0].Fields[1].At(0).(*float64))
+		require.Equal(t, 4.0, *res[0].Fields[1].At(1).(*float64))
+		// Series with fewer samples are kept as they are
+		require.Equal(t, 1, res[1].Fields[0].Len())
+		require.Equal(t, 5.0, *res[1].Fields[1].At(0).(*float64))
+	})
+
+	t.Run("matrix response should show NaN values according to the stale handling", func(t *testing.T) {
+		nan := p.SampleValue(math.NaN())
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType: p.Matrix{
+				{
+					Metric: p.Metric{"app": "Application"},
+					Values: []p.SamplePair{{Value: nan, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: nan, Timestamp: 3000}, {Value: nan, Timestamp: 4000}},
+				},
+			},
+		}
+		values := func(t *testing.T, staleHandling string) []*float64 {
+			t.Helper()
+			res, err := parseTimeSeriesResponse(value, &PrometheusQuery{StaleHandling: staleHandling})
+			require.NoError(t, err)
+			field := res[0].Fields[1]
+			values := make([]*float64, field.Len())
+			for i := range values {
+				values[i] = field.At(i).(*float64)
+			}
+			return values
+		}
+		number := func(v float64) *float64 { return &v }
+
+		require.Equal(t, []*float64{nil, number(2), nil, nil}, values(t, ""))
+		require.Equal(t, []*float64{nil, number(2), nil, nil}, values(t, staleHandlingGap))
+		require.Equal(t, []*float64{number(0), number(2), number(0), number(0)}, values(t, staleHandlingZero))
+		require.Equal(t, []*float64{nil, number(2), number(2), number(2)}, values(t, staleHandlingPrevious))
+	})
+
+	t.Run("series should be named after their raw labels with raw field names, keeping the legend as display name", func(t *testing.T) {
+		metric := p.Metric{"__name__": "up", "app": "Application"}
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType:   p.Matrix{{Metric: metric, Values: []p.SamplePair{{Value: 1, Timestamp: 1000}}}},
+			InstantQueryType: p.Vector{{Metric: metric, Value: 1, Timestamp: 1000}},
+		}
+
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Expr: "up", LegendFormat: "legend {{app}}", RawFieldNames: true})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		for _, frame := range res {
+			require.Equal(t, "legend Application", frame.Name)
+			require.Equal(t, `up{app="Application"}`, frame.Fields[1].Name)
+			require.Equal(t, "legend Application", frame.Fields[1].Config.DisplayNameFromDS)
+		}
+
+		res, err = parseTimeSeriesResponse(value, &PrometheusQuery{Expr: "up", LegendFormat: "legend {{app}}"})
+		require.NoError(t, err)
+		require.Equal(t, "Value", res[0].Fields[1].Name)
+		require.Equal(t, "Value", res[1].Fields[1].Name)
+	})
+
+	t.Run("series should carry their labels in the metadata with include labels meta", func(t *testing.T) {
+		metric := p.Metric{"__name__": "up", "app": "Application"}
+		value := map[TimeSeriesQueryType]interface{}{
+			RangeQueryType:   p.Matrix{{Metric: metric, Values: []p.SamplePair{{Value: 1, Timestamp: 1000}}}},
+			InstantQueryType: p.Vector{{Metric: metric, Value: 1, Timestamp: 1000}},
+		}
+
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Expr: "up", LegendFormat: "{{app}}", IncludeLabelsMeta: true})
+		require.NoError(t, err)
+		require.Len(t, res, 2)
+		for _, frame := range res {
+			custom := frame.Meta.Custom.(map[string]interface{})
+			require.Equal(t, map[string]string{"__name__": "up", "app": "Application"}, custom["labels"])
+		}
+
+		res, err = parseTimeSeriesResponse(value, &PrometheusQuery{Expr: "up", LegendFormat: "{{app}}"})
+		require.NoError(t, err)
+		for _, frame := range res {
+			require.NotContains(t, frame.Meta.Custom, "labels")
+		}
+	})
+
+	t.Run("instant queries drawn as range should span the time range", func(t *testing.T) {
+		value := map[TimeSeriesQueryType]interface{}{
+			InstantQueryType: p.Vector{
+				{Metric: p.Metric{"app": "Application"}, Value: 4, Timestamp: p.TimeFromUnix(now.Unix())},
+			},
+		}
+		query := &PrometheusQuery{
+			Start:          now,
+			End:            now.Add(time.Hour),
+			InstantAsRange: true,
+			LegendFormat:   "legend {{app}}",
+		}
+		res, err := parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+
+		require.Len(t, res, 1)
+		require.Equal(t, 2, res[0].Fields[0].Len())
+		require.Equal(t, now.UTC(), res[0].Fields[0].At(0))
+		require.Equal(t, now.Add(time.Hour).UTC(), res[0].Fields[0].At(1))
+		require.Equal(t, 4.0, res[0].Fields[1].At(0))
+		require.Equal(t, 4.0, res[0].Fields[1].At(1))
+		require.Equal(t, "app=Application", res[0].Fields[1].Labels.String())
+		require.Equal(t, "legend Application", res[0].Fields[1].Config.DisplayNameFromDS)
+
+		query = &PrometheusQuery{Start: now, End: now, InstantAsRange: true}
+		res, err = parseTimeSeriesResponse(value, query)
+		require.NoError(t, err)
+		require.Equal(t, 1, res[0].Fields[0].Len())
+	})
+}
+
+func TestPrometheus_executeTimeSeriesQuery(t *testing.T) {
+	service := Service{
+		intervalCalculator: intervalv2.NewCalculator(),
+	}
+
+	timeRange := backend.TimeRange{
+		From: now,
+		To:   now.Add(1 * time.Hour),
+	}
+
+	t.Run("exemplar query returning 404 should be skipped", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query_range":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+			default:
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		})
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"range": true,
+			"exemplar": true
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, "matrix", res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})["resultType"])
+	})
+
+	t.Run("query exceeding the query timeout should return a timeout error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+		dsInfo.QueryTimeout = 10 * time.Millisecond
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"range": true
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "query timed out after 10ms")
+
+		var queryErr *QueryError
+		require.ErrorAs(t, res.Responses["A"].Error, &queryErr)
+		require.Equal(t, ErrorSourceDownstream, queryErr.Source)
+		require.Equal(t, ErrorStatusTimeout, queryErr.Status)
+	})
+
+	t.Run("multiple queries should each get their own response", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			if req.Form.Get("query") == "bad" {
+				rw.WriteHeader(http.StatusBadRequest)
+				_, _ = rw.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"` + req.Form.Get("query") + `"},"values":[[1,"1"]]}]}}`))
+		})
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "bad", "range": true}`)},
+				{RefID: "C", TimeRange: timeRange, JSON: []byte(`{"expr": "go_goroutines", "range": true}`)},
+				{RefID: "D", TimeRange: timeRange, JSON: []byte(`{"expr": `)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Len(t, res.Responses, 4)
+
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, `up`, res.Responses["A"].Frames[0].Name)
+		require.Error(t, res.Responses["B"].Error)
+		require.NoError(t, res.Responses["C"].Error)
+		require.Equal(t, `go_goroutines`, res.Responses["C"].Frames[0].Name)
+		require.Error(t, res.Responses["D"].Error)
+
+		// Invalid queries are errors of the user, not of the datasource
+		for _, refID := range []string{"B", "D"} {
+			var queryErr *QueryError
+			require.ErrorAs(t, res.Responses[refID].Error, &queryErr)
+			require.Equal(t, ErrorSourceDownstream, queryErr.Source, refID)
+			require.Equal(t, ErrorStatusBadData, queryErr.Status, refID)
+		}
+	})
+
+	t.Run("invalid query should not be sent when validation is enabled", func(t *testing.T) {
+		var sent []string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			sent = append(sent, req.Form.Get("query"))
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		})
+		dsInfo.ValidateQueries = true
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "rate(up[$__rate_interval])", "range": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "sum(rate(up[5m])", "range": true}`)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, []string{"rate(up[15s])"}, sent)
+
+		var parseErrs parser.ParseErrors
+		require.ErrorAs(t, res.Responses["B"].Error, &parseErrs)
+		require.Equal(t, parser.Pos(16), parseErrs[0].PositionRange.Start)
+	})
+
+	t.Run("streaming range query should return the same frames", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"]]},{"metric":{"__name__":"up","job":"b"},"values":[[1,"0"]]}]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		c, err := client.New(srv.URL, http.DefaultTransport)
+		require.NoError(t, err)
+		dsInfo := &DatasourceInfo{URL: srv.URL, promClient: c}
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"range": true,
+			"streaming": true,
+			"legendFormat": "{{job}}"
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 2)
+		require.Equal(t, "a", res.Responses["A"].Frames[0].Name)
+		require.Equal(t, "b", res.Responses["A"].Frames[1].Name)
+		require.Equal(t, "matrix", res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})["resultType"])
+	})
+
+	t.Run("query returning more series than the limit should drop the others with a warning", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"]]},
+				{"metric":{"__name__":"up","job":"b"},"values":[[1,"1"]]},
+				{"metric":{"__name__":"up","job":"c"},"values":[[1,"1"]]}
+			]}}`))
+		}))
+		t.Cleanup(srv.Close)
+		c, err := client.New(srv.URL, http.DefaultTransport)
+		require.NoError(t, err)
+		dsInfo := &DatasourceInfo{promClient: c, MaxSeries: 2}
+
+		for _, streaming := range []bool{false, true} {
+			query := queryContext(`{"expr": "up", "range": true, "legendFormat": "{{job}}", "streaming": `+strconv.FormatBool(streaming)+`}`, timeRange)
+			res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+			require.NoError(t, err)
+			require.NoError(t, res.Responses["A"].Error)
+
+			frames := res.Responses["A"].Frames
+			require.Len(t, frames, 2, "streaming %t", streaming)
+			require.Equal(t, "a", frames[0].Name)
+			require.Equal(t, "b", frames[1].Name)
+			require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: "Dropped 1 series to stay within the limit of 2 series per query."}}, frames[0].Meta.Notices)
+		}
+
+		// The limit of the query replaces the one of the datasource
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true, "maxSeries": 3}`, timeRange), dsInfo)
+		require.NoError(t, err)
+		require.Len(t, res.Responses["A"].Frames, 3)
+		require.Empty(t, res.Responses["A"].Frames[0].Meta.Notices)
+
+		res, err = service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true, "maxSeries": -1}`, timeRange), dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "invalid max series -1, it must be a positive integer")
+	})
+
+	t.Run("range and instant queries failing with a 503 should be retried with their body", func(t *testing.T) {
+		var bodies []string
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/status/buildinfo" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			require.Equal(t, http.MethodPost, req.Method)
+			require.NoError(t, req.ParseForm())
+			bodies = append(bodies, req.URL.Path+" "+req.PostForm.Get("query"))
+			if len(bodies)%2 == 1 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if req.URL.Path == "/api/v1/query" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{ID: 1, URL: srv.URL, JSONData: []byte(`{"retryMaxAttempts": 2, "retryBackoff": "1ms"}`)})
+		require.NoError(t, err)
+		dsInfo := instance.(DatasourceInfo)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true, "instant": true}`, timeRange), &dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 2)
+		require.Equal(t, []string{
+			"/api/v1/query_range up", "/api/v1/query_range up",
+			"/api/v1/query up", "/api/v1/query up",
+		}, bodies)
+	})
+
+	t.Run("query without series limit should use the default limit", func(t *testing.T) {
+		models, err := service.parseTimeSeriesQuery(queryContext(`{"expr": "up"}`, timeRange), &DatasourceInfo{})
+		require.NoError(t, err)
+		require.Equal(t, defaultMaxSeries, models[0].MaxSeries)
+
+		// Alert queries aren't limited by default
+		query := queryContext(`{"expr": "up"}`, timeRange)
+		query.Queries[0].QueryType = alertQueryType
+		models, err = service.parseTimeSeriesQuery(query, &DatasourceInfo{})
+		require.NoError(t, err)
+		require.Zero(t, models[0].MaxSeries)
+	})
+
+	t.Run("alert query returning more series than the limit should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__name__":"up","job":"a"},"values":[[1,"1"]]},
+				{"metric":{"__name__":"up","job":"b"},"values":[[1,"1"]]}
+			]}}`))
+		})
+
+		for _, streaming := range []bool{false, true} {
+			query := queryContext(`{"expr": "up", "range": true, "maxSeries": 1, "streaming": `+strconv.FormatBool(streaming)+`}`, timeRange)
+			query.Queries[0].QueryType = alertQueryType
+			res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+			require.NoError(t, err)
+			require.EqualError(t, res.Responses["A"].Error, "the query returned more than the limit of 1 series", "streaming %t", streaming)
+			require.Empty(t, res.Responses["A"].Frames)
+		}
+	})
+
+	t.Run("query with an inverted or unset time range should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		end := time.Unix(1600000000, 0)
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{From: end, To: end.Add(-time.Hour)}), dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "invalid time range, the end 2020-09-13T11:26:40Z is before the start 2020-09-13T12:26:40Z")
+
+		res, err = service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true}`, backend.TimeRange{}), dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "invalid time range, it is not set")
+	})
+
+	t.Run("range query with a time range without duration should be an instant query at its time", func(t *testing.T) {
+		var received *http.Request
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			received = req
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1600000000,"1"]}]}}`))
+		})
+
+		at := time.Unix(1600000000, 0)
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "range": true, "exemplar": true}`, backend.TimeRange{From: at, To: at}), dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "/api/v1/query", received.URL.Path)
+		require.Equal(t, "1600000000", received.Form.Get("time"))
+		require.Len(t, res.Responses["A"].Frames, 1)
+	})
+
+	t.Run("instant query with time shift should be evaluated earlier", func(t *testing.T) {
+		var evaluatedAt string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			evaluatedAt = req.Form.Get("time")
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+		})
+
+		end := time.Unix(1600003600, 0)
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"instant": true,
+			"timeShift": "5m"
+		}`, backend.TimeRange{From: end.Add(-time.Hour), To: end})
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "1600003300", evaluatedAt)
+		require.Equal(t, "2020-09-13T13:21:40Z", res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})["evaluationTime"])
+	})
+
+	t.Run("query with invalid time shift should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"instant": true,
+			"timeShift": "yesterday"
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Error(t, res.Responses["A"].Error)
+		require.Contains(t, res.Responses["A"].Error.Error(), `invalid time shift "yesterday"`)
+	})
+
+	t.Run("range query with alignTimestamps should snap timestamps to the step", func(t *testing.T) {
+		values := `[[1599999991.2,"1"],[1600000019,"2"],[1600000051,"3"]]`
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":` + values + `}]}}`))
+		})
+		alignedRange := backend.TimeRange{From: time.Unix(1600000000, 0), To: time.Unix(1600000060, 0)}
+
+		query := queryContext(`{"expr": "up", "range": true, "step": "30s", "alignTimestamps": true}`, alignedRange)
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+
+		// The start of the range is aligned to the step, so the boundaries are multiples of 30s
+		frame := res.Responses["A"].Frames[0]
+		require.Equal(t, time.Unix(1599999990, 0).UTC(), frame.Fields[0].At(0))
+		require.Equal(t, time.Unix(1600000020, 0).UTC(), frame.Fields[0].At(1))
+		require.Equal(t, time.Unix(1600000050, 0).UTC(), frame.Fields[0].At(2))
+		require.Empty(t, frame.Meta.Notices)
+
+		query = queryContext(`{"expr": "up", "range": true, "step": "30s"}`, alignedRange)
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, time.Unix(1600000019, 0).UTC(), res.Responses["A"].Frames[0].Fields[0].At(1))
+	})
+
+	t.Run("range query with alignTimestamps should keep timestamps which would share a step", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1600000019,"1"],[1600000024,"2"]]}]}}`))
+		})
+
+		query := queryContext(`{"expr": "up", "range": true, "step": "30s", "alignTimestamps": true}`, backend.TimeRange{From: time.Unix(1600000000, 0), To: time.Unix(1600000060, 0)})
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+
+		frame := res.Responses["A"].Frames[0]
+		require.Equal(t, time.Unix(1600000019, 0).UTC(), frame.Fields[0].At(0))
+		require.Equal(t, time.Unix(1600000024, 0).UTC(), frame.Fields[0].At(1))
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+		require.Contains(t, frame.Meta.Notices[0].Text, "not aligned to the step")
+	})
+
+	t.Run("instant query with lookback delta should send it with the instant query only", func(t *testing.T) {
+		params := map[string]url.Values{}
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/status/buildinfo" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"0.24.0"}}`))
+				return
+			}
+			params[req.URL.Path] = req.URL.Query()
+			if req.URL.Path == "/api/v1/query" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{ID: 1, URL: srv.URL, JSONData: []byte(`{}`)})
+		require.NoError(t, err)
+		dsInfo := instance.(DatasourceInfo)
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"instant": true,
+			"range": true,
+			"lookbackDelta": "10m"
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, &dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "600", params["/api/v1/query"].Get("lookback_delta"))
+		require.NotContains(t, params["/api/v1/query_range"], "lookback_delta")
+		// Parameters of the backend are still added
+		require.Equal(t, "true", params["/api/v1/query"].Get("dedup"))
+	})
+
+	t.Run("instant query without lookback delta should use the default of Prometheus", func(t *testing.T) {
+		var form url.Values
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			form = req.Form
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		})
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(`{"expr": "up", "instant": true}`, timeRange), dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.NotContains(t, form, "lookback_delta")
+	})
+
+	t.Run("query timeout should be sent to Prometheus with the range and instant query", func(t *testing.T) {
+		params := map[string]url.Values{}
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/api/v1/status/buildinfo" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"version":"2.30.0"}}`))
+				return
+			}
+			params[req.URL.Path] = req.URL.Query()
+			if req.URL.Path == "/api/v1/query" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		execute := func(t *testing.T, jsonData string, queryJSON string) {
+			t.Helper()
+			params = map[string]url.Values{}
+			instance, err := newInstanceSettings(setting.NewCfg(), httpclient.NewProvider())(backend.DataSourceInstanceSettings{ID: 1, URL: srv.URL, JSONData: []byte(jsonData)})
+			require.NoError(t, err)
+			dsInfo := instance.(DatasourceInfo)
+
+			res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(queryJSON, timeRange), &dsInfo)
+			require.NoError(t, err)
+			require.NoError(t, res.Responses["A"].Error)
+		}
+
+		execute(t, `{"queryTimeout": "30s"}`, `{"expr": "up", "instant": true, "range": true}`)
+		require.Equal(t, "30", params["/api/v1/query"].Get("timeout"))
+		require.Equal(t, "30", params["/api/v1/query_range"].Get("timeout"))
+
+		// The timeout of the query replaces the one of the datasource
+		execute(t, `{"queryTimeout": "30s"}`, `{"expr": "up", "instant": true, "queryTimeout": "1500ms"}`)
+		require.Equal(t, "1.5", params["/api/v1/query"].Get("timeout"))
+
+		execute(t, `{}`, `{"expr": "up", "instant": true, "range": true}`)
+		require.NotContains(t, params["/api/v1/query"], "timeout")
+		require.NotContains(t, params["/api/v1/query_range"], "timeout")
+	})
+
+	t.Run("query with invalid query timeout should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		for _, timeout := range []string{"soon", "0s"} {
+			res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(fmt.Sprintf(`{"expr": "up", "instant": true, "queryTimeout": %q}`, timeout), timeRange), dsInfo)
+			require.NoError(t, err)
+			require.Error(t, res.Responses["A"].Error)
+		}
+	})
+
+	t.Run("query with invalid lookback delta should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		for _, lookbackDelta := range []string{"soon", "0s"} {
+			query := queryContext(`{"expr": "up", "instant": true, "lookbackDelta": "`+lookbackDelta+`"}`, timeRange)
+
+			res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+			require.NoError(t, err)
+			require.Error(t, res.Responses["A"].Error)
+			require.Contains(t, res.Responses["A"].Error.Error(), fmt.Sprintf("invalid lookback delta %q", lookbackDelta))
+		}
+	})
+
+	t.Run("query with invalid dedup epsilon should return an error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+
+		for _, epsilon := range []string{"soon", "0s"} {
+			query := queryContext(`{"expr": "up", "range": true, "dedupTimestamps": true, "dedupEpsilon": "`+epsilon+`"}`, timeRange)
+
+			res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+			require.NoError(t, err)
+			require.Error(t, res.Responses["A"].Error)
+			require.Contains(t, res.Responses["A"].Error.Error(), fmt.Sprintf("invalid dedup epsilon %q", epsilon))
+		}
+	})
+
+	t.Run("query with showStats should return the query statistics in the frame metadata", func(t *testing.T) {
+		var stats string
+		srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			stats = req.URL.Query().Get("stats")
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}],"stats":{"timings":{"execTotalTime":0.5},"samples":{"totalQueryableSamples":42}}}}`))
+		}))
+		t.Cleanup(srv.Close)
+
+		rt := middleware.QueryStatsMiddleware(plog).CreateMiddleware(sdkhttpclient.Options{}, http.DefaultTransport)
+		c, err := api.NewClient(api.Config{Address: srv.URL, RoundTripper: rt})
+		require.NoError(t, err)
+		dsInfo := &DatasourceInfo{URL: srv.URL, promClient: apiv1.NewAPI(c)}
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"range": true,
+			"showStats": true
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "all", stats)
+
+		custom := res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})
+		require.Equal(t, int64(42), custom["totalQueryableSamples"])
+		require.Equal(t, 0.5, custom["execTotalTime"])
+	})
+
+	t.Run("explain query should return the request it would send without sending it", func(t *testing.T) {
+		var sent url.Values
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			sent = req.Form
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+		})
+
+		queryJSON := `{"expr": "rate(up[$__rate_interval]) * $__interval_ms", "refId": "A", "range": true, "intervalMs": 15000%s}`
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), queryContext(fmt.Sprintf(queryJSON, `, "explain": true`), timeRange), dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Nil(t, sent)
+
+		require.Len(t, res.Responses["A"].Frames, 1)
+		frame := res.Responses["A"].Frames[0]
+		require.Equal(t, "explain", frame.Name)
+		require.Equal(t, frame.Fields[0].At(0), frame.Meta.ExecutedQueryString)
+
+		res, err = service.executeTimeSeriesQuery(context.Background(), queryContext(fmt.Sprintf(queryJSON, ""), timeRange), dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+
+		require.Equal(t, sent.Get("query"), frame.Fields[0].At(0))
+		require.Equal(t, sent.Get("step"), strconv.FormatFloat(frame.Fields[1].At(0).(float64), 'f', -1, 64))
+		require.Equal(t, sent.Get("start"), strconv.FormatInt(frame.Fields[2].At(0).(time.Time).Unix(), 10))
+		require.Equal(t, sent.Get("end"), strconv.FormatInt(frame.Fields[3].At(0).(time.Time).Unix(), 10))
+	})
+
+	t.Run("warnings should be added as notices to the partial result", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]},"warnings":["partial response"]}`))
+		})
+
+		query := queryContext(`{
+			"expr": "up",
+			"refId": "A",
+			"range": true
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: "partial response"}}, res.Responses["A"].Frames[0].Meta.Notices)
+	})
+
+	t.Run("empty query should not be sent", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		})
+
+		query := queryContext(`{
+			"expr": "  \n ",
+			"refId": "A",
+			"range": true
+		}`, timeRange)
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityInfo, Text: "query is empty, skipping"}}, res.Responses["A"].Frames[0].Meta.Notices)
+	})
+
+	t.Run("alert queries returning a scalar should return a descriptive error", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`))
+		})
+
+		query := queryContext(`{"expr": "scalar(up)", "instant": true}`, timeRange)
+		query.Queries[0].QueryType = alertQueryType
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "alert rules need a query returning numeric series, but the instant query returned a scalar, use e.g. vector(...) to turn it into a series")
+
+		var queryErr *QueryError
+		require.ErrorAs(t, res.Responses["A"].Error, &queryErr)
+		require.Equal(t, ErrorSourceDownstream, queryErr.Source)
+		require.Equal(t, ErrorStatusBadData, queryErr.Status)
+
+		// Other queries keep returning scalars
+		query.Queries[0].QueryType = ""
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+	})
+
+	t.Run("alert queries returning series should succeed", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+			default:
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+			}
+		})
+
+		query := queryContext(`{"expr": "up", "range": true, "instant": true}`, timeRange)
+		query.Queries[0].QueryType = alertQueryType
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 2)
+	})
+
+	t.Run("identical queries prefixing their ref ID should return their own names", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+		})
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "prefixRefId": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "prefixRefId": true}`)},
+				{RefID: "C", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, "A: up", res.Responses["A"].Frames[0].Name)
+		require.Equal(t, "B: up", res.Responses["B"].Frames[0].Name)
+		require.Equal(t, "up", res.Responses["C"].Frames[0].Name)
+	})
+
+	t.Run("NaN and infinite values should be kept, NaN range query samples as gaps", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"a"},"value":[1,"NaN"]},{"metric":{"job":"b"},"value":[1,"-Inf"]}]}}`))
+			default:
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"],[2,"NaN"],[3,"+Inf"],[4,"-Inf"]]}]}}`))
+			}
+		})
+
+		query := queryContext(`{"expr": "up", "range": true}`, timeRange)
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		values := res.Responses["A"].Frames[0].Fields[1]
+		require.Equal(t, 4, values.Len())
+		require.Equal(t, 1.0, *values.At(0).(*float64))
+		// Grafana breaks the line at null values
+		require.Nil(t, values.At(1))
+		require.True(t, math.IsInf(*values.At(2).(*float64), 1))
+		require.True(t, math.IsInf(*values.At(3).(*float64), -1))
+
+		query = queryContext(`{"expr": "up", "instant": true}`, timeRange)
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 2)
+		require.True(t, math.IsNaN(res.Responses["A"].Frames[0].Fields[1].At(0).(float64)))
+		require.True(t, math.IsInf(res.Responses["A"].Frames[1].Fields[1].At(0).(float64), -1))
+	})
+
+	t.Run("queries of metrics which are not allowed should not be sent", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			t.Fatal("request should not be sent")
+		})
+		dsInfo.AllowedMetricPrefixes = []string{"node_"}
+
+		query := queryContext(`{"expr": "up", "range": true}`, timeRange)
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, `the metric "up" is not allowed, only metrics starting with node_ can be queried`)
+
+		var queryErr *QueryError
+		require.ErrorAs(t, res.Responses["A"].Error, &queryErr)
+		require.Equal(t, ErrorStatusBadData, queryErr.Status)
+	})
+
+	t.Run("range and instant query should be evaluated at the end of the range", func(t *testing.T) {
+		var instantTime string
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			switch req.URL.Path {
+			case "/api/v1/query":
+				instantTime = req.Form.Get("time")
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+			default:
+				require.Equal(t, "3600", req.Form.Get("end"))
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+			}
+		})
+
+		query := queryContext(`{"expr": "up", "rangeAndInstant": true, "step": "60s"}`, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3630, 0)})
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Equal(t, "3600", instantTime)
+
+		frames := res.Responses["A"].Frames
+		require.Len(t, frames, 2)
+		resultTypes := []interface{}{frames[0].Meta.Custom.(map[string]interface{})["resultType"], frames[1].Meta.Custom.(map[string]interface{})["resultType"]}
+		require.ElementsMatch(t, []interface{}{"matrix", "vector"}, resultTypes)
+	})
+
+	t.Run("range and instant query should return the result of one if the other fails", func(t *testing.T) {
+		failing := "/api/v1/query_range"
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == failing || failing == "both" {
+				rw.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = rw.Write([]byte(`{"status":"error","errorType":"execution","error":"` + req.URL.Path + ` failed"}`))
+				return
+			}
+			if req.URL.Path == "/api/v1/query" {
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+				return
+			}
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+		})
+
+		query := queryContext(`{"expr": "up", "rangeAndInstant": true}`, timeRange)
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, "vector", res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})["resultType"])
+		require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: "The range query failed, only the result of the other query is returned: execution: /api/v1/query_range failed"}}, res.Responses["A"].Frames[0].Meta.Notices)
+
+		failing = "/api/v1/query"
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 1)
+		require.Equal(t, "matrix", res.Responses["A"].Frames[0].Meta.Custom.(map[string]interface{})["resultType"])
+
+		failing = "both"
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "execution: /api/v1/query_range failed")
+
+		// Alert queries are not evaluated on a partial result
+		failing = "/api/v1/query"
+		query.Queries[0].QueryType = alertQueryType
+		res, err = service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.EqualError(t, res.Responses["A"].Error, "execution: /api/v1/query failed")
+	})
+
+	t.Run("frames should record the executed query with its macros resolved", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/api/v1/query":
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+			default:
+				_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+			}
+		})
+
+		query := queryContext(`{"expr": "rate(up[$__interval]) * ${__range_s}", "range": true, "instant": true, "step": "60s"}`, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3630, 0)})
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+		require.Len(t, res.Responses["A"].Frames, 2)
+		for _, frame := range res.Responses["A"].Frames {
+			require.Equal(t, "Expr: rate(up[1m]) * 3630\nStep: 1m0s\nStart: 1970-01-01T00:00:00Z\nEnd: 1970-01-01T01:00:00Z\nTime: 1970-01-01T01:00:30Z", frame.Meta.ExecutedQueryString)
+		}
+	})
+
+	t.Run("identical queries should be sent once", func(t *testing.T) {
+		var sent []string
+		var mu sync.Mutex
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			require.NoError(t, req.ParseForm())
+			mu.Lock()
+			sent = append(sent, req.Form.Get("query"))
+			mu.Unlock()
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1,"1"]]}]}}`))
+		})
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "C", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "legendFormat": "{{job}}"}`)},
+				{RefID: "D", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "instant": true}`)},
+				{RefID: "E", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "intervalMs": 60000}`)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Len(t, res.Responses, 5)
+		require.Len(t, sent, 4)
+		for _, refID := range []string{"A", "B", "C", "D", "E"} {
+			require.NoError(t, res.Responses[refID].Error)
+			require.Len(t, res.Responses[refID].Frames, 1)
+		}
+		require.Equal(t, res.Responses["A"].Frames[0].Fields, res.Responses["B"].Frames[0].Fields)
+	})
+
+	t.Run("queries sorted differently should be sent separately", func(t *testing.T) {
+		var mu sync.Mutex
+		sent := 0
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			sent++
+			mu.Unlock()
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"]]},{"metric":{"job":"b"},"values":[[1,"2"]]}]}}`))
+		})
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "sortBy": "value:asc"}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true, "sortBy": "value:desc"}`)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		require.Equal(t, 2, sent)
+		jobs := func(refID string) []string {
+			var jobs []string
+			for _, frame := range res.Responses[refID].Frames {
+				jobs = append(jobs, frame.Fields[1].Labels["job"])
+			}
+			return jobs
+		}
+		require.Equal(t, []string{"a", "b"}, jobs("A"))
+		require.Equal(t, []string{"b", "a"}, jobs("B"))
+	})
+
+	t.Run("identical queries should return frames with their own ref ID", func(t *testing.T) {
+		dsInfo := newTestDSInfo(t, func(rw http.ResponseWriter, req *http.Request) {
+			_, _ = rw.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"]]},{"metric":{"job":"b"},"values":[[1,"2"]]}]}}`))
+		})
+
+		query := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "B", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+				{RefID: "C", TimeRange: timeRange, JSON: []byte(`{"expr": "up", "range": true}`)},
+			},
+		}
+
+		res, err := service.executeTimeSeriesQuery(context.Background(), query, dsInfo)
+		require.NoError(t, err)
+		for _, refID := range []string{"A", "B", "C"} {
+			require.NoError(t, res.Responses[refID].Error)
+			require.Len(t, res.Responses[refID].Frames, 2)
+			for _, frame := range res.Responses[refID].Frames {
+				require.Equal(t, refID, frame.RefID)
+			}
+		}
+		require.NotSame(t, res.Responses["A"].Frames[0], res.Responses["B"].Frames[0])
+	})
+}
+
+func newTestDSInfo(t *testing.T, handler http.HandlerFunc) *DatasourceInfo {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := api.NewClient(api.Config{Address: srv.URL})
+	require.NoError(t, err)
+
+	return &DatasourceInfo{
+		URL:              srv.URL,
+		promClient:       apiv1.NewAPI(c),
+		metadataCache:    newTTLCache(defaultMetadataCacheTTL),
+		metricNamesCache: newTTLCache(defaultMetadataCacheTTL),
+		statusCache:      newTTLCache(statusCacheTTL),
+		flavor:           &backendFlavor{},
+	}
 }
 
 func queryContext(json string, timeRange backend.TimeRange) *backend.QueryDataRequest {
@@ -0,0 +1,69 @@
+package prometheus
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ttlCacheSize is the number of values kept by a ttlCache, the least recently used ones are evicted first, so that
+// e.g. metadata requests for many different metrics don't fill the memory before their values expire
+const ttlCacheSize = 1000
+
+type ttlCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ttlCache keeps values of a datasource for a short time, such as responses of Prometheus which are expensive to
+// compute and rarely change. A TTL of zero disables the cache.
+type ttlCache struct {
+	ttl time.Duration
+
+	entries *lru.Cache
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	// lru.New only fails for sizes below one
+	entries, _ := lru.New(ttlCacheSize)
+	return &ttlCache{
+		ttl:     ttl,
+		entries: entries,
+	}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+
+	v, ok := c.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(ttlCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.entries.Remove(key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key string, value interface{}) {
+	c.setWithTTL(key, value, 0)
+}
+
+// setWithTTL caches value for the TTL of the cache, or for ttl if it is shorter and not zero.
+func (c *ttlCache) setWithTTL(key string, value interface{}, ttl time.Duration) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+
+	c.entries.Add(key, ttlCacheEntry{
+		value:   value,
+		expires: time.Now().Add(ttl),
+	})
+}
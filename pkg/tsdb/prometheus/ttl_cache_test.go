@@ -0,0 +1,71 @@
+package prometheus
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLCache(t *testing.T) {
+	t.Run("should return values until they expire", func(t *testing.T) {
+		cache := newTTLCache(time.Minute)
+		cache.set("a", []string{"up"})
+
+		value, ok := cache.get("a")
+		require.True(t, ok)
+		require.Equal(t, []string{"up"}, value)
+
+		_, ok = cache.get("b")
+		require.False(t, ok)
+
+		cache.entries.Add("a", ttlCacheEntry{value: []string{"up"}, expires: time.Now().Add(-time.Second)})
+		_, ok = cache.get("a")
+		require.False(t, ok)
+	})
+
+	t.Run("should cache values for a shorter TTL", func(t *testing.T) {
+		cache := newTTLCache(5 * time.Minute)
+		cache.setWithTTL("a", "short", time.Minute)
+		cache.setWithTTL("b", "long", time.Hour)
+		cache.set("c", "default")
+
+		expires := func(key string) time.Time {
+			v, ok := cache.entries.Peek(key)
+			require.True(t, ok)
+			return v.(ttlCacheEntry).expires
+		}
+		require.WithinDuration(t, time.Now().Add(time.Minute), expires("a"), time.Second)
+		require.WithinDuration(t, time.Now().Add(5*time.Minute), expires("b"), time.Second)
+		require.WithinDuration(t, time.Now().Add(5*time.Minute), expires("c"), time.Second)
+	})
+
+	t.Run("should evict the least recently used values over its size", func(t *testing.T) {
+		cache := newTTLCache(time.Minute)
+		for i := 0; i < ttlCacheSize; i++ {
+			cache.set(strconv.Itoa(i), i)
+		}
+		_, ok := cache.get("0")
+		require.True(t, ok)
+
+		cache.set("new", ttlCacheSize)
+		require.Equal(t, ttlCacheSize, cache.entries.Len())
+		_, ok = cache.get("1")
+		require.False(t, ok)
+		_, ok = cache.get("0")
+		require.True(t, ok)
+	})
+
+	t.Run("should not cache anything with a zero TTL", func(t *testing.T) {
+		cache := newTTLCache(0)
+		cache.set("a", []string{"up"})
+		_, ok := cache.get("a")
+		require.False(t, ok)
+
+		var disabled *ttlCache
+		disabled.set("a", []string{"up"})
+		_, ok = disabled.get("a")
+		require.False(t, ok)
+	})
+}
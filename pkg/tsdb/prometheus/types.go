@@ -1,30 +1,122 @@
 package prometheus
 
 import (
+	"net/url"
 	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	apiv1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
 
 type DatasourceInfo struct {
 	ID           int64
+	UID          string
 	URL          string
 	TimeInterval string
+	QueryTimeout time.Duration
+	// MaxDataPoints limits the number of data points per series, the step is increased to stay within it
+	MaxDataPoints int64
+	// MaxSeries limits the number of series returned by a query, the other series are dropped
+	MaxSeries int64
+	// ValidateQueries enables parsing queries before they are sent to Prometheus
+	ValidateQueries bool
+	// DisableMetricsLookup disables the resources browsing labels and metrics
+	DisableMetricsLookup bool
+	// CustomQueryParameters are added to the query string of every request sent to Prometheus
+	CustomQueryParameters url.Values
+	// DefaultLegendFormat is the legend format of queries which don't set their own
+	DefaultLegendFormat string
+	// TenantIDHeader is the forwarded request header holding the tenant of the user, if any
+	TenantIDHeader string
+	// OAuthPassThru forwards the OAuth token of the user running a query to Prometheus
+	OAuthPassThru bool
+	// AllowedMetricPrefixes restricts queries to metrics starting with one of the prefixes, if any
+	AllowedMetricPrefixes []string
+	// MaxConcurrentQueries limits the number of queries of all requests sent to Prometheus at the same time,
+	// zero means no limit
+	MaxConcurrentQueries int64
+	// HealthCheckQuery is the expression evaluated by the health check instead of a constant, if it is set
+	HealthCheckQuery string
+	// DownsampleFactor is how many times the scrape interval the calculated step of a query can be before the query
+	// gets a notice telling its data is downsampled, zero disables the notice
+	DownsampleFactor float64
 
-	promClient apiv1.API
+	promClient       apiv1.API
+	metadataCache    *ttlCache
+	metricNamesCache *ttlCache
+	statusCache      *ttlCache
+	flavor           *backendFlavor
+	// querySlots holds a value for every running query, it is nil if the number of queries isn't limited
+	querySlots chan struct{}
 }
 
 type PrometheusQuery struct {
 	Expr          string
 	Step          time.Duration
 	LegendFormat  string
+	Format        string
 	Start         time.Time
 	End           time.Time
 	RefId         string
 	InstantQuery  bool
 	RangeQuery    bool
 	ExemplarQuery bool
+	ShowStats     bool
+	AutoLegend    bool
+	Streaming     bool
 	UtcOffsetSec  int64
+	// Explain returns how the query would be sent to Prometheus, instead of running it
+	Explain bool
+	// PivotLabel names the fields of the wide format after the values of the label
+	PivotLabel string
+	// TimeShift moves the evaluation time of instant queries back from the end of the time range
+	TimeShift time.Duration
+	// AlignTimestamps snaps the timestamps of range query samples to the step of the query
+	AlignTimestamps bool
+	// FetchMetricType adds the type of the metric of each series, e.g. counter, to the custom metadata of its frame
+	FetchMetricType bool
+	// MaxSeries limits the number of series of the range and instant query results, zero means no limit
+	MaxSeries int64
+	// LookbackDelta is how far back instant queries look for the last sample of a series, the default of Prometheus if zero
+	LookbackDelta time.Duration
+	// DedupEpsilon collapses range query samples closer together than it, e.g. of deduplicated Thanos results,
+	// into the latest of them, zero disables it
+	DedupEpsilon time.Duration
+	// RangeAndInstant runs both a range and an instant query, evaluated at the end of the range
+	RangeAndInstant bool
+	// PrefixRefID prefixes the names of the frames and series with the ref ID of the query, e.g. "A: up"
+	PrefixRefID bool
+	// Timeout bounds the evaluation of the query, by Prometheus and by the client, zero means no timeout
+	Timeout time.Duration
+	// InstantAsRange draws the series of an instant query as flat lines from the start to the end of the time range
+	InstantAsRange bool
+	// LastN is the number of samples kept at the end of every series of a range query, zero keeps all samples.
+	// The series are trimmed once fetched, so Prometheus still evaluates the whole time range.
+	LastN int
+	// StaleHandling is how NaN values of range query series are shown: as gaps, the default, as zero or as the previous value
+	StaleHandling string
+	// ValueTransform is applied to the values of every series once fetched: negate, abs, cumsum or derivative
+	ValueTransform string
+	// DuplicateSeries is how range query series with the same labels are handled: kept apart, the default, or merged
+	DuplicateSeries string
+	// InferScrapeInterval records the scrape interval inferred from the samples of range vector selectors in the custom
+	// metadata of the frames, only set if the scrape interval of the datasource isn't configured
+	InferScrapeInterval bool
+	// Headers are sent with the requests of the query, overriding the custom headers of the datasource
+	Headers map[string]string
+	// RawFieldNames names the value fields of series after their metric and labels, instead of Value, so that
+	// transformations matching field names don't depend on the legend, which stays the display name
+	RawFieldNames bool
+	// IncludeLabelsMeta records the labels of series in the custom metadata of their frames, whatever the legend
+	IncludeLabelsMeta bool
+	// RoundTo is the number of decimal places sample values are rounded to, nil keeps the values as they are
+	RoundTo *int
+	// SortBy orders the series of the result by a label or by their latest value, nil keeps the order of Prometheus
+	SortBy *seriesSort
+	// Alerting requires the result to be numeric series, as alert rules can't reduce other results
+	Alerting bool
+	// Notices are added to the frames of the query result
+	Notices []data.Notice
 }
 
 type ExemplarEvent struct {
@@ -34,14 +126,49 @@ type ExemplarEvent struct {
 }
 
 type QueryModel struct {
-	Expr           string `json:"expr"`
-	LegendFormat   string `json:"legendFormat"`
-	Interval       string `json:"interval"`
-	IntervalMS     int64  `json:"intervalMS"`
-	StepMode       string `json:"stepMode"`
-	RangeQuery     bool   `json:"range"`
-	InstantQuery   bool   `json:"instant"`
-	ExemplarQuery  bool   `json:"exemplar"`
-	IntervalFactor int64  `json:"intervalFactor"`
-	UtcOffsetSec   int64  `json:"utcOffsetSec"`
+	Expr            string `json:"expr"`
+	LegendFormat    string `json:"legendFormat"`
+	Format          string `json:"format"`
+	PivotLabel      string `json:"pivotLabel"`
+	Interval        string `json:"interval"`
+	IntervalMS      int64  `json:"intervalMS"`
+	StepMode        string `json:"stepMode"`
+	Step            string `json:"step"`
+	MinStep         string `json:"minStep"`
+	Resolution      string `json:"resolution"`
+	RangeQuery      bool   `json:"range"`
+	InstantQuery    bool   `json:"instant"`
+	ExemplarQuery   bool   `json:"exemplar"`
+	IntervalFactor  int64  `json:"intervalFactor"`
+	MaxSeries       int64  `json:"maxSeries"`
+	UtcOffsetSec    int64  `json:"utcOffsetSec"`
+	ShowStats       bool   `json:"showStats"`
+	AutoLegend      bool   `json:"autoLegend"`
+	Streaming       bool   `json:"streaming"`
+	Explain         bool   `json:"explain"`
+	AlignTimestamps bool   `json:"alignTimestamps"`
+	FetchMetricType bool   `json:"fetchMetricType"`
+	TimeShift       string `json:"timeShift"`
+	LookbackDelta   string `json:"lookbackDelta"`
+	PrefixRefID     bool   `json:"prefixRefId"`
+	RangeAndInstant bool   `json:"rangeAndInstant"`
+	DedupTimestamps bool   `json:"dedupTimestamps"`
+	DedupEpsilon    string `json:"dedupEpsilon"`
+	SortBy          string `json:"sortBy"`
+	QueryTimeout    string `json:"queryTimeout"`
+	RoundTo         *int   `json:"roundTo"`
+	InstantAsRange  bool   `json:"instantAsRange"`
+	LastN           int    `json:"lastN"`
+	StaleHandling   string `json:"staleHandling"`
+	ValueTransform  string `json:"valueTransform"`
+	DuplicateSeries string `json:"duplicateSeries"`
+	RawFieldNames   bool   `json:"rawFieldNames"`
+	// Variables are the template variables of queries which the frontend didn't interpolate, e.g. of alert rules
+	Variables map[string]TemplateVariable `json:"variables"`
+	// InferScrapeInterval is ignored if the scrape interval of the datasource is configured
+	InferScrapeInterval bool `json:"inferScrapeInterval"`
+	// Headers route the requests of a query, e.g. through a gateway in front of several backends
+	Headers map[string]string `json:"headers"`
+	// IncludeLabelsMeta is off by default, as the labels double the size of responses with many short series
+	IncludeLabelsMeta bool `json:"includeLabelsMeta"`
 }
@@ -0,0 +1,106 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Transforms of the values of series selected by the valueTransform option of a query
+const (
+	negateTransform     = "negate"
+	absTransform        = "abs"
+	cumsumTransform     = "cumsum"
+	derivativeTransform = "derivative"
+)
+
+func validateValueTransform(transform string) error {
+	switch transform {
+	case "", negateTransform, absTransform, cumsumTransform, derivativeTransform:
+		return nil
+	}
+	return fmt.Errorf("invalid value transform %q, it must be negate, abs, cumsum or derivative", transform)
+}
+
+// transformValues applies transform to the series of frames, each with its times in the first field and its values
+// in the second one. Null and NaN values stay as they are: cumsum skips them, and derivative computes the rate of
+// change per second from the previous number, so the first number of a series, which has none, becomes null or NaN.
+func transformValues(frames data.Frames, transform string) {
+	if transform == "" {
+		return
+	}
+
+	for _, frame := range frames {
+		if len(frame.Fields) < 2 || frame.Fields[0].Type() != data.FieldTypeTime {
+			continue
+		}
+		times, values := frame.Fields[0], frame.Fields[1]
+		if values.Type() != data.FieldTypeFloat64 && values.Type() != data.FieldTypeNullableFloat64 {
+			continue
+		}
+
+		var (
+			sum          float64
+			previous     float64
+			previousTime time.Time
+			hasPrevious  bool
+		)
+		for i := 0; i < values.Len(); i++ {
+			value, ok := floatValue(values, i)
+			if !ok {
+				continue
+			}
+
+			result := value
+			switch transform {
+			case negateTransform:
+				result = -value
+			case absTransform:
+				result = math.Abs(value)
+			case cumsumTransform:
+				sum += value
+				result = sum
+			case derivativeTransform:
+				t := times.At(i).(time.Time)
+				result = math.NaN()
+				if seconds := t.Sub(previousTime).Seconds(); hasPrevious && seconds > 0 {
+					result = (value - previous) / seconds
+				}
+				previous, previousTime, hasPrevious = value, t, true
+			}
+			setFloatValue(values, i, result)
+		}
+	}
+}
+
+// floatValue returns the i-th value of field, which is false for null and NaN values
+func floatValue(field *data.Field, i int) (float64, bool) {
+	var value float64
+	switch v := field.At(i).(type) {
+	case float64:
+		value = v
+	case *float64:
+		if v == nil {
+			return 0, false
+		}
+		value = *v
+	default:
+		return 0, false
+	}
+	return value, !math.IsNaN(value)
+}
+
+// setFloatValue sets the i-th value of field, NaN values of nullable fields are set to null as in matrixToDataFrames
+func setFloatValue(field *data.Field, i int, value float64) {
+	if field.Type() == data.FieldTypeFloat64 {
+		field.Set(i, value)
+		return
+	}
+	if math.IsNaN(value) {
+		field.Set(i, nil)
+		return
+	}
+	field.Set(i, &value)
+}
@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_validateValueTransform(t *testing.T) {
+	for _, valid := range []string{"", "negate", "abs", "cumsum", "derivative"} {
+		require.NoError(t, validateValueTransform(valid), valid)
+	}
+	require.EqualError(t, validateValueTransform("log"), `invalid value transform "log", it must be negate, abs, cumsum or derivative`)
+}
+
+func TestPrometheus_transformValues(t *testing.T) {
+	nan := p.SampleValue(math.NaN())
+	// Samples 10 seconds apart, with a NaN value and a missing sample at 40s
+	matrix := p.Matrix{
+		{
+			Metric: p.Metric{"app": "Application"},
+			Values: []p.SamplePair{
+				{Value: 1, Timestamp: 10000},
+				{Value: -3, Timestamp: 20000},
+				{Value: nan, Timestamp: 30000},
+				{Value: 7, Timestamp: 50000},
+			},
+		},
+	}
+	values := func(t *testing.T, transform string) []*float64 {
+		t.Helper()
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{RangeQueryType: matrix}, &PrometheusQuery{ValueTransform: transform})
+		require.NoError(t, err)
+		field := res[0].Fields[1]
+		values := make([]*float64, field.Len())
+		for i := range values {
+			values[i] = field.At(i).(*float64)
+		}
+		return values
+	}
+	number := func(v float64) *float64 { return &v }
+
+	require.Equal(t, []*float64{number(1), number(-3), nil, number(7)}, values(t, ""))
+	require.Equal(t, []*float64{number(-1), number(3), nil, number(-7)}, values(t, "negate"))
+	require.Equal(t, []*float64{number(1), number(3), nil, number(7)}, values(t, "abs"))
+	require.Equal(t, []*float64{number(1), number(-2), nil, number(5)}, values(t, "cumsum"))
+	require.Equal(t, []*float64{nil, number(-0.4), nil, number(1 / 3.0)}, values(t, "derivative"))
+
+	t.Run("values of instant queries should be transformed as well", func(t *testing.T) {
+		vector := p.Vector{
+			{Metric: p.Metric{"app": "a"}, Value: -2, Timestamp: 1000},
+			{Metric: p.Metric{"app": "b"}, Value: nan, Timestamp: 1000},
+		}
+		res, err := parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{InstantQueryType: vector}, &PrometheusQuery{ValueTransform: "abs"})
+		require.NoError(t, err)
+		require.Equal(t, 2.0, res[0].Fields[1].At(0))
+		require.True(t, math.IsNaN(res[1].Fields[1].At(0).(float64)))
+
+		// A single value has no rate of change
+		res, err = parseTimeSeriesResponse(map[TimeSeriesQueryType]interface{}{InstantQueryType: vector}, &PrometheusQuery{ValueTransform: "derivative"})
+		require.NoError(t, err)
+		require.True(t, math.IsNaN(res[0].Fields[1].At(0).(float64)))
+	})
+}
@@ -0,0 +1,78 @@
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
+)
+
+const wideFormat = "wide"
+
+// transformToWide joins the series of a range query into one frame with a shared time field and
+// a value field per series. Fields are named after the value of pivotLabel, or the full metric
+// if the label is not set. Fields which would get the same name are suffixed with an index.
+func transformToWide(frames data.Frames, pivotLabel string) data.Frames {
+	if len(frames) == 0 {
+		return frames
+	}
+
+	timestamps := map[int64]time.Time{}
+	for _, frame := range frames {
+		for i := 0; i < frame.Fields[0].Len(); i++ {
+			t := frame.Fields[0].At(i).(time.Time)
+			timestamps[t.UnixNano()] = t
+		}
+	}
+	times := make([]time.Time, 0, len(timestamps))
+	for _, t := range timestamps {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	rows := make(map[int64]int, len(times))
+	for i, t := range times {
+		rows[t.UnixNano()] = i
+	}
+
+	timeField := data.NewField(data.TimeSeriesTimeFieldName, nil, times)
+	fields := []*data.Field{timeField}
+	names := map[string]int{}
+	for _, frame := range frames {
+		labels := seriesLabels(frame)
+		name := wideFieldName(labels, pivotLabel)
+		if n := names[name]; n > 0 {
+			names[name]++
+			name = fmt.Sprintf("%s_%d", name, n)
+		} else {
+			names[name] = 1
+		}
+
+		field := data.NewFieldFromFieldType(data.FieldTypeNullableFloat64, len(times))
+		field.Name = name
+		field.Labels = labels
+		field.Config = &data.FieldConfig{DisplayNameFromDS: name}
+		for i := 0; i < frame.Fields[0].Len(); i++ {
+			row := rows[frame.Fields[0].At(i).(time.Time).UnixNano()]
+			field.Set(row, frame.Fields[1].At(i))
+		}
+		fields = append(fields, field)
+	}
+
+	wide := newDataFrame("", "matrix", fields...)
+	return data.Frames{wide}
+}
+
+func wideFieldName(labels data.Labels, pivotLabel string) string {
+	if value, ok := labels[pivotLabel]; ok && pivotLabel != "" {
+		return value
+	}
+
+	metric := make(model.Metric, len(labels))
+	for k, v := range labels {
+		metric[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return metric.String()
+}
@@ -0,0 +1,62 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	p "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_transformToWide(t *testing.T) {
+	series := func(metric p.Metric, samples map[int64]p.SampleValue) *p.SampleStream {
+		stream := &p.SampleStream{Metric: metric}
+		for _, ts := range []int64{1, 2, 3} {
+			if v, ok := samples[ts]; ok {
+				stream.Values = append(stream.Values, p.SamplePair{Value: v, Timestamp: p.Time(ts * 1000)})
+			}
+		}
+		return stream
+	}
+
+	value := map[TimeSeriesQueryType]interface{}{
+		RangeQueryType: p.Matrix{
+			series(p.Metric{"__name__": "up", "job": "api"}, map[int64]p.SampleValue{1: 1, 2: 1}),
+			series(p.Metric{"__name__": "up", "job": "db"}, map[int64]p.SampleValue{2: 0, 3: 1}),
+			series(p.Metric{"__name__": "up", "job": "api", "instance": "b"}, map[int64]p.SampleValue{3: 1}),
+			series(p.Metric{"__name__": "up"}, map[int64]p.SampleValue{1: 0}),
+		},
+	}
+
+	t.Run("series should be pivoted into fields named by the label", func(t *testing.T) {
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Format: "wide", PivotLabel: "job"})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+
+		frame := res[0]
+		require.Len(t, frame.Fields, 5)
+		require.Equal(t, []time.Time{time.Unix(1, 0).UTC(), time.Unix(2, 0).UTC(), time.Unix(3, 0).UTC()}, []time.Time{
+			frame.Fields[0].At(0).(time.Time), frame.Fields[0].At(1).(time.Time), frame.Fields[0].At(2).(time.Time),
+		})
+
+		require.Equal(t, "api", frame.Fields[1].Name)
+		require.Equal(t, "db", frame.Fields[2].Name)
+		require.Equal(t, "api_1", frame.Fields[3].Name)
+		require.Equal(t, `up`, frame.Fields[4].Name)
+		require.Equal(t, "db", frame.Fields[2].Config.DisplayNameFromDS)
+
+		require.Equal(t, 1.0, *frame.Fields[1].At(1).(*float64))
+		require.Nil(t, frame.Fields[1].At(2))
+		require.Nil(t, frame.Fields[2].At(0))
+		require.Equal(t, 0.0, *frame.Fields[2].At(1).(*float64))
+	})
+
+	t.Run("without pivot label fields should be named by the full metric", func(t *testing.T) {
+		res, err := parseTimeSeriesResponse(value, &PrometheusQuery{Format: "wide"})
+		require.NoError(t, err)
+		require.Len(t, res, 1)
+
+		require.Equal(t, `up{job="api"}`, res[0].Fields[1].Name)
+		require.Equal(t, `up{instance="b", job="api"}`, res[0].Fields[3].Name)
+	})
+}